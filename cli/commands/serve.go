@@ -35,6 +35,9 @@ func serveAction(cCtx *cli.Context) error {
 	if cfg.Secret == "" {
 		return fmt.Errorf("secret is required. Please set ACTIONS_GATEWAY_SECRET or set 'secret' in the config file")
 	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
 
 	return server.Start(cfg)
 }
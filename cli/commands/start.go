@@ -81,9 +81,22 @@ func startAction(cCtx *cli.Context) (err error) {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	c := newClient(cCtx, config)
+
+	// serve the metrics on the loopback address
+	if config.MetricsAddr != "" {
+		srv, err := c.StartMetricsServer()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = srv.Close()
+		}()
+	}
+
 	// connect to the server
 	go func() {
-		if err2 := newClient(cCtx, config).Connect(am, sw); err2 != nil {
+		if err2 := c.Connect(am, sw); err2 != nil {
 			err = fmt.Errorf("failed to connect to the server: %w", err2)
 		}
 		stop()
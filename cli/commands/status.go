@@ -6,7 +6,9 @@ import (
 	"github.com/kohkimakimoto/actions-gateway/client/status"
 	"github.com/urfave/cli/v2"
 	"os"
+	"slices"
 	"strconv"
+	"time"
 )
 
 var StatusCommand = &cli.Command{
@@ -54,7 +56,47 @@ func statusAction(cCtx *cli.Context) error {
 	t := newSimpleTableWriter(cCtx.App.Writer)
 	t.AppendRow(table.Row{"Pid:", pid})
 	t.AppendRow(table.Row{"Status:", s.StatusCode})
+	t.AppendRow(table.Row{"Server:", config.Server})
+	t.AppendRow(table.Row{"Started:", formatStatusTime(s.StartedAt)})
+	t.AppendRow(table.Row{"Connected since:", formatStatusTime(s.ConnectedAt)})
+	t.AppendRow(table.Row{"Reconnects:", s.Reconnects})
+	if s.Error != "" {
+		t.AppendRow(table.Row{"Error:", s.Error})
+	}
+	if config.MetricsAddr != "" {
+		t.AppendRow(table.Row{"Metrics:", fmt.Sprintf("http://%s/metrics", config.MetricsAddr)})
+	}
+	t.Render()
+
+	if len(s.Actions) == 0 {
+		return nil
+	}
+
+	_, _ = fmt.Fprintln(cCtx.App.Writer)
+	t = newSimpleTableWriter(cCtx.App.Writer)
+	t.AppendHeader(table.Row{"Action", "Invocations", "Failures", "Last exit code", "Avg duration", "Last run"})
+	names := make([]string, 0, len(s.Actions))
+	for name := range s.Actions {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		stats := s.Actions[name]
+		exitCode := "-"
+		if stats.LastExitCode != nil {
+			exitCode = strconv.Itoa(*stats.LastExitCode)
+		}
+		t.AppendRow(table.Row{name, stats.Invocations, stats.Failures, exitCode, stats.AverageDuration(), formatStatusTime(stats.LastRunAt)})
+	}
 	t.Render()
 
 	return nil
 }
+
+// formatStatusTime formats the time in the status. It returns "-" for nil.
+func formatStatusTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
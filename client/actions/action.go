@@ -4,17 +4,42 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/kohkimakimoto/actions-gateway/client/config"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
 	"text/template"
+	"time"
 )
 
 // Action represents an action that is an executable file to be run by the client
 type Action struct {
 	Name string
 	Path string
+	// Extensions is the Actions Gateway extensions declared in the action's spec.
+	// It is nil until the spec is generated by ActionManager.OutputSpec.
+	Extensions *SpecExtensions
+	// Methods is a list of the HTTP methods that the action's spec declares.
+	// It is nil if the spec declares no methods, and then the action accepts only POST.
+	Methods []string
+}
+
+// Timeout returns the execution timeout of the action. Zero means no timeout.
+func (a *Action) Timeout() time.Duration {
+	if a.Extensions == nil {
+		return 0
+	}
+	return a.Extensions.Timeout
+}
+
+// Concurrency returns the maximum number of the runs of the action at the same time. Zero means no limit.
+func (a *Action) Concurrency() int {
+	if a.Extensions == nil {
+		return 0
+	}
+	return a.Extensions.Concurrency
 }
 
 // ActionManager is a object that manages actions
@@ -73,6 +98,8 @@ func (m *ActionManager) OutputSpec(errWriter io.Writer) (string, error) {
 		if err != nil {
 			return "", fmt.Errorf("failed to generate spec for action %s: %w", a.Name, err)
 		}
+		a.Extensions = spec.Extensions
+		a.Methods = spec.Methods
 		if spec.Spec != "" {
 			actionPathSpecs = append(actionPathSpecs, spec)
 		}
@@ -99,6 +126,32 @@ func (m *ActionManager) OutputSpec(errWriter io.Writer) (string, error) {
 	return m.spec, nil
 }
 
+// ActionOptions returns the options of the actions that the server needs to know.
+// It must be called after OutputSpec, because the options are declared in the spec.
+func (m *ActionManager) ActionOptions() map[string]*types.ActionOptions {
+	options := make(map[string]*types.ActionOptions)
+	for _, a := range m.actions {
+		if (a.Extensions == nil || *a.Extensions == (SpecExtensions{})) && len(a.Methods) == 0 {
+			// the action uses the default options
+			continue
+		}
+		opts := &types.ActionOptions{
+			Methods: a.Methods,
+		}
+		if a.Extensions != nil {
+			// round up to avoid the timeout of the server being shorter than that of the action
+			opts.Timeout = int(math.Ceil(a.Extensions.Timeout.Seconds()))
+			opts.Stream = a.Extensions.Stream
+			opts.Deferrable = a.Extensions.Deferrable
+			// round down not to serve the cached result longer than the action declares
+			opts.Cache = int(a.Extensions.Cache.Seconds())
+			opts.RateLimit = a.Extensions.RateLimit
+		}
+		options[a.Name] = opts
+	}
+	return options
+}
+
 // isExecutable checks if the file is executable
 func isExecutable(mode os.FileMode) bool {
 	return mode&0111 != 0 // Checks if any execution permission is set (user, group, others)
@@ -168,7 +221,11 @@ security:
 paths:
 {{- range .ActionPathSpecs }}
 {{ indent "  " .ApiPath -}}
+{{ if .Methods -}}
+{{ indent "    " .Spec -}}
+{{ else -}}
 {{ indent "    " "post:" -}}
 {{ indent "      " .Spec -}}
+{{ end -}}
 {{- end -}}
 `, "\n")
@@ -100,4 +100,107 @@ echo 'This is a test action2'
 	assert.Contains(t, names, "testAction2")
 }
 
+func TestActionManager_ActionOptions(t *testing.T) {
+	dir := testTempDir(t)
+	actionsDir := filepath.Join(dir, "actions")
+	err := os.MkdirAll(actionsDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAction1File := filepath.Join(actionsDir, "testAction1")
+	err = os.WriteFile(testAction1File, []byte(`#!/usr/bin/env bash
+if [[ -n "$ACTIONS_GATEWAY_ACTIONS_SPEC" ]]; then
+  echo 'summary: test action1'
+  echo 'x-actions-gateway-timeout: 1500ms'
+  echo 'x-actions-gateway-deferrable: true'
+  echo 'x-actions-gateway-cache: 90s'
+  echo 'x-actions-gateway-rate-limit: 10/m'
+fi
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAction2File := filepath.Join(actionsDir, "testAction2")
+	err = os.WriteFile(testAction2File, []byte(`#!/usr/bin/env bash
+if [[ -n "$ACTIONS_GATEWAY_ACTIONS_SPEC" ]]; then
+  echo 'summary: test action2'
+fi
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewActionManager(&config.Config{
+		ActionsAbsDir: actionsDir,
+		SpecInfo:      &config.SpecInfoConfig{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.OutputSpec(nil)
+	assert.NoError(t, err)
+
+	options := m.ActionOptions()
+	assert.Len(t, options, 1)
+	assert.Equal(t, 2, options["testAction1"].Timeout)
+	assert.True(t, options["testAction1"].Deferrable)
+	assert.Equal(t, 90, options["testAction1"].Cache)
+	assert.Equal(t, "10/m", options["testAction1"].RateLimit)
+}
+
+func TestActionManager_OutputSpec(t *testing.T) {
+	dir := testTempDir(t)
+	actionsDir := filepath.Join(dir, "actions")
+	err := os.MkdirAll(actionsDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the spec of a single operation is served as POST
+	testAction1File := filepath.Join(actionsDir, "testAction1")
+	err = os.WriteFile(testAction1File, []byte(`#!/usr/bin/env bash
+if [[ -n "$ACTIONS_GATEWAY_ACTIONS_SPEC" ]]; then
+  echo 'summary: test action1'
+fi
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the spec of a path item declares the operations by method
+	testAction2File := filepath.Join(actionsDir, "testAction2")
+	err = os.WriteFile(testAction2File, []byte(`#!/usr/bin/env bash
+if [[ -n "$ACTIONS_GATEWAY_ACTIONS_SPEC" ]]; then
+  echo 'get:'
+  echo '  summary: get test action2'
+  echo 'delete:'
+  echo '  summary: delete test action2'
+fi
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewActionManager(&config.Config{
+		ActionsAbsDir: actionsDir,
+		SpecInfo:      &config.SpecInfoConfig{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := m.OutputSpec(nil)
+	assert.NoError(t, err)
+	assert.Contains(t, spec, `paths:
+  /actions/testAction1:
+    post:
+      summary: test action1
+
+  /actions/testAction2:
+    get:
+      summary: get test action2
+    delete:
+      summary: delete test action2
+`)
+
+	options := m.ActionOptions()
+	assert.Len(t, options, 1)
+	assert.Equal(t, []string{"GET", "DELETE"}, options["testAction2"].Methods)
+}
+
 // TODO: Add more tests
@@ -0,0 +1,45 @@
+package actions
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// responseFD is the file descriptor that the action writes its HTTP response to.
+// It is passed to the action as the ACTIONS_GATEWAY_RESPONSE_FD environment variable.
+const responseFD = 3
+
+// ActionResponse is the HTTP response that the action declares by writing it as JSON to the response file descriptor.
+// The body of the response is the action's STDOUT.
+type ActionResponse struct {
+	// StatusCode is the HTTP status code. Zero means the default status code.
+	StatusCode int `json:"status"`
+	// Headers is the HTTP response headers, such as Content-Type and Content-Disposition.
+	Headers map[string]string `json:"headers"`
+}
+
+// readActionResponse reads the response that the action wrote to the response file.
+// It returns nil if the action did not write anything.
+func readActionResponse(f *os.File) (*ActionResponse, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read the response: %w", err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the response: %w", err)
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	res := &ActionResponse{}
+	if err := json.Unmarshal(b, res); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if res.StatusCode != 0 && (res.StatusCode < 100 || res.StatusCode > 599) {
+		return nil, fmt.Errorf("invalid response: unexpected status code: %d", res.StatusCode)
+	}
+	return res, nil
+}
@@ -2,6 +2,8 @@ package actions
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/kohkimakimoto/actions-gateway/server/types"
 	"io"
@@ -9,27 +11,55 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// terminationGracePeriod is the time to wait for the action to exit after sending SIGTERM.
+// If the action does not exit within the period, it is killed by SIGKILL.
+const terminationGracePeriod = 5 * time.Second
+
+// ErrActionCanceled is returned by ActionRunner.Run when the action is canceled.
+var ErrActionCanceled = errors.New("action canceled")
+
+// ErrActionTimeout is returned by ActionRunner.Run when the timeout of the action passes.
+var ErrActionTimeout = errors.New("action timed out")
+
 // ActionRunner runs an action
 type ActionRunner struct {
-	action    *Action
-	workDir   string
-	errWriter io.Writer
+	action      *Action
+	workDir     string
+	errWriter   io.Writer
+	gracePeriod time.Duration
+	// upload is the files uploaded with the multipart request. It is nil for the other requests.
+	upload *Upload
 }
 
 func NewActionRunner(action *Action, workDir string, errWriter io.Writer) *ActionRunner {
 	return &ActionRunner{
-		action:    action,
-		workDir:   workDir,
-		errWriter: errWriter,
+		action:      action,
+		workDir:     workDir,
+		errWriter:   errWriter,
+		gracePeriod: terminationGracePeriod,
 	}
 }
 
+// SetUpload sets the files uploaded with the multipart request.
+// The manifest of the files is passed to the action's stdin instead of the body,
+// and the files are removed after the action finishes.
+func (r *ActionRunner) SetUpload(upload *Upload) {
+	r.upload = upload
+}
+
 type ActionPathSpec struct {
 	Name    string
 	ApiPath string
 	Spec    string
+	// Methods is a list of the HTTP methods of the operations when the spec is a path item.
+	// It is nil when the spec is a single operation.
+	Methods    []string
+	Extensions *SpecExtensions
 }
 
 // PathSpec returns the OpenAPI Path spec of this action's endpoint
@@ -47,29 +77,145 @@ func (r *ActionRunner) PathSpec() (*ActionPathSpec, error) {
 		return nil, fmt.Errorf("failed to generate spec: %w", err)
 	}
 
+	ext, err := parseSpecExtensions(string(output))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse spec: %w", err)
+	}
+
 	return &ActionPathSpec{
-		Name:    r.action.Name,
-		ApiPath: path.Join("/actions", r.action.Name+":"),
-		Spec:    string(output),
+		Name:       r.action.Name,
+		ApiPath:    path.Join("/actions", r.action.Name+":"),
+		Spec:       string(output),
+		Methods:    parseSpecMethods(string(output)),
+		Extensions: ext,
 	}, nil
 }
 
-// Run runs the action
-func (r *ActionRunner) Run(msg *types.ActionMessage) ([]byte, error) {
+// Run runs the action and returns its output and the response that the action declared.
+// When the context is canceled or the timeout of the action passes, the action is terminated.
+// If the action exits with an error, the output and the response are returned together with the error,
+// so that the caller can return the response that the action declared for the failure.
+func (r *ActionRunner) Run(ctx context.Context, msg *types.ActionMessage) ([]byte, *ActionResponse, error) {
+	var stdout bytes.Buffer
+	res, err := r.run(ctx, msg, &stdout)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return stdout.Bytes(), res, err
+		}
+		return nil, nil, err
+	}
+	return stdout.Bytes(), res, nil
+}
+
+// RunStream runs the action and writes its output to w as it is produced.
+// It returns the response that the action declared.
+// When the context is canceled or the timeout of the action passes, the action is terminated.
+func (r *ActionRunner) RunStream(ctx context.Context, msg *types.ActionMessage, w io.Writer) (*ActionResponse, error) {
+	return r.run(ctx, msg, w)
+}
+
+func (r *ActionRunner) run(ctx context.Context, msg *types.ActionMessage, stdout io.Writer) (*ActionResponse, error) {
+	stdin := []byte(msg.Body)
+	var uploadEnv []string
+	if r.upload != nil {
+		defer func() {
+			_ = r.upload.Remove()
+		}()
+		manifest, err := r.upload.Manifest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare the uploaded files: %w", err)
+		}
+		stdin = manifest
+		uploadEnv = append(uploadEnv, "ACTIONS_GATEWAY_UPLOAD_DIR="+r.upload.Dir())
+	}
+
 	ex, err := r.resolveExecutablePath()
 	if err != nil {
 		return nil, err
 	}
-	cmd := exec.Command(r.action.Path)
+
+	// The action can declare its HTTP response by writing it to the file descriptor.
+	// A file is used instead of a pipe, because a pipe blocks the action if nobody reads it.
+	responseFile, err := os.CreateTemp("", "actions-gateway-response-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the response file: %w", err)
+	}
+	defer func() {
+		_ = responseFile.Close()
+		_ = os.Remove(responseFile.Name())
+	}()
+
+	if timeout := r.action.Timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, r.action.Path)
 	cmd.Dir = r.workDir
+	cmd.Stdout = stdout
 	cmd.Stderr = r.errWriter
 	cmd.Env = append(os.Environ(), "ACTIONS_GATEWAY_EXECUTABLE="+ex)
-	cmd.Stdin = bytes.NewReader([]byte(msg.Body))
-	output, err := cmd.Output()
+	cmd.Env = append(cmd.Env, requestEnv(msg)...)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("ACTIONS_GATEWAY_RESPONSE_FD=%d", responseFD))
+	cmd.Env = append(cmd.Env, uploadEnv...)
+	cmd.ExtraFiles = []*os.File{responseFile}
+	cmd.Stdin = bytes.NewReader(stdin)
+	// Run the action in its own process group to terminate the child processes that the action spawns as well.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var killTimer *time.Timer
+	cmd.Cancel = func() error {
+		// Ask the processes to exit gracefully first, and kill them if they are still running after the grace period.
+		pgid := cmd.Process.Pid
+		killTimer = time.AfterFunc(r.gracePeriod, func() {
+			_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		return syscall.Kill(-pgid, syscall.SIGTERM)
+	}
+	// Do not wait forever for the I/O of the processes that survived the kill.
+	cmd.WaitDelay = r.gracePeriod + time.Second
+	err = cmd.Run()
+	if killTimer != nil {
+		killTimer.Stop()
+	}
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w after %s", ErrActionTimeout, r.action.Timeout())
+		} else if errors.Is(ctx.Err(), context.Canceled) {
+			return nil, ErrActionCanceled
+		}
+	}
+
+	res, resErr := readActionResponse(responseFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to run action: %w", err)
+		return res, fmt.Errorf("failed to run action: %w", err)
+	}
+	if resErr != nil {
+		return nil, resErr
+	}
+	return res, nil
+}
+
+// requestEnv returns the environment variables that describe the HTTP request of the action message.
+// The variables for the missing parts of the request are not set.
+func requestEnv(msg *types.ActionMessage) []string {
+	var env []string
+	if msg.Method != "" {
+		env = append(env, "ACTIONS_GATEWAY_REQUEST_METHOD="+msg.Method)
+	}
+	if msg.Path != "" {
+		env = append(env, "ACTIONS_GATEWAY_REQUEST_PATH="+msg.Path)
+	}
+	if msg.Query != "" {
+		env = append(env, "ACTIONS_GATEWAY_REQUEST_QUERY="+msg.Query)
+	}
+	for name, value := range msg.Headers {
+		// e.g. "Content-Type" is exposed as ACTIONS_GATEWAY_REQUEST_HEADER_CONTENT_TYPE
+		key := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		env = append(env, "ACTIONS_GATEWAY_REQUEST_HEADER_"+key+"="+value)
 	}
-	return output, nil
+	return env
 }
 
 // resolveExecutablePath resolves the Path of the executable
@@ -1,11 +1,14 @@
 package actions
 
 import (
+	"bytes"
+	"context"
 	"github.com/kohkimakimoto/actions-gateway/server/types"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestActionRunner_PathSpec(t *testing.T) {
@@ -35,6 +38,65 @@ fi
 		assert.Equal(t, "testAction", spec.Name)
 		assert.Equal(t, "/actions/testAction:", spec.ApiPath)
 		assert.Equal(t, "You should output the OpenAPI spec of this action here\n", spec.Spec)
+		assert.Equal(t, &SpecExtensions{}, spec.Extensions)
+	})
+
+	t.Run("with extensions", func(t *testing.T) {
+		dir := testTempDir(t)
+		actionsDir := filepath.Join(dir, "actions")
+		err := os.MkdirAll(actionsDir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testActionFile := filepath.Join(actionsDir, "testAction")
+		err = os.WriteFile(testActionFile, []byte(`#!/usr/bin/env bash
+if [[ -n "$ACTIONS_GATEWAY_ACTIONS_SPEC" ]]; then
+  echo 'summary: test action'
+  echo 'x-actions-gateway-timeout: 2m'
+fi
+`), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		action := &Action{
+			Name: "testAction",
+			Path: testActionFile,
+		}
+
+		spec, err := NewActionRunner(action, dir, nil).PathSpec()
+		assert.NoError(t, err)
+		assert.Equal(t, 2*time.Minute, spec.Extensions.Timeout)
+	})
+}
+
+func TestActionRunner_RunStream(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		dir := testTempDir(t)
+		actionsDir := filepath.Join(dir, "actions")
+		err := os.MkdirAll(actionsDir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testActionFile := filepath.Join(actionsDir, "testAction")
+		err = os.WriteFile(testActionFile, []byte(`#!/usr/bin/env bash
+echo 'line1'
+echo 'line2'
+`), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		action := &Action{
+			Name: "testAction",
+			Path: testActionFile,
+		}
+
+		var buf bytes.Buffer
+		_, err = NewActionRunner(action, dir, nil).RunStream(context.Background(), &types.ActionMessage{
+			Id:   "00000000-0000-0000-0000-000000000001",
+			Name: "testAction",
+		}, &buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "line1\nline2\n", buf.String())
 	})
 }
 
@@ -58,11 +120,222 @@ echo 'This is a test action'
 			Path: testActionFile,
 		}
 
-		b, err := NewActionRunner(action, dir, nil).Run(&types.ActionMessage{
+		b, res, err := NewActionRunner(action, dir, nil).Run(context.Background(), &types.ActionMessage{
 			Id:   "00000000-0000-0000-0000-000000000001",
 			Name: "testAction",
 		})
 		assert.NoError(t, err)
 		assert.Equal(t, "This is a test action\n", string(b))
+		assert.Nil(t, res)
+	})
+
+	t.Run("request environment variables", func(t *testing.T) {
+		dir := testTempDir(t)
+		actionsDir := filepath.Join(dir, "actions")
+		err := os.MkdirAll(actionsDir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testActionFile := filepath.Join(actionsDir, "testAction")
+		err = os.WriteFile(testActionFile, []byte(`#!/usr/bin/env bash
+echo "$ACTIONS_GATEWAY_REQUEST_METHOD $ACTIONS_GATEWAY_REQUEST_PATH $ACTIONS_GATEWAY_REQUEST_QUERY $ACTIONS_GATEWAY_REQUEST_HEADER_CONTENT_TYPE"
+`), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		action := &Action{
+			Name: "testAction",
+			Path: testActionFile,
+		}
+
+		b, _, err := NewActionRunner(action, dir, nil).Run(context.Background(), &types.ActionMessage{
+			Id:     "00000000-0000-0000-0000-000000000001",
+			Name:   "testAction",
+			Method: "GET",
+			Path:   "/items/1",
+			Query:  "q=test&limit=10",
+			Headers: map[string]string{
+				"Content-Type": "application/json",
+			},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "GET /items/1 q=test&limit=10 application/json\n", string(b))
+	})
+
+	t.Run("declared response", func(t *testing.T) {
+		dir := testTempDir(t)
+		actionsDir := filepath.Join(dir, "actions")
+		err := os.MkdirAll(actionsDir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testActionFile := filepath.Join(actionsDir, "testAction")
+		// The action fails, but it declares the response to return.
+		err = os.WriteFile(testActionFile, []byte(`#!/usr/bin/env bash
+echo '{"status": 404, "headers": {"Content-Type": "application/json"}}' >&$ACTIONS_GATEWAY_RESPONSE_FD
+echo '{"error": "not found"}'
+exit 1
+`), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		action := &Action{
+			Name: "testAction",
+			Path: testActionFile,
+		}
+
+		b, res, err := NewActionRunner(action, dir, nil).Run(context.Background(), &types.ActionMessage{
+			Id:   "00000000-0000-0000-0000-000000000001",
+			Name: "testAction",
+		})
+		assert.Error(t, err)
+		assert.Equal(t, "{\"error\": \"not found\"}\n", string(b))
+		assert.Equal(t, &ActionResponse{
+			StatusCode: 404,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+		}, res)
+	})
+
+	t.Run("invalid response", func(t *testing.T) {
+		dir := testTempDir(t)
+		actionsDir := filepath.Join(dir, "actions")
+		err := os.MkdirAll(actionsDir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testActionFile := filepath.Join(actionsDir, "testAction")
+		err = os.WriteFile(testActionFile, []byte(`#!/usr/bin/env bash
+echo '{"status": 1000}' >&3
+`), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		action := &Action{
+			Name: "testAction",
+			Path: testActionFile,
+		}
+
+		b, res, err := NewActionRunner(action, dir, nil).Run(context.Background(), &types.ActionMessage{
+			Id:   "00000000-0000-0000-0000-000000000001",
+			Name: "testAction",
+		})
+		assert.EqualError(t, err, "invalid response: unexpected status code: 1000")
+		assert.Nil(t, b)
+		assert.Nil(t, res)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		dir := testTempDir(t)
+		actionsDir := filepath.Join(dir, "actions")
+		err := os.MkdirAll(actionsDir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testActionFile := filepath.Join(actionsDir, "testAction")
+		// The child process "sleep" must be killed together with the action.
+		err = os.WriteFile(testActionFile, []byte(`#!/usr/bin/env bash
+sleep 10
+echo 'This is a test action'
+`), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		action := &Action{
+			Name: "testAction",
+			Path: testActionFile,
+			Extensions: &SpecExtensions{
+				Timeout: 100 * time.Millisecond,
+			},
+		}
+
+		start := time.Now()
+		b, _, err := NewActionRunner(action, dir, nil).Run(context.Background(), &types.ActionMessage{
+			Id:   "00000000-0000-0000-0000-000000000001",
+			Name: "testAction",
+		})
+		assert.Error(t, err)
+		assert.Equal(t, "action timed out after 100ms", err.Error())
+		assert.ErrorIs(t, err, ErrActionTimeout)
+		assert.Nil(t, b)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		dir := testTempDir(t)
+		actionsDir := filepath.Join(dir, "actions")
+		err := os.MkdirAll(actionsDir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testActionFile := filepath.Join(actionsDir, "testAction")
+		// The action ignores SIGTERM, so it must be killed after the grace period.
+		err = os.WriteFile(testActionFile, []byte(`#!/usr/bin/env bash
+trap '' TERM
+sleep 10
+`), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		action := &Action{
+			Name: "testAction",
+			Path: testActionFile,
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		r := NewActionRunner(action, dir, nil)
+		r.gracePeriod = 100 * time.Millisecond
+		start := time.Now()
+		b, _, err := r.Run(ctx, &types.ActionMessage{
+			Id:   "00000000-0000-0000-0000-000000000001",
+			Name: "testAction",
+		})
+		assert.ErrorIs(t, err, ErrActionCanceled)
+		assert.Nil(t, b)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+
+	t.Run("with upload", func(t *testing.T) {
+		dir := testTempDir(t)
+		actionsDir := filepath.Join(dir, "actions")
+		err := os.MkdirAll(actionsDir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testActionFile := filepath.Join(actionsDir, "testAction")
+		err = os.WriteFile(testActionFile, []byte(`#!/usr/bin/env bash
+cat
+cat "$ACTIONS_GATEWAY_UPLOAD_DIR/0-a.txt"
+`), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		action := &Action{
+			Name: "testAction",
+			Path: testActionFile,
+		}
+
+		upload, err := NewUpload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = upload.Write(&types.UploadChunk{Index: 0, Field: "file", Filename: "a.txt", ContentType: "text/plain", Data: "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewActionRunner(action, dir, nil)
+		r.SetUpload(upload)
+		b, _, err := r.Run(context.Background(), &types.ActionMessage{
+			Id:        "00000000-0000-0000-0000-000000000001",
+			Name:      "testAction",
+			Multipart: true,
+		})
+		assert.NoError(t, err)
+		path := filepath.Join(upload.Dir(), "0-a.txt")
+		assert.Equal(t, `{"parts":[{"field":"file","filename":"a.txt","content_type":"text/plain","path":"`+path+`","size":5}]}hello`, string(b))
+		// The uploaded files are removed after the action finishes.
+		assert.NoDirExists(t, upload.Dir())
 	})
 }
@@ -0,0 +1,155 @@
+package actions
+
+import (
+	"fmt"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"gopkg.in/yaml.v3"
+	"strings"
+	"time"
+)
+
+// The following are the OpenAPI extensions that an action can declare in its spec
+// to configure how Actions Gateway handles the action.
+const (
+	// ExtensionTimeout is the execution timeout of the action.
+	// The value is a duration string like "90s" or "5m", or a number of seconds.
+	ExtensionTimeout = "x-actions-gateway-timeout"
+	// ExtensionStream enables streaming the output of the action to the HTTP caller as it is produced.
+	ExtensionStream = "x-actions-gateway-stream"
+	// ExtensionDeferrable allows the server to queue the durable invocations of the action while the client is offline
+	// and deliver them when the client connects.
+	ExtensionDeferrable = "x-actions-gateway-deferrable"
+	// ExtensionCache is the time to cache the successful results of the read-only action on the server.
+	// The value is a duration string like "60s" or "5m", or a number of seconds.
+	ExtensionCache = "x-actions-gateway-cache"
+	// ExtensionConcurrency is the maximum number of the runs of the action at the same time on the client.
+	// The value 1 makes the action run exclusively.
+	ExtensionConcurrency = "x-actions-gateway-concurrency"
+	// ExtensionRateLimit is the rate limit of the requests to the action on the server.
+	// The value is the number of the requests and the period like "10/m". It overrides the server default.
+	ExtensionRateLimit = "x-actions-gateway-rate-limit"
+)
+
+// SpecExtensions is a set of the Actions Gateway extensions declared in the action's spec.
+type SpecExtensions struct {
+	Timeout     time.Duration
+	Stream      bool
+	Deferrable  bool
+	Cache       time.Duration
+	Concurrency int
+	RateLimit   string
+}
+
+// parseSpecExtensions parses the action's spec (a YAML fragment of an OpenAPI operation)
+// and extracts the Actions Gateway extensions.
+// The spec that is not a YAML mapping is passed through as it is, so it has no extensions.
+func parseSpecExtensions(spec string) (*SpecExtensions, error) {
+	ext := &SpecExtensions{}
+
+	values := map[string]any{}
+	if err := yaml.Unmarshal([]byte(spec), &values); err != nil {
+		return ext, nil
+	}
+
+	if v, ok := values[ExtensionTimeout]; ok {
+		d, err := parseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", ExtensionTimeout, err)
+		}
+		ext.Timeout = d
+	}
+
+	if v, ok := values[ExtensionStream]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s: unexpected value: %v", ExtensionStream, v)
+		}
+		ext.Stream = b
+	}
+
+	if v, ok := values[ExtensionDeferrable]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s: unexpected value: %v", ExtensionDeferrable, v)
+		}
+		ext.Deferrable = b
+	}
+
+	if v, ok := values[ExtensionCache]; ok {
+		d, err := parseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", ExtensionCache, err)
+		}
+		// The server caches the results in whole seconds, so a shorter time would disable the cache.
+		if d < time.Second {
+			return nil, fmt.Errorf("invalid %s: it must be at least 1s: %v", ExtensionCache, v)
+		}
+		ext.Cache = d
+	}
+
+	if v, ok := values[ExtensionConcurrency]; ok {
+		n, ok := v.(int)
+		if !ok || n < 1 {
+			return nil, fmt.Errorf("invalid %s: unexpected value: %v", ExtensionConcurrency, v)
+		}
+		ext.Concurrency = n
+	}
+
+	if v, ok := values[ExtensionRateLimit]; ok {
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s: unexpected value: %v", ExtensionRateLimit, v)
+		}
+		limit, err := types.ParseRateLimit(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", ExtensionRateLimit, err)
+		}
+		ext.RateLimit = limit.String()
+	}
+
+	return ext, nil
+}
+
+// specMethods is a list of the operation keys of an OpenAPI path item that the server routes to the actions.
+var specMethods = []string{"get", "post", "put", "patch", "delete"}
+
+// parseSpecMethods returns the HTTP methods (in upper case) of the operations
+// if the action's spec is an OpenAPI path item that has operation keys such as "get:" and "post:".
+// It returns nil if the spec is a single operation, which is served as POST.
+func parseSpecMethods(spec string) []string {
+	values := map[string]any{}
+	if err := yaml.Unmarshal([]byte(spec), &values); err != nil {
+		return nil
+	}
+
+	var methods []string
+	for _, m := range specMethods {
+		if _, ok := values[m]; ok {
+			methods = append(methods, strings.ToUpper(m))
+		}
+	}
+	return methods
+}
+
+// parseDuration parses a duration string like "90s" or a number of seconds.
+// The duration must be positive.
+func parseDuration(v any) (time.Duration, error) {
+	var d time.Duration
+	switch v := v.(type) {
+	case int:
+		d = time.Duration(v) * time.Second
+	case float64:
+		d = time.Duration(v * float64(time.Second))
+	case string:
+		var err error
+		if d, err = time.ParseDuration(v); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unexpected value: %v", v)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("the duration must be positive: %v", v)
+	}
+	return d, nil
+}
@@ -0,0 +1,142 @@
+package actions
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseSpecExtensions(t *testing.T) {
+	testCases := map[string]struct {
+		spec     string
+		expected *SpecExtensions
+		hasError bool
+	}{
+		"no extensions": {
+			spec:     "summary: test\noperationId: test\n",
+			expected: &SpecExtensions{},
+		},
+		"empty spec": {
+			spec:     "",
+			expected: &SpecExtensions{},
+		},
+		"timeout as duration string": {
+			spec:     "summary: test\nx-actions-gateway-timeout: 5m\n",
+			expected: &SpecExtensions{Timeout: 5 * time.Minute},
+		},
+		"timeout as seconds": {
+			spec:     "summary: test\nx-actions-gateway-timeout: 90\n",
+			expected: &SpecExtensions{Timeout: 90 * time.Second},
+		},
+		"stream": {
+			spec:     "summary: test\nx-actions-gateway-stream: true\n",
+			expected: &SpecExtensions{Stream: true},
+		},
+		"deferrable": {
+			spec:     "summary: test\nx-actions-gateway-deferrable: true\n",
+			expected: &SpecExtensions{Deferrable: true},
+		},
+		"invalid deferrable": {
+			spec:     "summary: test\nx-actions-gateway-deferrable: later\n",
+			hasError: true,
+		},
+		"cache": {
+			spec:     "summary: test\nx-actions-gateway-cache: 60s\n",
+			expected: &SpecExtensions{Cache: time.Minute},
+		},
+		"invalid cache": {
+			spec:     "summary: test\nx-actions-gateway-cache: forever\n",
+			hasError: true,
+		},
+		"concurrency": {
+			spec:     "summary: test\nx-actions-gateway-concurrency: 1\n",
+			expected: &SpecExtensions{Concurrency: 1},
+		},
+		"invalid concurrency": {
+			spec:     "summary: test\nx-actions-gateway-concurrency: 0\n",
+			hasError: true,
+		},
+		"rate limit": {
+			spec:     "summary: test\nx-actions-gateway-rate-limit: 10/m\n",
+			expected: &SpecExtensions{RateLimit: "10/m"},
+		},
+		"rate limit with a duration period": {
+			spec:     "summary: test\nx-actions-gateway-rate-limit: 5/30s\n",
+			expected: &SpecExtensions{RateLimit: "5/30s"},
+		},
+		"invalid rate limit": {
+			spec:     "summary: test\nx-actions-gateway-rate-limit: 10\n",
+			hasError: true,
+		},
+		"invalid stream": {
+			spec:     "summary: test\nx-actions-gateway-stream: yes please\n",
+			hasError: true,
+		},
+		"invalid timeout": {
+			spec:     "summary: test\nx-actions-gateway-timeout: forever\n",
+			hasError: true,
+		},
+		"negative timeout": {
+			spec:     "summary: test\nx-actions-gateway-timeout: -30s\n",
+			hasError: true,
+		},
+		"zero timeout": {
+			spec:     "summary: test\nx-actions-gateway-timeout: 0\n",
+			hasError: true,
+		},
+		"negative cache": {
+			spec:     "summary: test\nx-actions-gateway-cache: -1\n",
+			hasError: true,
+		},
+		"cache shorter than a second": {
+			spec:     "summary: test\nx-actions-gateway-cache: 500ms\n",
+			hasError: true,
+		},
+		"timeout shorter than a second": {
+			spec:     "summary: test\nx-actions-gateway-timeout: 0.5\n",
+			expected: &SpecExtensions{Timeout: 500 * time.Millisecond},
+		},
+		"not a yaml mapping": {
+			spec:     "This is not a spec\n",
+			expected: &SpecExtensions{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ext, err := parseSpecExtensions(tc.spec)
+			if tc.hasError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, ext)
+		})
+	}
+}
+
+func TestParseSpecMethods(t *testing.T) {
+	testCases := map[string]struct {
+		spec     string
+		expected []string
+	}{
+		"operation": {
+			spec:     "summary: test\noperationId: test\n",
+			expected: nil,
+		},
+		"path item": {
+			spec:     "delete:\n  summary: delete\nget:\n  summary: get\nparameters: []\n",
+			expected: []string{"GET", "DELETE"},
+		},
+		"not yaml mapping": {
+			spec:     "This is a test action",
+			expected: nil,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, parseSpecMethods(tc.spec))
+		})
+	}
+}
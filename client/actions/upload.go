@@ -0,0 +1,143 @@
+package actions
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Upload is a set of the files uploaded with a multipart request to an action.
+// The files are written to a temporary directory that is dedicated to the action invocation.
+type Upload struct {
+	// dir is the temporary directory that contains the uploaded files
+	dir string
+	// parts is a list of the uploaded parts in the order of the request
+	parts []*UploadedPart
+	// files is a map of the files that are being written. The key of the map is a part index.
+	files map[int]*os.File
+	// err is the first error of writing the files. The upload is incomplete if it is not nil.
+	err error
+	// mu is a mutex for operations on parts and files
+	mu sync.Mutex
+}
+
+// UploadedPart is an entry of the manifest that describes an uploaded part.
+type UploadedPart struct {
+	// Field is the form field name of the part
+	Field string `json:"field"`
+	// Filename is the original filename of the part. It is empty for the form values.
+	Filename string `json:"filename,omitempty"`
+	// ContentType is the content type of the part
+	ContentType string `json:"content_type,omitempty"`
+	// Path is the path of the temporary file that has the content of the part
+	Path string `json:"path"`
+	// Size is the size of the content in bytes
+	Size int64 `json:"size"`
+}
+
+// NewUpload creates a new Upload with its temporary directory.
+func NewUpload() (*Upload, error) {
+	dir, err := os.MkdirTemp("", "actions-gateway-upload-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the upload directory: %w", err)
+	}
+	return &Upload{
+		dir:   dir,
+		files: make(map[int]*os.File),
+	}, nil
+}
+
+// Dir returns the temporary directory that contains the uploaded files.
+func (u *Upload) Dir() string {
+	return u.dir
+}
+
+// Write writes the chunk to the file of the part.
+// The first chunk of a part creates the file with the metadata of the part.
+func (u *Upload) Write(chunk *types.UploadChunk) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.err != nil {
+		return u.err
+	}
+	if err := u.write(chunk); err != nil {
+		u.err = err
+		return err
+	}
+	return nil
+}
+
+func (u *Upload) write(chunk *types.UploadChunk) error {
+	f, ok := u.files[chunk.Index]
+	if !ok {
+		if chunk.Index != len(u.parts) {
+			return fmt.Errorf("unexpected part index: %d", chunk.Index)
+		}
+		path := filepath.Join(u.dir, fmt.Sprintf("%d-%s", chunk.Index, partFileName(chunk)))
+		var err error
+		f, err = os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create the upload file: %w", err)
+		}
+		u.files[chunk.Index] = f
+		u.parts = append(u.parts, &UploadedPart{
+			Field:       chunk.Field,
+			Filename:    chunk.Filename,
+			ContentType: chunk.ContentType,
+			Path:        path,
+		})
+	}
+
+	n, err := f.WriteString(chunk.Data)
+	u.parts[chunk.Index].Size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write the upload file: %w", err)
+	}
+	return nil
+}
+
+// Manifest closes the files and returns the manifest of the uploaded parts as JSON.
+func (u *Upload) Manifest() ([]byte, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closeFiles()
+	if u.err != nil {
+		return nil, fmt.Errorf("the upload is incomplete: %w", u.err)
+	}
+	parts := u.parts
+	if parts == nil {
+		parts = []*UploadedPart{}
+	}
+	return json.Marshal(map[string]any{"parts": parts})
+}
+
+// Remove removes the temporary directory and the uploaded files.
+func (u *Upload) Remove() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closeFiles()
+	return os.RemoveAll(u.dir)
+}
+
+func (u *Upload) closeFiles() {
+	for index, f := range u.files {
+		_ = f.Close()
+		delete(u.files, index)
+	}
+}
+
+// partFileName returns a safe file name for the part.
+// The filename sent by the caller must not be used as a path as it is.
+func partFileName(chunk *types.UploadChunk) string {
+	name := filepath.Base(chunk.Filename)
+	if chunk.Filename == "" || name == "." || name == string(filepath.Separator) {
+		return "part"
+	}
+	return name
+}
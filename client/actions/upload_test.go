@@ -0,0 +1,70 @@
+package actions
+
+import (
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpload(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		upload, err := NewUpload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer upload.Remove()
+
+		chunks := []*types.UploadChunk{
+			{Index: 0, Field: "name", Data: "value"},
+			{Index: 1, Field: "file", Filename: "../../etc/passwd", ContentType: "application/octet-stream", Data: "abc"},
+			{Index: 1, Data: "def"},
+		}
+		for _, chunk := range chunks {
+			assert.NoError(t, upload.Write(chunk))
+		}
+
+		b, err := upload.Manifest()
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"parts":[
+			{"field":"name","path":"`+filepath.Join(upload.Dir(), "0-part")+`","size":5},
+			{"field":"file","filename":"../../etc/passwd","content_type":"application/octet-stream","path":"`+filepath.Join(upload.Dir(), "1-passwd")+`","size":6}
+		]}`, string(b))
+
+		data, err := os.ReadFile(filepath.Join(upload.Dir(), "1-passwd"))
+		assert.NoError(t, err)
+		assert.Equal(t, "abcdef", string(data))
+
+		assert.NoError(t, upload.Remove())
+		assert.NoDirExists(t, upload.Dir())
+	})
+
+	t.Run("no parts", func(t *testing.T) {
+		upload, err := NewUpload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer upload.Remove()
+
+		b, err := upload.Manifest()
+		assert.NoError(t, err)
+		assert.Equal(t, `{"parts":[]}`, string(b))
+	})
+
+	t.Run("unexpected part index", func(t *testing.T) {
+		upload, err := NewUpload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer upload.Remove()
+
+		err = upload.Write(&types.UploadChunk{Index: 1, Field: "file"})
+		assert.EqualError(t, err, "unexpected part index: 1")
+
+		// The upload is incomplete after the error.
+		assert.Error(t, upload.Write(&types.UploadChunk{Index: 0, Field: "file"}))
+		_, err = upload.Manifest()
+		assert.EqualError(t, err, "the upload is incomplete: unexpected part index: 1")
+	})
+}
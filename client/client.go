@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +11,9 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -18,6 +21,7 @@ import (
 	"github.com/kohkimakimoto/actions-gateway/client/actions"
 	"github.com/kohkimakimoto/actions-gateway/client/config"
 	"github.com/kohkimakimoto/actions-gateway/client/status"
+	"github.com/kohkimakimoto/actions-gateway/metrics"
 	"github.com/kohkimakimoto/actions-gateway/server/types"
 	"github.com/kohkimakimoto/actions-gateway/version"
 )
@@ -34,17 +38,52 @@ type Client struct {
 	httpClient *http.Client
 	// reconnectAttempts is the current state of the reconnect attempts.
 	reconnectAttempts int
+	// running is a map of the functions to cancel the running actions. The key of the map is an action message id.
+	running map[string]context.CancelFunc
+	// runningMu is a mutex for operations on running
+	runningMu sync.Mutex
+	// uploads is a map of the files uploaded for the action messages that have not arrived yet.
+	// The key of the map is an action message id.
+	uploads map[string]*actions.Upload
+	// uploadErrors is a map of the errors of receiving the uploaded files for the action messages that have not arrived yet.
+	// The action message whose upload failed is not run. The key of the map is an action message id.
+	uploadErrors map[string]error
+	// uploadsMu is a mutex for operations on uploads and uploadErrors
+	uploadsMu sync.Mutex
+	// deferred remembers the deferred action messages that have been handled and their results.
+	// The server may deliver a deferred action message more than once, but its action runs only once.
+	deferred *deferredStore
+	// conn is the current connection with the server. It is nil while the client is not connected.
+	conn *serverConn
+	// connMu is a mutex for operations on conn
+	connMu sync.Mutex
+	// limiter limits the number of the actions that run at the same time
+	limiter *limiter
+	// metricsRegistry is the registry of the metrics of the agent
+	metricsRegistry *metrics.Registry
+	// metrics is the metrics of the agent
+	metrics *agentMetrics
+	// status is the writer of the status that records the invocations of the actions. It is set by Connect.
+	status *status.Writer
 }
 
 // New creates a new client instance.
 func New(cfg *config.Config, w io.Writer, errW io.Writer) *Client {
-	return &Client{
+	c := &Client{
 		config:            cfg,
 		writer:            w,
 		errWriter:         errW,
 		httpClient:        &http.Client{},
 		reconnectAttempts: 0,
+		running:           make(map[string]context.CancelFunc),
+		uploads:           make(map[string]*actions.Upload),
+		uploadErrors:      make(map[string]error),
+		deferred:          newDeferredStore(cfg.DeferredAbsFile, time.Duration(cfg.DeferredTTL)*time.Second),
+		limiter:           newLimiter(cfg.MaxConcurrentActions, cfg.MaxQueuedActions),
+		metricsRegistry:   metrics.NewRegistry(),
 	}
+	c.metrics = newAgentMetrics(c, c.metricsRegistry)
+	return c
 }
 
 func (c *Client) NewToken() (string, error) {
@@ -72,10 +111,15 @@ func (c *Client) NewToken() (string, error) {
 }
 
 func (c *Client) Connect(m *actions.ActionManager, sw *status.Writer) (err error) {
+	c.status = sw
+	if err := c.deferred.load(); err != nil {
+		return err
+	}
 	maxBackoff := time.Duration(c.config.MaxReconnectBackoff) * time.Second
 	for c.reconnectAttempts < c.config.MaxReconnectAttempts {
 		if err = c.connect(m, sw); err != nil {
 			c.reconnectAttempts++
+			c.metrics.reconnectAttempts.Inc()
 			backoff := time.Duration(1<<c.reconnectAttempts) * time.Second
 			if backoff > maxBackoff {
 				backoff = maxBackoff
@@ -104,6 +148,12 @@ func (c *Client) connect(m *actions.ActionManager, sw *status.Writer) error {
 	sessionNewRequest := &types.SessionNewRequest{
 		Actions: m.ActionNames(),
 		Spec:    spec,
+		Options: m.ActionOptions(),
+		// The clients that do not send it are treated as supporting only protocol version 1.
+		ProtocolVersions: types.SupportedProtocolVersions,
+		Capabilities:     []string{types.CapabilityBase64Body, types.CapabilityMultipart},
+		Labels:           c.config.Labels,
+		InstanceId:       c.config.InstanceId,
 	}
 
 	if err := sw.UpdateToConnecting(sessionNewRequest); err != nil {
@@ -136,6 +186,15 @@ func (c *Client) connect(m *actions.ActionManager, sw *status.Writer) error {
 		return fmt.Errorf("failed to parse the response body: %w", err)
 	}
 
+	// The servers that do not respond with the protocol version support only protocol version 1.
+	protocolVersion := sessionNewResponse.ProtocolVersion
+	if protocolVersion == 0 {
+		protocolVersion = types.ProtocolVersion1
+	}
+	if !slices.Contains(types.SupportedProtocolVersions, protocolVersion) {
+		return fmt.Errorf("the server chose an unsupported protocol version %d: the client supports %v", protocolVersion, types.SupportedProtocolVersions)
+	}
+
 	// handle the interrupt signal
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
@@ -154,6 +213,8 @@ func (c *Client) connect(m *actions.ActionManager, sw *status.Writer) error {
 		return fmt.Errorf("failed to connect to the websocket server: %w", err)
 	}
 	defer conn.Close()
+	// remove the uploaded files of the action messages that will never arrive
+	defer c.removeUploads()
 
 	// reset the reconnect attempts, because the connection is successful
 	c.reconnectAttempts = 0
@@ -163,13 +224,28 @@ func (c *Client) connect(m *actions.ActionManager, sw *status.Writer) error {
 	if err := sw.UpdateToActive(sessionNewRequest, sessionNewResponse); err != nil {
 		return fmt.Errorf("failed to update the status: %w", err)
 	}
+	c.metrics.connections.Inc()
+	c.metrics.connected.Set(1)
+	defer c.metrics.connected.Set(0)
+
+	sc := newServerConn(conn, protocolVersion, sessionNewResponse.Capabilities)
+	c.setConn(sc)
+	defer c.setConn(nil)
 
 	// channel to handle closing the connection
 	done := make(chan struct{})
+	// The actions that arrive on the connection are canceled when it is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if sc.version >= types.ProtocolVersion2 {
+		go c.sendHeartbeats(sc, done)
+	}
+	go c.flushStatus(sw, done)
 
 	// goroutine to receive messages from the server
 	go func() {
 		defer close(done)
+		defer cancel()
 		for {
 			// read a message from the server
 			_, message, err := conn.ReadMessage()
@@ -177,7 +253,8 @@ func (c *Client) connect(m *actions.ActionManager, sw *status.Writer) error {
 				// This error means disconnection from the server.
 				return
 			}
-			go c.handleActionMessage(m, message)
+			// The messages are dispatched in order, and the actions run concurrently.
+			c.handleMessage(ctx, m, sc, message)
 		}
 	}()
 
@@ -190,7 +267,7 @@ func (c *Client) connect(m *actions.ActionManager, sw *status.Writer) error {
 			// handle the interrupt signal
 			_, _ = fmt.Fprintf(c.writer, "Received signal (%s).\n", sig.String())
 			// send a close message to the server
-			err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			err := sc.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 			if err != nil {
 				return fmt.Errorf("failed to send a close message to the server: %w", err)
 			}
@@ -205,49 +282,431 @@ func (c *Client) connect(m *actions.ActionManager, sw *status.Writer) error {
 	}
 }
 
-func (c *Client) handleActionMessage(m *actions.ActionManager, message []byte) {
-	_, _ = fmt.Fprintf(c.writer, "Received message: %s\n", message)
-
-	// setup a result object
-	result := &types.ActionResult{}
+// handleMessage handles the message that is sent from the server via websocket.
+// It must not block, because it is called in the loop that reads the messages.
+// The actions run with ctx, which is canceled when the connection is closed.
+func (c *Client) handleMessage(ctx context.Context, m *actions.ActionManager, sc *serverConn, message []byte) {
+	if sc.version < types.ProtocolVersion2 {
+		// The server sends only bare action messages.
+		msg := &types.ActionMessage{}
+		if err := json.Unmarshal(message, msg); err != nil {
+			_, _ = fmt.Fprintf(c.errWriter, "Failed to parse the message: %v\n", err)
+			return
+		}
+		c.startAction(ctx, m, sc, msg, nil)
+		return
+	}
 
-	// parse the message
-	msg := &types.ActionMessage{}
-	if err := json.Unmarshal(message, msg); err != nil {
+	env, err := types.ParseEnvelope(message)
+	if err == nil && env.Type == types.MessageTypeUpload {
+		c.handleUpload(sc, env)
+		return
+	}
+	if err != nil {
 		_, _ = fmt.Fprintf(c.errWriter, "Failed to parse the message: %v\n", err)
+		// report the error to the server, because the message can not be processed
+		c.sendError(sc, "", err)
 		return
 	}
-	result.Id = msg.Id
+
+	switch env.Type {
+	case types.MessageTypeAction:
+		msg := &types.ActionMessage{}
+		if err := env.DecodePayload(msg); err != nil {
+			_, _ = fmt.Fprintf(c.errWriter, "Failed to parse the message: %v\n", err)
+			c.sendError(sc, env.Id, err)
+			return
+		}
+		msg.Id = env.Id
+		if msg.Body, err = types.DecodeBody(msg.Body, msg.BodyEncoding); err != nil {
+			_, _ = fmt.Fprintf(c.errWriter, "Failed to parse the message: %v\n", err)
+			c.sendError(sc, env.Id, err)
+			return
+		}
+		msg.BodyEncoding = ""
+
+		var upload *actions.Upload
+		if msg.Multipart {
+			// The action does not run without the files that have not been uploaded completely.
+			if upload, err = c.takeUpload(msg.Id); err != nil {
+				_, _ = fmt.Fprintf(c.errWriter, "Failed to prepare the uploaded files: %v\n", err)
+				c.sendError(sc, env.Id, err)
+				return
+			}
+		}
+		c.startAction(ctx, m, sc, msg, upload)
+	case types.MessageTypeCancel:
+		c.cancelAction(env.Id)
+	default:
+		_, _ = fmt.Fprintf(c.errWriter, "Unknown message type: %s\n", env.Type)
+		c.sendError(sc, "", fmt.Errorf("unknown message type: %s", env.Type))
+	}
+}
+
+// startAction registers the action message as running and handles it in the background.
+// The registration is done before returning, so that the following cancel message can find it.
+// The action is canceled when ctx is done, except the deferred action, which sends its result
+// on the next connection because the server delivers it again.
+func (c *Client) startAction(ctx context.Context, m *actions.ActionManager, sc *serverConn, msg *types.ActionMessage, upload *actions.Upload) {
+	// The message is not logged as it is, because the body may be large or contain private data.
+	_, _ = fmt.Fprintf(c.writer, "Received the action: %s (%s)\n", msg.Name, msg.Id)
+	if msg.Deferred && !c.startDeferred(sc, msg) {
+		if upload != nil {
+			_ = upload.Remove()
+		}
+		return
+	}
+
+	if msg.Deferred {
+		ctx = context.WithoutCancel(ctx)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.runningMu.Lock()
+	c.running[msg.Id] = cancel
+	c.runningMu.Unlock()
+
+	go func() {
+		defer func() {
+			c.runningMu.Lock()
+			delete(c.running, msg.Id)
+			c.runningMu.Unlock()
+			cancel()
+			if msg.Deferred {
+				c.finishDeferred(msg.Id)
+			}
+		}()
+		c.handleActionMessage(ctx, m, sc, msg, upload)
+	}()
+}
+
+// startDeferred records that the deferred action message is handled.
+// It returns false if the action message has already been handled. In that case, the result is sent again
+// if the action has finished, otherwise the running action sends it.
+func (c *Client) startDeferred(sc *serverConn, msg *types.ActionMessage) bool {
+	started, result := c.deferred.start(msg.Id)
+	if started {
+		return true
+	}
+
+	_, _ = fmt.Fprintf(c.writer, "Skipped the duplicate action: %s (%s)\n", msg.Name, msg.Id)
+	if result != nil {
+		if err := c.sendResult(sc, result); err != nil {
+			_, _ = fmt.Fprintf(c.errWriter, "Failed to send the result: %v\n", err)
+		}
+	}
+	return false
+}
+
+// finishDeferred forgets the deferred action message if its action did not produce the result, such as when
+// it was canceled, so that it runs again if it is delivered again.
+func (c *Client) finishDeferred(msgId string) {
+	c.deferred.forget(msgId)
+}
+
+// handleActionMessage runs the action of the action message and sends its result to the server.
+// The upload is the files uploaded with the multipart request. It is nil for the other requests.
+func (c *Client) handleActionMessage(ctx context.Context, m *actions.ActionManager, sc *serverConn, msg *types.ActionMessage, upload *actions.Upload) {
+	// setup a result object
+	result := &types.ActionResult{
+		Id: msg.Id,
+	}
 
 	action := m.GetAction(msg.Name)
 	if action == nil {
 		_, _ = fmt.Fprintf(c.errWriter, "Failed to find the action: %s\n", msg.Name)
+		if upload != nil {
+			_ = upload.Remove()
+		}
+		c.recordRejected(unknownAction, failureNotFound)
 		result.Status = types.ActionResultStatusError
 		result.Body = `{"error": "action not found"}`
-		if err := c.NotifyResult(result); err != nil {
-			_, _ = fmt.Fprintf(c.writer, "Failed to notify the result: %v\n", err)
+		if err := c.sendResult(sc, result); err != nil {
+			_, _ = fmt.Fprintf(c.errWriter, "Failed to send the result: %v\n", err)
+		}
+		return
+	}
+
+	// wait for the concurrency limits
+	release, err := c.limiter.acquire(ctx, action.Name, c.actionConcurrency(action))
+	if err != nil {
+		if upload != nil {
+			_ = upload.Remove()
+		}
+		if !errors.Is(err, errBusy) {
+			// The server does not wait for the result anymore.
+			c.recordRejected(msg.Name, failureCanceled)
+			_, _ = fmt.Fprintf(c.writer, "Canceled the action: %s (%s)\n", msg.Name, msg.Id)
+			return
 		}
+		c.recordRejected(msg.Name, failureBusy)
+		_, _ = fmt.Fprintf(c.errWriter, "Rejected the action: %s (%s), %v\n", msg.Name, msg.Id, err)
+		result.Status = types.ActionResultStatusBusy
+		result.Body = "The agent is busy"
+		if err := c.sendResult(sc, result); err != nil {
+			_, _ = fmt.Fprintf(c.errWriter, "Failed to send the result: %v\n", err)
+		}
+		return
+	}
+	defer release()
+
+	runner := actions.NewActionRunner(action, c.config.Dir(), c.errWriter)
+	if upload != nil {
+		runner.SetUpload(upload)
+	}
+	if msg.Stream {
+		c.runActionStream(ctx, runner, sc, msg)
 		return
 	}
-	b, err := actions.NewActionRunner(action, c.config.Dir(), c.errWriter).Run(msg)
+
+	start := time.Now()
+	b, res, err := runner.Run(ctx, msg)
+	c.recordRun(msg.Name, start, int64(len(b)), err)
 	if err != nil {
+		if errors.Is(err, actions.ErrActionCanceled) {
+			// The server does not wait for the result anymore.
+			_, _ = fmt.Fprintf(c.writer, "Canceled the action: %s (%s)\n", msg.Name, msg.Id)
+			return
+		}
 		_, _ = fmt.Fprintf(c.errWriter, "Failed to run the action: %v\n", err)
 		result.Status = types.ActionResultStatusError
 	} else {
 		result.Status = types.ActionResultStatusSuccess
+		result.Body = string(b)
 	}
 
-	if b != nil {
+	if res != nil {
+		// The action declared its response, so the output is returned to the caller even if the action failed.
 		result.Body = string(b)
+		setResponse(result, res)
+	}
+
+	if err := c.sendResult(sc, result); err != nil {
+		_, _ = fmt.Fprintf(c.errWriter, "Failed to send the result: %v\n", err)
+	}
+}
+
+// actionConcurrency returns the maximum number of the runs of the action at the same time. Zero means no limit.
+// The config overrides the spec of the action.
+func (c *Client) actionConcurrency(action *actions.Action) int {
+	if n, ok := c.config.ActionConcurrency[action.Name]; ok {
+		return n
+	}
+	return action.Concurrency()
+}
+
+// runActionStream runs the action in streaming mode.
+// The output chunks and the result are sent to the server via the websocket connection.
+func (c *Client) runActionStream(ctx context.Context, runner *actions.ActionRunner, sc *serverConn, msg *types.ActionMessage) {
+	result := &types.ActionResult{
+		Id:     msg.Id,
+		Status: types.ActionResultStatusSuccess,
+	}
+
+	start := time.Now()
+	w := &outputWriter{sc: sc, id: msg.Id}
+	res, err := runner.RunStream(ctx, msg, w)
+	c.recordRun(msg.Name, start, w.written, err)
+	if res != nil {
+		setResponse(result, res)
+	}
+	if err != nil {
+		if errors.Is(err, actions.ErrActionCanceled) {
+			// The server does not wait for the result anymore.
+			_, _ = fmt.Fprintf(c.writer, "Canceled the action: %s (%s)\n", msg.Name, msg.Id)
+			return
+		}
+		_, _ = fmt.Fprintf(c.errWriter, "Failed to run the action: %v\n", err)
+		result.Status = types.ActionResultStatusError
+	}
+
+	if err := c.sendResult(sc, result); err != nil {
+		_, _ = fmt.Fprintf(c.errWriter, "Failed to send the result: %v\n", err)
+	}
+}
+
+// setResponse sets the response that the action declared to the result.
+func setResponse(result *types.ActionResult, res *actions.ActionResponse) {
+	result.StatusCode = res.StatusCode
+	result.Headers = res.Headers
+}
+
+// handleUpload writes the chunk of the uploaded file to the upload of the action message.
+// The upload is created by the first chunk, and it is taken by the action message that follows the chunks.
+func (c *Client) handleUpload(sc *serverConn, env *types.Envelope) {
+	chunk := &types.UploadChunk{}
+	err := env.DecodePayload(chunk)
+	if err == nil {
+		chunk.Data, err = types.DecodeBody(chunk.Data, chunk.DataEncoding)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(c.errWriter, "Failed to parse the upload message: %v\n", err)
+		c.sendError(sc, env.Id, err)
+		return
+	}
+
+	c.uploadsMu.Lock()
+	defer c.uploadsMu.Unlock()
+	if _, failed := c.uploadErrors[env.Id]; failed {
+		// The rest of the failed upload is discarded.
+		return
+	}
+	upload, ok := c.uploads[env.Id]
+	if !ok {
+		if upload, err = actions.NewUpload(); err != nil {
+			c.failUpload(env.Id, err)
+			return
+		}
+		c.uploads[env.Id] = upload
+	}
+	if err := upload.Write(chunk); err != nil {
+		c.failUpload(env.Id, err)
+	}
+}
+
+// failUpload records the error of receiving the uploaded files for the action message, and removes the files.
+// The action message fails with the error when it arrives. It must be called with uploadsMu locked.
+func (c *Client) failUpload(msgId string, err error) {
+	_, _ = fmt.Fprintf(c.errWriter, "Failed to receive the uploaded file: %v\n", err)
+	if upload, ok := c.uploads[msgId]; ok {
+		_ = upload.Remove()
+		delete(c.uploads, msgId)
+	}
+	c.uploadErrors[msgId] = err
+}
+
+// takeUpload removes the upload of the action message from the pending uploads and returns it.
+// It returns an empty upload if no file has been uploaded, and the error if receiving the uploaded files failed.
+func (c *Client) takeUpload(msgId string) (*actions.Upload, error) {
+	c.uploadsMu.Lock()
+	upload, ok := c.uploads[msgId]
+	delete(c.uploads, msgId)
+	uploadErr, failed := c.uploadErrors[msgId]
+	delete(c.uploadErrors, msgId)
+	c.uploadsMu.Unlock()
+	if failed {
+		return nil, fmt.Errorf("failed to receive the uploaded files: %w", uploadErr)
+	}
+	if ok {
+		return upload, nil
+	}
+	return actions.NewUpload()
+}
+
+// removeUploads removes all the pending uploads.
+func (c *Client) removeUploads() {
+	c.uploadsMu.Lock()
+	defer c.uploadsMu.Unlock()
+	for id, upload := range c.uploads {
+		_ = upload.Remove()
+		delete(c.uploads, id)
+	}
+	clear(c.uploadErrors)
+}
+
+// cancelAction cancels the running action of the action message.
+func (c *Client) cancelAction(msgId string) {
+	// The upload of the action message that will never arrive is no longer needed.
+	c.uploadsMu.Lock()
+	if upload, ok := c.uploads[msgId]; ok {
+		_ = upload.Remove()
+		delete(c.uploads, msgId)
+	}
+	delete(c.uploadErrors, msgId)
+	c.uploadsMu.Unlock()
+
+	c.runningMu.Lock()
+	cancel, ok := c.running[msgId]
+	c.runningMu.Unlock()
+	if !ok {
+		// The action has already finished.
+		return
+	}
+	_, _ = fmt.Fprintf(c.writer, "Canceling the action: %s\n", msgId)
+	cancel()
+}
+
+// setConn sets the current connection with the server.
+func (c *Client) setConn(sc *serverConn) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.conn = sc
+}
+
+// currentConn returns the current connection with the server, or nil if the client is not connected.
+func (c *Client) currentConn() *serverConn {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.conn
+}
+
+// sendResult sends the action result to the server.
+// It is sent via websocket since protocol version 2, otherwise via the /api/notify endpoint.
+func (c *Client) sendResult(sc *serverConn, result *types.ActionResult) error {
+	// remember the result of the deferred action message to send it again if the message is delivered again
+	// The busy result is not remembered, because the action has not run.
+	deferred := false
+	if result.Status != types.ActionResultStatusBusy {
+		var err error
+		if deferred, err = c.deferred.finish(result); err != nil {
+			_, _ = fmt.Fprintf(c.errWriter, "Failed to save the deferred result: %v\n", err)
+		}
+	}
+
+	if deferred {
+		// The connection that the deferred action message arrived on may have been lost while the action ran.
+		// The server waits for the result on the current connection, on which it delivers the message again.
+		if current := c.currentConn(); current != nil {
+			sc = current
+		}
 	}
 
-	if err := c.NotifyResult(result); err != nil {
-		_, _ = fmt.Fprintf(c.errWriter, "Failed to notify the result: %v\n", err)
+	if sc.version >= types.ProtocolVersion2 {
+		if sc.Supports(types.CapabilityBase64Body) {
+			encoded := *result
+			encoded.Body, encoded.BodyEncoding = types.EncodeBody(result.Body)
+			result = &encoded
+		}
+		return sc.Send(types.MessageTypeResult, result.Id, result)
+	}
+	return c.NotifyResult(result)
+}
+
+// sendError reports the error to the server.
+// If id is not empty, the action of the action message that has the id is treated as failed.
+// The servers of protocol version 1 do not accept errors, so it only works since protocol version 2.
+func (c *Client) sendError(sc *serverConn, id string, err error) {
+	if sc.version < types.ProtocolVersion2 {
+		return
+	}
+	if err := sc.Send(types.MessageTypeError, id, &types.ErrorPayload{Error: err.Error()}); err != nil {
+		_, _ = fmt.Fprintf(c.errWriter, "Failed to send the error: %v\n", err)
+	}
+}
+
+// heartbeatPeriod is the interval of the heartbeat messages that are sent to the server.
+const heartbeatPeriod = 10 * time.Second
+
+// sendHeartbeats sends heartbeat messages to the server periodically until done is closed.
+func (c *Client) sendHeartbeats(sc *serverConn, done <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := sc.Send(types.MessageTypeHeartbeat, "", nil); err != nil {
+				_, _ = fmt.Fprintf(c.errWriter, "Failed to send a heartbeat: %v\n", err)
+				return
+			}
+		}
 	}
 }
 
+// NotifyResult notifies the action result to the server via the /api/notify endpoint.
+// It is used for the servers of protocol version 1.
 func (c *Client) NotifyResult(result *types.ActionResult) error {
-	resp, err := c.post("/api/notify", result)
+	resp, err := c.post("/api/notify", types.NewLegacyActionResult(result))
 	if err != nil {
 		return fmt.Errorf("failed to notify the action result: %w", err)
 	}
@@ -286,3 +745,76 @@ func (c *Client) setHeaders(req *http.Request) {
 		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.config.Token))
 	}
 }
+
+// serverConn is a websocket connection with the server.
+type serverConn struct {
+	conn *websocket.Conn
+	// version is the protocol version that the server chose for the session
+	version int
+	// capabilities is a set of the optional features that both the server and the client support
+	capabilities map[string]bool
+	// mu serializes the writes to the websocket connection,
+	// because the websocket connection does not support concurrent writers.
+	mu sync.Mutex
+}
+
+func newServerConn(conn *websocket.Conn, version int, capabilities []string) *serverConn {
+	sc := &serverConn{
+		conn:         conn,
+		version:      version,
+		capabilities: make(map[string]bool),
+	}
+	for _, capability := range capabilities {
+		sc.capabilities[capability] = true
+	}
+	return sc
+}
+
+// Supports reports whether the server supports the capability.
+func (sc *serverConn) Supports(capability string) bool {
+	return sc.capabilities[capability]
+}
+
+// Send sends the message wrapped in an envelope to the server.
+func (sc *serverConn) Send(typ types.MessageType, id string, payload any) error {
+	env, err := types.NewEnvelope(typ, id, payload)
+	if err != nil {
+		return err
+	}
+	return sc.WriteJSON(env)
+}
+
+func (sc *serverConn) WriteJSON(v any) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.conn.WriteJSON(v)
+}
+
+func (sc *serverConn) WriteMessage(messageType int, data []byte) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.conn.WriteMessage(messageType, data)
+}
+
+// outputWriter is an io.Writer that sends the written data to the server as output chunks of the action.
+type outputWriter struct {
+	sc *serverConn
+	id string
+	// written is the number of the bytes that have been written
+	written int64
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	output := &types.ActionOutput{
+		Id:   w.id,
+		Data: string(p),
+	}
+	if w.sc.Supports(types.CapabilityBase64Body) {
+		output.Data, output.DataEncoding = types.EncodeBody(output.Data)
+	}
+	if err := w.sc.Send(types.MessageTypeOutput, w.id, output); err != nil {
+		return 0, err
+	}
+	w.written += int64(len(p))
+	return len(p), nil
+}
@@ -2,12 +2,20 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/kohkimakimoto/actions-gateway/client/actions"
 	"github.com/kohkimakimoto/actions-gateway/client/config"
 	"github.com/kohkimakimoto/actions-gateway/server/types"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestClient_makeURL(t *testing.T) {
@@ -80,6 +88,9 @@ func TestClient_NotifyResult(t *testing.T) {
 			// Check the request
 			assert.Equal(t, http.MethodPost, req.Method)
 			assert.Equal(t, "http://localhost:8080/api/notify", req.URL.String())
+			// the result body is sent under the "error" key for the servers of protocol version 1
+			b, _ := io.ReadAll(req.Body)
+			assert.JSONEq(t, `{"id":"","status":"success","error":"ok"}`, string(b))
 
 			return &http.Response{
 				StatusCode: http.StatusNoContent,
@@ -88,11 +99,215 @@ func TestClient_NotifyResult(t *testing.T) {
 
 		err := client.NotifyResult(&types.ActionResult{
 			Status: types.ActionResultStatusSuccess,
+			Body:   "ok",
 		})
 		assert.NoError(t, err)
 	})
 }
 
+func TestClient_cancelAction(t *testing.T) {
+	client := New(&config.Config{
+		Server: "http://localhost:8080",
+	}, io.Discard, io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client.running["00000000-0000-0000-0000-000000000001"] = cancel
+
+	// canceling the action that is not running does nothing
+	client.cancelAction("00000000-0000-0000-0000-000000000002")
+	assert.NoError(t, ctx.Err())
+
+	client.cancelAction("00000000-0000-0000-0000-000000000001")
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+}
+
+func TestClient_handleUpload(t *testing.T) {
+	client := New(&config.Config{
+		Server: "http://localhost:8080",
+	}, io.Discard, io.Discard)
+	sc := newServerConn(nil, types.ProtocolVersion2, nil)
+	upload := func(id string, chunk *types.UploadChunk) {
+		env, err := types.NewEnvelope(types.MessageTypeUpload, id, chunk)
+		assert.NoError(t, err)
+		client.handleUpload(sc, env)
+	}
+
+	upload("00000000-0000-0000-0000-000000000001", &types.UploadChunk{Index: 0, Field: "file", Filename: "a.txt", Data: "hello"})
+	u, err := client.takeUpload("00000000-0000-0000-0000-000000000001")
+	assert.NoError(t, err)
+	defer func() { _ = u.Remove() }()
+
+	// the part that comes out of order fails the upload, and the rest of it is discarded
+	upload("00000000-0000-0000-0000-000000000002", &types.UploadChunk{Index: 1, Field: "file", Data: "hello"})
+	upload("00000000-0000-0000-0000-000000000002", &types.UploadChunk{Index: 0, Field: "file", Data: "hello"})
+	_, err = client.takeUpload("00000000-0000-0000-0000-000000000002")
+	assert.ErrorContains(t, err, "failed to receive the uploaded files: unexpected part index: 1")
+	assert.Empty(t, client.uploads)
+	assert.Empty(t, client.uploadErrors)
+}
+
+func TestClient_sendResult(t *testing.T) {
+	t.Run("fall back to the notify endpoint", func(t *testing.T) {
+		client := New(&config.Config{
+			Server: "http://localhost:8080",
+		}, nil, nil)
+		called := false
+		client.httpClient = testHttpClient(t, func(req *http.Request) *http.Response {
+			called = true
+			assert.Equal(t, "http://localhost:8080/api/notify", req.URL.String())
+			return &http.Response{
+				StatusCode: http.StatusNoContent,
+				Body:       io.NopCloser(bytes.NewBuffer(nil)),
+			}
+		})
+
+		// the server of protocol version 1 does not receive the results via websocket
+		sc := newServerConn(nil, types.ProtocolVersion1, nil)
+		err := client.sendResult(sc, &types.ActionResult{
+			Status: types.ActionResultStatusSuccess,
+		})
+		assert.NoError(t, err)
+		assert.True(t, called)
+	})
+}
+
+func TestClient_startDeferred(t *testing.T) {
+	client := New(&config.Config{
+		Server: "http://localhost:8080",
+	}, io.Discard, io.Discard)
+	var notified []string
+	client.httpClient = testHttpClient(t, func(req *http.Request) *http.Response {
+		b, _ := io.ReadAll(req.Body)
+		notified = append(notified, string(b))
+		return &http.Response{
+			StatusCode: http.StatusNoContent,
+			Body:       io.NopCloser(bytes.NewBuffer(nil)),
+		}
+	})
+	sc := newServerConn(nil, types.ProtocolVersion1, nil)
+	msg := &types.ActionMessage{
+		Id:       "00000000-0000-0000-0000-000000000001",
+		Name:     "test",
+		Deferred: true,
+	}
+
+	assert.True(t, client.startDeferred(sc, msg))
+	// the duplicate message is skipped while the action is running
+	assert.False(t, client.startDeferred(sc, msg))
+	assert.Empty(t, notified)
+
+	err := client.sendResult(sc, &types.ActionResult{
+		Id:     msg.Id,
+		Status: types.ActionResultStatusSuccess,
+		Body:   "ok",
+	})
+	assert.NoError(t, err)
+	assert.Len(t, notified, 1)
+
+	// the result is sent again for the duplicate message after the action finished
+	client.finishDeferred(msg.Id)
+	assert.False(t, client.startDeferred(sc, msg))
+	assert.Len(t, notified, 2)
+	assert.Equal(t, notified[0], notified[1])
+
+	t.Run("the action that did not produce the result runs again", func(t *testing.T) {
+		msg := &types.ActionMessage{
+			Id:       "00000000-0000-0000-0000-000000000002",
+			Name:     "test",
+			Deferred: true,
+		}
+		assert.True(t, client.startDeferred(sc, msg))
+		client.finishDeferred(msg.Id)
+		assert.True(t, client.startDeferred(sc, msg))
+	})
+}
+
+func TestClient_deferredResultAfterReconnect(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "slow"), []byte("#!/usr/bin/env bash\nsleep 0.5\necho ok\n"), 0755)
+	assert.NoError(t, err)
+	cfg := &config.Config{
+		Server:        "http://localhost:8080",
+		Path:          filepath.Join(dir, "config.toml"),
+		ActionsAbsDir: dir,
+	}
+	m, err := actions.NewActionManager(cfg)
+	assert.NoError(t, err)
+	client := New(cfg, io.Discard, io.Discard)
+
+	results := make(chan *types.ActionResult, 1)
+	onMessage := func(message []byte) {
+		env, err := types.ParseEnvelope(message)
+		assert.NoError(t, err)
+		if env.Type != types.MessageTypeResult {
+			return
+		}
+		result := &types.ActionResult{}
+		assert.NoError(t, env.DecodePayload(result))
+		results <- result
+	}
+	sc1 := newServerConn(testServerConn(t, onMessage), types.ProtocolVersion2, nil)
+	client.setConn(sc1)
+	msg := &types.ActionMessage{
+		Id:       "00000000-0000-0000-0000-000000000001",
+		Name:     "slow",
+		Deferred: true,
+	}
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	client.startAction(ctx1, m, sc1, msg, nil)
+
+	// the connection drops while the action is running, and the server delivers the message again
+	// on the new connection
+	_ = sc1.conn.Close()
+	cancel1()
+	sc2 := newServerConn(testServerConn(t, onMessage), types.ProtocolVersion2, nil)
+	client.setConn(sc2)
+	client.startAction(context.Background(), m, sc2, msg, nil)
+
+	select {
+	case result := <-results:
+		assert.Equal(t, msg.Id, result.Id)
+		assert.Equal(t, types.ActionResultStatusSuccess, result.Status)
+		assert.Equal(t, "ok\n", result.Body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the result was not sent on the new connection")
+	}
+}
+
+func TestClient_startAction(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "slow"), []byte("#!/usr/bin/env bash\nsleep 5\necho ok\n"), 0755)
+	assert.NoError(t, err)
+	cfg := &config.Config{
+		Server:        "http://localhost:8080",
+		Path:          filepath.Join(dir, "config.toml"),
+		ActionsAbsDir: dir,
+	}
+	m, err := actions.NewActionManager(cfg)
+	assert.NoError(t, err)
+	client := New(cfg, io.Discard, io.Discard)
+	sc := newServerConn(testServerConn(t, func(message []byte) {}), types.ProtocolVersion2, nil)
+
+	// the action is canceled when the connection that it arrived on is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	client.startAction(ctx, m, sc, &types.ActionMessage{
+		Id:   "00000000-0000-0000-0000-000000000001",
+		Name: "slow",
+	}, nil)
+	cancel()
+	assert.Eventually(t, func() bool {
+		client.runningMu.Lock()
+		defer client.runningMu.Unlock()
+		return len(client.running) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestServerConn_Supports(t *testing.T) {
+	sc := newServerConn(nil, types.ProtocolVersion2, []string{"test-capability"})
+	assert.True(t, sc.Supports("test-capability"))
+	assert.False(t, sc.Supports("unknown"))
+}
+
 type RoundTripFunc func(req *http.Request) *http.Response
 
 func (f RoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -105,3 +320,34 @@ func testHttpClient(t *testing.T, fn RoundTripFunc) *http.Client {
 		Transport: fn,
 	}
 }
+
+// testServerConn returns a websocket connection to a fake server.
+// The fake server passes the messages sent to the connection to onMessage.
+func testServerConn(t *testing.T, onMessage func(message []byte)) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			onMessage(message)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
@@ -1,6 +1,11 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -43,12 +48,43 @@ type Config struct {
 	LogFile string `toml:"log_file"`
 	// This is the absolute path to the LogFile file.
 	LogAbsFile string `toml:"-"`
+	// This is the deferred file path.
+	// The deferred file is used to remember the deferred actions that have run across restarts of the agent,
+	// so that their actions do not run again when the server delivers them again.
+	// If it is a relative path, it will be relative to the directory where the config file is located.
+	// The default value is empty, which remembers them only while the agent is running.
+	DeferredFile string `toml:"deferred_file"`
+	// This is the absolute path to the DeferredFile file.
+	DeferredAbsFile string `toml:"-"`
+	// This is the time in seconds to remember a deferred action that has run.
+	// It should not be shorter than durable_queue_ttl of the server.
+	// The default value is 604800 (7 days).
+	DeferredTTL int `toml:"deferred_ttl"`
 	// This is the maximum number of reconnection attempts.
 	// The default value is 10.
 	MaxReconnectAttempts int `toml:"max_reconnect_attempts"`
 	// This is the maximum backoff time in seconds.
 	// The default value is 32.
 	MaxReconnectBackoff int `toml:"max_reconnect_backoff"`
+	// This is a set of the labels of the agent.
+	// The callers use them to select the agent that runs the action when several agents use the same token.
+	Labels map[string]string `toml:"labels"`
+	// This is the id of the agent that is used to replace its stale session on the server when it reconnects.
+	// The default value is generated from the hostname and the path to the config file.
+	InstanceId string `toml:"instance_id"`
+	// This is the maximum number of the actions that run at the same time.
+	// The default value is 0, which means no limit.
+	MaxConcurrentActions int `toml:"max_concurrent_actions"`
+	// This is the maximum number of the actions that wait for the concurrency limits.
+	// The actions over it are rejected as busy. A negative value rejects them without waiting.
+	// The default value is 100.
+	MaxQueuedActions int `toml:"max_queued_actions"`
+	// This is a map of the maximum number of the runs of each action at the same time by action name.
+	// It overrides the x-actions-gateway-concurrency extension in the action's spec.
+	ActionConcurrency map[string]int `toml:"action_concurrency"`
+	// This is the address that the agent serves its metrics on at /metrics in the Prometheus format.
+	// It must be a loopback address. The default value is empty, which disables the metrics.
+	MetricsAddr string `toml:"metrics_addr"`
 	// This is the info object config of the OpenAPI spec.
 	// https://swagger.io/specification/#info-object
 	SpecInfo *SpecInfoConfig `toml:"spec_info"`
@@ -137,6 +173,25 @@ func LoadFromFile(path string) (*Config, error) {
 		c.LogAbsFile = logAbsFile
 	}
 
+	if c.DeferredFile != "" {
+		var deferredAbsFile string
+		if filepath.IsAbs(c.DeferredFile) {
+			deferredAbsFile = c.DeferredFile
+		} else {
+			deferredAbsFile, err = filepath.Abs(filepath.Join(c.Dir(), c.DeferredFile))
+			if err != nil {
+				return nil, err
+			}
+		}
+		c.DeferredAbsFile = deferredAbsFile
+	}
+
+	if c.DeferredTTL == 0 {
+		c.DeferredTTL = 604800
+	} else if c.DeferredTTL < 0 {
+		return nil, fmt.Errorf("invalid deferred_ttl: it must be positive")
+	}
+
 	if c.MaxReconnectAttempts == 0 {
 		c.MaxReconnectAttempts = 10
 	}
@@ -144,6 +199,22 @@ func LoadFromFile(path string) (*Config, error) {
 		c.MaxReconnectBackoff = 32
 	}
 
+	if c.InstanceId == "" {
+		c.InstanceId = defaultInstanceId(c.Path)
+	}
+
+	if c.MaxQueuedActions == 0 {
+		c.MaxQueuedActions = 100
+	} else if c.MaxQueuedActions < 0 {
+		c.MaxQueuedActions = 0
+	}
+
+	if c.MetricsAddr != "" {
+		if err := validateLoopbackAddr(c.MetricsAddr); err != nil {
+			return nil, fmt.Errorf("invalid metrics_addr: %w", err)
+		}
+	}
+
 	if c.SpecInfo.Title == "" {
 		c.SpecInfo.Title = "Actions Gateway API"
 	}
@@ -160,6 +231,30 @@ func LoadFromFile(path string) (*Config, error) {
 	return c, nil
 }
 
+// defaultInstanceId generates the instance id from the hostname and the path to the config file.
+// It is stable across restarts of the agent, but differs between the agents on different machines.
+func defaultInstanceId(path string) string {
+	hostname, _ := os.Hostname()
+	sum := sha256.Sum256([]byte(hostname + "\n" + path))
+	return hex.EncodeToString(sum[:16])
+}
+
+// validateLoopbackAddr checks that addr is a host and port on the loopback interface,
+// so that the metrics of the agent are not exposed to the network.
+func validateLoopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%s is not a loopback address", addr)
+	}
+	return nil
+}
+
 var InitialConfig = strings.TrimLeft(`
 # ------------------------------------------------------------
 # This is a client config for Actions Gateway.
@@ -202,6 +297,17 @@ pid_file = "client.pid"
 # If it is a relative path, it will be relative to the directory where the config file is located.
 log_file = "client.log"
 
+# This is the deferred file path.
+# The deferred file is used to remember the deferred actions that have run across restarts of the agent,
+# so that their actions do not run again when the server delivers them again.
+# If it is a relative path, it will be relative to the directory where the config file is located.
+deferred_file = "deferred.json"
+
+# This is the time in seconds to remember a deferred action that has run.
+# It should not be shorter than durable_queue_ttl of the server.
+# The default value is 604800 (7 days).
+#deferred_ttl = 604800
+
 # This is the maximum number of reconnection attempts.
 # The default value is 10.
 max_reconnect_attempts = 10
@@ -210,6 +316,32 @@ max_reconnect_attempts = 10
 # The default value is 32.
 max_reconnect_backoff = 32
 
+# This is a set of the labels of the agent.
+# The callers use them to select the agent that runs the action when several agents use the same token.
+#labels = { host = "nas", env = "prod" }
+
+# This is the id of the agent that is used to replace its stale session on the server when it reconnects.
+# The default value is generated from the hostname and the path to the config file.
+#instance_id = "my-nas"
+
+# This is the maximum number of the actions that run at the same time.
+# The default value is 0, which means no limit.
+#max_concurrent_actions = 8
+
+# This is the maximum number of the actions that wait for the concurrency limits.
+# The actions over it are rejected as busy, and the server responds with 429.
+# The default value is 100.
+#max_queued_actions = 100
+
+# This is a map of the maximum number of the runs of each action at the same time.
+# It overrides the x-actions-gateway-concurrency extension in the action's spec.
+# The value 1 makes the action run exclusively.
+#action_concurrency = { backup = 1 }
+
+# This is the address that the agent serves its metrics on at /metrics in the Prometheus format.
+# It must be a loopback address. The metrics are disabled by default.
+#metrics_addr = "127.0.0.1:9101"
+
 # ------------------------------------------------------------
 # Spec info config.
 # ------------------------------------------------------------
@@ -3,6 +3,7 @@ package config
 import (
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -22,6 +23,94 @@ server = "http://localhost:8080"
 		assert.NoError(t, err)
 		assert.Equal(t, "http://localhost:8080", cfg.Server)
 	})
+
+	t.Run("labels", func(t *testing.T) {
+		f := testTempFile(t, []byte(`
+labels = { host = "nas", env = "prod" }
+`))
+		cfg, err := LoadFromFile(f.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"host": "nas", "env": "prod"}, cfg.Labels)
+	})
+
+	t.Run("instance id", func(t *testing.T) {
+		f := testTempFile(t, []byte(``))
+		cfg, err := LoadFromFile(f.Name())
+		assert.NoError(t, err)
+		assert.Len(t, cfg.InstanceId, 32)
+		// the default instance id is stable
+		cfg2, err := LoadFromFile(f.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, cfg.InstanceId, cfg2.InstanceId)
+
+		f = testTempFile(t, []byte(`
+instance_id = "my-nas"
+`))
+		cfg, err = LoadFromFile(f.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, "my-nas", cfg.InstanceId)
+	})
+
+	t.Run("concurrency limits", func(t *testing.T) {
+		f := testTempFile(t, []byte(``))
+		cfg, err := LoadFromFile(f.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, cfg.MaxConcurrentActions)
+		assert.Equal(t, 100, cfg.MaxQueuedActions)
+		assert.Nil(t, cfg.ActionConcurrency)
+
+		f = testTempFile(t, []byte(`
+max_concurrent_actions = 4
+max_queued_actions = -1
+action_concurrency = { backup = 1 }
+`))
+		cfg, err = LoadFromFile(f.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, 4, cfg.MaxConcurrentActions)
+		assert.Equal(t, 0, cfg.MaxQueuedActions)
+		assert.Equal(t, map[string]int{"backup": 1}, cfg.ActionConcurrency)
+	})
+
+	t.Run("deferred", func(t *testing.T) {
+		f := testTempFile(t, []byte(``))
+		cfg, err := LoadFromFile(f.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, "", cfg.DeferredAbsFile)
+		assert.Equal(t, 604800, cfg.DeferredTTL)
+
+		f = testTempFile(t, []byte(`
+deferred_file = "deferred.json"
+deferred_ttl = 3600
+`))
+		cfg, err = LoadFromFile(f.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(filepath.Dir(f.Name()), "deferred.json"), cfg.DeferredAbsFile)
+		assert.Equal(t, 3600, cfg.DeferredTTL)
+
+		f = testTempFile(t, []byte(`deferred_ttl = -1`))
+		_, err = LoadFromFile(f.Name())
+		assert.Error(t, err)
+	})
+
+	t.Run("metrics addr", func(t *testing.T) {
+		f := testTempFile(t, []byte(``))
+		cfg, err := LoadFromFile(f.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, "", cfg.MetricsAddr)
+
+		for _, addr := range []string{"127.0.0.1:9101", "[::1]:9101", "localhost:9101"} {
+			f = testTempFile(t, []byte(`metrics_addr = "`+addr+`"`))
+			cfg, err = LoadFromFile(f.Name())
+			assert.NoError(t, err)
+			assert.Equal(t, addr, cfg.MetricsAddr)
+		}
+
+		for _, addr := range []string{"0.0.0.0:9101", ":9101", "example.com:9101", "127.0.0.1"} {
+			f = testTempFile(t, []byte(`metrics_addr = "`+addr+`"`))
+			_, err = LoadFromFile(f.Name())
+			assert.Error(t, err, addr)
+		}
+	})
 }
 
 func testTempFile(t *testing.T, b []byte) *os.File {
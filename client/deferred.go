@@ -0,0 +1,140 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"os"
+	"sync"
+	"time"
+)
+
+// deferredStore remembers the deferred action messages that the client has handled, and their results.
+// The server may deliver a deferred action message more than once until it receives the result,
+// so the client runs its action only once and sends the remembered result for the duplicates.
+// The messages are forgotten after ttl, which should be as long as the server keeps them in the durable queue.
+// If path is not empty, the finished messages are saved to the file so that they are remembered across restarts.
+type deferredStore struct {
+	// path is the file that the finished messages are saved to. It is empty if they are kept only in memory.
+	path string
+	// ttl is the time to remember a message since it was handled. Zero means that the messages are never forgotten.
+	ttl time.Duration
+	// entries is a map of the handled messages. The key of the map is an action message id.
+	entries map[string]*deferredEntry
+	// mu is a mutex for operations on entries
+	mu sync.Mutex
+}
+
+// deferredEntry is a deferred action message that the client has handled.
+type deferredEntry struct {
+	// Result is the result of the action. It is nil while the action is running.
+	Result *types.ActionResult `json:"result,omitempty"`
+	// HandledAt is the time when the message arrived for the first time
+	HandledAt time.Time `json:"handled_at"`
+}
+
+func newDeferredStore(path string, ttl time.Duration) *deferredStore {
+	return &deferredStore{
+		path:    path,
+		ttl:     ttl,
+		entries: make(map[string]*deferredEntry),
+	}
+}
+
+// load reads the finished messages that have been saved to the file.
+func (s *deferredStore) load() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read the deferred file: %w", err)
+	}
+	entries := make(map[string]*deferredEntry)
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("failed to parse the deferred file: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, entry := range entries {
+		// The action that was running when the client stopped has not produced the result, so it runs again.
+		if entry != nil && entry.Result != nil {
+			s.entries[id] = entry
+		}
+	}
+	s.expire(time.Now())
+	return nil
+}
+
+// start records that the message is handled. It returns false and the result of the message
+// if it has already been handled. The result is nil if its action is still running.
+func (s *deferredStore) start(msgId string) (bool, *types.ActionResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+	if entry, ok := s.entries[msgId]; ok {
+		return false, entry.Result
+	}
+	s.entries[msgId] = &deferredEntry{HandledAt: time.Now()}
+	return true, nil
+}
+
+// finish remembers the result of the message. It returns false if the message is not a deferred one.
+func (s *deferredStore) finish(result *types.ActionResult) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[result.Id]
+	if !ok {
+		return false, nil
+	}
+	entry.Result = result
+	return true, s.save()
+}
+
+// forget forgets the message if its action did not produce the result, so that it runs again if it is delivered again.
+func (s *deferredStore) forget(msgId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[msgId]; ok && entry.Result == nil {
+		delete(s.entries, msgId)
+	}
+}
+
+// expire removes the messages that have been remembered for longer than ttl. It must be called with mu locked.
+func (s *deferredStore) expire(now time.Time) {
+	if s.ttl <= 0 {
+		return
+	}
+	for id, entry := range s.entries {
+		if now.Sub(entry.HandledAt) > s.ttl {
+			delete(s.entries, id)
+		}
+	}
+}
+
+// save writes the finished messages to the file. It must be called with mu locked.
+func (s *deferredStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.expire(time.Now())
+	finished := make(map[string]*deferredEntry, len(s.entries))
+	for id, entry := range s.entries {
+		if entry.Result != nil {
+			finished[id] = entry
+		}
+	}
+	b, err := json.Marshal(finished)
+	if err != nil {
+		return fmt.Errorf("failed to serialize the deferred messages: %w", err)
+	}
+	// The results may contain private data of the actions.
+	if err := os.WriteFile(s.path, b, os.FileMode(0600)); err != nil {
+		return fmt.Errorf("failed to write the deferred file: %w", err)
+	}
+	return nil
+}
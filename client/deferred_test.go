@@ -0,0 +1,46 @@
+package client
+
+import (
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeferredStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deferred.json")
+	s := newDeferredStore(path, time.Hour)
+	assert.NoError(t, s.load())
+
+	started, _ := s.start("00000000-0000-0000-0000-000000000001")
+	assert.True(t, started)
+	started, _ = s.start("00000000-0000-0000-0000-000000000002")
+	assert.True(t, started)
+	deferred, err := s.finish(&types.ActionResult{Id: "00000000-0000-0000-0000-000000000001", Status: types.ActionResultStatusSuccess, Body: "ok"})
+	assert.NoError(t, err)
+	assert.True(t, deferred)
+	// the result of the message that is not deferred is not remembered
+	deferred, err = s.finish(&types.ActionResult{Id: "00000000-0000-0000-0000-000000000003"})
+	assert.NoError(t, err)
+	assert.False(t, deferred)
+
+	t.Run("the finished messages are remembered after a restart", func(t *testing.T) {
+		s := newDeferredStore(path, time.Hour)
+		assert.NoError(t, s.load())
+		started, result := s.start("00000000-0000-0000-0000-000000000001")
+		assert.False(t, started)
+		assert.Equal(t, "ok", result.Body)
+		// the action that was running runs again
+		started, _ = s.start("00000000-0000-0000-0000-000000000002")
+		assert.True(t, started)
+	})
+
+	t.Run("the messages are forgotten after the ttl", func(t *testing.T) {
+		s := newDeferredStore(path, time.Hour)
+		assert.NoError(t, s.load())
+		s.entries["00000000-0000-0000-0000-000000000001"].HandledAt = time.Now().Add(-2 * time.Hour)
+		started, _ := s.start("00000000-0000-0000-0000-000000000001")
+		assert.True(t, started)
+	})
+}
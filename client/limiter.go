@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errBusy is returned when the action can not run, because the limits are reached and the queue is full.
+var errBusy = errors.New("too many actions are running")
+
+// limiter limits the number of the actions that run concurrently, in total and per action.
+// The actions over the limits wait in a bounded queue.
+type limiter struct {
+	// global is the semaphore of all the actions. It is nil if the number is not limited.
+	global chan struct{}
+	// perAction is a map of the semaphores by action name
+	perAction map[string]*semaphore
+	// maxQueued is the maximum number of the actions that wait for the limits.
+	// The actions over it are rejected with errBusy. Zero rejects them without waiting.
+	maxQueued int
+	// queued is the number of the actions that wait for the limits
+	queued int
+	// mu is a mutex for operations on perAction and queued
+	mu sync.Mutex
+}
+
+// semaphore is the semaphore of an action and the limit that it was created with.
+type semaphore struct {
+	// ch has a slot for each run of the action
+	ch chan struct{}
+	// limit is the capacity of ch
+	limit int
+}
+
+// newLimiter creates a new limiter. maxConcurrent is the maximum number of all the actions that run concurrently,
+// and zero means no limit.
+func newLimiter(maxConcurrent int, maxQueued int) *limiter {
+	l := &limiter{
+		perAction: make(map[string]*semaphore),
+		maxQueued: maxQueued,
+	}
+	if maxConcurrent > 0 {
+		l.global = make(chan struct{}, maxConcurrent)
+	}
+	return l
+}
+
+// acquire waits until the action can run within the limits, and returns the function to release it.
+// limit is the maximum number of the runs of the action, and zero means no limit.
+// It returns errBusy if the queue is full, or the context error if the context is done while waiting.
+func (l *limiter) acquire(ctx context.Context, name string, limit int) (func(), error) {
+	sems := make([]chan struct{}, 0, 2)
+	// The slot of the action is taken first, so that the actions that wait for an exclusive action
+	// do not occupy the slots of all the actions.
+	if limit > 0 {
+		sems = append(sems, l.actionSemaphore(name, limit))
+	}
+	if l.global != nil {
+		sems = append(sems, l.global)
+	}
+
+	release := func(n int) {
+		for _, sem := range sems[:n] {
+			<-sem
+		}
+	}
+	for i, sem := range sems {
+		if err := l.wait(ctx, sem); err != nil {
+			release(i)
+			return nil, err
+		}
+	}
+	return func() { release(len(sems)) }, nil
+}
+
+// wait takes a slot of the semaphore. If no slot is free, it waits in the queue.
+func (l *limiter) wait(ctx context.Context, sem chan struct{}) error {
+	select {
+	case sem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.queued >= l.maxQueued {
+		l.mu.Unlock()
+		return errBusy
+	}
+	l.queued++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+	}()
+
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// actionSemaphore returns the semaphore of the action. It is created with the limit on the first use,
+// and created again when the limit changes, such as when the spec of the action is updated.
+// The runs that hold the slots of the old semaphore release them to it, so they do not count against the new limit.
+func (l *limiter) actionSemaphore(name string, limit int) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sem, ok := l.perAction[name]
+	if !ok || sem.limit != limit {
+		sem = &semaphore{ch: make(chan struct{}, limit), limit: limit}
+		l.perAction[name] = sem
+	}
+	return sem.ch
+}
+
+// numQueued returns the number of the actions that wait for the limits.
+func (l *limiter) numQueued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queued
+}
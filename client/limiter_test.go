@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	t.Run("global limit", func(t *testing.T) {
+		l := newLimiter(2, 1)
+		release1, err := l.acquire(context.Background(), "action1", 0)
+		assert.NoError(t, err)
+		release2, err := l.acquire(context.Background(), "action2", 0)
+		assert.NoError(t, err)
+
+		// the third action waits in the queue
+		acquired := make(chan func())
+		go func() {
+			release, err := l.acquire(context.Background(), "action3", 0)
+			assert.NoError(t, err)
+			acquired <- release
+		}()
+		assert.Eventually(t, func() bool { return l.numQueued() == 1 }, time.Second, time.Millisecond)
+
+		// the fourth action is rejected, because the queue is full
+		_, err = l.acquire(context.Background(), "action4", 0)
+		assert.ErrorIs(t, err, errBusy)
+
+		release1()
+		release3 := <-acquired
+		assert.Equal(t, 0, l.numQueued())
+		release2()
+		release3()
+	})
+
+	t.Run("exclusive action", func(t *testing.T) {
+		l := newLimiter(0, 10)
+		release, err := l.acquire(context.Background(), "sqlite", 1)
+		assert.NoError(t, err)
+
+		// the other actions are not limited
+		releaseOther, err := l.acquire(context.Background(), "other", 1)
+		assert.NoError(t, err)
+		releaseOther()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err = l.acquire(ctx, "sqlite", 1)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, 0, l.numQueued())
+
+		release()
+		release, err = l.acquire(context.Background(), "sqlite", 1)
+		assert.NoError(t, err)
+		release()
+	})
+
+	t.Run("the action slot is released if the global limit is not acquired", func(t *testing.T) {
+		l := newLimiter(1, 0)
+		release, err := l.acquire(context.Background(), "action1", 0)
+		assert.NoError(t, err)
+
+		_, err = l.acquire(context.Background(), "action2", 1)
+		assert.ErrorIs(t, err, errBusy)
+		release()
+
+		release, err = l.acquire(context.Background(), "action2", 1)
+		assert.NoError(t, err)
+		release()
+	})
+
+	t.Run("the limit of the action changes", func(t *testing.T) {
+		l := newLimiter(0, 0)
+		release, err := l.acquire(context.Background(), "backup", 1)
+		assert.NoError(t, err)
+		_, err = l.acquire(context.Background(), "backup", 1)
+		assert.ErrorIs(t, err, errBusy)
+
+		// the new limit is applied to the next runs
+		release2, err := l.acquire(context.Background(), "backup", 2)
+		assert.NoError(t, err)
+		release3, err := l.acquire(context.Background(), "backup", 2)
+		assert.NoError(t, err)
+		_, err = l.acquire(context.Background(), "backup", 2)
+		assert.ErrorIs(t, err, errBusy)
+
+		release()
+		release2()
+		release3()
+	})
+
+	t.Run("no limits", func(t *testing.T) {
+		l := newLimiter(0, 0)
+		for i := 0; i < 10; i++ {
+			_, err := l.acquire(context.Background(), "action1", 0)
+			assert.NoError(t, err)
+		}
+	})
+}
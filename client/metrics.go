@@ -0,0 +1,171 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/kohkimakimoto/actions-gateway/client/actions"
+	"github.com/kohkimakimoto/actions-gateway/client/status"
+	"github.com/kohkimakimoto/actions-gateway/metrics"
+)
+
+// The reasons of the failures of the actions in the metrics.
+const (
+	failureNotFound = "not_found"
+	failureBusy     = "busy"
+	failureTimeout  = "timeout"
+	failureCanceled = "canceled"
+	failureError    = "error"
+)
+
+// unknownAction is the action name in the metrics and the status for the invocations of the actions that are not found.
+// The names that the agent does not have are not used as they are, so that the number of the label values is bounded.
+const unknownAction = "_unknown"
+
+// outputBuckets are the upper bounds in bytes of the buckets of the histogram of the output sizes.
+var outputBuckets = []float64{0, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+
+// agentMetrics is a set of the metrics of the agent.
+type agentMetrics struct {
+	invocations       *metrics.Counter
+	failures          *metrics.Counter
+	exitCodes         *metrics.Counter
+	duration          *metrics.Histogram
+	outputSize        *metrics.Histogram
+	connected         *metrics.Gauge
+	connections       *metrics.Counter
+	reconnectAttempts *metrics.Counter
+}
+
+// newAgentMetrics creates the metrics of the agent and registers them to the registry.
+func newAgentMetrics(c *Client, reg *metrics.Registry) *agentMetrics {
+	reg.NewGaugeFunc("actions_gateway_agent_running_actions", "The number of the actions that are running or waiting for the concurrency limits.", func() float64 {
+		c.runningMu.Lock()
+		defer c.runningMu.Unlock()
+		return float64(len(c.running))
+	})
+	reg.NewGaugeFunc("actions_gateway_agent_queued_actions", "The number of the actions that wait for the concurrency limits.", func() float64 {
+		return float64(c.limiter.numQueued())
+	})
+	return &agentMetrics{
+		invocations:       reg.NewCounter("actions_gateway_agent_action_invocations_total", "The number of the invocations of the actions by action.", "action"),
+		failures:          reg.NewCounter("actions_gateway_agent_action_failures_total", "The number of the failed invocations of the actions by action and reason.", "action", "reason"),
+		exitCodes:         reg.NewCounter("actions_gateway_agent_action_exit_codes_total", "The number of the runs of the actions by action and exit code.", "action", "code"),
+		duration:          reg.NewHistogram("actions_gateway_agent_action_duration_seconds", "The execution time of the actions.", metrics.DefaultBuckets, "action"),
+		outputSize:        reg.NewHistogram("actions_gateway_agent_action_output_bytes", "The size of the output of the actions.", outputBuckets, "action"),
+		connected:         reg.NewGauge("actions_gateway_agent_connected", "Whether the agent is connected to the server."),
+		connections:       reg.NewCounter("actions_gateway_agent_connections_total", "The number of the times that the agent connected to the server."),
+		reconnectAttempts: reg.NewCounter("actions_gateway_agent_reconnect_attempts_total", "The number of the attempts to reconnect to the server after the failures."),
+	}
+}
+
+// recordRejected records the invocation of the action that was rejected before it ran.
+func (c *Client) recordRejected(name string, reason string) {
+	c.metrics.invocations.Inc(name)
+	c.metrics.failures.Inc(name, reason)
+	c.recordStatus(name, &status.ActionRecord{Failed: true})
+}
+
+// recordRun records the run of the action that started at start, produced the output of size bytes
+// and ended with the error.
+func (c *Client) recordRun(name string, start time.Time, size int64, err error) {
+	duration := time.Since(start)
+	c.metrics.invocations.Inc(name)
+	c.metrics.duration.Observe(duration.Seconds(), name)
+	c.metrics.outputSize.Observe(float64(size), name)
+	if err != nil {
+		c.metrics.failures.Inc(name, failureReason(err))
+	}
+
+	exitCode := actionExitCode(err)
+	if exitCode != nil {
+		c.metrics.exitCodes.Inc(name, strconv.Itoa(*exitCode))
+	}
+	c.recordStatus(name, &status.ActionRecord{
+		Failed:   err != nil,
+		Ran:      true,
+		ExitCode: exitCode,
+		Duration: duration,
+	})
+}
+
+// recordStatus adds the invocation of the action to the status. It does nothing before the agent connects.
+func (c *Client) recordStatus(name string, rec *status.ActionRecord) {
+	if c.status == nil {
+		return
+	}
+	c.status.RecordAction(name, rec)
+}
+
+// statusFlushPeriod is the interval of writing the statistics of the actions to the status file.
+const statusFlushPeriod = 5 * time.Second
+
+// flushStatus writes the statistics of the actions to the status file periodically until done is closed.
+// The statistics are also written when the connection status changes.
+func (c *Client) flushStatus(sw *status.Writer, done <-chan struct{}) {
+	ticker := time.NewTicker(statusFlushPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := sw.Flush(); err != nil {
+				_, _ = fmt.Fprintf(c.errWriter, "Failed to update the status: %v\n", err)
+			}
+		}
+	}
+}
+
+// failureReason returns the reason of the failure of the run of the action in the metrics.
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, actions.ErrActionTimeout):
+		return failureTimeout
+	case errors.Is(err, actions.ErrActionCanceled):
+		return failureCanceled
+	default:
+		return failureError
+	}
+}
+
+// actionExitCode returns the exit code of the action that ended with the error.
+// It returns nil if the action did not exit by itself, such as when it was terminated or could not start.
+func actionExitCode(err error) *int {
+	code := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() < 0 {
+			return nil
+		}
+		code = exitErr.ExitCode()
+	}
+	return &code
+}
+
+// StartMetricsServer starts serving the metrics of the agent at /metrics on the metrics_addr in the config.
+// The caller must close the returned server.
+func (c *Client) StartMetricsServer() (*http.Server, error) {
+	ln, err := net.Listen("tcp", c.config.MetricsAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on the metrics address: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", c.metricsRegistry)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			_, _ = fmt.Fprintf(c.errWriter, "Failed to serve the metrics: %v\n", err)
+		}
+	}()
+	_, _ = fmt.Fprintf(c.writer, "Serving the metrics on http://%s/metrics\n", ln.Addr())
+	return srv, nil
+}
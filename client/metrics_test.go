@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/kohkimakimoto/actions-gateway/client/actions"
+	"github.com/kohkimakimoto/actions-gateway/client/config"
+	"github.com/kohkimakimoto/actions-gateway/client/status"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClient_recordRun(t *testing.T) {
+	client := New(&config.Config{
+		Server: "http://localhost:8080",
+	}, io.Discard, io.Discard)
+	statusFile := filepath.Join(t.TempDir(), "status.json")
+	client.status = status.NewWriter(statusFile)
+
+	exitErr := exec.Command("sh", "-c", "exit 3").Run()
+	assert.Error(t, exitErr)
+
+	client.recordRun("hello", time.Now(), 10, nil)
+	client.recordRun("hello", time.Now(), 0, fmt.Errorf("failed to run action: %w", exitErr))
+	client.recordRun("hello", time.Now(), 0, fmt.Errorf("%w after 1s", actions.ErrActionTimeout))
+	client.recordRejected("hello", failureBusy)
+	client.recordRejected(unknownAction, failureNotFound)
+
+	assert.Equal(t, float64(4), client.metrics.invocations.Value("hello"))
+	assert.Equal(t, float64(1), client.metrics.failures.Value("hello", failureError))
+	assert.Equal(t, float64(1), client.metrics.failures.Value("hello", failureTimeout))
+	assert.Equal(t, float64(1), client.metrics.failures.Value("hello", failureBusy))
+	assert.Equal(t, float64(1), client.metrics.failures.Value("_unknown", failureNotFound))
+	assert.Equal(t, float64(1), client.metrics.exitCodes.Value("hello", "0"))
+	assert.Equal(t, float64(1), client.metrics.exitCodes.Value("hello", "3"))
+	assert.Equal(t, uint64(3), client.metrics.duration.Count("hello"))
+	assert.Equal(t, uint64(3), client.metrics.outputSize.Count("hello"))
+
+	assert.NoError(t, client.status.Flush())
+	s, err := status.NewReader(statusFile).Read()
+	assert.NoError(t, err)
+	stats := s.Actions["hello"]
+	assert.Equal(t, int64(4), stats.Invocations)
+	assert.Equal(t, int64(3), stats.Failures)
+	assert.Equal(t, int64(3), stats.Runs)
+	// the action that timed out did not exit by itself
+	assert.Nil(t, stats.LastExitCode)
+	assert.Equal(t, int64(1), s.Actions["_unknown"].Failures)
+
+	var buf bytes.Buffer
+	assert.NoError(t, client.metricsRegistry.Write(&buf))
+	assert.Contains(t, buf.String(), `actions_gateway_agent_action_exit_codes_total{action="hello",code="3"} 1`)
+	assert.Contains(t, buf.String(), "actions_gateway_agent_running_actions 0\n")
+	assert.Contains(t, buf.String(), "actions_gateway_agent_connected 0\n")
+}
+
+func TestActionExitCode(t *testing.T) {
+	exitErr := exec.Command("sh", "-c", "exit 2").Run()
+	assert.Error(t, exitErr)
+
+	testCases := map[string]struct {
+		err      error
+		expected *int
+	}{
+		"success": {
+			expected: intPtr(0),
+		},
+		"exit error": {
+			err:      fmt.Errorf("failed to run action: %w", exitErr),
+			expected: intPtr(2),
+		},
+		"timeout": {
+			err: fmt.Errorf("%w after 1s", actions.ErrActionTimeout),
+		},
+		"other error": {
+			err: errors.New("failed to create the response file"),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, actionExitCode(tc.err))
+		})
+	}
+}
+
+func TestClient_StartMetricsServer(t *testing.T) {
+	client := New(&config.Config{
+		Server:      "http://localhost:8080",
+		MetricsAddr: "127.0.0.1:0",
+	}, io.Discard, io.Discard)
+	var out bytes.Buffer
+	client.writer = &out
+	srv, err := client.StartMetricsServer()
+	assert.NoError(t, err)
+	defer srv.Close()
+
+	var url string
+	_, err = fmt.Sscanf(out.String(), "Serving the metrics on %s\n", &url)
+	assert.NoError(t, err)
+
+	resp, err := http.Get(url)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(b), "actions_gateway_agent_connections_total 0\n")
+}
+
+func intPtr(v int) *int {
+	return &v
+}
@@ -1,6 +1,9 @@
 package status
 
-import "github.com/kohkimakimoto/actions-gateway/server/types"
+import (
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"time"
+)
 
 type CodeType string
 
@@ -15,6 +18,50 @@ type Status struct {
 	SessionNewRequest  *types.SessionNewRequest  `json:"session_new_request,omitempty"`
 	SessionNewResponse *types.SessionNewResponse `json:"session_new_response,omitempty"`
 	Error              string                    `json:"error,omitempty"`
+	// StartedAt is the time when the agent started
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	// ConnectedAt is the time when the agent connected to the server. It is nil while the agent is not connected.
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	// Reconnects is the number of the times that the agent connected to the server again after the first connection
+	Reconnects int `json:"reconnects,omitempty"`
+	// Actions is the statistics of the actions since the agent started by action name
+	Actions map[string]*ActionStats `json:"actions,omitempty"`
+}
+
+// ActionStats is the statistics of the invocations of an action.
+type ActionStats struct {
+	// Invocations is the number of the invocations
+	Invocations int64 `json:"invocations"`
+	// Failures is the number of the invocations that failed, including the ones that were rejected as busy
+	Failures int64 `json:"failures"`
+	// Runs is the number of the invocations that ran the action
+	Runs int64 `json:"runs"`
+	// TotalDurationMs is the total execution time of the runs in milliseconds
+	TotalDurationMs int64 `json:"total_duration_ms"`
+	// LastExitCode is the exit code of the last run. It is nil if the action did not exit by itself, such as when it timed out.
+	LastExitCode *int `json:"last_exit_code,omitempty"`
+	// LastRunAt is the time when the last run finished
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+}
+
+// AverageDuration returns the average execution time of the runs.
+func (s *ActionStats) AverageDuration() time.Duration {
+	if s.Runs == 0 {
+		return 0
+	}
+	return time.Duration(s.TotalDurationMs/s.Runs) * time.Millisecond
+}
+
+// ActionRecord is an invocation of an action to record in the status.
+type ActionRecord struct {
+	// Failed reports whether the invocation failed
+	Failed bool
+	// Ran reports whether the action ran. The invocations that were rejected did not run.
+	Ran bool
+	// ExitCode is the exit code of the action. It is nil if the action did not exit by itself.
+	ExitCode *int
+	// Duration is the execution time of the action
+	Duration time.Duration
 }
 
 var initialStatus = &Status{
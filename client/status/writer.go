@@ -6,18 +6,27 @@ import (
 	"github.com/kohkimakimoto/actions-gateway/server/types"
 	"os"
 	"sync"
+	"time"
 )
 
 type Writer struct {
 	path   string
 	status *Status
-	mu     sync.RWMutex
+	// connections is the number of the times that the agent connected to the server
+	connections int
+	// dirty reports whether the statistics of the actions have changed since the status was saved
+	dirty bool
+	mu    sync.RWMutex
 }
 
 func NewWriter(fPath string) *Writer {
+	now := time.Now()
 	return &Writer{
-		path:   fPath,
-		status: initialStatus,
+		path: fPath,
+		status: &Status{
+			StatusCode: initialStatus.StatusCode,
+			StartedAt:  &now,
+		},
 	}
 }
 
@@ -46,6 +55,10 @@ func (m *Writer) UpdateToActive(req *types.SessionNewRequest, res *types.Session
 	m.status.SessionNewRequest = req
 	m.status.SessionNewResponse = res
 	m.status.Error = ""
+	now := time.Now()
+	m.status.ConnectedAt = &now
+	m.connections++
+	m.status.Reconnects = m.connections - 1
 
 	return m.save()
 }
@@ -56,6 +69,7 @@ func (m *Writer) UpdateToInactive(err error) error {
 	m.status.StatusCode = CodeInactive
 	m.status.SessionNewRequest = nil
 	m.status.SessionNewResponse = nil
+	m.status.ConnectedAt = nil
 	if err != nil {
 		m.status.Error = err.Error()
 	}
@@ -63,10 +77,49 @@ func (m *Writer) UpdateToInactive(err error) error {
 	return m.save()
 }
 
+// RecordAction adds the invocation of the action to the statistics of the action.
+// The statistics are kept in memory and written to the file by Flush or the next update of the connection status,
+// so that the file is not written on every invocation.
+func (m *Writer) RecordAction(name string, rec *ActionRecord) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status.Actions == nil {
+		m.status.Actions = make(map[string]*ActionStats)
+	}
+	stats, ok := m.status.Actions[name]
+	if !ok {
+		stats = &ActionStats{}
+		m.status.Actions[name] = stats
+	}
+	stats.Invocations++
+	if rec.Failed {
+		stats.Failures++
+	}
+	if rec.Ran {
+		now := time.Now()
+		stats.Runs++
+		stats.TotalDurationMs += rec.Duration.Milliseconds()
+		stats.LastExitCode = rec.ExitCode
+		stats.LastRunAt = &now
+	}
+	m.dirty = true
+}
+
+// Flush writes the statistics of the actions to the file if they have changed since the status was saved.
+func (m *Writer) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirty {
+		return nil
+	}
+	return m.save()
+}
+
 // save saves the status to the file
 // It is not thread-safe. You need to call this function with a lock.
 func (m *Writer) save() error {
 	if m.path == "" {
+		m.dirty = false
 		return nil
 	}
 	b, err := json.Marshal(m.status)
@@ -76,5 +129,6 @@ func (m *Writer) save() error {
 	if err := os.WriteFile(m.path, b, os.FileMode(0644)); err != nil {
 		return fmt.Errorf("failed to write the status file: %w", err)
 	}
+	m.dirty = false
 	return nil
 }
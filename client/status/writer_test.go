@@ -1,11 +1,13 @@
 package status
 
 import (
+	"errors"
 	"github.com/kohkimakimoto/actions-gateway/server/types"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestWriter_Init(t *testing.T) {
@@ -42,3 +44,75 @@ func TestWriter_UpdateToConnecting(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, CodeConnecting, s.StatusCode)
 }
+
+func TestWriter_UpdateToActive(t *testing.T) {
+	d := testTempDir(t)
+	f := filepath.Join(d, "status.json")
+	w := NewWriter(f)
+	err := w.Init()
+	assert.NoError(t, err)
+
+	err = w.UpdateToActive(&types.SessionNewRequest{}, &types.SessionNewResponse{})
+	assert.NoError(t, err)
+
+	r := NewReader(f)
+	s, err := r.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, CodeActive, s.StatusCode)
+	assert.NotNil(t, s.StartedAt)
+	assert.NotNil(t, s.ConnectedAt)
+	assert.Equal(t, 0, s.Reconnects)
+
+	// connect again after the disconnection
+	err = w.UpdateToInactive(errors.New("server disconnected"))
+	assert.NoError(t, err)
+	s, err = r.Read()
+	assert.NoError(t, err)
+	assert.Nil(t, s.ConnectedAt)
+	assert.Equal(t, "server disconnected", s.Error)
+
+	err = w.UpdateToActive(&types.SessionNewRequest{}, &types.SessionNewResponse{})
+	assert.NoError(t, err)
+	s, err = r.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, s.Reconnects)
+}
+
+func TestWriter_RecordAction(t *testing.T) {
+	d := testTempDir(t)
+	f := filepath.Join(d, "status.json")
+	w := NewWriter(f)
+	err := w.Init()
+	assert.NoError(t, err)
+
+	exitCode := 0
+	w.RecordAction("hello", &ActionRecord{Ran: true, ExitCode: &exitCode, Duration: 100 * time.Millisecond})
+	exitCode2 := 2
+	w.RecordAction("hello", &ActionRecord{Failed: true, Ran: true, ExitCode: &exitCode2, Duration: 300 * time.Millisecond})
+	// rejected as busy
+	w.RecordAction("hello", &ActionRecord{Failed: true})
+
+	// the statistics are not written until they are flushed
+	r := NewReader(f)
+	s, err := r.Read()
+	assert.NoError(t, err)
+	assert.Nil(t, s.Actions)
+
+	assert.NoError(t, w.Flush())
+	s, err = r.Read()
+	assert.NoError(t, err)
+	stats := s.Actions["hello"]
+	assert.Equal(t, int64(3), stats.Invocations)
+	assert.Equal(t, int64(2), stats.Failures)
+	assert.Equal(t, int64(2), stats.Runs)
+	assert.Equal(t, 2, *stats.LastExitCode)
+	assert.Equal(t, 200*time.Millisecond, stats.AverageDuration())
+	assert.NotNil(t, stats.LastRunAt)
+
+	// the update of the connection status writes them too
+	w.RecordAction("hello", &ActionRecord{Failed: true})
+	assert.NoError(t, w.UpdateToInactive(nil))
+	s, err = r.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), s.Actions["hello"].Invocations)
+}
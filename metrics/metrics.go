@@ -0,0 +1,375 @@
+// Package metrics provides the counters, gauges and histograms that the server and the client agent expose
+// in the Prometheus text exposition format.
+//
+// It is written here instead of using the Prometheus client library (client_golang), because the agent
+// is a single binary that runs on the users' machines, and the library would pull a large dependency tree
+// (client_model with protobuf, common, procfs and their transitive modules) into it for a few counters.
+// The package implements only what the endpoints need: labeled counters, gauges and histograms
+// written in the text format, which every Prometheus-compatible scraper reads.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the default upper bounds in seconds of the buckets of a histogram of durations.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Registry is a set of the metrics. It writes the metrics in the Prometheus text exposition format.
+type Registry struct {
+	// metrics stores the metrics by name
+	metrics map[string]metric
+	// mu is a mutex for operations on metrics
+	mu sync.Mutex
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry creates a new Registry object.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]metric),
+	}
+}
+
+// register adds the metric to the registry. It panics if the name is already registered,
+// because it is a programming error.
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metrics: duplicate metric: %s", name))
+	}
+	r.metrics[name] = m
+}
+
+// NewCounter creates a counter that is partitioned by the labels, and registers it.
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	c := &Counter{vec: newVec(name, help, "counter", labelNames)}
+	r.register(name, c)
+	return c
+}
+
+// NewGauge creates a gauge that is partitioned by the labels, and registers it.
+func (r *Registry) NewGauge(name string, help string, labelNames ...string) *Gauge {
+	g := &Gauge{vec: newVec(name, help, "gauge", labelNames)}
+	r.register(name, g)
+	return g
+}
+
+// NewHistogram creates a histogram with the upper bounds of the buckets that is partitioned by the labels,
+// and registers it.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	h := &Histogram{vec: newVec(name, help, "histogram", labelNames), buckets: buckets}
+	r.register(name, h)
+	return h
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by fn when the metrics are written.
+func (r *Registry) NewGaugeFunc(name string, help string, fn func() float64) {
+	r.register(name, &funcMetric{name: name, help: help, typ: "gauge", fn: func() map[string]float64 {
+		return map[string]float64{"": fn()}
+	}})
+}
+
+// NewCounterFunc registers a counter whose value is returned by fn when the metrics are written.
+func (r *Registry) NewCounterFunc(name string, help string, fn func() float64) {
+	r.register(name, &funcMetric{name: name, help: help, typ: "counter", fn: func() map[string]float64 {
+		return map[string]float64{"": fn()}
+	}})
+}
+
+// NewCounterMapFunc registers a counter that is partitioned by a label.
+// fn returns the values by the label value when the metrics are written.
+func (r *Registry) NewCounterMapFunc(name string, help string, labelName string, fn func() map[string]float64) {
+	r.register(name, &funcMetric{name: name, help: help, typ: "counter", labelName: labelName, fn: fn})
+}
+
+// Write writes the metrics in the Prometheus text exposition format in the order of their names.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	metrics := make([]metric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP writes the metrics as the response.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_ = r.Write(w)
+}
+
+// vec is a set of the series of a metric by the label values.
+type vec struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	// series stores the series by the joined label values
+	series map[string]*series
+	// mu is a mutex for operations on series and their values
+	mu sync.Mutex
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// counts is the number of the observations in each bucket of a histogram, which is not cumulative
+	counts []uint64
+	count  uint64
+}
+
+func newVec(name string, help string, typ string, labelNames []string) *vec {
+	v := &vec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+	if len(labelNames) == 0 {
+		// The metric without labels is reported as zero before it is updated.
+		v.get(nil)
+	}
+	return v
+}
+
+// get returns the series of the label values, creating it if it does not exist. The caller must hold the lock.
+func (v *vec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, but got %d values", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: slices.Clone(labelValues)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series in the order of their label values. The caller must hold the lock.
+func (v *vec) sorted() []*series {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	list := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, v.series[key])
+	}
+	return list
+}
+
+func (v *vec) writeHeader(w *bufio.Writer) {
+	writeHeader(w, v.name, v.help, v.typ)
+}
+
+func (v *vec) writeValues(w *bufio.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.writeHeader(w)
+	for _, s := range v.sorted() {
+		writeSample(w, v.name, v.labelNames, s.labelValues, s.value)
+	}
+}
+
+// Counter is a metric whose value only goes up.
+type Counter struct {
+	vec *vec
+}
+
+// Inc adds 1 to the counter of the label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter of the label values. v must not be negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.vec.mu.Lock()
+	defer c.vec.mu.Unlock()
+	c.vec.get(labelValues).value += v
+}
+
+// Value returns the value of the counter of the label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.vec.mu.Lock()
+	defer c.vec.mu.Unlock()
+	return c.vec.get(labelValues).value
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.vec.writeValues(w)
+}
+
+// Gauge is a metric whose value goes up and down.
+type Gauge struct {
+	vec *vec
+}
+
+// Set sets the gauge of the label values to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.vec.mu.Lock()
+	defer g.vec.mu.Unlock()
+	g.vec.get(labelValues).value = v
+}
+
+// Add adds v to the gauge of the label values. v can be negative.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.vec.mu.Lock()
+	defer g.vec.mu.Unlock()
+	g.vec.get(labelValues).value += v
+}
+
+// Value returns the value of the gauge of the label values.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.vec.mu.Lock()
+	defer g.vec.mu.Unlock()
+	return g.vec.get(labelValues).value
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.vec.writeValues(w)
+}
+
+// Histogram is a metric that counts the observations in the buckets.
+type Histogram struct {
+	vec *vec
+	// buckets are the upper bounds of the buckets in ascending order
+	buckets []float64
+}
+
+// Observe adds the observation v to the histogram of the label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.vec.mu.Lock()
+	defer h.vec.mu.Unlock()
+	s := h.vec.get(labelValues)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets))
+	}
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.value += v
+	s.count++
+}
+
+// Count returns the number of the observations of the label values.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.vec.mu.Lock()
+	defer h.vec.mu.Unlock()
+	return h.vec.get(labelValues).count
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.vec.mu.Lock()
+	defer h.vec.mu.Unlock()
+	h.vec.writeHeader(w)
+	labelNames := append(slices.Clone(h.vec.labelNames), "le")
+	for _, s := range h.vec.sorted() {
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			if s.counts != nil {
+				cumulative += s.counts[i]
+			}
+			writeSample(w, h.vec.name+"_bucket", labelNames, append(slices.Clone(s.labelValues), formatFloat(upper)), float64(cumulative))
+		}
+		writeSample(w, h.vec.name+"_bucket", labelNames, append(slices.Clone(s.labelValues), "+Inf"), float64(s.count))
+		writeSample(w, h.vec.name+"_sum", h.vec.labelNames, s.labelValues, s.value)
+		writeSample(w, h.vec.name+"_count", h.vec.labelNames, s.labelValues, float64(s.count))
+	}
+}
+
+// funcMetric is a metric whose values are returned by a function when the metrics are written.
+type funcMetric struct {
+	name string
+	help string
+	typ  string
+	// labelName is the name of the label that partitions the values. It is empty if the metric has no labels.
+	labelName string
+	fn        func() map[string]float64
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	values := m.fn()
+	writeHeader(w, m.name, m.help, m.typ)
+	if m.labelName == "" {
+		writeSample(w, m.name, nil, nil, values[""])
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		writeSample(w, m.name, []string{m.labelName}, []string{key}, values[key])
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func writeHeader(w *bufio.Writer, name string, help string, typ string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, typ)
+}
+
+func writeSample(w *bufio.Writer, name string, labelNames []string, labelValues []string, v float64) {
+	_, _ = w.WriteString(name)
+	if len(labelNames) > 0 {
+		_ = w.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i > 0 {
+				_ = w.WriteByte(',')
+			}
+			_, _ = fmt.Fprintf(w, `%s="%s"`, labelName, labelEscaper.Replace(labelValues[i]))
+		}
+		_ = w.WriteByte('}')
+	}
+	_ = w.WriteByte(' ')
+	_, _ = w.WriteString(formatFloat(v))
+	_ = w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
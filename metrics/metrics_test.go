@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.NewCounter("test_requests_total", "The number of the requests.", "action", "outcome")
+	g := reg.NewGauge("test_queued", "The number of the queued requests.")
+	h := reg.NewHistogram("test_duration_seconds", "The duration of the requests.", []float64{1, 0.1}, "action")
+	reg.NewCounter("test_failures_total", "The number of the failures.")
+	reg.NewGaugeFunc("test_sessions", "The number of the sessions.", func() float64 { return 3 })
+	reg.NewCounterFunc("test_tokens_total", "The number of the tokens.", func() float64 { return 5 })
+	reg.NewCounterMapFunc("test_rejections_total", "The number of the rejections.", "scope", func() map[string]float64 {
+		return map[string]float64{"ip": 2, "client": 1}
+	})
+
+	c.Inc("hello", "success")
+	c.Add(2, "hello", "success")
+	c.Inc("say \"hi\"", "error")
+	g.Set(4)
+	g.Add(-1)
+	h.Observe(0.05, "hello")
+	h.Observe(0.5, "hello")
+	h.Observe(2, "hello")
+
+	assert.Equal(t, float64(3), c.Value("hello", "success"))
+	assert.Equal(t, float64(3), g.Value())
+	assert.Equal(t, uint64(3), h.Count("hello"))
+
+	var buf bytes.Buffer
+	err := reg.Write(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP test_duration_seconds The duration of the requests.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{action="hello",le="0.1"} 1
+test_duration_seconds_bucket{action="hello",le="1"} 2
+test_duration_seconds_bucket{action="hello",le="+Inf"} 3
+test_duration_seconds_sum{action="hello"} 2.55
+test_duration_seconds_count{action="hello"} 3
+# HELP test_failures_total The number of the failures.
+# TYPE test_failures_total counter
+test_failures_total 0
+# HELP test_queued The number of the queued requests.
+# TYPE test_queued gauge
+test_queued 3
+# HELP test_rejections_total The number of the rejections.
+# TYPE test_rejections_total counter
+test_rejections_total{scope="client"} 1
+test_rejections_total{scope="ip"} 2
+# HELP test_requests_total The number of the requests.
+# TYPE test_requests_total counter
+test_requests_total{action="hello",outcome="success"} 3
+test_requests_total{action="say \"hi\"",outcome="error"} 1
+# HELP test_sessions The number of the sessions.
+# TYPE test_sessions gauge
+test_sessions 3
+# HELP test_tokens_total The number of the tokens.
+# TYPE test_tokens_total counter
+test_tokens_total 5
+`, buf.String())
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("test_total", "The test counter.").Inc()
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "test_total 1\n")
+}
+
+func TestRegistry_Duplicate(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("test_total", "The test counter.")
+	assert.Panics(t, func() {
+		reg.NewGauge("test_total", "The test gauge.")
+	})
+}
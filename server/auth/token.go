@@ -6,6 +6,7 @@ import (
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/lestrrat-go/jwx/v2/jwt"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +24,8 @@ type TokenGenerator struct {
 	key         jwk.Key
 	genClientId GenClientIdFunc
 	clock       func() time.Time
+	// generated is the number of the generated tokens
+	generated atomic.Int64
 }
 
 type TokenGeneratorOption func(*TokenGenerator)
@@ -81,5 +84,11 @@ func (g *TokenGenerator) NewTokenAsJWTString() (string, error) {
 		return "", fmt.Errorf("failed to sign JWT token: %w", err)
 	}
 
+	g.generated.Add(1)
 	return string(signedToken), nil
 }
+
+// Generated returns the number of the tokens that the generator has generated.
+func (g *TokenGenerator) Generated() int64 {
+	return g.generated.Load()
+}
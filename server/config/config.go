@@ -3,7 +3,9 @@ package config
 import (
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -19,29 +21,174 @@ type Config struct {
 	ExposeNewToken bool `toml:"expose_new_token"`
 	// Debug enables debug logging
 	Debug bool `toml:"debug"`
+	// JobTimeout is the maximum execution time in seconds of an asynchronous action invocation (job)
+	JobTimeout int `toml:"job_timeout"`
+	// JobRetention is the time in seconds to keep a finished job
+	JobRetention int `toml:"job_retention"`
+	// HeartbeatTimeout is the time in seconds after the last heartbeat of an agent after which its connection is closed as dead.
+	// Zero disables it.
+	HeartbeatTimeout int `toml:"heartbeat_timeout"`
+	// ReconnectGracePeriod is the time in seconds after the client disconnects during which the invocations
+	// wait for the client to reconnect instead of failing. Zero disables it.
+	ReconnectGracePeriod int `toml:"reconnect_grace_period"`
+	// ReconnectQueueSize is the maximum number of the invocations of a client that wait for the client to reconnect
+	ReconnectQueueSize int `toml:"reconnect_queue_size"`
+	// Registry is the registry of the sessions that are shared by the server nodes: "memory" or "file".
+	// "memory" is for the server that runs as a single node.
+	Registry string `toml:"registry"`
+	// RegistryDir is the directory shared by the server nodes for the "file" registry
+	RegistryDir string `toml:"registry_dir"`
+	// RegistryTTL is the time in seconds after which the registry entries of a node that stopped are ignored
+	RegistryTTL int `toml:"registry_ttl"`
+	// NodeURL is the URL to reach this server node directly from the other nodes and the clients.
+	// It defaults to URL.
+	NodeURL string `toml:"node_url"`
+	// DurableQueueDir is the directory to persist the durable invocations that wait for the client to connect.
+	// Empty disables the durable invocations.
+	DurableQueueDir string `toml:"durable_queue_dir"`
+	// DurableQueueTTL is the maximum time in seconds that a durable invocation waits for the client to connect
+	DurableQueueTTL int `toml:"durable_queue_ttl"`
+	// IdempotencyTTL is the time in seconds to remember the responses of the requests with the Idempotency-Key header.
+	// Zero disables the idempotency keys.
+	IdempotencyTTL int `toml:"idempotency_ttl"`
+	// IdempotencyMaxEntries is the maximum number of the responses that are remembered for the idempotency keys.
+	// The oldest ones are forgotten first. Zero means no limit.
+	IdempotencyMaxEntries int `toml:"idempotency_max_entries"`
+	// IdempotencyMaxBytes is the maximum total size in bytes of the responses that are remembered for the idempotency keys.
+	// The oldest ones are forgotten first, and a larger response is not remembered. Zero means no limit.
+	IdempotencyMaxBytes int `toml:"idempotency_max_bytes"`
+	// MaxUploadSize is the maximum size in bytes of the multipart requests that upload files to the actions.
+	// Zero means no limit.
+	MaxUploadSize int64 `toml:"max_upload_size"`
+	// CacheSize is the maximum number of the cached results of the read-only actions. Zero disables the result caching.
+	CacheSize int `toml:"cache_size"`
+	// OutboundQueueSize is the maximum number of the messages that wait to be sent to each agent
+	OutboundQueueSize int `toml:"outbound_queue_size"`
+	// RateLimitClient is the rate limit of the requests to each client like "100/m". Empty disables it.
+	RateLimitClient string `toml:"rate_limit_client"`
+	// RateLimitAction is the default rate limit of the requests to each action of a client like "10/s".
+	// The actions can override it. Empty disables it.
+	RateLimitAction string `toml:"rate_limit_action"`
+	// RateLimitIP is the rate limit of the requests from each source IP address like "60/m". Empty disables it.
+	RateLimitIP string `toml:"rate_limit_ip"`
+	// TrustedProxies is a list of the IP addresses or the CIDR ranges of the proxies in front of the server.
+	// The IP address of the caller is taken from the X-Forwarded-For header only if the request comes from them.
+	// Empty uses the address of the connection.
+	TrustedProxies []string `toml:"trusted_proxies"`
+	// Metrics enables the /metrics endpoint that exposes the metrics in the Prometheus text format
+	Metrics bool `toml:"metrics"`
+	// MetricsAddr is the address to serve the /metrics endpoint on separately from Addr. Empty serves it on Addr.
+	MetricsAddr string `toml:"metrics_addr"`
+	// MetricsToken is the bearer token that the /metrics endpoint requires. Empty allows anyone to read it,
+	// which is allowed only on MetricsAddr.
+	MetricsToken string `toml:"metrics_token"`
 }
 
 func New() *Config {
 	return &Config{
-		Addr:   ":18800",
-		URL:    "http://localhost:18800",
-		Secret: "",
+		Addr:         ":18800",
+		URL:          "http://localhost:18800",
+		Secret:       "",
+		JobTimeout:   3600,
+		JobRetention: 3600,
+
+		HeartbeatTimeout: 60,
+
+		ReconnectGracePeriod: 0,
+		ReconnectQueueSize:   100,
+
+		Registry:    "memory",
+		RegistryTTL: 30,
+
+		DurableQueueTTL: 604800,
+		IdempotencyTTL:  86400,
+		CacheSize:       1000,
+		MaxUploadSize:   100 << 20,
+
+		IdempotencyMaxEntries: 10000,
+		IdempotencyMaxBytes:   64 << 20,
+
+		OutboundQueueSize: 256,
 	}
 }
 
 // WebSocketURL returns the WebSocket URL based on the server URL configuration
 func (c *Config) WebSocketURL() string {
+	return toWebSocketURL(c.URL)
+}
+
+// NodeURLOrDefault returns the URL of this server node. It returns URL if NodeURL is not set.
+func (c *Config) NodeURLOrDefault() string {
+	if c.NodeURL != "" {
+		return strings.TrimRight(c.NodeURL, "/")
+	}
+	return strings.TrimRight(c.URL, "/")
+}
+
+// NodeWebSocketURL returns the WebSocket URL of this server node.
+// The clients connect to the node that created their sessions with it.
+func (c *Config) NodeWebSocketURL() string {
+	return toWebSocketURL(c.NodeURLOrDefault())
+}
+
+func toWebSocketURL(u string) string {
 	var wsPath string
-	if strings.HasPrefix(c.URL, "https://") {
-		wsPath = "wss://" + c.URL[8:]
-	} else if strings.HasPrefix(c.URL, "http://") {
-		wsPath = "ws://" + c.URL[7:]
+	if strings.HasPrefix(u, "https://") {
+		wsPath = "wss://" + u[8:]
+	} else if strings.HasPrefix(u, "http://") {
+		wsPath = "ws://" + u[7:]
 	} else {
-		wsPath = "ws://" + c.URL
+		wsPath = "ws://" + u
 	}
 	return strings.TrimRight(wsPath, "/")
 }
 
+// Validate checks the values of the configuration that the server can not run with.
+func (c *Config) Validate() error {
+	if c.RegistryTTL <= 0 {
+		return fmt.Errorf("registry_ttl must be positive: %d", c.RegistryTTL)
+	}
+	if c.DurableQueueDir != "" && c.Registry != "memory" {
+		// The deferred invocations are delivered only to the agents that connect to the node that queued them.
+		return fmt.Errorf("durable_queue_dir is not supported with the %q registry, because the durable queue works only on a single node", c.Registry)
+	}
+	if _, err := c.TrustedProxyRanges(); err != nil {
+		return err
+	}
+	if c.Metrics && c.MetricsAddr == "" && c.MetricsToken == "" {
+		// The metrics reveal the clients and the actions to anyone who can reach the server.
+		return fmt.Errorf("metrics_token or metrics_addr is required to expose the metrics on addr")
+	}
+	return nil
+}
+
+// TrustedProxyRanges returns the IP address ranges of TrustedProxies.
+// A single IP address is a range that has only the address.
+func (c *Config) TrustedProxyRanges() ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, v := range c.TrustedProxies {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted_proxies: %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted_proxies: %q", v)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
+
 // UpdateByFile updates the configuration from a file
 func UpdateByFile(c *Config, path string) error {
 	if _, err := toml.DecodeFile(path, c); err != nil {
@@ -77,4 +224,112 @@ func UpdateByEnvironments(c *Config) {
 			c.Debug = false
 		}
 	}
+	if v := os.Getenv("ACTIONS_GATEWAY_JOB_TIMEOUT"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			c.JobTimeout = i
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_JOB_RETENTION"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			c.JobRetention = i
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_HEARTBEAT_TIMEOUT"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			c.HeartbeatTimeout = i
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_RECONNECT_GRACE_PERIOD"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			c.ReconnectGracePeriod = i
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_RECONNECT_QUEUE_SIZE"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			c.ReconnectQueueSize = i
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_REGISTRY"); v != "" {
+		c.Registry = v
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_REGISTRY_DIR"); v != "" {
+		c.RegistryDir = v
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_REGISTRY_TTL"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			c.RegistryTTL = i
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_NODE_URL"); v != "" {
+		c.NodeURL = v
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_DURABLE_QUEUE_DIR"); v != "" {
+		c.DurableQueueDir = v
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_DURABLE_QUEUE_TTL"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			c.DurableQueueTTL = i
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_IDEMPOTENCY_TTL"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			c.IdempotencyTTL = i
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_IDEMPOTENCY_MAX_ENTRIES"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			c.IdempotencyMaxEntries = i
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_IDEMPOTENCY_MAX_BYTES"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			c.IdempotencyMaxBytes = i
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_MAX_UPLOAD_SIZE"); v != "" {
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			c.MaxUploadSize = i
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_CACHE_SIZE"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			c.CacheSize = i
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_OUTBOUND_QUEUE_SIZE"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			c.OutboundQueueSize = i
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_RATE_LIMIT_CLIENT"); v != "" {
+		c.RateLimitClient = v
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_RATE_LIMIT_ACTION"); v != "" {
+		c.RateLimitAction = v
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_RATE_LIMIT_IP"); v != "" {
+		c.RateLimitIP = v
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_TRUSTED_PROXIES"); v != "" {
+		c.TrustedProxies = nil
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				c.TrustedProxies = append(c.TrustedProxies, p)
+			}
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_METRICS"); v != "" {
+		v = strings.ToLower(v)
+		if v == "true" || v == "1" {
+			c.Metrics = true
+		} else {
+			c.Metrics = false
+		}
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_METRICS_ADDR"); v != "" {
+		c.MetricsAddr = v
+	}
+	if v := os.Getenv("ACTIONS_GATEWAY_METRICS_TOKEN"); v != "" {
+		c.MetricsToken = v
+	}
 }
@@ -2,6 +2,7 @@ package config
 
 import (
 	"github.com/stretchr/testify/assert"
+	"net"
 	"os"
 	"testing"
 )
@@ -44,6 +45,74 @@ func TestConfig_WebSocketURL(t *testing.T) {
 	}
 }
 
+func TestConfig_NodeWebSocketURL(t *testing.T) {
+	testCases := map[string]struct {
+		cfg      *Config
+		expected string
+	}{
+		"node url": {
+			cfg: &Config{
+				URL:     "https://gateway.example.com",
+				NodeURL: "http://10.0.0.1:18800/",
+			},
+			expected: "ws://10.0.0.1:18800",
+		},
+		"default": {
+			cfg: &Config{
+				URL: "https://gateway.example.com",
+			},
+			expected: "wss://gateway.example.com",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.cfg.NodeWebSocketURL())
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, New().Validate())
+
+	for _, ttl := range []int{0, -1} {
+		cfg := New()
+		cfg.RegistryTTL = ttl
+		assert.Error(t, cfg.Validate())
+	}
+
+	cfg := New()
+	cfg.DurableQueueDir = "/var/lib/actions-gateway/queue"
+	assert.NoError(t, cfg.Validate())
+	cfg.Registry = "file"
+	assert.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1", "::1"}
+	ranges, err := cfg.TrustedProxyRanges()
+	assert.NoError(t, err)
+	if assert.Len(t, ranges, 3) {
+		assert.True(t, ranges[0].Contains(net.ParseIP("10.1.2.3")))
+		assert.True(t, ranges[1].Contains(net.ParseIP("192.168.1.1")))
+		assert.False(t, ranges[1].Contains(net.ParseIP("192.168.1.2")))
+		assert.True(t, ranges[2].Contains(net.ParseIP("::1")))
+	}
+	for _, v := range []string{"10.0.0.0/33", "proxy"} {
+		cfg.TrustedProxies = []string{v}
+		assert.Error(t, cfg.Validate())
+	}
+
+	// the metrics on addr require the token
+	cfg = New()
+	cfg.Metrics = true
+	assert.Error(t, cfg.Validate())
+	cfg.MetricsToken = "metrics_secret"
+	assert.NoError(t, cfg.Validate())
+	cfg.MetricsToken = ""
+	cfg.MetricsAddr = "127.0.0.1:9100"
+	assert.NoError(t, cfg.Validate())
+}
+
 func TestUpdateByFile(t *testing.T) {
 	t.Run("use config from file", func(t *testing.T) {
 		cfg := New()
@@ -53,6 +122,30 @@ url = "http://localhost:8080"
 secret = "test_secret"
 expose_new_token = true
 debug = true
+job_timeout = 60
+job_retention = 120
+heartbeat_timeout = 90
+reconnect_grace_period = 15
+reconnect_queue_size = 10
+registry = "file"
+registry_dir = "/var/lib/actions-gateway/registry"
+registry_ttl = 60
+node_url = "http://10.0.0.1:18800"
+durable_queue_dir = "/var/lib/actions-gateway/queue"
+durable_queue_ttl = 3600
+idempotency_ttl = 600
+idempotency_max_entries = 100
+idempotency_max_bytes = 1048576
+cache_size = 10
+max_upload_size = 1048576
+outbound_queue_size = 16
+rate_limit_client = "100/m"
+rate_limit_action = "10/s"
+rate_limit_ip = "60/m"
+trusted_proxies = ["10.0.0.0/8", "192.168.1.1"]
+metrics = true
+metrics_addr = "127.0.0.1:9100"
+metrics_token = "metrics_secret"
 `))
 		err := UpdateByFile(cfg, f.Name())
 		assert.NoError(t, err)
@@ -61,6 +154,30 @@ debug = true
 		assert.Equal(t, "test_secret", cfg.Secret)
 		assert.True(t, cfg.ExposeNewToken)
 		assert.True(t, cfg.Debug)
+		assert.Equal(t, 60, cfg.JobTimeout)
+		assert.Equal(t, 120, cfg.JobRetention)
+		assert.Equal(t, 90, cfg.HeartbeatTimeout)
+		assert.Equal(t, 15, cfg.ReconnectGracePeriod)
+		assert.Equal(t, 10, cfg.ReconnectQueueSize)
+		assert.Equal(t, "file", cfg.Registry)
+		assert.Equal(t, "/var/lib/actions-gateway/registry", cfg.RegistryDir)
+		assert.Equal(t, 60, cfg.RegistryTTL)
+		assert.Equal(t, "http://10.0.0.1:18800", cfg.NodeURL)
+		assert.Equal(t, "/var/lib/actions-gateway/queue", cfg.DurableQueueDir)
+		assert.Equal(t, 3600, cfg.DurableQueueTTL)
+		assert.Equal(t, 600, cfg.IdempotencyTTL)
+		assert.Equal(t, 100, cfg.IdempotencyMaxEntries)
+		assert.Equal(t, 1048576, cfg.IdempotencyMaxBytes)
+		assert.Equal(t, 10, cfg.CacheSize)
+		assert.Equal(t, int64(1048576), cfg.MaxUploadSize)
+		assert.Equal(t, 16, cfg.OutboundQueueSize)
+		assert.Equal(t, "100/m", cfg.RateLimitClient)
+		assert.Equal(t, "10/s", cfg.RateLimitAction)
+		assert.Equal(t, "60/m", cfg.RateLimitIP)
+		assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.1"}, cfg.TrustedProxies)
+		assert.True(t, cfg.Metrics)
+		assert.Equal(t, "127.0.0.1:9100", cfg.MetricsAddr)
+		assert.Equal(t, "metrics_secret", cfg.MetricsToken)
 	})
 
 	t.Run("use default config", func(t *testing.T) {
@@ -73,6 +190,30 @@ debug = true
 		assert.Equal(t, "", cfg.Secret)
 		assert.False(t, cfg.ExposeNewToken)
 		assert.False(t, cfg.Debug)
+		assert.Equal(t, 3600, cfg.JobTimeout)
+		assert.Equal(t, 3600, cfg.JobRetention)
+		assert.Equal(t, 60, cfg.HeartbeatTimeout)
+		assert.Equal(t, 0, cfg.ReconnectGracePeriod)
+		assert.Equal(t, 100, cfg.ReconnectQueueSize)
+		assert.Equal(t, "memory", cfg.Registry)
+		assert.Equal(t, "", cfg.RegistryDir)
+		assert.Equal(t, 30, cfg.RegistryTTL)
+		assert.Equal(t, "", cfg.NodeURL)
+		assert.Equal(t, "", cfg.DurableQueueDir)
+		assert.Equal(t, 604800, cfg.DurableQueueTTL)
+		assert.Equal(t, 86400, cfg.IdempotencyTTL)
+		assert.Equal(t, 10000, cfg.IdempotencyMaxEntries)
+		assert.Equal(t, 64<<20, cfg.IdempotencyMaxBytes)
+		assert.Equal(t, 1000, cfg.CacheSize)
+		assert.Equal(t, int64(100<<20), cfg.MaxUploadSize)
+		assert.Equal(t, 256, cfg.OutboundQueueSize)
+		assert.Equal(t, "", cfg.RateLimitClient)
+		assert.Equal(t, "", cfg.RateLimitAction)
+		assert.Equal(t, "", cfg.RateLimitIP)
+		assert.Empty(t, cfg.TrustedProxies)
+		assert.False(t, cfg.Metrics)
+		assert.Equal(t, "", cfg.MetricsAddr)
+		assert.Equal(t, "", cfg.MetricsToken)
 	})
 
 	t.Run("fail to load config from file", func(t *testing.T) {
@@ -90,12 +231,60 @@ func TestUpdateByEnvironments(t *testing.T) {
 		_ = os.Setenv("ACTIONS_GATEWAY_SECRET", "test_secret")
 		_ = os.Setenv("ACTIONS_GATEWAY_EXPOSE_NEW_TOKEN", "true")
 		_ = os.Setenv("ACTIONS_GATEWAY_DEBUG", "true")
+		_ = os.Setenv("ACTIONS_GATEWAY_JOB_TIMEOUT", "60")
+		_ = os.Setenv("ACTIONS_GATEWAY_JOB_RETENTION", "120")
+		_ = os.Setenv("ACTIONS_GATEWAY_HEARTBEAT_TIMEOUT", "90")
+		_ = os.Setenv("ACTIONS_GATEWAY_RECONNECT_GRACE_PERIOD", "15")
+		_ = os.Setenv("ACTIONS_GATEWAY_RECONNECT_QUEUE_SIZE", "10")
+		_ = os.Setenv("ACTIONS_GATEWAY_REGISTRY", "file")
+		_ = os.Setenv("ACTIONS_GATEWAY_REGISTRY_DIR", "/var/lib/actions-gateway/registry")
+		_ = os.Setenv("ACTIONS_GATEWAY_REGISTRY_TTL", "60")
+		_ = os.Setenv("ACTIONS_GATEWAY_NODE_URL", "http://10.0.0.1:18800")
+		_ = os.Setenv("ACTIONS_GATEWAY_DURABLE_QUEUE_DIR", "/var/lib/actions-gateway/queue")
+		_ = os.Setenv("ACTIONS_GATEWAY_DURABLE_QUEUE_TTL", "3600")
+		_ = os.Setenv("ACTIONS_GATEWAY_IDEMPOTENCY_TTL", "600")
+		_ = os.Setenv("ACTIONS_GATEWAY_IDEMPOTENCY_MAX_ENTRIES", "100")
+		_ = os.Setenv("ACTIONS_GATEWAY_IDEMPOTENCY_MAX_BYTES", "1048576")
+		_ = os.Setenv("ACTIONS_GATEWAY_CACHE_SIZE", "10")
+		_ = os.Setenv("ACTIONS_GATEWAY_MAX_UPLOAD_SIZE", "1048576")
+		_ = os.Setenv("ACTIONS_GATEWAY_OUTBOUND_QUEUE_SIZE", "16")
+		_ = os.Setenv("ACTIONS_GATEWAY_RATE_LIMIT_CLIENT", "100/m")
+		_ = os.Setenv("ACTIONS_GATEWAY_RATE_LIMIT_ACTION", "10/s")
+		_ = os.Setenv("ACTIONS_GATEWAY_RATE_LIMIT_IP", "60/m")
+		_ = os.Setenv("ACTIONS_GATEWAY_TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1")
+		_ = os.Setenv("ACTIONS_GATEWAY_METRICS", "true")
+		_ = os.Setenv("ACTIONS_GATEWAY_METRICS_ADDR", "127.0.0.1:9100")
+		_ = os.Setenv("ACTIONS_GATEWAY_METRICS_TOKEN", "metrics_secret")
 		defer func() {
 			_ = os.Unsetenv("ACTIONS_GATEWAY_ADDR")
 			_ = os.Unsetenv("ACTIONS_GATEWAY_URL")
 			_ = os.Unsetenv("ACTIONS_GATEWAY_SECRET")
 			_ = os.Unsetenv("ACTIONS_GATEWAY_EXPOSE_NEW_TOKEN")
 			_ = os.Unsetenv("ACTIONS_GATEWAY_DEBUG")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_JOB_TIMEOUT")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_JOB_RETENTION")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_HEARTBEAT_TIMEOUT")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_RECONNECT_GRACE_PERIOD")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_RECONNECT_QUEUE_SIZE")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_REGISTRY")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_REGISTRY_DIR")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_REGISTRY_TTL")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_NODE_URL")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_DURABLE_QUEUE_DIR")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_DURABLE_QUEUE_TTL")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_IDEMPOTENCY_TTL")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_IDEMPOTENCY_MAX_ENTRIES")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_IDEMPOTENCY_MAX_BYTES")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_CACHE_SIZE")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_MAX_UPLOAD_SIZE")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_OUTBOUND_QUEUE_SIZE")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_RATE_LIMIT_CLIENT")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_RATE_LIMIT_ACTION")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_RATE_LIMIT_IP")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_TRUSTED_PROXIES")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_METRICS")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_METRICS_ADDR")
+			_ = os.Unsetenv("ACTIONS_GATEWAY_METRICS_TOKEN")
 		}()
 		cfg := New()
 		UpdateByEnvironments(cfg)
@@ -104,6 +293,30 @@ func TestUpdateByEnvironments(t *testing.T) {
 		assert.Equal(t, "test_secret", cfg.Secret)
 		assert.True(t, cfg.ExposeNewToken)
 		assert.True(t, cfg.Debug)
+		assert.Equal(t, 60, cfg.JobTimeout)
+		assert.Equal(t, 120, cfg.JobRetention)
+		assert.Equal(t, 90, cfg.HeartbeatTimeout)
+		assert.Equal(t, 15, cfg.ReconnectGracePeriod)
+		assert.Equal(t, 10, cfg.ReconnectQueueSize)
+		assert.Equal(t, "file", cfg.Registry)
+		assert.Equal(t, "/var/lib/actions-gateway/registry", cfg.RegistryDir)
+		assert.Equal(t, 60, cfg.RegistryTTL)
+		assert.Equal(t, "http://10.0.0.1:18800", cfg.NodeURL)
+		assert.Equal(t, "/var/lib/actions-gateway/queue", cfg.DurableQueueDir)
+		assert.Equal(t, 3600, cfg.DurableQueueTTL)
+		assert.Equal(t, 600, cfg.IdempotencyTTL)
+		assert.Equal(t, 100, cfg.IdempotencyMaxEntries)
+		assert.Equal(t, 1048576, cfg.IdempotencyMaxBytes)
+		assert.Equal(t, 10, cfg.CacheSize)
+		assert.Equal(t, int64(1048576), cfg.MaxUploadSize)
+		assert.Equal(t, 16, cfg.OutboundQueueSize)
+		assert.Equal(t, "100/m", cfg.RateLimitClient)
+		assert.Equal(t, "10/s", cfg.RateLimitAction)
+		assert.Equal(t, "60/m", cfg.RateLimitIP)
+		assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.1"}, cfg.TrustedProxies)
+		assert.True(t, cfg.Metrics)
+		assert.Equal(t, "127.0.0.1:9100", cfg.MetricsAddr)
+		assert.Equal(t, "metrics_secret", cfg.MetricsToken)
 	})
 }
 
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"github.com/kohkimakimoto/actions-gateway/server/auth"
 	"github.com/kohkimakimoto/actions-gateway/server/router"
@@ -8,96 +9,667 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
 	"io"
+	"mime"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
-func FetchActionHandler(r *router.Router, aFactory *router.ActionMessageFactory) echo.HandlerFunc {
-	return func(c echo.Context) error {
+// defaultActionTimeout is the execution timeout of the action that does not declare its own timeout.
+const defaultActionTimeout = 30 * time.Second
+
+// preferRespondAsync is the preference (RFC 7240) to request an asynchronous action invocation.
+const preferRespondAsync = "respond-async"
+
+// preferDurable is the preference of the Prefer header to queue the invocation durably
+// and deliver it when the client connects. It implies preferRespondAsync.
+const preferDurable = "durable"
+
+// selectorHeader is the request header to select the agents that run the action by their labels.
+const selectorHeader = "X-Actions-Gateway-Selector"
+
+// selectorQueryParam is the query parameter to select the agents like selectorHeader.
+// It is not forwarded to the actions.
+const selectorQueryParam = "actions_gateway_selector"
+
+// ActionMethods is a list of the HTTP methods that are routed to the actions.
+var ActionMethods = []string{
+	http.MethodGet,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// forwardedHeaders is an allowlist of the request headers that are forwarded to the actions.
+// The other headers, such as Authorization, never reach the client.
+var forwardedHeaders = []string{
+	echo.HeaderAccept,
+	"Accept-Language",
+	echo.HeaderContentType,
+	"User-Agent",
+	echo.HeaderXRequestID,
+}
+
+// FetchActionHandler invokes the action on the client and returns its result.
+// The deferred queue dq is nil if the durable invocations are disabled,
+// the idempotency store idempotency is nil if the idempotency keys are disabled,
+// and the result cache is nil if the result caching is disabled.
+// The multipart requests larger than maxUploadSize bytes are rejected. Zero means no limit.
+func FetchActionHandler(r *router.Router, aFactory *router.ActionMessageFactory, jm *router.JobManager, dq *router.DeferredQueue, idempotency *router.IdempotencyStore, cache *router.ResultCache, maxUploadSize int64) echo.HandlerFunc {
+	return withIdempotency(idempotency, func(c echo.Context) error {
 		name := c.Param("name")
-		sess := r.GetActiveSession(auth.MustGetClient(c))
-		if sess == nil {
-			return c.String(http.StatusServiceUnavailable, "The session is not active")
+		client := auth.MustGetClient(c)
+		selector, err := requestSelector(c.Request())
+		if err != nil {
+			return c.String(http.StatusBadRequest, "The selector is invalid")
+		}
+
+		if hasPreference(c.Request(), preferDurable) {
+			return deferAction(c, dq, aFactory, client, name, selector)
+		}
+
+		// The cached results of the read-only actions are served without invoking the client.
+		if served, err := serveCachedResult(c, cache, client, name); served || err != nil {
+			return err
+		}
+
+		// The agent that runs the action may be connected to another server node.
+		if r.SelectSession(client, name, selector) == nil && !r.IsAuthenticatedForward(c.Request()) {
+			entry, err := r.LookupRemote(client, name, selector)
+			if err != nil {
+				// Internal server error. The stack trace should be captured.
+				return errors.WithStack(err)
+			}
+			if entry != nil {
+				c.Logger().Debugf("Forwarding the request to the node: %s (%s)", entry.NodeId, entry.NodeURL)
+				r.Forward(c.Response(), c.Request(), entry)
+				return nil
+			}
+		}
+
+		sessions, code, unavailable := activeSessions(c, r, client)
+		if len(sessions) == 0 {
+			return c.String(code, unavailable)
+		}
+		if len(r.MatchingSessions(client, selector)) == 0 {
+			return c.String(http.StatusServiceUnavailable, noMatchingSessionMessage(selector, sessions))
 		}
 
-		if !sess.IsActionExist(name) {
+		// dispatch the invocation to one of the sessions that match the selector and advertise the action
+		sess := r.SelectSession(client, name, selector)
+		if sess == nil {
 			return c.String(http.StatusNotFound, "The action is not found")
 		}
 
-		body, err := io.ReadAll(c.Request().Body)
-		if err != nil {
-			// Internal server error. The stack trace should be captured.
-			return errors.WithStack(err)
+		if !sess.IsMethodAllowed(name, c.Request().Method) {
+			c.Response().Header().Set(echo.HeaderAllow, strings.Join(sess.ActionMethods(name), ", "))
+			return c.String(http.StatusMethodNotAllowed, "The method is not allowed for the action")
+		}
+
+		// The parts of a multipart request are sent to the client as files instead of the body.
+		multipartReq := isMultipartRequest(c.Request()) && sess.Supports(types.CapabilityMultipart)
+
+		var body []byte
+		if !multipartReq {
+			b, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				// Internal server error. The stack trace should be captured.
+				return errors.WithStack(err)
+			}
+			body = b
 		}
 
 		// create a new action message
-		msg, err := aFactory.NewMessage(name, string(body))
+		msg, err := newActionMessage(c, aFactory, name, string(body))
 		if err != nil {
 			// Internal server error. The stack trace should be captured.
 			return errors.WithStack(err)
 		}
-		// make sure to free the result channel
-		defer sess.FreeResultChannel(msg.Id)
-
-		// Allocate a result channel to receive the action result
-		resultChan := sess.AllocateResultChannel(msg.Id)
 
-		// Get a websocket connection from the session
-		conn := sess.Conn()
-		if conn == nil {
-			// Internal server error. The stack trace should be captured.
-			return errors.New("the session is active but the websocket connection is nil")
+		if multipartReq {
+			if maxUploadSize > 0 {
+				if c.Request().ContentLength > maxUploadSize {
+					return uploadTooLarge(c, maxUploadSize)
+				}
+				// The request without the content length is cut off at the limit while it is sent.
+				c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxUploadSize)
+			}
+			msg.Multipart = true
+			if err := sendUploads(sess, msg, c.Request()); err != nil {
+				// let the client remove the files that have already been sent
+				_ = sess.SendCancel(msg)
+				if errors.Is(err, errUploadTooLarge) {
+					return uploadTooLarge(c, maxUploadSize)
+				}
+				if errors.Is(err, errInvalidMultipart) {
+					return c.String(http.StatusBadRequest, "The multipart request is invalid")
+				}
+				if errors.Is(err, router.ErrOutboundQueueFull) {
+					return c.String(http.StatusServiceUnavailable, "The client is too busy to receive the action")
+				}
+				// Internal server error. The stack trace should be captured.
+				return errors.WithStack(err)
+			}
 		}
 
-		// Send the action message to the client
-		if err := conn.WriteJSON(msg); err != nil {
-			// Internal server error. The stack trace should be captured.
-			return errors.WithStack(err)
+		if hasPreference(c.Request(), preferRespondAsync) {
+			// Run the action in the background and return the job immediately.
+			job, err := jm.Start(r, sess, msg, selector)
+			if err != nil {
+				// Internal server error. The stack trace should be captured.
+				return errors.WithStack(err)
+			}
+			c.Response().Header().Set("Location", "/jobs/"+job.Id())
+			c.Response().Header().Set("Preference-Applied", preferRespondAsync)
+			return c.JSON(http.StatusAccepted, job.Response())
 		}
 
-		ctx, cancel := context.WithTimeout(c.Request().Context(), 30*time.Second) // Set your desired timeout duration
+		timeout := sess.ActionTimeout(name)
+		if timeout == 0 {
+			timeout = defaultActionTimeout
+		}
+		ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
 		defer cancel()
 
-		// Wait for the action result or timeout
-		select {
-		case result := <-resultChan:
-			if result.Status == types.ActionResultStatusSuccess {
-				if strings.HasPrefix(result.Body, "{") {
-					return c.JSONBlob(http.StatusOK, []byte(result.Body))
-				} else {
-					return c.String(http.StatusOK, result.Body)
+		if sse := acceptsEventStream(c.Request()); sse || sess.IsStreamingAction(name) {
+			return fetchActionStream(ctx, c, r, sess, msg, selector, sse)
+		}
+
+		// Send the action message and wait for the action result or timeout
+		result, err := r.Invoke(ctx, sess, msg, selector)
+		if err != nil {
+			return handleInvokeError(c, msg, err)
+		}
+		if ttl := sess.ActionCacheTTL(name); ttl > 0 && cache != nil && isCacheableRequest(c.Request()) && !isMultipartRequest(c.Request()) {
+			if cached := cache.Put(client.Id, name, cacheKey(c.Request(), body), result, ttl); cached != nil {
+				return writeCachedResult(c, cached, cacheStatusMiss)
+			}
+		}
+		return writeActionResult(c, result)
+	})
+}
+
+// activeSessions returns the active sessions of the client.
+// If the client is reconnecting, it waits for the client to reconnect within the grace period.
+// It returns the status code and the message for the caller if no session is active.
+func activeSessions(c echo.Context, r *router.Router, client *auth.Client) ([]*router.Session, int, string) {
+	if sessions := r.ActiveSessions(client); len(sessions) > 0 {
+		return sessions, 0, ""
+	}
+
+	start := time.Now()
+	sessions, err := r.WaitForReconnect(c.Request().Context(), client)
+	switch {
+	case err == nil:
+		c.Logger().Infof("The request waited %s for the client to reconnect: %s", time.Since(start), client.Id)
+		return sessions, 0, ""
+	case errors.Is(err, router.ErrReconnectQueueFull):
+		c.Logger().Warnf("The request was rejected, because too many requests are waiting for the client to reconnect: %s", client.Id)
+		c.Response().Header().Set("Retry-After", "1")
+		return nil, http.StatusTooManyRequests, "Too many requests are waiting for the client to reconnect"
+	case errors.Is(err, router.ErrReconnectTimeout):
+		c.Logger().Infof("The client did not reconnect in %s: %s", time.Since(start), client.Id)
+		return nil, http.StatusServiceUnavailable, "The client did not reconnect in time"
+	default:
+		return nil, http.StatusServiceUnavailable, "The session is not active"
+	}
+}
+
+// deferAction queues the invocation of the action durably and returns the deferred job.
+// The invocation is delivered when a session of the client that can run the action becomes active.
+func deferAction(c echo.Context, dq *router.DeferredQueue, aFactory *router.ActionMessageFactory, client *auth.Client, name string, selector router.Selector) error {
+	if dq == nil {
+		return c.String(http.StatusNotImplemented, "The durable invocations are not enabled on the server")
+	}
+	if !dq.IsDeferrable(client, name) {
+		return c.String(http.StatusUnprocessableEntity, "The action does not allow deferred delivery")
+	}
+	if isMultipartRequest(c.Request()) {
+		return c.String(http.StatusBadRequest, "The multipart request cannot be deferred")
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		// Internal server error. The stack trace should be captured.
+		return errors.WithStack(err)
+	}
+	msg, err := newActionMessage(c, aFactory, name, string(body))
+	if err != nil {
+		// Internal server error. The stack trace should be captured.
+		return errors.WithStack(err)
+	}
+	job, err := dq.Enqueue(client, msg, selector)
+	if err != nil {
+		// Internal server error. The stack trace should be captured.
+		return errors.WithStack(err)
+	}
+	c.Logger().Infof("The invocation was deferred: %s (%s)", job.Id, name)
+
+	c.Response().Header().Set("Location", "/jobs/"+job.Id)
+	c.Response().Header().Set("Preference-Applied", preferDurable)
+	return c.JSON(http.StatusAccepted, dq.Response(job))
+}
+
+// newActionMessage creates a new action message that carries the HTTP request to the action.
+func newActionMessage(c echo.Context, aFactory *router.ActionMessageFactory, name string, body string) (*types.ActionMessage, error) {
+	msg, err := aFactory.NewMessage(name, body)
+	if err != nil {
+		return nil, err
+	}
+	msg.Method = c.Request().Method
+	if subPath := c.Param("*"); subPath != "" {
+		msg.Path = "/" + subPath
+	}
+	msg.Query = forwardedQuery(c.Request())
+	msg.Headers = requestHeaders(c.Request())
+	return msg, nil
+}
+
+// fetchActionStream relays the output of the action to the caller as it is produced.
+// The output is sent as Server-Sent Events if sse is true, otherwise as a chunked HTTP response.
+func fetchActionStream(ctx context.Context, c echo.Context, r *router.Router, sess *router.Session, msg *types.ActionMessage, selector router.Selector, sse bool) error {
+	w := &streamWriter{c: c, sse: sse}
+	result, err := r.InvokeStream(ctx, sess, msg, selector, w.Write)
+	if err != nil {
+		if !w.started {
+			return handleInvokeError(c, msg, err)
+		}
+		// The response status has already been sent, so the error can only be reported in the stream.
+		c.Logger().Infof("Action stream aborted: %s (%s), %v", msg.Name, msg.Id, err)
+		if sse {
+			message := "The action execution timeout"
+			if errors.Is(err, router.ErrOutputOverflow) {
+				message = "The output of the action was not received as fast as it was produced"
+			}
+			_ = w.WriteEvent("error", message)
+		}
+		return nil
+	}
+
+	if !w.started && !sse {
+		// Nothing has been streamed yet, so the response that the action declared can still be applied.
+		return writeActionResult(c, result)
+	}
+
+	if result.Status != types.ActionResultStatusSuccess {
+		if !w.started {
+			return writeActionResult(c, result)
+		}
+		if sse {
+			_ = w.WriteEvent("error", result.Body)
+		}
+		return nil
+	}
+
+	// The client that does not support streaming sends the whole output in the result.
+	if result.Body != "" {
+		if err := w.Write(result.Body); err != nil {
+			return nil
+		}
+	}
+	if sse {
+		_ = w.WriteEvent("done", "")
+	}
+	return nil
+}
+
+// statusClientClosedRequest is the non-standard status code that is logged for the request
+// whose caller disconnected before the response.
+const statusClientClosedRequest = 499
+
+// handleInvokeError converts the error of invoking the action message to the HTTP response.
+func handleInvokeError(c echo.Context, msg *types.ActionMessage, err error) error {
+	if errors.Is(err, context.Canceled) {
+		// The caller disconnected, so nobody receives the response.
+		// The client has been asked to cancel the running action.
+		c.Logger().Infof("Action canceled by the caller: %s (%s), %v", msg.Name, msg.Id, err)
+		return c.NoContent(statusClientClosedRequest)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		// The action execution timed out.
+		// The client has been asked to cancel the running action.
+		c.Logger().Infof("Action canceled: %s (%s), %v", msg.Name, msg.Id, err)
+		return c.String(http.StatusInternalServerError, "The action execution timeout")
+	}
+	if errors.Is(err, router.ErrSessionReplaced) {
+		// The client reconnected with a new session, and the running action was lost with the stale session.
+		c.Logger().Infof("Action aborted: %s (%s), %v", msg.Name, msg.Id, err)
+		return c.String(http.StatusServiceUnavailable, "The client reconnected while running the action")
+	}
+	if errors.Is(err, router.ErrSessionClosed) {
+		// The client disconnected while running the action, and no other session could take it over.
+		c.Logger().Infof("Action aborted: %s (%s), %v", msg.Name, msg.Id, err)
+		return c.String(http.StatusServiceUnavailable, "The client disconnected while running the action")
+	}
+	if errors.Is(err, router.ErrOutputOverflow) {
+		// The output of the action was produced faster than it was relayed to the caller.
+		c.Logger().Warnf("Action aborted: %s (%s), %v", msg.Name, msg.Id, err)
+		return c.String(http.StatusServiceUnavailable, "The output of the action was not received as fast as it was produced")
+	}
+	if errors.Is(err, router.ErrOutboundQueueFull) {
+		// The client does not receive the messages as fast as they are sent.
+		c.Logger().Warnf("Action rejected: %s (%s), %v", msg.Name, msg.Id, err)
+		return c.String(http.StatusServiceUnavailable, "The client is too busy to receive the action")
+	}
+	return err
+}
+
+func writeActionResult(c echo.Context, result *types.ActionResult) error {
+	if result.Status == types.ActionResultStatusBusy {
+		// The client rejected the action, because too many actions are running on it.
+		c.Response().Header().Set("Retry-After", "1")
+		return c.String(http.StatusTooManyRequests, "The client is busy")
+	}
+
+	if result.StatusCode != 0 || len(result.Headers) > 0 {
+		return writeDeclaredResponse(c, result)
+	}
+
+	if result.Status == types.ActionResultStatusSuccess {
+		return c.Blob(http.StatusOK, guessContentType(result.Body), []byte(result.Body))
+	} else {
+		// The action message was sent successfully, but its execution failed.
+		// The system returns an internal server error but does not log the error
+		// because it is not the fault of the Action Gateway Server.
+		// Therefore, the handler returns nil.
+		if result.Body != "" {
+			return c.String(http.StatusInternalServerError, result.Body)
+		}
+		return c.String(http.StatusInternalServerError, "The action execution failed")
+	}
+}
+
+// ignoredResponseHeaders is a list of the response headers that the actions can not declare,
+// because they are managed by the server.
+var ignoredResponseHeaders = []string{
+	"Connection",
+	echo.HeaderContentLength,
+	"Transfer-Encoding",
+}
+
+// writeDeclaredResponse writes the response that the action declared.
+// The status code defaults to 200 for the successful action and 500 for the failed one.
+func writeDeclaredResponse(c echo.Context, result *types.ActionResult) error {
+	status := result.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+		if result.Status != types.ActionResultStatusSuccess {
+			status = http.StatusInternalServerError
+		}
+	}
+
+	header := c.Response().Header()
+	for name, value := range result.Headers {
+		if slices.Contains(ignoredResponseHeaders, http.CanonicalHeaderKey(name)) {
+			continue
+		}
+		header.Set(name, value)
+	}
+
+	contentType := header.Get(echo.HeaderContentType)
+	if contentType == "" {
+		contentType = guessContentType(result.Body)
+	}
+	return c.Blob(status, contentType, []byte(result.Body))
+}
+
+// guessContentType guesses the content type of the action's output that does not declare it.
+func guessContentType(body string) string {
+	switch {
+	case strings.HasPrefix(body, "{"):
+		return echo.MIMEApplicationJSON
+	case !utf8.ValidString(body):
+		// binary data such as images and archives
+		return http.DetectContentType([]byte(body))
+	default:
+		return echo.MIMETextPlainCharsetUTF8
+	}
+}
+
+// uploadChunkSize is the maximum size of the data in an upload message.
+const uploadChunkSize = 64 * 1024
+
+var errInvalidMultipart = errors.New("invalid multipart request")
+
+// errUploadTooLarge is returned when the multipart request exceeds the maximum upload size.
+var errUploadTooLarge = errors.New("the upload is too large")
+
+// uploadTooLarge responds that the multipart request exceeds the maximum upload size.
+func uploadTooLarge(c echo.Context, maxUploadSize int64) error {
+	return c.String(http.StatusRequestEntityTooLarge, "The upload is too large. The maximum is "+strconv.FormatInt(maxUploadSize, 10)+" bytes")
+}
+
+// multipartError returns the error of reading the multipart request.
+func multipartError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errUploadTooLarge
+	}
+	return errors.Wrap(errInvalidMultipart, err.Error())
+}
+
+// isMultipartRequest reports whether the request is a multipart/form-data request.
+func isMultipartRequest(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+	return err == nil && mediaType == echo.MIMEMultipartForm
+}
+
+// sendUploads streams the parts of the multipart request to the client as the upload messages.
+// The parts are not buffered in the server.
+func sendUploads(sess *router.Session, msg *types.ActionMessage, req *http.Request) error {
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return multipartError(err)
+	}
+
+	buf := make([]byte, uploadChunkSize)
+	for index := 0; ; index++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return multipartError(err)
+		}
+
+		for first := true; ; first = false {
+			n, err := io.ReadFull(part, buf)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return multipartError(err)
+			}
+			// The first chunk has the metadata of the part, and it is sent even if the part is empty.
+			if n > 0 || first {
+				chunk := &types.UploadChunk{
+					Index: index,
+					Data:  string(buf[:n]),
+				}
+				if first {
+					chunk.Field = part.FormName()
+					chunk.Filename = part.FileName()
+					chunk.ContentType = part.Header.Get(echo.HeaderContentType)
 				}
-			} else {
-				// The action message was sent successfully, but its execution failed.
-				// The system returns an internal server error but does not log the error
-				// because it is not the fault of the Action Gateway Server.
-				// Therefore, the handler returns nil.
-				if result.Body != "" {
-					return c.String(http.StatusInternalServerError, result.Body)
+				if err := sess.SendUpload(msg, chunk); err != nil {
+					return err
 				}
-				return c.String(http.StatusInternalServerError, "The action execution failed")
 			}
-		case <-ctx.Done():
-			// The action execution timed out.
-			return c.String(http.StatusInternalServerError, "The action execution timeout")
+			if err != nil {
+				// the end of the part
+				break
+			}
+		}
+	}
+}
+
+// requestSelector returns the selector of the request.
+// The header takes precedence over the query parameter.
+func requestSelector(req *http.Request) (router.Selector, error) {
+	s := req.Header.Get(selectorHeader)
+	if s == "" {
+		s = req.URL.Query().Get(selectorQueryParam)
+	}
+	return router.ParseSelector(s)
+}
+
+// forwardedQuery returns the query string of the request without the selector.
+func forwardedQuery(req *http.Request) string {
+	query := req.URL.Query()
+	if !query.Has(selectorQueryParam) {
+		return req.URL.RawQuery
+	}
+	query.Del(selectorQueryParam)
+	return query.Encode()
+}
+
+// noMatchingSessionMessage returns the message that lists the connected agents
+// when no agent matches the selector.
+func noMatchingSessionMessage(selector router.Selector, sessions []*router.Session) string {
+	var b strings.Builder
+	b.WriteString("No agent matches the selector: " + selector.String() + "\n")
+	b.WriteString("Connected agents:\n")
+	for _, sess := range sessions {
+		labels := router.FormatLabels(sess.Labels())
+		if labels == "" {
+			labels = "(no labels)"
+		}
+		b.WriteString("- " + labels + "\n")
+	}
+	return b.String()
+}
+
+// requestHeaders returns the allowlisted headers of the request.
+func requestHeaders(req *http.Request) map[string]string {
+	headers := make(map[string]string)
+	for _, name := range forwardedHeaders {
+		if values := req.Header.Values(name); len(values) > 0 {
+			headers[name] = strings.Join(values, ", ")
+		}
+	}
+	return headers
+}
+
+// acceptsEventStream reports whether the caller accepts Server-Sent Events.
+func acceptsEventStream(req *http.Request) bool {
+	return strings.Contains(req.Header.Get(echo.HeaderAccept), "text/event-stream")
+}
+
+// streamWriter writes the output chunks of an action to the HTTP response as soon as they arrive.
+type streamWriter struct {
+	c   echo.Context
+	sse bool
+	// started is true after the response header is sent
+	started bool
+}
+
+func (w *streamWriter) start() {
+	res := w.c.Response()
+	if w.sse {
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	} else {
+		res.Header().Set(echo.HeaderContentType, echo.MIMETextPlainCharsetUTF8)
+	}
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+	w.started = true
+}
+
+// Write writes the output chunk to the response.
+func (w *streamWriter) Write(data string) error {
+	if w.sse {
+		return w.WriteEvent("", data)
+	}
+	if !w.started {
+		w.start()
+	}
+	if _, err := w.c.Response().Write([]byte(data)); err != nil {
+		return err
+	}
+	w.c.Response().Flush()
+	return nil
+}
+
+// WriteEvent writes a Server-Sent Event. An empty event name means the default "message" event.
+func (w *streamWriter) WriteEvent(event string, data string) error {
+	if !w.started {
+		w.start()
+	}
+	var b strings.Builder
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	if _, err := w.c.Response().Write([]byte(b.String())); err != nil {
+		return err
+	}
+	w.c.Response().Flush()
+	return nil
+}
+
+// hasPreference reports whether the request has the preference in the Prefer header (RFC 7240).
+func hasPreference(req *http.Request, preference string) bool {
+	for _, v := range req.Header.Values("Prefer") {
+		for _, p := range strings.Split(v, ",") {
+			// ignore the parameters of the preference
+			p, _, _ = strings.Cut(p, ";")
+			if strings.EqualFold(strings.TrimSpace(p), preference) {
+				return true
+			}
 		}
 	}
+	return false
 }
 
+// NotifyActionResultHandler receives the action result from the client.
+// The clients of protocol version 2 or later send the results via websocket,
+// but this endpoint is kept for the clients of protocol version 1.
+// The result of the action message that another server node sent is forwarded to the node.
 func NotifyActionResultHandler(r *router.Router) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		sess := r.GetActiveSession(auth.MustGetClient(c))
-		if sess == nil {
-			return c.String(http.StatusServiceUnavailable, "The session is not active")
-		}
+		client := auth.MustGetClient(c)
 
-		result := &types.ActionResult{}
-		if err := c.Bind(result); err != nil {
+		// keep the body to forward the request after binding it
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			// Internal server error. The stack trace should be captured.
+			return errors.WithStack(err)
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+		legacyResult := &types.LegacyActionResult{}
+		if err := c.Bind(legacyResult); err != nil {
 			return err
 		}
+		result := legacyResult.ActionResult()
+
+		if !r.IsAuthenticatedForward(c.Request()) {
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+			forwarded, err := r.ForwardToNode(c.Response(), c.Request(), router.NodeIdOf(result.Id))
+			if err != nil {
+				// Internal server error. The stack trace should be captured.
+				return errors.WithStack(err)
+			}
+			if forwarded {
+				return nil
+			}
+		}
+
+		if len(r.ActiveSessions(client)) == 0 {
+			return c.String(http.StatusServiceUnavailable, "The session is not active")
+		}
 
-		if err := sess.HandleActionResult(result); err != nil {
+		if err := r.HandleActionResult(client, result); err != nil {
+			if errors.Is(err, router.ErrResultChannelNotFound) {
+				// The result arrived after the request was canceled or timed out.
+				// It is not an error of the client, so just discard it.
+				c.Logger().Infof("Discarded the late result of the action message: %s", result.Id)
+				return c.NoContent(http.StatusNoContent)
+			}
 			// Internal server error. The stack trace should be captured.
 			return errors.WithStack(err)
 		}
@@ -0,0 +1,402 @@
+package handlers
+
+import (
+	"context"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/kohkimakimoto/actions-gateway/server/testutil"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHasPreference(t *testing.T) {
+	testCases := map[string]struct {
+		prefer   []string
+		expected bool
+	}{
+		"no header": {
+			prefer:   nil,
+			expected: false,
+		},
+		"single preference": {
+			prefer:   []string{"respond-async"},
+			expected: true,
+		},
+		"multiple preferences": {
+			prefer:   []string{"return=minimal, respond-async"},
+			expected: true,
+		},
+		"multiple headers": {
+			prefer:   []string{"return=minimal", "Respond-Async"},
+			expected: true,
+		},
+		"preference with parameters": {
+			prefer:   []string{"respond-async; foo=bar"},
+			expected: true,
+		},
+		"other preference": {
+			prefer:   []string{"wait=10"},
+			expected: false,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/actions/test", nil)
+			for _, v := range tc.prefer {
+				req.Header.Add("Prefer", v)
+			}
+			assert.Equal(t, tc.expected, hasPreference(req, preferRespondAsync))
+		})
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/actions/test", nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Add("Accept", "text/plain")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+
+	assert.Equal(t, map[string]string{
+		"Content-Type": "application/json",
+		"Accept":       "text/plain, application/json",
+	}, requestHeaders(req))
+}
+
+func TestIsMultipartRequest(t *testing.T) {
+	testCases := map[string]struct {
+		contentType string
+		expected    bool
+	}{
+		"no content type": {
+			contentType: "",
+			expected:    false,
+		},
+		"json": {
+			contentType: "application/json",
+			expected:    false,
+		},
+		"multipart": {
+			contentType: "multipart/form-data; boundary=xyz",
+			expected:    true,
+		},
+		"invalid": {
+			contentType: "multipart/form-data; boundary",
+			expected:    false,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/actions/test", nil)
+			if tc.contentType != "" {
+				req.Header.Set(echo.HeaderContentType, tc.contentType)
+			}
+			assert.Equal(t, tc.expected, isMultipartRequest(req))
+		})
+	}
+}
+
+func TestRequestSelector(t *testing.T) {
+	t.Run("header", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/actions/test?actions_gateway_selector=host=laptop", nil)
+		req.Header.Set(selectorHeader, "host=nas")
+		sel, err := requestSelector(req)
+		assert.NoError(t, err)
+		assert.Equal(t, router.Selector{"host": "nas"}, sel)
+	})
+
+	t.Run("query", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/actions/test?actions_gateway_selector=host%3Dnas&page=2", nil)
+		sel, err := requestSelector(req)
+		assert.NoError(t, err)
+		assert.Equal(t, router.Selector{"host": "nas"}, sel)
+		// the selector is not forwarded to the action
+		assert.Equal(t, "page=2", forwardedQuery(req))
+	})
+
+	t.Run("no selector", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/actions/test?b=2&a=1", nil)
+		sel, err := requestSelector(req)
+		assert.NoError(t, err)
+		assert.Nil(t, sel)
+		assert.Equal(t, "b=2&a=1", forwardedQuery(req))
+	})
+
+	t.Run("invalid selector", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/actions/test", nil)
+		req.Header.Set(selectorHeader, "nas")
+		_, err := requestSelector(req)
+		assert.Error(t, err)
+	})
+}
+
+func TestNoMatchingSessionMessage(t *testing.T) {
+	r := router.New()
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	sess1, err := r.NewSession(ct, &types.SessionNewRequest{Labels: map[string]string{"host": "laptop", "env": "dev"}})
+	assert.NoError(t, err)
+	sess2, err := r.NewSession(ct, &types.SessionNewRequest{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, `No agent matches the selector: host=nas
+Connected agents:
+- env=dev,host=laptop
+- (no labels)
+`, noMatchingSessionMessage(router.Selector{"host": "nas"}, []*router.Session{sess1, sess2}))
+}
+
+func TestAcceptsEventStream(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/actions/test", nil)
+	assert.False(t, acceptsEventStream(req))
+	req.Header.Set(echo.HeaderAccept, "text/event-stream")
+	assert.True(t, acceptsEventStream(req))
+}
+
+func TestStreamWriter(t *testing.T) {
+	t.Run("chunked", func(t *testing.T) {
+		e := testutil.NewEchoInstance(t)
+		req := httptest.NewRequest(http.MethodPost, "/actions/test", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		w := &streamWriter{c: c}
+		assert.NoError(t, w.Write("line1\n"))
+		assert.NoError(t, w.Write("line2\n"))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, echo.MIMETextPlainCharsetUTF8, rec.Header().Get(echo.HeaderContentType))
+		assert.Equal(t, "line1\nline2\n", rec.Body.String())
+	})
+
+	t.Run("sse", func(t *testing.T) {
+		e := testutil.NewEchoInstance(t)
+		req := httptest.NewRequest(http.MethodPost, "/actions/test", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		w := &streamWriter{c: c, sse: true}
+		assert.NoError(t, w.Write("line1\nline2\n"))
+		assert.NoError(t, w.WriteEvent("done", ""))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "text/event-stream", rec.Header().Get(echo.HeaderContentType))
+		assert.Equal(t, "data: line1\ndata: line2\n\nevent: done\ndata: \n\n", rec.Body.String())
+	})
+}
+
+func TestWriteActionResult(t *testing.T) {
+	testCases := map[string]struct {
+		result      *types.ActionResult
+		code        int
+		contentType string
+		body        string
+		headers     map[string]string
+	}{
+		"json": {
+			result:      &types.ActionResult{Status: types.ActionResultStatusSuccess, Body: `{"key":"value"}`},
+			code:        http.StatusOK,
+			contentType: echo.MIMEApplicationJSON,
+			body:        `{"key":"value"}`,
+		},
+		"text": {
+			result:      &types.ActionResult{Status: types.ActionResultStatusSuccess, Body: "hello"},
+			code:        http.StatusOK,
+			contentType: echo.MIMETextPlainCharsetUTF8,
+			body:        "hello",
+		},
+		"binary": {
+			result:      &types.ActionResult{Status: types.ActionResultStatusSuccess, Body: "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"},
+			code:        http.StatusOK,
+			contentType: "image/png",
+			body:        "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR",
+		},
+		"failed": {
+			result:      &types.ActionResult{Status: types.ActionResultStatusError},
+			code:        http.StatusInternalServerError,
+			contentType: echo.MIMETextPlainCharsetUTF8,
+			body:        "The action execution failed",
+		},
+		"busy": {
+			result:      &types.ActionResult{Status: types.ActionResultStatusBusy, Body: "The agent is busy"},
+			code:        http.StatusTooManyRequests,
+			contentType: echo.MIMETextPlainCharsetUTF8,
+			body:        "The client is busy",
+			headers: map[string]string{
+				"Retry-After": "1",
+			},
+		},
+		"declared status": {
+			result:      &types.ActionResult{Status: types.ActionResultStatusError, Body: `{"error":"not found"}`, StatusCode: http.StatusNotFound},
+			code:        http.StatusNotFound,
+			contentType: echo.MIMEApplicationJSON,
+			body:        `{"error":"not found"}`,
+		},
+		"declared headers": {
+			result: &types.ActionResult{
+				Status: types.ActionResultStatusSuccess,
+				Body:   "a,b\n1,2\n",
+				Headers: map[string]string{
+					"Content-Type":        "text/csv",
+					"Content-Disposition": `attachment; filename="data.csv"`,
+					"Content-Length":      "1",
+				},
+			},
+			code:        http.StatusOK,
+			contentType: "text/csv",
+			body:        "a,b\n1,2\n",
+			headers: map[string]string{
+				"Content-Disposition": `attachment; filename="data.csv"`,
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			e := testutil.NewEchoInstance(t)
+			req := httptest.NewRequest(http.MethodPost, "/actions/test", nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			assert.NoError(t, writeActionResult(c, tc.result))
+			assert.Equal(t, tc.code, rec.Code)
+			assert.Equal(t, tc.contentType, rec.Header().Get(echo.HeaderContentType))
+			assert.Equal(t, tc.body, rec.Body.String())
+			for k, v := range tc.headers {
+				assert.Equal(t, v, rec.Header().Get(k))
+			}
+		})
+	}
+}
+
+func TestHandleInvokeError(t *testing.T) {
+	testCases := map[string]struct {
+		err  error
+		code int
+		body string
+	}{
+		"timeout": {
+			err:  context.DeadlineExceeded,
+			code: http.StatusInternalServerError,
+			body: "The action execution timeout",
+		},
+		"canceled by the caller": {
+			err:  context.Canceled,
+			code: statusClientClosedRequest,
+			body: "",
+		},
+		"disconnected": {
+			err:  router.ErrSessionClosed,
+			code: http.StatusServiceUnavailable,
+			body: "The client disconnected while running the action",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			e := testutil.NewEchoInstance(t)
+			req := httptest.NewRequest(http.MethodPost, "/actions/test", nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			assert.NoError(t, handleInvokeError(c, &types.ActionMessage{Id: "00000000-0000-0000-0000-000000000001", Name: "test"}, tc.err))
+			assert.Equal(t, tc.code, rec.Code)
+			assert.Equal(t, tc.body, rec.Body.String())
+		})
+	}
+}
+
+func TestFetchActionHandler_Durable(t *testing.T) {
+	newEcho := func(t *testing.T, dq *router.DeferredQueue) *echo.Echo {
+		e := testutil.NewEchoInstance(t)
+		e.HTTPErrorHandler = HTTPErrorHandler
+		e.POST("/actions/:name", FetchActionHandler(router.New(), router.NewActionMessageFactory(), router.NewJobManager(), dq, nil, nil, 0), func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				// set a client object to the context for testing
+				auth.SetClient(c, &auth.Client{
+					Id: "00000000-0000-0000-0000-000000000001",
+				})
+				return next(c)
+			}
+		})
+		return e
+	}
+
+	t.Run("durable invocations are disabled", func(t *testing.T) {
+		e := newEcho(t, nil)
+		req := httptest.NewRequest(http.MethodPost, "/actions/test", nil)
+		req.Header.Set("Prefer", "durable")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotImplemented, rec.Code)
+	})
+
+	t.Run("the action is not deferrable", func(t *testing.T) {
+		dq, err := router.NewDeferredQueue(t.TempDir(), router.New())
+		assert.NoError(t, err)
+		defer dq.Close()
+
+		e := newEcho(t, dq)
+		req := httptest.NewRequest(http.MethodPost, "/actions/test", nil)
+		req.Header.Set("Prefer", "durable")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		assert.Equal(t, "The action does not allow deferred delivery", rec.Body.String())
+		assert.Equal(t, 0, dq.NumQueued())
+	})
+}
+
+func TestNotifyActionResultHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		_, _ = w.Write([]byte(string(b) + " from " + req.Header.Get(router.ForwardedHeader)))
+	}))
+	defer ts.Close()
+	reg := router.NewMemoryRegistry()
+	r := router.New(router.WithRegistry(reg), router.WithNode("node1", "http://node1"))
+	router.New(router.WithRegistry(reg), router.WithNode("node2", ts.URL))
+
+	e := testutil.NewEchoInstance(t)
+	e.POST("/api/notify", NotifyActionResultHandler(r), func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// set a client object to the context for testing
+			auth.SetClient(c, &auth.Client{
+				Id: "00000000-0000-0000-0000-000000000001",
+			})
+			return next(c)
+		}
+	})
+
+	t.Run("forwards the result of the action message of another node", func(t *testing.T) {
+		body := `{"id":"node2.00000000-0000-0000-0000-000000000002","status":"success","error":"ok"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/notify", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, body+" from node1", rec.Body.String())
+	})
+
+	t.Run("returns status service unavailable when no session is active", func(t *testing.T) {
+		for _, id := range []string{"node1.00000000-0000-0000-0000-000000000002", "00000000-0000-0000-0000-000000000002"} {
+			req := httptest.NewRequest(http.MethodPost, "/api/notify", strings.NewReader(`{"id":"`+id+`","status":"success"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+			assert.Equal(t, "The session is not active", rec.Body.String())
+		}
+	})
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBatchItems is the maximum number of the items in a batch.
+const maxBatchItems = 50
+
+// BatchActionsHandler invokes the actions of the items in the request body on the client,
+// and returns their results in the same order.
+// The items whose actions are available only on the agents on the other server nodes are forwarded to one of them.
+// Each item counts against the rate limit of its action like a request to the action.
+// The idempotency store idempotency is nil if the idempotency keys are disabled.
+func BatchActionsHandler(r *router.Router, aFactory *router.ActionMessageFactory, limiter *router.RateLimiter, idempotency *router.IdempotencyStore) echo.HandlerFunc {
+	return withIdempotency(idempotency, func(c echo.Context) error {
+		client := auth.MustGetClient(c)
+		selector, err := requestSelector(c.Request())
+		if err != nil {
+			return c.String(http.StatusBadRequest, "The selector is invalid")
+		}
+		sequential := false
+		if v := c.QueryParam("sequential"); v != "" {
+			if sequential, err = strconv.ParseBool(v); err != nil {
+				return c.String(http.StatusBadRequest, "The sequential parameter is invalid")
+			}
+		}
+
+		var items []*types.BatchItem
+		if err := json.NewDecoder(c.Request().Body).Decode(&items); err != nil {
+			return c.String(http.StatusBadRequest, "The batch must be a JSON array of the items")
+		}
+		if len(items) == 0 {
+			return c.String(http.StatusBadRequest, "The batch has no items")
+		}
+		if len(items) > maxBatchItems {
+			return c.String(http.StatusBadRequest, "The batch has too many items. The maximum is "+strconv.Itoa(maxBatchItems))
+		}
+
+		remote, err := remoteEntries(c, r, client, "", selector)
+		if err != nil {
+			// Internal server error. The stack trace should be captured.
+			return errors.WithStack(err)
+		}
+		// Waiting for the agents to reconnect to this node is pointless if they are connected to the other nodes.
+		if len(remote) == 0 {
+			sessions, code, unavailable := activeSessions(c, r, client)
+			if len(sessions) == 0 {
+				return c.String(code, unavailable)
+			}
+			if len(r.MatchingSessions(client, selector)) == 0 {
+				return c.String(http.StatusServiceUnavailable, noMatchingSessionMessage(selector, sessions))
+			}
+		}
+
+		// The overall deadline is the longest timeout of the actions,
+		// or the sum of the timeouts if the actions run one after another.
+		deadline := time.Duration(0)
+		results := make([]*types.BatchResult, len(items))
+		invocations := make([]*router.BatchInvocation, len(items))
+		for i, item := range items {
+			inv, result, err := newBatchInvocation(c, r, aFactory, limiter, client, selector, item)
+			if err != nil {
+				// Internal server error. The stack trace should be captured.
+				return errors.WithStack(err)
+			}
+			if result != nil {
+				results[i] = result
+				continue
+			}
+			invocations[i] = inv
+			if sequential {
+				deadline += inv.Timeout
+			} else {
+				deadline = max(deadline, inv.Timeout)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request().Context(), deadline)
+		defer cancel()
+		for i, result := range r.Batch(ctx, invocations, selector, sequential) {
+			if result != nil {
+				results[i] = result
+			}
+		}
+		return c.JSON(http.StatusOK, results)
+	})
+}
+
+// newBatchInvocation creates the invocation of the batch item on the client.
+// The item is checked against a session that advertises the action now, and the session to run it on
+// is selected again when it is dispatched. It returns the failed result instead if the item can not be invoked or exceeds the rate limit of its action.
+func newBatchInvocation(c echo.Context, r *router.Router, aFactory *router.ActionMessageFactory, limiter *router.RateLimiter, client *auth.Client, selector router.Selector, item *types.BatchItem) (*router.BatchInvocation, *types.BatchResult, error) {
+	if item == nil || item.Name == "" {
+		return nil, &types.BatchResult{
+			Status:     types.JobStatusFailed,
+			StatusCode: http.StatusBadRequest,
+			Body:       "The item has no action name",
+		}, nil
+	}
+
+	sess := r.SelectSession(client, item.Name, selector)
+	// The item is forwarded to another server node if the action is available only on the agents on it.
+	var remote *router.RegistryEntry
+	if sess == nil && !r.IsAuthenticatedForward(c.Request()) {
+		entry, err := r.LookupRemote(client, item.Name, selector)
+		if err != nil {
+			return nil, nil, err
+		}
+		remote = entry
+	}
+	if sess == nil && remote == nil {
+		return nil, &types.BatchResult{
+			Name:       item.Name,
+			Status:     types.JobStatusFailed,
+			StatusCode: http.StatusNotFound,
+			Body:       "The action is not found",
+		}, nil
+	}
+	method := strings.ToUpper(item.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+	// The other node checks the methods that its agent accepts.
+	if !slices.Contains(ActionMethods, method) || (sess != nil && !sess.IsMethodAllowed(item.Name, method)) {
+		return nil, &types.BatchResult{
+			Name:       item.Name,
+			Status:     types.JobStatusFailed,
+			StatusCode: http.StatusMethodNotAllowed,
+			Body:       "The method is not allowed for the action",
+		}, nil
+	}
+	// The node that forwarded the item has already counted it against the rate limit.
+	if !r.IsAuthenticatedForward(c.Request()) {
+		if decision := limiter.Allow(actionRateLimitCheck(limiter, r, client, item.Name)); decision != nil && !decision.Allowed {
+			c.Logger().Infof("Rate limit exceeded: %s (%s)", client.Id, decision.Scope)
+			return nil, &types.BatchResult{
+				Name:       item.Name,
+				Status:     types.JobStatusFailed,
+				StatusCode: http.StatusTooManyRequests,
+				Body:       "Too many requests",
+			}, nil
+		}
+	}
+
+	body, contentType := batchItemBody(item)
+	msg, err := aFactory.NewMessage(item.Name, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg.Method = method
+	msg.Headers = requestHeaders(c.Request())
+	delete(msg.Headers, echo.HeaderContentType)
+	if contentType != "" {
+		msg.Headers[echo.HeaderContentType] = contentType
+	}
+
+	inv := &router.BatchInvocation{
+		Client:  client,
+		Message: msg,
+	}
+	if sess != nil {
+		inv.Timeout = sess.ActionTimeout(item.Name)
+	} else {
+		inv.Timeout = remote.ActionTimeout(item.Name)
+		forwarded := *item
+		forwarded.Method = method
+		inv.Forward = func() *types.BatchResult {
+			return forwardBatchItem(c, r, remote, &forwarded)
+		}
+	}
+	if inv.Timeout == 0 {
+		inv.Timeout = defaultActionTimeout
+	}
+	return inv, nil, nil
+}
+
+// forwardBatchItem forwards the batch of the item to the node of the registry entry, and returns the result of the item.
+// The item fails with the response of the node if the node fails to run the batch.
+func forwardBatchItem(c echo.Context, r *router.Router, remote *router.RegistryEntry, item *types.BatchItem) *types.BatchResult {
+	body, err := json.Marshal([]*types.BatchItem{item})
+	if err != nil {
+		return newForwardedBatchResult(item.Name, http.StatusInternalServerError, "The item can not be forwarded")
+	}
+	c.Logger().Debugf("Forwarding the batch item to the node: %s (%s)", remote.NodeId, remote.NodeURL)
+	res := r.ForwardBuffered(forwardedRequest(c, body), remote)
+
+	var results []*types.BatchResult
+	if res.StatusCode != http.StatusOK || json.Unmarshal(res.Body.Bytes(), &results) != nil || len(results) != 1 || results[0] == nil {
+		return newForwardedBatchResult(item.Name, res.StatusCode, res.Body.String())
+	}
+	return results[0]
+}
+
+func newForwardedBatchResult(name string, statusCode int, body string) *types.BatchResult {
+	return &types.BatchResult{
+		Name:       name,
+		Status:     types.JobStatusFailed,
+		StatusCode: statusCode,
+		Body:       body,
+	}
+}
+
+// batchItemBody returns the request body of the batch item and its content type.
+// A JSON string is the body as is, and the other JSON values are the body in JSON.
+func batchItemBody(item *types.BatchItem) (string, string) {
+	if len(item.Body) == 0 || string(item.Body) == "null" {
+		return "", ""
+	}
+	var s string
+	if err := json.Unmarshal(item.Body, &s); err == nil {
+		return s, ""
+	}
+	return string(item.Body), echo.MIMEApplicationJSON
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/kohkimakimoto/actions-gateway/server/testutil"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchActionsHandler(t *testing.T) {
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	newEcho := func(r *router.Router) *echo.Echo {
+		e := testutil.NewEchoInstance(t)
+		e.POST("/batch", BatchActionsHandler(r, router.NewActionMessageFactory(), router.NewRateLimiter(), nil), func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				// set a client object to the context for testing
+				auth.SetClient(c, ct)
+				return next(c)
+			}
+		})
+		return e
+	}
+
+	t.Run("returns status bad request when the body is invalid", func(t *testing.T) {
+		testCases := map[string]struct {
+			target   string
+			body     string
+			expected string
+		}{
+			"not an array":  {target: "/batch", body: `{"name":"action1"}`, expected: "The batch must be a JSON array of the items"},
+			"empty":         {target: "/batch", body: `[]`, expected: "The batch has no items"},
+			"too many":      {target: "/batch", body: "[" + strings.Repeat(`{"name":"action1"},`, maxBatchItems) + `{"name":"action1"}]`, expected: "The batch has too many items. The maximum is 50"},
+			"bad parameter": {target: "/batch?sequential=maybe", body: `[{"name":"action1"}]`, expected: "The sequential parameter is invalid"},
+		}
+		for name, tc := range testCases {
+			t.Run(name, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodPost, tc.target, strings.NewReader(tc.body))
+				rec := httptest.NewRecorder()
+				newEcho(router.New()).ServeHTTP(rec, req)
+
+				assert.Equal(t, http.StatusBadRequest, rec.Code)
+				assert.Equal(t, tc.expected, rec.Body.String())
+			})
+		}
+	})
+
+	t.Run("returns status service unavailable when no session is active", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`[{"name":"action1"}]`))
+		rec := httptest.NewRecorder()
+		newEcho(router.New()).ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, "The session is not active", rec.Body.String())
+	})
+
+	t.Run("forwards the items whose actions are on the other nodes", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var items []*types.BatchItem
+			_ = json.NewDecoder(req.Body).Decode(&items)
+			_, _ = w.Write([]byte(`[{"name":"` + items[0].Name + `","status":"succeeded","status_code":200,"body":"` +
+				items[0].Method + ` from ` + req.Header.Get(router.ForwardedHeader) + `","duration_ms":1}]`))
+		}))
+		defer ts.Close()
+
+		reg := router.NewMemoryRegistry()
+		assert.NoError(t, reg.Register(&router.RegistryEntry{
+			ClientId:  ct.Id,
+			SessionId: "00000000-0000-0000-0000-000000000002",
+			NodeId:    "node2",
+			NodeURL:   ts.URL,
+			Actions:   []string{"action1"},
+		}))
+		assert.NoError(t, reg.Register(&router.RegistryEntry{
+			ClientId:  ct.Id,
+			SessionId: "00000000-0000-0000-0000-000000000003",
+			NodeId:    "node3",
+			NodeURL:   "http://127.0.0.1:1",
+			Actions:   []string{"action3"},
+		}))
+		r := router.New(router.WithRegistry(reg), router.WithNode("node1", "http://node1"))
+
+		req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`[{"name":"action1","method":"put"},{"name":"action2"},{"name":"action3"}]`))
+		rec := httptest.NewRecorder()
+		newEcho(r).ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var results []*types.BatchResult
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &results))
+		assert.Len(t, results, 3)
+		assert.Equal(t, "action1", results[0].Name)
+		assert.Equal(t, types.JobStatusSucceeded, results[0].Status)
+		assert.Equal(t, "PUT from node1", results[0].Body)
+		assert.Equal(t, &types.BatchResult{Name: "action2", Status: types.JobStatusFailed, StatusCode: http.StatusNotFound, Body: "The action is not found"}, results[1])
+		// the item that the node fails to run fails with its response
+		assert.Equal(t, "action3", results[2].Name)
+		assert.Equal(t, types.JobStatusFailed, results[2].Status)
+		assert.Equal(t, http.StatusBadGateway, results[2].StatusCode)
+	})
+}
+
+func TestBatchItemBody(t *testing.T) {
+	testCases := map[string]struct {
+		body        string
+		expected    string
+		contentType string
+	}{
+		"none":   {body: ``, expected: "", contentType: ""},
+		"null":   {body: `null`, expected: "", contentType: ""},
+		"string": {body: `"hello\nworld"`, expected: "hello\nworld", contentType: ""},
+		"object": {body: `{"url":"https://github.com"}`, expected: `{"url":"https://github.com"}`, contentType: "application/json"},
+		"number": {body: `42`, expected: `42`, contentType: "application/json"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			body, contentType := batchItemBody(&types.BatchItem{Name: "action1", Body: []byte(tc.body)})
+			assert.Equal(t, tc.expected, body)
+			assert.Equal(t, tc.contentType, contentType)
+		})
+	}
+}
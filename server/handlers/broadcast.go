@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BroadcastActionHandler invokes the action on every agent that matches the selector and advertises the action,
+// and returns the aggregated results keyed by agent.
+// The request is forwarded to the other server nodes that the matching agents are connected to,
+// and their results are merged.
+func BroadcastActionHandler(r *router.Router, aFactory *router.ActionMessageFactory) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("name")
+		client := auth.MustGetClient(c)
+		selector, err := requestSelector(c.Request())
+		if err != nil {
+			return c.String(http.StatusBadRequest, "The selector is invalid")
+		}
+		remote, err := remoteEntries(c, r, client, name, selector)
+		if err != nil {
+			// Internal server error. The stack trace should be captured.
+			return errors.WithStack(err)
+		}
+
+		// Waiting for the agents to reconnect to this node is pointless if they are connected to the other nodes.
+		if len(remote) == 0 {
+			sessions, code, unavailable := activeSessions(c, r, client)
+			if len(sessions) == 0 {
+				return c.String(code, unavailable)
+			}
+			if len(r.MatchingSessions(client, selector)) == 0 {
+				return c.String(http.StatusServiceUnavailable, noMatchingSessionMessage(selector, sessions))
+			}
+		}
+		matched := r.MatchingSessions(client, selector)
+
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			// Internal server error. The stack trace should be captured.
+			return errors.WithStack(err)
+		}
+
+		// The overall deadline is the longest timeout of the actions on the agents on this node.
+		// The other nodes apply the timeouts of the actions on their agents.
+		timeout := time.Duration(0)
+		invocations := make(map[*router.Session]*types.ActionMessage)
+		for _, sess := range matched {
+			if !sess.IsActionExist(name) || !sess.IsMethodAllowed(name, c.Request().Method) {
+				continue
+			}
+			// Each agent receives its own action message, so that the results and cancellations are not mixed up.
+			msg, err := newActionMessage(c, aFactory, name, string(body))
+			if err != nil {
+				// Internal server error. The stack trace should be captured.
+				return errors.WithStack(err)
+			}
+			invocations[sess] = msg
+
+			t := sess.ActionTimeout(name)
+			if t == 0 {
+				t = defaultActionTimeout
+			}
+			timeout = max(timeout, t)
+		}
+		if len(invocations) == 0 && len(remote) == 0 {
+			return c.String(http.StatusNotFound, "The action is not found")
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+		defer cancel()
+
+		var remoteResults map[string]*types.BroadcastResult
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			remoteResults = forwardBroadcast(c, r, body, remote)
+		}()
+		results := router.Broadcast(ctx, invocations)
+		wg.Wait()
+		for id, result := range remoteResults {
+			results[id] = result
+		}
+		return c.JSON(http.StatusOK, &types.BroadcastResponse{
+			Action:  name,
+			Results: results,
+		})
+	}
+}
+
+// remoteEntries returns the registry entries of the sessions of the client on the other server nodes
+// that match the selector and advertise the action.
+// It returns nil for the request that has been forwarded from another node.
+func remoteEntries(c echo.Context, r *router.Router, client *auth.Client, name string, selector router.Selector) ([]*router.RegistryEntry, error) {
+	if r.IsAuthenticatedForward(c.Request()) {
+		return nil, nil
+	}
+	return r.RemoteEntries(client, name, selector)
+}
+
+// forwardBroadcast forwards the broadcast request to the nodes of the registry entries concurrently,
+// and returns the merged results of the agents on them.
+// The agents on the node that fails to broadcast are reported as failed with its response.
+func forwardBroadcast(c echo.Context, r *router.Router, body []byte, remote []*router.RegistryEntry) map[string]*types.BroadcastResult {
+	nodes := make(map[string][]*router.RegistryEntry)
+	for _, entry := range remote {
+		nodes[entry.NodeId] = append(nodes[entry.NodeId], entry)
+	}
+
+	results := make(map[string]*types.BroadcastResult, len(remote))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, entries := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			res := r.ForwardBuffered(forwardedRequest(c, body), entries[0])
+
+			var response types.BroadcastResponse
+			ok := res.StatusCode == http.StatusOK && json.Unmarshal(res.Body.Bytes(), &response) == nil
+
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				for id, result := range response.Results {
+					results[id] = result
+				}
+				return
+			}
+			for _, entry := range entries {
+				results[entry.SessionId] = &types.BroadcastResult{
+					Labels:     entry.Labels,
+					Status:     types.JobStatusFailed,
+					StatusCode: res.StatusCode,
+					Body:       res.Body.String(),
+					DurationMs: time.Since(start).Milliseconds(),
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// forwardedRequest returns the copy of the request with the body to forward to another node.
+// The idempotency key is removed, because the node that receives the request from the caller handles it.
+func forwardedRequest(c echo.Context, body []byte) *http.Request {
+	req := c.Request().Clone(c.Request().Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Del(idempotencyKeyHeader)
+	return req
+}
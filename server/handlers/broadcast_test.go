@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/kohkimakimoto/actions-gateway/server/testutil"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBroadcastActionHandler(t *testing.T) {
+	t.Run("returns status service unavailable when no session is active", func(t *testing.T) {
+		e := testutil.NewEchoInstance(t)
+		r := router.New()
+		e.POST("/broadcast/:name", BroadcastActionHandler(r, router.NewActionMessageFactory()), func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				// set a client object to the context for testing
+				auth.SetClient(c, &auth.Client{
+					Id: "00000000-0000-0000-0000-000000000001",
+				})
+				return next(c)
+			}
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/broadcast/action1", nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, "The session is not active", rec.Body.String())
+	})
+
+	t.Run("forwards the request to the other nodes", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			b, _ := io.ReadAll(req.Body)
+			_, _ = w.Write([]byte(`{"action":"action1","results":{"00000000-0000-0000-0000-000000000002":{"labels":{"region":"tokyo"},"status":"succeeded","status_code":200,"body":"` +
+				string(b) + ` from ` + req.Header.Get(router.ForwardedHeader) + `","duration_ms":1}}}`))
+		}))
+		defer ts.Close()
+
+		e := testutil.NewEchoInstance(t)
+		reg := router.NewMemoryRegistry()
+		for i, nodeURL := range []string{ts.URL, "http://127.0.0.1:1"} {
+			assert.NoError(t, reg.Register(&router.RegistryEntry{
+				ClientId:  "00000000-0000-0000-0000-000000000001",
+				SessionId: "00000000-0000-0000-0000-00000000000" + strconv.Itoa(i+2),
+				NodeId:    "node" + strconv.Itoa(i+2),
+				NodeURL:   nodeURL,
+				Actions:   []string{"action1"},
+				Labels:    map[string]string{"region": "tokyo"},
+			}))
+		}
+		r := router.New(router.WithRegistry(reg), router.WithNode("node1", "http://node1"))
+		e.POST("/broadcast/:name", BroadcastActionHandler(r, router.NewActionMessageFactory()), func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				// set a client object to the context for testing
+				auth.SetClient(c, &auth.Client{
+					Id: "00000000-0000-0000-0000-000000000001",
+				})
+				return next(c)
+			}
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/broadcast/action1", strings.NewReader("hello"))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var res types.BroadcastResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		assert.Len(t, res.Results, 2)
+		// the results of the node are merged
+		assert.Equal(t, &types.BroadcastResult{
+			Labels:     map[string]string{"region": "tokyo"},
+			Status:     types.JobStatusSucceeded,
+			StatusCode: http.StatusOK,
+			Body:       "hello from node1",
+			DurationMs: 1,
+		}, res.Results["00000000-0000-0000-0000-000000000002"])
+		// the agents on the unreachable node fail
+		unreachable := res.Results["00000000-0000-0000-0000-000000000003"]
+		assert.Equal(t, types.JobStatusFailed, unreachable.Status)
+		assert.Equal(t, http.StatusBadGateway, unreachable.StatusCode)
+		assert.Equal(t, map[string]string{"region": "tokyo"}, unreachable.Labels)
+	})
+}
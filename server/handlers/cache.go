@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheStatusHeader is the response header that reports whether the result was served from the cache.
+const cacheStatusHeader = "X-Actions-Gateway-Cache"
+
+const (
+	cacheStatusHit  = "HIT"
+	cacheStatusMiss = "MISS"
+)
+
+// serveCachedResult writes the cached result of the request if it is cached.
+// It returns false if the request is not served from the cache.
+func serveCachedResult(c echo.Context, cache *router.ResultCache, client *auth.Client, name string) (bool, error) {
+	req := c.Request()
+	if cache == nil || !isCacheableRequest(req) || hasCacheDirective(req, "no-cache") ||
+		acceptsEventStream(req) || isMultipartRequest(req) {
+		return false, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		// Internal server error. The stack trace should be captured.
+		return false, errors.WithStack(err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	cached := cache.Get(client.Id, name, cacheKey(req, body))
+	if cached == nil {
+		return false, nil
+	}
+	return true, writeCachedResult(c, cached, cacheStatusHit)
+}
+
+// cacheKey returns the hash of the parts of the request that the cached result is for.
+// The actions may return different results in the formats and the languages that the callers accept,
+// so the Accept and Accept-Language headers are a part of it in addition to the parts that requestHash covers.
+func cacheKey(req *http.Request, body []byte) string {
+	h := sha256.New()
+	for _, s := range []string{requestHash(req, body), req.Header.Get(echo.HeaderAccept), req.Header.Get("Accept-Language")} {
+		_, _ = io.WriteString(h, s)
+		_, _ = h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isCacheableRequest reports whether the result of the request can be served from and stored to the cache.
+func isCacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		return false
+	}
+	return !hasCacheDirective(req, "no-store")
+}
+
+// writeCachedResult writes the cached result with the cache validators.
+// It responds with 304 if the caller already has the same result.
+func writeCachedResult(c echo.Context, cached *router.CachedResult, status string) error {
+	header := c.Response().Header()
+	header.Set("ETag", cached.ETag)
+	// The results are scoped to the token, so the shared caches must not store them.
+	header.Set(echo.HeaderCacheControl, fmt.Sprintf("private, max-age=%d", int(time.Until(cached.ExpiresAt).Round(time.Second).Seconds())))
+	// The result depends on the same headers as the cache key.
+	header.Add(echo.HeaderVary, "Accept, Accept-Language")
+	if status == cacheStatusHit {
+		header.Set("Age", strconv.Itoa(int(time.Since(cached.StoredAt).Seconds())))
+	}
+	header.Set(cacheStatusHeader, status)
+
+	if etagMatches(c.Request().Header.Get("If-None-Match"), cached.ETag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return writeActionResult(c, cached.Result)
+}
+
+// hasCacheDirective reports whether the Cache-Control header of the request has the directive.
+func hasCacheDirective(req *http.Request, directive string) bool {
+	for _, v := range req.Header.Values(echo.HeaderCacheControl) {
+		for _, d := range strings.Split(v, ",") {
+			// ignore the argument of the directive
+			d, _, _ = strings.Cut(d, "=")
+			if strings.EqualFold(strings.TrimSpace(d), directive) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// etagMatches reports whether the If-None-Match header value matches the entity tag.
+// The weak comparison is used as RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// PurgeCacheHandler removes the cached results of the client.
+// If the action name is given, only the results of the action are removed.
+// The result cache is nil if the result caching is disabled.
+func PurgeCacheHandler(cache *router.ResultCache) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		n := 0
+		if cache != nil {
+			n = cache.Purge(auth.MustGetClient(c).Id, c.Param("name"))
+		}
+		return c.JSON(http.StatusOK, &types.CachePurgeResponse{
+			Purged: n,
+		})
+	}
+}
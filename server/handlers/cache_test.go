@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/kohkimakimoto/actions-gateway/server/testutil"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeCachedResult(t *testing.T) {
+	client := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	cache := router.NewResultCache(10)
+	req := httptest.NewRequest(http.MethodPost, "/actions/test", strings.NewReader("body"))
+	cached := cache.Put(client.Id, "test", cacheKey(req, []byte("body")), &types.ActionResult{
+		Status: types.ActionResultStatusSuccess,
+		Body:   "ok",
+	}, time.Minute)
+
+	serve := func(req *http.Request) (bool, *httptest.ResponseRecorder) {
+		e := testutil.NewEchoInstance(t)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		served, err := serveCachedResult(c, cache, client, "test")
+		assert.NoError(t, err)
+		return served, rec
+	}
+
+	t.Run("hit", func(t *testing.T) {
+		served, rec := serve(httptest.NewRequest(http.MethodPost, "/actions/test", strings.NewReader("body")))
+		assert.True(t, served)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "ok", rec.Body.String())
+		assert.Equal(t, "HIT", rec.Header().Get("X-Actions-Gateway-Cache"))
+		assert.Equal(t, cached.ETag, rec.Header().Get("ETag"))
+		assert.Regexp(t, `^private, max-age=\d+$`, rec.Header().Get("Cache-Control"))
+		assert.Equal(t, "0", rec.Header().Get("Age"))
+		assert.Equal(t, "Accept, Accept-Language", rec.Header().Get("Vary"))
+	})
+
+	t.Run("not modified", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/actions/test", strings.NewReader("body"))
+		req.Header.Set("If-None-Match", "W/"+cached.ETag)
+		served, rec := serve(req)
+		assert.True(t, served)
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+		assert.Empty(t, rec.Body.String())
+	})
+
+	t.Run("miss", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/actions/test", strings.NewReader("other"))
+		served, _ := serve(req)
+		assert.False(t, served)
+
+		// the results for the other formats and languages are cached separately
+		for header, value := range map[string]string{"Accept": "text/csv", "Accept-Language": "ja"} {
+			req := httptest.NewRequest(http.MethodPost, "/actions/test", strings.NewReader("body"))
+			req.Header.Set(header, value)
+			served, _ := serve(req)
+			assert.False(t, served, header)
+		}
+	})
+
+	t.Run("no-cache", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/actions/test", strings.NewReader("body"))
+		req.Header.Set("Cache-Control", "no-cache")
+		served, _ := serve(req)
+		assert.False(t, served)
+	})
+
+	t.Run("not cacheable method", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/actions/test", strings.NewReader("body"))
+		served, _ := serve(req)
+		assert.False(t, served)
+	})
+}
+
+func TestEtagMatches(t *testing.T) {
+	testCases := map[string]struct {
+		ifNoneMatch string
+		expected    bool
+	}{
+		"empty":    {ifNoneMatch: "", expected: false},
+		"match":    {ifNoneMatch: `"abc"`, expected: true},
+		"weak":     {ifNoneMatch: `W/"abc"`, expected: true},
+		"list":     {ifNoneMatch: `"xyz", "abc"`, expected: true},
+		"any":      {ifNoneMatch: `*`, expected: true},
+		"no match": {ifNoneMatch: `"xyz"`, expected: false},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, etagMatches(tc.ifNoneMatch, `"abc"`))
+		})
+	}
+}
+
+func TestPurgeCacheHandler(t *testing.T) {
+	clientId := "00000000-0000-0000-0000-000000000001"
+	cache := router.NewResultCache(10)
+	ok := &types.ActionResult{Status: types.ActionResultStatusSuccess}
+	cache.Put(clientId, "action1", "hash1", ok, time.Minute)
+	cache.Put(clientId, "action2", "hash1", ok, time.Minute)
+
+	e := testutil.NewEchoInstance(t)
+	setClient := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// set a client object to the context for testing
+			auth.SetClient(c, &auth.Client{
+				Id: clientId,
+			})
+			return next(c)
+		}
+	}
+	e.DELETE("/cache", PurgeCacheHandler(cache), setClient)
+	e.DELETE("/cache/:name", PurgeCacheHandler(cache), setClient)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/cache/action1", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"purged":1}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/cache", nil))
+	assert.JSONEq(t, `{"purged":1}`, rec.Body.String())
+	assert.Equal(t, 0, cache.Len())
+}
@@ -5,18 +5,39 @@ import (
 	"github.com/kohkimakimoto/actions-gateway/server/router"
 	openapidocs "github.com/kohkimakimoto/echo-openapidocs"
 	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
 	"net/http"
 )
 
+// DocsHandler serves the OpenAPI documentation of the actions of the agents of the client on this server node.
+// If no agent is connected to this node, the request is forwarded to a node that has an agent of the client.
 func DocsHandler(r *router.Router) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		sess := r.GetActiveSession(auth.MustGetClient(c))
-		if sess == nil {
+		client := auth.MustGetClient(c)
+		// The spec merges the actions of the agents of the client that are connected to this node.
+		spec, ok, err := r.Spec(client)
+		if !ok && !r.IsAuthenticatedForward(c.Request()) {
+			// The agents may be connected to another server node.
+			entry, err := r.LookupRemote(client, "", nil)
+			if err != nil {
+				// Internal server error. The stack trace should be captured.
+				return errors.WithStack(err)
+			}
+			if entry != nil {
+				r.Forward(c.Response(), c.Request(), entry)
+				return nil
+			}
+		}
+		if !ok {
 			return c.String(http.StatusServiceUnavailable, "Your client is not connected to the server")
 		}
+		if err != nil {
+			// Internal server error. The stack trace should be captured.
+			return errors.WithStack(err)
+		}
 
 		return openapidocs.ScalarDocumentsHandler(openapidocs.ScalarConfig{
-			Spec: sess.Spec(),
+			Spec: spec,
 		})(c)
 	}
 }
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+)
+
+// idempotencyKeyHeader is the request header that identifies the retries of the same request.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentReplayedHeader is the response header that is set to the responses replayed for the retries.
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength is the maximum length of the idempotency key.
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotencyBodyHashSize is the maximum size of the request body that is buffered to hash it.
+// The larger bodies, such as the uploads, are streamed to the action, and only their first part and length are hashed.
+const maxIdempotencyBodyHashSize = 1 << 20
+
+// withIdempotency wraps the handler to return the same response to the retries of a request
+// that have the same idempotency key, instead of running the handler again.
+// The retries that arrive while the first request is running wait for it to finish.
+// The first request runs even if its caller disconnects, so that the retries can attach to it.
+// The store is nil if the idempotency keys are disabled.
+func withIdempotency(store *router.IdempotencyStore, next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(idempotencyKeyHeader)
+		if store == nil || key == "" {
+			return next(c)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return c.String(http.StatusBadRequest, "The idempotency key is too long")
+		}
+
+		req := c.Request()
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxIdempotencyBodyHashSize+1))
+		if err != nil {
+			// Internal server error. The stack trace should be captured.
+			return errors.WithStack(err)
+		}
+		hashed := body
+		if len(body) > maxIdempotencyBodyHashSize {
+			req.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+			hashed = fmt.Appendf(body[:maxIdempotencyBodyHashSize:maxIdempotencyBodyHashSize], "\x00%d", req.ContentLength)
+		} else {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		client := auth.MustGetClient(c)
+		entry, stored, err := store.Begin(req.Context(), client.Id, key, requestHash(req, hashed))
+		if err != nil {
+			if errors.Is(err, router.ErrIdempotencyKeyMismatch) {
+				return c.String(http.StatusUnprocessableEntity, "The idempotency key was used for a different request")
+			}
+			// The caller disconnected while waiting for the first request.
+			return nil
+		}
+		if stored != nil {
+			c.Logger().Debugf("Replayed the response for the idempotency key: %s", key)
+			return replayResponse(c, stored)
+		}
+
+		// The invocation is detached from the caller, and the handlers bound it by the timeouts of the actions.
+		c.SetRequest(req.WithContext(context.WithoutCancel(req.Context())))
+		defer c.SetRequest(req)
+
+		w := &captureWriter{ResponseWriter: c.Response().Writer, limit: store.MaxBytes()}
+		c.Response().Writer = w
+		err = next(c)
+		c.Response().Writer = w.ResponseWriter
+
+		res := c.Response()
+		if err != nil || !res.Committed || isRetryableStatus(res.Status) || w.overflow {
+			// The action did not run to the end, so the retry runs it.
+			store.Abort(entry)
+			return err
+		}
+		store.Complete(entry, &router.StoredResponse{
+			StatusCode: res.Status,
+			Header:     res.Header().Clone(),
+			Body:       w.buf.Bytes(),
+		})
+		return nil
+	}
+}
+
+// isRetryableStatus reports whether the response status means that the request did not reach the action,
+// such as when the client was unavailable or busy.
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusBadGateway || status == http.StatusServiceUnavailable
+}
+
+// requestHash returns the hash of the parts of the request that the retries must repeat.
+func requestHash(req *http.Request, body []byte) string {
+	h := sha256.New()
+	for _, s := range []string{req.Method, req.URL.Path, req.URL.RawQuery, req.Header.Get(selectorHeader), req.Header.Get("Prefer")} {
+		_, _ = io.WriteString(h, s)
+		_, _ = h.Write([]byte{0})
+	}
+	_, _ = h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func replayResponse(c echo.Context, stored *router.StoredResponse) error {
+	header := c.Response().Header()
+	for k, v := range stored.Header {
+		header[k] = v
+	}
+	header.Set(idempotentReplayedHeader, "true")
+	c.Response().WriteHeader(stored.StatusCode)
+	_, err := c.Response().Write(stored.Body)
+	return err
+}
+
+// captureWriter is a http.ResponseWriter that keeps a copy of the response body.
+// It keeps writing the copy after the caller disconnected, so that the response is stored for the retries.
+type captureWriter struct {
+	http.ResponseWriter
+	buf bytes.Buffer
+	// limit is the maximum size of the copy. Zero means no limit.
+	limit int
+	// overflow is true if the response body is larger than the limit. The copy is dropped then.
+	overflow bool
+	// lost is true after writing to the caller failed
+	lost bool
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if w.limit > 0 && w.buf.Len()+len(b) > w.limit {
+			w.overflow = true
+			w.buf = bytes.Buffer{}
+		} else {
+			w.buf.Write(b)
+		}
+	}
+	if !w.lost {
+		if _, err := w.ResponseWriter.Write(b); err != nil {
+			w.lost = true
+		}
+	}
+	return len(b), nil
+}
+
+// Unwrap returns the original http.ResponseWriter for http.ResponseController, which flushes the streaming output.
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// readCloser is an io.ReadCloser that reads from Reader and closes Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
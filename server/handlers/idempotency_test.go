@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"context"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/kohkimakimoto/actions-gateway/server/testutil"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithIdempotency(t *testing.T) {
+	newEcho := func(t *testing.T, store *router.IdempotencyStore, handler echo.HandlerFunc) *echo.Echo {
+		e := testutil.NewEchoInstance(t)
+		e.HTTPErrorHandler = HTTPErrorHandler
+		e.POST("/actions/:name", withIdempotency(store, handler), func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				// set a client object to the context for testing
+				auth.SetClient(c, &auth.Client{
+					Id: "00000000-0000-0000-0000-000000000001",
+				})
+				return next(c)
+			}
+		})
+		return e
+	}
+	request := func(e *echo.Echo, key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/actions/test", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("the retry returns the stored response", func(t *testing.T) {
+		runs := 0
+		e := newEcho(t, router.NewIdempotencyStore(time.Minute), func(c echo.Context) error {
+			runs++
+			b, _ := io.ReadAll(c.Request().Body)
+			c.Response().Header().Set("X-Test", "test")
+			return c.String(http.StatusCreated, "run "+string(b))
+		})
+
+		rec := request(e, "key1", "body1")
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Equal(t, "run body1", rec.Body.String())
+		assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+
+		rec = request(e, "key1", "body1")
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Equal(t, "run body1", rec.Body.String())
+		assert.Equal(t, "test", rec.Header().Get("X-Test"))
+		assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, 1, runs)
+
+		// the same key with a different body
+		rec = request(e, "key1", "body2")
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		assert.Equal(t, 1, runs)
+
+		// the requests without the key always run
+		request(e, "", "body1")
+		request(e, "", "body1")
+		assert.Equal(t, 3, runs)
+	})
+
+	t.Run("the unavailable client is not remembered", func(t *testing.T) {
+		runs := 0
+		e := newEcho(t, router.NewIdempotencyStore(time.Minute), func(c echo.Context) error {
+			runs++
+			return c.String(http.StatusServiceUnavailable, "The session is not active")
+		})
+		request(e, "key1", "body1")
+		request(e, "key1", "body1")
+		assert.Equal(t, 2, runs)
+	})
+
+	t.Run("the retry attaches to the request whose caller disconnected", func(t *testing.T) {
+		runs := 0
+		proceed := make(chan struct{})
+		started := make(chan struct{})
+		e := newEcho(t, router.NewIdempotencyStore(time.Minute), func(c echo.Context) error {
+			runs++
+			close(started)
+			<-proceed
+			if err := c.Request().Context().Err(); err != nil {
+				return c.String(http.StatusInternalServerError, err.Error())
+			}
+			return c.String(http.StatusOK, "done")
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest(http.MethodPost, "/actions/test", strings.NewReader("body1")).WithContext(ctx)
+		req.Header.Set("Idempotency-Key", "key1")
+		go e.ServeHTTP(httptest.NewRecorder(), req)
+		<-started
+
+		// the first caller disconnects while the action is running
+		cancel()
+		retry := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			retry <- request(e, "key1", "body1")
+		}()
+		close(proceed)
+
+		select {
+		case rec := <-retry:
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "done", rec.Body.String())
+			assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+		case <-time.After(5 * time.Second):
+			t.Fatal("the retry did not return")
+		}
+		assert.Equal(t, 1, runs)
+	})
+
+	t.Run("large body", func(t *testing.T) {
+		var received []byte
+		e := newEcho(t, router.NewIdempotencyStore(time.Minute), func(c echo.Context) error {
+			received, _ = io.ReadAll(c.Request().Body)
+			return c.NoContent(http.StatusOK)
+		})
+		body := strings.Repeat("a", maxIdempotencyBodyHashSize+10)
+		rec := request(e, "key1", body)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		// the whole body reaches the handler
+		assert.Equal(t, body, string(received))
+
+		rec = request(e, "key1", body)
+		assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+		// the body of a different length is a different request
+		rec = request(e, "key1", body+"a")
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	})
+
+	t.Run("too long key", func(t *testing.T) {
+		e := newEcho(t, router.NewIdempotencyStore(time.Minute), func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		})
+		rec := request(e, strings.Repeat("a", 256), "body1")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		runs := 0
+		e := newEcho(t, nil, func(c echo.Context) error {
+			runs++
+			return c.NoContent(http.StatusOK)
+		})
+		request(e, "key1", "body1")
+		request(e, "key1", "body1")
+		assert.Equal(t, 2, runs)
+	})
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// GetJobHandler returns the job or the deferred job.
+// The deferred queue dq is nil if the durable invocations are disabled.
+// The request for the job of another server node is forwarded to the node.
+func GetJobHandler(r *router.Router, jm *router.JobManager, dq *router.DeferredQueue) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		client := auth.MustGetClient(c)
+		if job := jm.Get(client, c.Param("id")); job != nil {
+			return c.JSON(http.StatusOK, job.Response())
+		}
+		if dq != nil {
+			if job := dq.Get(client, c.Param("id")); job != nil {
+				return c.JSON(http.StatusOK, dq.Response(job))
+			}
+		}
+		if forwarded, err := forwardJobRequest(c, r); forwarded || err != nil {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusNotFound, "The job is not found")
+	}
+}
+
+// DeleteJobHandler cancels and removes the job or the deferred job.
+// The deferred queue dq is nil if the durable invocations are disabled.
+// The request for the job of another server node is forwarded to the node.
+func DeleteJobHandler(r *router.Router, jm *router.JobManager, dq *router.DeferredQueue) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		client := auth.MustGetClient(c)
+		if jm.Delete(client, c.Param("id")) {
+			return c.NoContent(http.StatusNoContent)
+		}
+		if dq != nil && dq.Delete(client, c.Param("id")) {
+			return c.NoContent(http.StatusNoContent)
+		}
+		if forwarded, err := forwardJobRequest(c, r); forwarded || err != nil {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusNotFound, "The job is not found")
+	}
+}
+
+// forwardJobRequest forwards the request for the job to the node that created it.
+// It returns false if the job was created by this node or its node is not found.
+func forwardJobRequest(c echo.Context, r *router.Router) (bool, error) {
+	if r.IsAuthenticatedForward(c.Request()) {
+		return false, nil
+	}
+	forwarded, err := r.ForwardToNode(c.Response(), c.Request(), router.NodeIdOf(c.Param("id")))
+	if err != nil {
+		// Internal server error. The stack trace should be captured.
+		return false, errors.WithStack(err)
+	}
+	return forwarded, nil
+}
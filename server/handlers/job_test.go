@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/kohkimakimoto/actions-gateway/server/testutil"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetJobHandler(t *testing.T) {
+	t.Run("returns not found when the job does not exist", func(t *testing.T) {
+		e := testutil.NewEchoInstance(t)
+		e.HTTPErrorHandler = HTTPErrorHandler
+		jm := router.NewJobManager()
+		e.GET("/jobs/:id", GetJobHandler(router.New(), jm, nil), func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				// set a client object to the context for testing
+				auth.SetClient(c, &auth.Client{
+					Id: "00000000-0000-0000-0000-000000000001",
+				})
+				return next(c)
+			}
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/jobs/00000000-0000-0000-0000-000000000003", nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.JSONEq(t, `{"error":"The job is not found"}`, rec.Body.String())
+	})
+
+	t.Run("forwards the request for the job of another node", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte(req.Method + " " + req.URL.Path + " from " + req.Header.Get(router.ForwardedHeader)))
+		}))
+		defer ts.Close()
+		reg := router.NewMemoryRegistry()
+		r := router.New(router.WithRegistry(reg), router.WithNode("node1", "http://node1"), router.WithForwardKey([]byte("secret")))
+		r2 := router.New(router.WithRegistry(reg), router.WithNode("node2", ts.URL), router.WithForwardKey([]byte("secret")))
+
+		e := testutil.NewEchoInstance(t)
+		e.HTTPErrorHandler = HTTPErrorHandler
+		jm := router.NewJobManager()
+		setClient := func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				// set a client object to the context for testing
+				auth.SetClient(c, &auth.Client{
+					Id: "00000000-0000-0000-0000-000000000001",
+				})
+				return next(c)
+			}
+		}
+		e.GET("/jobs/:id", GetJobHandler(r, jm, nil), setClient)
+		e.DELETE("/jobs/:id", DeleteJobHandler(r, jm, nil), setClient)
+
+		for _, method := range []string{http.MethodGet, http.MethodDelete} {
+			req := httptest.NewRequest(method, "/jobs/node2.00000000-0000-0000-0000-000000000003", nil)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, method+" /jobs/node2.00000000-0000-0000-0000-000000000003 from node1", rec.Body.String())
+		}
+
+		// the job of an unknown node is not found
+		req := httptest.NewRequest(http.MethodGet, "/jobs/node3.00000000-0000-0000-0000-000000000003", nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		// the forwarded request is never forwarded again
+		req = httptest.NewRequest(http.MethodGet, "/jobs/node2.00000000-0000-0000-0000-000000000003", nil)
+		r2.SignForward(req)
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		// the forwarding header without a valid signature is not trusted
+		req = httptest.NewRequest(http.MethodGet, "/jobs/node2.00000000-0000-0000-0000-000000000003", nil)
+		req.Header.Set(router.ForwardedHeader, "node2")
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "GET /jobs/node2.00000000-0000-0000-0000-000000000003 from node1", rec.Body.String())
+	})
+}
+
+func TestDeleteJobHandler(t *testing.T) {
+	t.Run("returns not found when the job does not exist", func(t *testing.T) {
+		e := testutil.NewEchoInstance(t)
+		e.HTTPErrorHandler = HTTPErrorHandler
+		jm := router.NewJobManager()
+		e.DELETE("/jobs/:id", DeleteJobHandler(router.New(), jm, nil), func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				// set a client object to the context for testing
+				auth.SetClient(c, &auth.Client{
+					Id: "00000000-0000-0000-0000-000000000001",
+				})
+				return next(c)
+			}
+		})
+
+		req := httptest.NewRequest(http.MethodDelete, "/jobs/00000000-0000-0000-0000-000000000003", nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"github.com/kohkimakimoto/actions-gateway/metrics"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// MetricsHandler responds with the metrics in the Prometheus text format.
+func MetricsHandler(reg *metrics.Registry) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentType, metrics.ContentType)
+		c.Response().WriteHeader(http.StatusOK)
+		return reg.Write(c.Response())
+	}
+}
@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"github.com/kohkimakimoto/actions-gateway/metrics"
+	"github.com/kohkimakimoto/actions-gateway/server/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	reg := metrics.NewRegistry()
+	reg.NewCounter("test_total", "The test counter.").Inc()
+
+	e := testutil.NewEchoInstance(t)
+	e.GET("/metrics", MetricsHandler(reg))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, metrics.ContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "# HELP test_total The test counter.\n# TYPE test_total counter\ntest_total 1\n", rec.Body.String())
+}
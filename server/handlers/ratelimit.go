@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/labstack/echo/v4"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ForwardAuthMiddleware removes the headers of the forwarded requests whose signature is invalid,
+// so that the callers can not skip the forwarding to the other nodes or the rate limits by setting them.
+func ForwardAuthMiddleware(r *router.Router) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r.DropUnauthenticatedForward(c.Request())
+			return next(c)
+		}
+	}
+}
+
+// RateLimitMiddleware limits the rate of the requests per client, per action and per source IP address.
+// The rate limit of an action that the client declares overrides the default one.
+// The requests that another node forwarded are not limited, because the node has already limited them.
+// It must be used after the token authentication.
+func RateLimitMiddleware(limiter *router.RateLimiter, r *router.Router) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if r.IsAuthenticatedForward(c.Request()) {
+				return next(c)
+			}
+			client := auth.MustGetClient(c)
+			checks := []*router.RateLimitCheck{
+				{Scope: router.RateLimitScopeClient, Key: client.Id, Limit: limiter.Limit(router.RateLimitScopeClient)},
+				{Scope: router.RateLimitScopeIP, Key: c.RealIP(), Limit: limiter.Limit(router.RateLimitScopeIP)},
+			}
+			if name := c.Param("name"); name != "" {
+				checks = append(checks, actionRateLimitCheck(limiter, r, client, name))
+			}
+
+			decision := limiter.Allow(checks...)
+			if decision == nil {
+				return next(c)
+			}
+			header := c.Response().Header()
+			header.Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+			header.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+			header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+			if !decision.Allowed {
+				c.Logger().Infof("Rate limit exceeded: %s (%s)", client.Id, decision.Scope)
+				header.Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(decision.RetryAfter))))
+				return c.String(http.StatusTooManyRequests, "Too many requests")
+			}
+			return next(c)
+		}
+	}
+}
+
+// actionRateLimitCheck returns the check of the rate limit of the action of the client.
+func actionRateLimitCheck(limiter *router.RateLimiter, r *router.Router, client *auth.Client, name string) *router.RateLimitCheck {
+	limit := limiter.Limit(router.RateLimitScopeAction)
+	if l := actionRateLimit(r, client, name); l != nil {
+		limit = l
+	}
+	return &router.RateLimitCheck{Scope: router.RateLimitScopeAction, Key: client.Id + "/" + name, Limit: limit}
+}
+
+// actionRateLimit returns the rate limit that the action declares on the first session of the client that advertises it.
+func actionRateLimit(r *router.Router, client *auth.Client, name string) *types.RateLimit {
+	for _, sess := range r.ActiveSessions(client) {
+		if sess.IsActionExist(name) {
+			return sess.ActionRateLimit(name)
+		}
+	}
+	return nil
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
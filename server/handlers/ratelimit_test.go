@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/kohkimakimoto/actions-gateway/server/testutil"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	newEcho := func(t *testing.T, limiter *router.RateLimiter) *echo.Echo {
+		e := testutil.NewEchoInstance(t)
+		e.HTTPErrorHandler = HTTPErrorHandler
+		e.POST("/actions/:name", func(c echo.Context) error {
+			return c.String(http.StatusOK, "ok")
+		}, func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				// set a client object to the context for testing
+				auth.SetClient(c, &auth.Client{
+					Id: "00000000-0000-0000-0000-000000000001",
+				})
+				return next(c)
+			}
+		}, RateLimitMiddleware(limiter, router.New()))
+		return e
+	}
+	request := func(e *echo.Echo, name string, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/actions/"+name, nil)
+		req.Header.Set(echo.HeaderXRealIP, ip)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("no rate limits", func(t *testing.T) {
+		e := newEcho(t, router.NewRateLimiter())
+		for i := 0; i < 3; i++ {
+			rec := request(e, "test", "192.0.2.1")
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+		}
+	})
+
+	t.Run("reject the requests over the client limit", func(t *testing.T) {
+		limiter := router.NewRateLimiter(
+			router.WithRateLimit(router.RateLimitScopeClient, &types.RateLimit{Count: 2, Period: time.Minute}),
+		)
+		e := newEcho(t, limiter)
+
+		rec := request(e, "test", "192.0.2.1")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "2", rec.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "1", rec.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "30", rec.Header().Get("RateLimit-Reset"))
+
+		rec = request(e, "other", "192.0.2.2")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+
+		rec = request(e, "test", "192.0.2.1")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+		assert.Equal(t, int64(1), limiter.Rejected()[router.RateLimitScopeClient])
+	})
+
+	t.Run("reject the requests over the action limit", func(t *testing.T) {
+		limiter := router.NewRateLimiter(
+			router.WithRateLimit(router.RateLimitScopeAction, &types.RateLimit{Count: 1, Period: time.Second}),
+		)
+		e := newEcho(t, limiter)
+
+		assert.Equal(t, http.StatusOK, request(e, "test", "192.0.2.1").Code)
+		rec := request(e, "test", "192.0.2.1")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+		// the other action has its own limit
+		assert.Equal(t, http.StatusOK, request(e, "other", "192.0.2.1").Code)
+	})
+
+	t.Run("reject the requests over the ip limit", func(t *testing.T) {
+		limiter := router.NewRateLimiter(
+			router.WithRateLimit(router.RateLimitScopeIP, &types.RateLimit{Count: 1, Period: time.Hour}),
+		)
+		e := newEcho(t, limiter)
+
+		assert.Equal(t, http.StatusOK, request(e, "test", "192.0.2.1").Code)
+		assert.Equal(t, http.StatusTooManyRequests, request(e, "other", "192.0.2.1").Code)
+		// the other caller has its own limit
+		assert.Equal(t, http.StatusOK, request(e, "test", "192.0.2.2").Code)
+		assert.Equal(t, int64(1), limiter.Rejected()[router.RateLimitScopeIP])
+	})
+}
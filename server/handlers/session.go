@@ -1,7 +1,6 @@
 package handlers
 
 import (
-	"github.com/gorilla/websocket"
 	"github.com/kohkimakimoto/actions-gateway/server/auth"
 	"github.com/kohkimakimoto/actions-gateway/server/config"
 	"github.com/kohkimakimoto/actions-gateway/server/router"
@@ -23,7 +22,7 @@ func SessionNewHandler(cfg *config.Config, r *router.Router) echo.HandlerFunc {
 
 		// create a new session
 		client := auth.MustGetClient(c)
-		sess, err := r.NewSession(client, req.Actions, req.Spec)
+		sess, err := r.NewSession(client, req)
 		if err != nil {
 			var sessErr *router.SessionError
 			if errors.As(err, &sessErr) {
@@ -33,10 +32,12 @@ func SessionNewHandler(cfg *config.Config, r *router.Router) echo.HandlerFunc {
 			return errors.WithStack(err)
 		}
 
-		c.Logger().Infof("New session created: %s", sess.Key())
+		c.Logger().Infof("New session created: %s (protocol version %d)", sess.Key(), sess.ProtocolVersion())
 
 		return c.JSON(http.StatusOK, &types.SessionNewResponse{
-			URL: cfg.WebSocketURL() + sess.ConnectPath(),
+			URL:             cfg.NodeWebSocketURL() + sess.ConnectPath(),
+			ProtocolVersion: sess.ProtocolVersion(),
+			Capabilities:    sess.Capabilities(),
 		})
 	}
 }
@@ -84,23 +85,39 @@ func SessionConnectHandler(r *router.Router) echo.HandlerFunc {
 
 		ticker := time.NewTicker(pingPeriod)
 		defer ticker.Stop()
+		done := make(chan struct{})
+		defer close(done)
 
 		go func() {
-			for range ticker.C {
-				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-					c.Logger().Infof("Failed to send Ping message: %v", err)
+			for {
+				select {
+				case <-ticker.C:
+					// A failed ping does not end the session by itself.
+					// The session ends when the read deadline passes without a pong message.
+					if err := sess.Ping(); err != nil {
+						c.Logger().Infof("Failed to send Ping message: %v", err)
+					}
+				case <-done:
 					return
 				}
 			}
 		}()
 
 		for {
-			_, _, err := conn.ReadMessage()
+			_, message, err := conn.ReadMessage()
 			if err != nil {
 				// terminate the session
 				c.Logger().Infof("Session disconnected: %s, %v", sId, err)
 				break
 			}
+			if err := sess.HandleMessage(message); err != nil {
+				if errors.Is(err, router.ErrResultChannelNotFound) {
+					// The message arrived after the request was canceled or timed out.
+					c.Logger().Debugf("Discarded the late message: %s", message)
+					continue
+				}
+				c.Logger().Warnf("Failed to handle the message from the client: %v", err)
+			}
 		}
 
 		return nil
@@ -34,8 +34,9 @@ func TestSessionNewHandler(t *testing.T) {
 		})
 
 		reqBody := &types.SessionNewRequest{
-			Actions: []string{"action1", "action2"},
-			Spec:    "",
+			Actions:          []string{"action1", "action2"},
+			Spec:             "",
+			ProtocolVersions: types.SupportedProtocolVersions,
 		}
 		b, _ := json.Marshal(reqBody)
 		req := httptest.NewRequest(http.MethodPost, "/api/session/new", bytes.NewBuffer(b))
@@ -48,6 +49,7 @@ func TestSessionNewHandler(t *testing.T) {
 		err := json.Unmarshal(rec.Body.Bytes(), resp)
 		assert.NoError(t, err)
 		assert.Equal(t, "ws://localhost:18800/api/session/connect/00000000-0000-0000-0000-000000000001/00000000-0000-0000-0000-000000000002", resp.URL)
+		assert.Equal(t, types.ProtocolVersion2, resp.ProtocolVersion)
 	})
 
 	t.Run("invalid request", func(t *testing.T) {
@@ -81,7 +83,7 @@ func TestSessionNewHandler(t *testing.T) {
 			Id: "00000000-0000-0000-0000-000000000001",
 		}
 		// create a new session before calling the handler
-		_, _ = r.NewSession(ct, []string{"action1", "action2"}, "")
+		_, _ = r.NewSession(ct, &types.SessionNewRequest{Actions: []string{"action1", "action2"}})
 
 		e.POST("/api/session/new", SessionNewHandler(cfg, r), func(next echo.HandlerFunc) echo.HandlerFunc {
 			return func(c echo.Context) error {
@@ -106,6 +108,35 @@ func TestSessionNewHandler(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, "Session already exists", resp.Error)
 	})
+
+	t.Run("unsupported protocol version", func(t *testing.T) {
+		e := testutil.NewEchoInstance(t)
+		e.HTTPErrorHandler = HTTPErrorHandler
+		cfg := &config.Config{
+			URL: "http://localhost:18800",
+		}
+		r := router.New()
+		ct := &auth.Client{
+			Id: "00000000-0000-0000-0000-000000000001",
+		}
+		e.POST("/api/session/new", SessionNewHandler(cfg, r), func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				// set a client object to the context for testing
+				auth.SetClient(c, ct)
+				return next(c)
+			}
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/api/session/new", bytes.NewBufferString(`{"actions":[],"protocol_versions":[99]}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		resp := &types.ErrorResponse{}
+		err := json.Unmarshal(rec.Body.Bytes(), resp)
+		assert.NoError(t, err)
+		assert.Equal(t, "Unsupported protocol version: the client supports [99], but the server supports [2 1]", resp.Error)
+	})
 }
 
 // TODO: websocket connection test
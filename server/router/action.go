@@ -9,6 +9,8 @@ type GenActionIdFunc func() (uuid.UUID, error)
 
 type ActionMessageFactory struct {
 	genActionId GenActionIdFunc
+	// nodeId is the id of the node that is prefixed to the action message ids
+	nodeId string
 }
 
 type ActionMessageFactoryOption func(*ActionMessageFactory)
@@ -21,6 +23,14 @@ func WithActionId(aId string) ActionMessageFactoryOption {
 	}
 }
 
+// WithActionNode prefixes the action message ids with the id of the node, so that the other nodes can forward
+// the results that the clients of protocol version 1 send via HTTP to the node that awaits them.
+func WithActionNode(nodeId string) ActionMessageFactoryOption {
+	return func(f *ActionMessageFactory) {
+		f.nodeId = nodeId
+	}
+}
+
 func NewActionMessageFactory(options ...ActionMessageFactoryOption) *ActionMessageFactory {
 	f := &ActionMessageFactory{
 		genActionId: uuid.NewV7,
@@ -37,7 +47,7 @@ func (f *ActionMessageFactory) NewMessage(name string, body string) (*types.Acti
 		return nil, err
 	}
 	return &types.ActionMessage{
-		Id:   UUID.String(),
+		Id:   withNodeId(f.nodeId, UUID.String()),
 		Name: name,
 		Body: body,
 	}, nil
@@ -13,3 +13,11 @@ func TestActionMessageFactory_NewMessage(t *testing.T) {
 	assert.Equal(t, "action name", msg.Name)
 	assert.Equal(t, "action body", msg.Body)
 }
+
+func TestActionMessageFactory_NewMessageWithNode(t *testing.T) {
+	f := NewActionMessageFactory(WithActionId("00000000-0000-0000-0000-000000000001"), WithActionNode("node1"))
+	msg, err := f.NewMessage("action name", "action body")
+	assert.NoError(t, err)
+	assert.Equal(t, "node1.00000000-0000-0000-0000-000000000001", msg.Id)
+	assert.Equal(t, "node1", NodeIdOf(msg.Id))
+}
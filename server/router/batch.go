@@ -0,0 +1,110 @@
+package router
+
+import (
+	"context"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BatchInvocation is an action message of a batch and the client to invoke it on.
+type BatchInvocation struct {
+	// Client is the client whose sessions the action message is invoked on
+	Client *auth.Client
+	// Message is the action message
+	Message *types.ActionMessage
+	// Timeout is the execution timeout of the action
+	Timeout time.Duration
+	// Forward invokes the action message on another node and returns its result.
+	// It is nil if the action message is invoked on the sessions on this node.
+	Forward func() *types.BatchResult
+}
+
+// Batch invokes the action messages of a batch and waits for all the results.
+// The action messages are invoked concurrently, or one after another in order if sequential is true.
+// The session of each action message is selected when it is invoked, so that the load is spread over the sessions
+// and the sessions that closed while the earlier action messages ran are not used. Like Invoke, an action message is invoked again on another session that matches the selector
+// if its session is closed. The results are in the same order as the invocations,
+// and the result is nil for a nil invocation. The actions that do not finish before the context is done
+// are reported as timeout, and the ones that have not started are not invoked.
+// The invocations that have Forward are forwarded to another node instead.
+func (r *Router) Batch(ctx context.Context, invocations []*BatchInvocation, selector Selector, sequential bool) []*types.BatchResult {
+	results := make([]*types.BatchResult, len(invocations))
+	invoke := func(i int) {
+		inv := invocations[i]
+		if ctx.Err() != nil {
+			results[i] = newBatchResult(inv.Message.Name, nil, ctx.Err())
+			return
+		}
+		if inv.Forward != nil {
+			// The other node applies the execution timeout of the action.
+			start := time.Now()
+			results[i] = inv.Forward()
+			results[i].DurationMs = time.Since(start).Milliseconds()
+			return
+		}
+		sess := r.SelectSession(inv.Client, inv.Message.Name, selector)
+		if sess == nil {
+			results[i] = &types.BatchResult{
+				Name:       inv.Message.Name,
+				Status:     types.JobStatusFailed,
+				StatusCode: http.StatusServiceUnavailable,
+				Body:       "The client disconnected before running the action",
+			}
+			return
+		}
+		if !sess.IsMethodAllowed(inv.Message.Name, inv.Message.Method) {
+			results[i] = &types.BatchResult{
+				Name:       inv.Message.Name,
+				Status:     types.JobStatusFailed,
+				StatusCode: http.StatusMethodNotAllowed,
+				Body:       "The method is not allowed for the action",
+			}
+			return
+		}
+		start := time.Now()
+		ictx, cancel := context.WithTimeout(ctx, inv.Timeout)
+		defer cancel()
+		result, err := r.Invoke(ictx, sess, inv.Message, selector)
+		results[i] = newBatchResult(inv.Message.Name, result, err)
+		results[i].DurationMs = time.Since(start).Milliseconds()
+	}
+
+	if sequential {
+		for i, inv := range invocations {
+			if inv != nil {
+				invoke(i)
+			}
+		}
+		return results
+	}
+
+	// Each goroutine writes to its own index of the results, so that no lock is needed.
+	var wg sync.WaitGroup
+	for i, inv := range invocations {
+		if inv == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			invoke(i)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func newBatchResult(name string, result *types.ActionResult, err error) *types.BatchResult {
+	// The results are classified in the same way as the broadcast results.
+	br := newBroadcastResult(result, err)
+	return &types.BatchResult{
+		Name:         name,
+		Status:       br.Status,
+		StatusCode:   br.StatusCode,
+		Body:         br.Body,
+		BodyEncoding: br.BodyEncoding,
+	}
+}
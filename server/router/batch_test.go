@@ -0,0 +1,119 @@
+package router
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRouter_Batch(t *testing.T) {
+	r := New()
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	sess, err := r.NewSession(ct, &types.SessionNewRequest{
+		Actions:          []string{"action1", "action2", "slow", "getter"},
+		ProtocolVersions: []int{types.ProtocolVersion2},
+		Options: map[string]*types.ActionOptions{
+			"getter": {Methods: []string{http.MethodGet}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client returns the results of the actions except for "slow"
+	var mu sync.Mutex
+	var received []string
+	sess.conn = testWebsocketConn(t, func(message []byte) {
+		env, err := types.ParseEnvelope(message)
+		assert.NoError(t, err)
+		if env.Type != types.MessageTypeAction {
+			return
+		}
+		msg := &types.ActionMessage{}
+		assert.NoError(t, env.DecodePayload(msg))
+		mu.Lock()
+		received = append(received, msg.Name)
+		mu.Unlock()
+		if msg.Name == "slow" {
+			return
+		}
+		go func() {
+			assert.NoError(t, sess.HandleActionResult(&types.ActionResult{
+				Id:     env.Id,
+				Status: types.ActionResultStatusSuccess,
+				Body:   "ok " + msg.Name,
+			}))
+		}()
+	})
+
+	newInvocations := func(timeout time.Duration, names ...string) []*BatchInvocation {
+		invocations := make([]*BatchInvocation, len(names))
+		for i, name := range names {
+			if name == "" {
+				continue
+			}
+			invocations[i] = &BatchInvocation{
+				Client:  ct,
+				Message: &types.ActionMessage{Id: uuid.NewString(), Name: name, Method: http.MethodPost},
+				Timeout: timeout,
+			}
+		}
+		return invocations
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		results := r.Batch(context.Background(), newInvocations(100*time.Millisecond, "action1", "", "slow", "action2"), nil, false)
+		assert.Len(t, results, 4)
+		assert.Equal(t, "action1", results[0].Name)
+		assert.Equal(t, types.JobStatusSucceeded, results[0].Status)
+		assert.Equal(t, "ok action1", results[0].Body)
+		assert.Nil(t, results[1])
+		assert.Equal(t, types.JobStatusTimeout, results[2].Status)
+		assert.GreaterOrEqual(t, results[2].DurationMs, int64(100))
+		assert.Equal(t, "ok action2", results[3].Body)
+	})
+
+	t.Run("sequential", func(t *testing.T) {
+		mu.Lock()
+		received = nil
+		mu.Unlock()
+
+		// the overall deadline passes while "slow" is running, so "action2" is not invoked
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		results := r.Batch(ctx, newInvocations(time.Second, "action1", "slow", "action2"), nil, true)
+		assert.Len(t, results, 3)
+		assert.Equal(t, types.JobStatusSucceeded, results[0].Status)
+		assert.Equal(t, types.JobStatusTimeout, results[1].Status)
+		assert.Equal(t, types.JobStatusTimeout, results[2].Status)
+		assert.Equal(t, int64(0), results[2].DurationMs)
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, []string{"action1", "slow"}, received)
+	})
+
+	t.Run("method", func(t *testing.T) {
+		invocations := newInvocations(100*time.Millisecond, "getter", "getter")
+		invocations[1].Message.Method = http.MethodGet
+		results := r.Batch(context.Background(), invocations, nil, false)
+		assert.Equal(t, http.StatusMethodNotAllowed, results[0].StatusCode)
+		assert.Equal(t, types.JobStatusSucceeded, results[1].Status)
+		assert.Equal(t, "ok getter", results[1].Body)
+	})
+
+	t.Run("the session is selected at dispatch", func(t *testing.T) {
+		r.CloseSession(sess)
+		results := r.Batch(context.Background(), newInvocations(100*time.Millisecond, "action1"), nil, false)
+		assert.Equal(t, types.JobStatusFailed, results[0].Status)
+		assert.Equal(t, http.StatusServiceUnavailable, results[0].StatusCode)
+	})
+}
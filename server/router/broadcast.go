@@ -0,0 +1,69 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Broadcast invokes the action messages on their sessions concurrently and waits for all the results.
+// The key of the invocations map is the session to invoke the action message on.
+// The sessions that do not return the result before the context is done are reported as timeout,
+// and the running actions on them are canceled. The results are keyed by session id.
+func Broadcast(ctx context.Context, invocations map[*Session]*types.ActionMessage) map[string]*types.BroadcastResult {
+	results := make(map[string]*types.BroadcastResult, len(invocations))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for sess, msg := range invocations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			result, err := sess.Invoke(ctx, msg)
+			br := newBroadcastResult(result, err)
+			br.Labels = sess.Labels()
+			br.DurationMs = time.Since(start).Milliseconds()
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[sess.id] = br
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func newBroadcastResult(result *types.ActionResult, err error) *types.BroadcastResult {
+	if err != nil {
+		status := types.JobStatusFailed
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = types.JobStatusTimeout
+		}
+		return &types.BroadcastResult{
+			Status: status,
+			Body:   invokeErrorMessage(err),
+		}
+	}
+
+	if result.Status == types.ActionResultStatusBusy {
+		return &types.BroadcastResult{
+			Status:     types.JobStatusFailed,
+			StatusCode: http.StatusTooManyRequests,
+			Body:       "The client is busy",
+		}
+	}
+
+	br := &types.BroadcastResult{
+		Status:     types.JobStatusSucceeded,
+		StatusCode: result.StatusCode,
+	}
+	if result.Status != types.ActionResultStatusSuccess {
+		br.Status = types.JobStatusFailed
+	}
+	// The binary result is encoded in base64 to return it in JSON.
+	br.Body, br.BodyEncoding = types.EncodeBody(result.Body)
+	return br
+}
@@ -0,0 +1,69 @@
+package router
+
+import (
+	"context"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBroadcast(t *testing.T) {
+	r := New()
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	newSession := func(labels map[string]string) *Session {
+		sess, err := r.NewSession(ct, &types.SessionNewRequest{
+			Actions:          []string{"action1"},
+			ProtocolVersions: []int{types.ProtocolVersion2},
+			Labels:           labels,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sess
+	}
+
+	// the client that returns the result
+	succeeded := newSession(map[string]string{"host": "nas"})
+	succeeded.conn = testWebsocketConn(t, func(message []byte) {
+		env, err := types.ParseEnvelope(message)
+		assert.NoError(t, err)
+		if env.Type != types.MessageTypeAction {
+			return
+		}
+		assert.NoError(t, succeeded.HandleActionResult(&types.ActionResult{
+			Id:     env.Id,
+			Status: types.ActionResultStatusSuccess,
+			Body:   "ok",
+		}))
+	})
+	// the client that disconnects
+	disconnected := newSession(map[string]string{"host": "laptop"})
+	disconnected.conn = testWebsocketConn(t, func(message []byte) {
+		r.CloseSession(disconnected)
+	})
+	// the client that never returns the result
+	timedOut := newSession(nil)
+	timedOut.conn = testWebsocketConn(t, func(message []byte) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	results := Broadcast(ctx, map[*Session]*types.ActionMessage{
+		succeeded:    {Id: "00000000-0000-0000-0000-000000000004", Name: "action1"},
+		disconnected: {Id: "00000000-0000-0000-0000-000000000005", Name: "action1"},
+		timedOut:     {Id: "00000000-0000-0000-0000-000000000006", Name: "action1"},
+	})
+
+	assert.Len(t, results, 3)
+	assert.Equal(t, types.JobStatusSucceeded, results[succeeded.id].Status)
+	assert.Equal(t, "ok", results[succeeded.id].Body)
+	assert.Equal(t, map[string]string{"host": "nas"}, results[succeeded.id].Labels)
+	assert.Equal(t, types.JobStatusFailed, results[disconnected.id].Status)
+	assert.Equal(t, "The client disconnected while running the action", results[disconnected.id].Body)
+	assert.Equal(t, types.JobStatusTimeout, results[timedOut.id].Status)
+	// the duration is measured from when the action was sent, which is slightly after the context was created
+	assert.Greater(t, results[timedOut.id].DurationMs, int64(100))
+}
@@ -0,0 +1,160 @@
+package router
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ResultCache is an in-memory LRU cache of the successful results of the read-only actions
+// that declare their cache time. The entries are scoped to the client and the action.
+type ResultCache struct {
+	// size is the maximum number of the entries
+	size int
+	// entries stores the list elements of the entries by key
+	entries map[resultCacheKey]*list.Element
+	// lru is the list of the entries from the most recently used
+	lru *list.List
+	// mu is a mutex for operations on entries and lru
+	mu sync.Mutex
+}
+
+type resultCacheKey struct {
+	clientId string
+	action   string
+	hash     string
+}
+
+// CachedResult is an action result in the ResultCache.
+type CachedResult struct {
+	key resultCacheKey
+	// Result is the action result
+	Result *types.ActionResult
+	// ETag is the entity tag of the result, including the quotes
+	ETag string
+	// StoredAt is the time when the result was stored
+	StoredAt time.Time
+	// ExpiresAt is the time when the result expires
+	ExpiresAt time.Time
+}
+
+// MaxCachedBodySize is the maximum size of the body of the result that can be cached.
+const MaxCachedBodySize = 1 << 20
+
+// NewResultCache creates a new ResultCache object that keeps up to size entries.
+func NewResultCache(size int) *ResultCache {
+	return &ResultCache{
+		size:    size,
+		entries: make(map[resultCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns the fresh cached result of the request to the action of the client.
+// It returns nil if the result is not cached or has expired.
+func (c *ResultCache) Get(clientId string, action string, hash string) *CachedResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[resultCacheKey{clientId: clientId, action: action, hash: hash}]
+	if !ok {
+		return nil
+	}
+	cached := elem.Value.(*CachedResult)
+	if time.Now().After(cached.ExpiresAt) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return cached
+}
+
+// Put caches the result of the request to the action of the client for ttl, and returns the cached result.
+// It returns nil if the result can not be cached, because it is not successful or is too large.
+func (c *ResultCache) Put(clientId string, action string, hash string, result *types.ActionResult, ttl time.Duration) *CachedResult {
+	if !IsCacheableResult(result) || ttl <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	cached := &CachedResult{
+		key:       resultCacheKey{clientId: clientId, action: action, hash: hash},
+		Result:    result,
+		ETag:      resultETag(result),
+		StoredAt:  now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[cached.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[cached.key] = c.lru.PushFront(cached)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	return cached
+}
+
+// Purge removes the cached results of the client. If action is not empty, only the results of the action are removed.
+// It returns the number of the removed results.
+func (c *ResultCache) Purge(clientId string, action string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for key, elem := range c.entries {
+		if key.clientId == clientId && (action == "" || key.action == action) {
+			c.remove(elem)
+			n++
+		}
+	}
+	return n
+}
+
+// Len returns the number of the cached results including the expired ones that have not been removed yet.
+func (c *ResultCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// remove removes the entry. The caller must hold the lock.
+func (c *ResultCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*CachedResult).key)
+}
+
+// IsCacheableResult reports whether the action result can be cached.
+// Only the successful results with a 2xx status code and a body that is not too large are cached.
+func IsCacheableResult(result *types.ActionResult) bool {
+	if result.Status != types.ActionResultStatusSuccess {
+		return false
+	}
+	if result.StatusCode != 0 && (result.StatusCode < 200 || result.StatusCode >= 300) {
+		return false
+	}
+	return len(result.Body) <= MaxCachedBodySize
+}
+
+// resultETag returns a strong entity tag of the result that changes when its body or declared response changes.
+func resultETag(result *types.ActionResult) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%d\x00", result.StatusCode)
+	names := make([]string, 0, len(result.Headers))
+	for name := range result.Headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		_, _ = fmt.Fprintf(h, "%s: %s\x00", name, result.Headers[name])
+	}
+	_, _ = h.Write([]byte(result.Body))
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
@@ -0,0 +1,89 @@
+package router
+
+import (
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResultCache(t *testing.T) {
+	clientId := "00000000-0000-0000-0000-000000000001"
+	ok := &types.ActionResult{
+		Status: types.ActionResultStatusSuccess,
+		Body:   "ok",
+	}
+
+	t.Run("get and put", func(t *testing.T) {
+		c := NewResultCache(10)
+		assert.Nil(t, c.Get(clientId, "action1", "hash1"))
+
+		cached := c.Put(clientId, "action1", "hash1", ok, time.Minute)
+		if assert.NotNil(t, cached) {
+			assert.Equal(t, ok, cached.Result)
+			assert.Regexp(t, `^"[0-9a-f]{32}"$`, cached.ETag)
+		}
+		assert.Equal(t, cached, c.Get(clientId, "action1", "hash1"))
+
+		// the results are scoped to the client, the action and the request
+		assert.Nil(t, c.Get("00000000-0000-0000-0000-000000000002", "action1", "hash1"))
+		assert.Nil(t, c.Get(clientId, "action2", "hash1"))
+		assert.Nil(t, c.Get(clientId, "action1", "hash2"))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		c := NewResultCache(10)
+		c.Put(clientId, "action1", "hash1", ok, time.Millisecond)
+		time.Sleep(2 * time.Millisecond)
+		assert.Nil(t, c.Get(clientId, "action1", "hash1"))
+		assert.Equal(t, 0, c.Len())
+	})
+
+	t.Run("evict the least recently used", func(t *testing.T) {
+		c := NewResultCache(2)
+		c.Put(clientId, "action1", "hash1", ok, time.Minute)
+		c.Put(clientId, "action1", "hash2", ok, time.Minute)
+		assert.NotNil(t, c.Get(clientId, "action1", "hash1"))
+		c.Put(clientId, "action1", "hash3", ok, time.Minute)
+		assert.Equal(t, 2, c.Len())
+		assert.NotNil(t, c.Get(clientId, "action1", "hash1"))
+		assert.Nil(t, c.Get(clientId, "action1", "hash2"))
+		assert.NotNil(t, c.Get(clientId, "action1", "hash3"))
+	})
+
+	t.Run("not cacheable", func(t *testing.T) {
+		c := NewResultCache(10)
+		testCases := map[string]*types.ActionResult{
+			"failed":      {Status: types.ActionResultStatusError, Body: "error"},
+			"status code": {Status: types.ActionResultStatusSuccess, StatusCode: 404},
+			"too large":   {Status: types.ActionResultStatusSuccess, Body: strings.Repeat("a", MaxCachedBodySize+1)},
+		}
+		for name, result := range testCases {
+			t.Run(name, func(t *testing.T) {
+				assert.Nil(t, c.Put(clientId, "action1", "hash1", result, time.Minute))
+			})
+		}
+		assert.Equal(t, 0, c.Len())
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		c := NewResultCache(10)
+		c.Put(clientId, "action1", "hash1", ok, time.Minute)
+		c.Put(clientId, "action2", "hash1", ok, time.Minute)
+		c.Put("00000000-0000-0000-0000-000000000002", "action1", "hash1", ok, time.Minute)
+
+		assert.Equal(t, 1, c.Purge(clientId, "action1"))
+		assert.Nil(t, c.Get(clientId, "action1", "hash1"))
+		assert.NotNil(t, c.Get(clientId, "action2", "hash1"))
+		assert.Equal(t, 1, c.Purge(clientId, ""))
+		assert.Equal(t, 1, c.Len())
+	})
+
+	t.Run("etag", func(t *testing.T) {
+		a := resultETag(&types.ActionResult{Body: "a"})
+		assert.Equal(t, a, resultETag(&types.ActionResult{Body: "a"}))
+		assert.NotEqual(t, a, resultETag(&types.ActionResult{Body: "b"}))
+		assert.NotEqual(t, a, resultETag(&types.ActionResult{Body: "a", Headers: map[string]string{"X-Test": "test"}}))
+	})
+}
@@ -0,0 +1,469 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeferredQueue is a durable queue of the action invocations (deferred jobs) that wait for the client to connect.
+// The jobs are persisted in a directory, so that they survive the server restart.
+// A job is delivered when a session of the client that matches its selector and advertises its action becomes active.
+// The delivery is at-least-once: a job that was being delivered when the session closed or the server stopped
+// is delivered again with the same message id, and the client runs the message only once for the same id.
+type DeferredQueue struct {
+	// dir is the directory to persist the jobs
+	dir string
+	// router is used to dispatch the jobs to the sessions
+	router *Router
+	// ttl is the maximum time that a job waits for the client
+	ttl time.Duration
+	// timeout is the maximum execution time of a job whose action does not declare its timeout
+	timeout time.Duration
+	// retention is the time to keep a finished job
+	retention time.Duration
+	// jobs stores the jobs by job id
+	jobs map[string]*DeferredJob
+	// deferrable stores the names of the deferrable actions by client id.
+	// It is learned from the sessions, so that the invocations can be queued while the client is offline.
+	deferrable map[string][]string
+	// mu is a mutex for operations on jobs and deferrable
+	mu sync.Mutex
+	// done is closed when the queue is closed
+	done chan struct{}
+	// closeOnce ensures that the queue is closed only once
+	closeOnce sync.Once
+}
+
+// DeferredJob is an action invocation in the DeferredQueue.
+// Its fields are protected by the mutex of the queue.
+type DeferredJob struct {
+	// Id is the job id. It is the same as the id of the action message.
+	Id string `json:"id"`
+	// ClientId is the id of the client that owns the job
+	ClientId string `json:"client_id"`
+	// Selector selects the sessions that the job is delivered to
+	Selector Selector `json:"selector,omitempty"`
+	// Message is the action message
+	Message *types.ActionMessage `json:"message"`
+	// Status is the current status of the job
+	Status types.JobStatus `json:"status"`
+	// Attempts is the number of times that the job was delivered
+	Attempts int `json:"attempts"`
+	// Result is the action result. It is nil until the job finishes.
+	Result *types.ActionResult `json:"result,omitempty"`
+	// Error is the reason why the job failed without the result of the action
+	Error string `json:"error,omitempty"`
+	// CreatedAt is the time when the job was queued
+	CreatedAt time.Time `json:"created_at"`
+	// FinishedAt is the time when the job finished
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	// cancel cancels the delivery in progress
+	cancel context.CancelFunc
+}
+
+type DeferredQueueOption func(*DeferredQueue)
+
+// WithDeferredTTL sets the maximum time that a job waits for the client.
+func WithDeferredTTL(ttl time.Duration) DeferredQueueOption {
+	return func(q *DeferredQueue) {
+		q.ttl = ttl
+	}
+}
+
+// WithDeferredTimeout sets the maximum execution time of a job whose action does not declare its timeout.
+func WithDeferredTimeout(timeout time.Duration) DeferredQueueOption {
+	return func(q *DeferredQueue) {
+		q.timeout = timeout
+	}
+}
+
+// WithDeferredRetention sets the time to keep a finished job.
+func WithDeferredRetention(retention time.Duration) DeferredQueueOption {
+	return func(q *DeferredQueue) {
+		q.retention = retention
+	}
+}
+
+// deferredSweepInterval is the interval to expire the jobs that waited too long and remove the old finished jobs.
+var deferredSweepInterval = time.Minute
+
+// deferredBusyRetryInterval is the interval to deliver the job again after the client rejected it as busy.
+var deferredBusyRetryInterval = 5 * time.Second
+
+// NewDeferredQueue creates a new DeferredQueue object that persists the jobs in the directory.
+// It loads the jobs that were persisted before, and delivers them when the sessions are activated on the router.
+func NewDeferredQueue(dir string, r *Router, options ...DeferredQueueOption) (*DeferredQueue, error) {
+	q := &DeferredQueue{
+		dir:        dir,
+		router:     r,
+		ttl:        7 * 24 * time.Hour,
+		timeout:    1 * time.Hour,
+		retention:  1 * time.Hour,
+		jobs:       make(map[string]*DeferredJob),
+		deferrable: make(map[string][]string),
+		done:       make(chan struct{}),
+	}
+	for _, option := range options {
+		option(q)
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	r.OnSessionActivated(q.handleSessionActivated)
+	go q.sweepLoop()
+	return q, nil
+}
+
+var (
+	ErrDeferredJobExists = errors.New("deferred job already exists")
+)
+
+// Enqueue queues the action message of the client, and delivers it immediately if a session can run it.
+// The message id is used as the job id, so the same message is queued only once.
+func (q *DeferredQueue) Enqueue(client *auth.Client, msg *types.ActionMessage, selector Selector) (*DeferredJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.jobs[msg.Id]; ok {
+		return nil, ErrDeferredJobExists
+	}
+	msg.Deferred = true
+	job := &DeferredJob{
+		Id:        msg.Id,
+		ClientId:  client.Id,
+		Selector:  selector,
+		Message:   msg,
+		Status:    types.JobStatusQueued,
+		CreatedAt: time.Now(),
+	}
+	if err := q.save(job); err != nil {
+		return nil, err
+	}
+	q.jobs[job.Id] = job
+
+	q.deliver(client)
+	return job, nil
+}
+
+// IsDeferrable reports whether the action of the client allows deferred delivery.
+// It is known from the sessions of the client that have been activated, even if the client is offline now.
+func (q *DeferredQueue) IsDeferrable(client *auth.Client, name string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return slices.Contains(q.deferrable[client.Id], name)
+}
+
+// Get returns the job that is owned by the client.
+// It returns nil if the job is not found.
+func (q *DeferredQueue) Get(client *auth.Client, id string) *DeferredJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := q.jobs[id]
+	if job == nil || job.ClientId != client.Id {
+		return nil
+	}
+	return job
+}
+
+// Delete cancels the job and removes it.
+// It returns false if the job is not found.
+func (q *DeferredQueue) Delete(client *auth.Client, id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := q.jobs[id]
+	if job == nil || job.ClientId != client.Id {
+		return false
+	}
+	if job.cancel != nil {
+		job.cancel()
+	}
+	q.remove(job)
+	return true
+}
+
+// Response returns a snapshot of the job for the API response.
+func (q *DeferredQueue) Response(job *DeferredJob) *types.JobResponse {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	resp := &types.JobResponse{
+		Id:        job.Id,
+		Action:    job.Message.Name,
+		Status:    job.Status,
+		CreatedAt: job.CreatedAt,
+		Attempts:  job.Attempts,
+	}
+	if job.Result != nil {
+		// The binary result is encoded in base64 to return it in JSON.
+		resp.Body, resp.BodyEncoding = types.EncodeBody(job.Result.Body)
+		resp.StatusCode = job.Result.StatusCode
+		resp.Headers = job.Result.Headers
+	}
+	resp.Error = job.Error
+	if !job.FinishedAt.IsZero() {
+		finishedAt := job.FinishedAt
+		resp.FinishedAt = &finishedAt
+		resp.DurationMs = finishedAt.Sub(job.CreatedAt).Milliseconds()
+	}
+	return resp
+}
+
+// NumQueued returns the number of the jobs that wait for the client.
+func (q *DeferredQueue) NumQueued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for _, job := range q.jobs {
+		if job.Status == types.JobStatusQueued {
+			n++
+		}
+	}
+	return n
+}
+
+// Close stops the background tasks of the queue. The jobs stay in the directory.
+func (q *DeferredQueue) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.done)
+	})
+	return nil
+}
+
+// handleSessionActivated learns the deferrable actions of the session and delivers the jobs of its client.
+func (q *DeferredQueue) handleSessionActivated(sess *Session) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	names := slices.Clone(q.deferrable[sess.client.Id])
+	for _, name := range sess.actions {
+		names = slices.DeleteFunc(names, func(n string) bool {
+			return n == name
+		})
+		if sess.IsDeferrableAction(name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, q.deferrable[sess.client.Id]) {
+		q.deferrable[sess.client.Id] = names
+		// It is learned again from the next session if this fails.
+		_ = q.saveDeferrable(sess.client.Id)
+	}
+
+	q.deliver(sess.client)
+}
+
+// deliver dispatches the queued jobs of the client to the sessions that can run them in the order of creation.
+// The caller must hold the lock.
+func (q *DeferredQueue) deliver(client *auth.Client) {
+	var jobs []*DeferredJob
+	for _, job := range q.jobs {
+		if job.ClientId == client.Id && job.Status == types.JobStatusQueued {
+			jobs = append(jobs, job)
+		}
+	}
+	slices.SortFunc(jobs, func(a, b *DeferredJob) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	for _, job := range jobs {
+		sess := q.router.SelectSession(client, job.Message.Name, job.Selector)
+		if sess == nil {
+			continue
+		}
+		timeout := sess.ActionTimeout(job.Message.Name)
+		if timeout == 0 {
+			timeout = q.timeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		job.cancel = cancel
+		job.Status = types.JobStatusRunning
+		job.Attempts++
+		// The job is delivered again after the restart if this fails.
+		_ = q.save(job)
+
+		go func() {
+			defer cancel()
+			result, err := q.router.Invoke(ctx, sess, job.Message, job.Selector)
+			q.finish(job, result, err)
+		}()
+	}
+}
+
+// finish records the outcome of the delivery of the job.
+func (q *DeferredQueue) finish(job *DeferredJob, result *types.ActionResult, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.jobs[job.Id] != job {
+		// deleted by the caller
+		return
+	}
+	job.cancel = nil
+
+	switch {
+	case errors.Is(err, ErrSessionClosed):
+		// The client may or may not have run the action. It is delivered again when the client connects.
+		job.Status = types.JobStatusQueued
+		_ = q.save(job)
+		return
+	case err == nil && result.Status == types.ActionResultStatusBusy:
+		// The client did not run the action. It is delivered again after a while.
+		job.Status = types.JobStatusQueued
+		_ = q.save(job)
+		time.AfterFunc(deferredBusyRetryInterval, func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.deliver(&auth.Client{Id: job.ClientId})
+		})
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		job.Status = types.JobStatusTimeout
+	case err != nil:
+		job.Status = types.JobStatusFailed
+	case result.Status == types.ActionResultStatusSuccess:
+		job.Status = types.JobStatusSucceeded
+	default:
+		job.Status = types.JobStatusFailed
+	}
+	job.Result = result
+	if err != nil {
+		job.Error = invokeErrorMessage(err)
+	}
+	job.FinishedAt = time.Now()
+	_ = q.save(job)
+}
+
+func (q *DeferredQueue) sweepLoop() {
+	ticker := time.NewTicker(deferredSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.sweep()
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// sweep expires the jobs that waited for the client too long, and removes the finished jobs after the retention time.
+func (q *DeferredQueue) sweep() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for _, job := range q.jobs {
+		switch {
+		case job.Status == types.JobStatusQueued && now.Sub(job.CreatedAt) > q.ttl:
+			job.Status = types.JobStatusTimeout
+			job.Error = "The client did not connect in time"
+			job.FinishedAt = now
+			_ = q.save(job)
+		case !job.FinishedAt.IsZero() && now.Sub(job.FinishedAt) > q.retention:
+			q.remove(job)
+		}
+	}
+}
+
+// remove removes the job from the queue and its file. The caller must hold the lock.
+func (q *DeferredQueue) remove(job *DeferredJob) {
+	delete(q.jobs, job.Id)
+	_ = os.Remove(q.jobPath(job.Id))
+}
+
+// load loads the jobs and the deferrable actions that were persisted in the directory.
+func (q *DeferredQueue) load() error {
+	if err := os.MkdirAll(filepath.Join(q.dir, "jobs"), 0700); err != nil {
+		return fmt.Errorf("failed to create the deferred queue directory: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(q.dir, "deferrable"), 0700); err != nil {
+		return fmt.Errorf("failed to create the deferred queue directory: %w", err)
+	}
+
+	files, err := os.ReadDir(filepath.Join(q.dir, "jobs"))
+	if err != nil {
+		return fmt.Errorf("failed to read the deferred queue directory: %w", err)
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(q.dir, "jobs", f.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read the deferred job: %w", err)
+		}
+		job := &DeferredJob{}
+		if err := json.Unmarshal(b, job); err != nil {
+			return fmt.Errorf("failed to decode the deferred job %s: %w", f.Name(), err)
+		}
+		if job.Status == types.JobStatusRunning {
+			// The server stopped while delivering the job.
+			job.Status = types.JobStatusQueued
+		}
+		q.jobs[job.Id] = job
+	}
+
+	files, err = os.ReadDir(filepath.Join(q.dir, "deferrable"))
+	if err != nil {
+		return fmt.Errorf("failed to read the deferred queue directory: %w", err)
+	}
+	for _, f := range files {
+		clientId, ok := strings.CutSuffix(f.Name(), ".json")
+		if f.IsDir() || !ok {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(q.dir, "deferrable", f.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read the deferrable actions: %w", err)
+		}
+		var names []string
+		if err := json.Unmarshal(b, &names); err != nil {
+			return fmt.Errorf("failed to decode the deferrable actions %s: %w", f.Name(), err)
+		}
+		q.deferrable[clientId] = names
+	}
+	return nil
+}
+
+// save persists the job. The caller must hold the lock.
+func (q *DeferredQueue) save(job *DeferredJob) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to encode the deferred job: %w", err)
+	}
+	if err := writeFileAtomic(q.jobPath(job.Id), b); err != nil {
+		return fmt.Errorf("failed to write the deferred job: %w", err)
+	}
+	return nil
+}
+
+// saveDeferrable persists the deferrable actions of the client. The caller must hold the lock.
+func (q *DeferredQueue) saveDeferrable(clientId string) error {
+	b, err := json.Marshal(q.deferrable[clientId])
+	if err != nil {
+		return fmt.Errorf("failed to encode the deferrable actions: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(q.dir, "deferrable", clientId+".json"), b); err != nil {
+		return fmt.Errorf("failed to write the deferrable actions: %w", err)
+	}
+	return nil
+}
+
+func (q *DeferredQueue) jobPath(id string) string {
+	return filepath.Join(q.dir, "jobs", id+".json")
+}
@@ -0,0 +1,198 @@
+package router
+
+import (
+	"encoding/json"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeferredQueue(t *testing.T) {
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	req := &types.SessionNewRequest{
+		Actions:          []string{"action1", "action2"},
+		ProtocolVersions: []int{types.ProtocolVersion2},
+		Options: map[string]*types.ActionOptions{
+			"action1": {Deferrable: true},
+		},
+	}
+	newMessage := func() *types.ActionMessage {
+		return &types.ActionMessage{
+			Id:   "00000000-0000-0000-0000-000000000004",
+			Name: "action1",
+		}
+	}
+
+	t.Run("deliver when the client connects", func(t *testing.T) {
+		dir := t.TempDir()
+		r := New()
+		q, err := NewDeferredQueue(dir, r)
+		assert.NoError(t, err)
+		defer q.Close()
+
+		job, err := q.Enqueue(ct, newMessage(), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, types.JobStatusQueued, q.Response(job).Status)
+		assert.FileExists(t, filepath.Join(dir, "jobs", job.Id+".json"))
+		assert.Equal(t, 1, q.NumQueued())
+
+		// the same message is queued only once
+		_, err = q.Enqueue(ct, newMessage(), nil)
+		assert.ErrorIs(t, err, ErrDeferredJobExists)
+
+		// the server restarts
+		r = New()
+		q, err = NewDeferredQueue(dir, r)
+		assert.NoError(t, err)
+		defer q.Close()
+		job = q.Get(ct, job.Id)
+		if !assert.NotNil(t, job) {
+			return
+		}
+		assert.False(t, q.IsDeferrable(ct, "action1"))
+
+		// the client connects
+		sess, err := r.NewSession(ct, req)
+		assert.NoError(t, err)
+		received := make(chan *types.ActionMessage, 1)
+		sess.conn = testWebsocketConn(t, func(message []byte) {
+			env, err := types.ParseEnvelope(message)
+			assert.NoError(t, err)
+			msg := &types.ActionMessage{}
+			assert.NoError(t, env.DecodePayload(msg))
+			received <- msg
+			assert.NoError(t, sess.HandleActionResult(&types.ActionResult{
+				Id:     env.Id,
+				Status: types.ActionResultStatusSuccess,
+				Body:   "ok",
+			}))
+		})
+		q.handleSessionActivated(sess)
+
+		assert.Eventually(t, func() bool {
+			return q.Response(job).Status == types.JobStatusSucceeded
+		}, 5*time.Second, 10*time.Millisecond)
+		resp := q.Response(job)
+		assert.Equal(t, "ok", resp.Body)
+		assert.Equal(t, 1, resp.Attempts)
+		assert.True(t, (<-received).Deferred)
+		assert.Equal(t, 0, q.NumQueued())
+
+		// the deferrable actions are learned from the session
+		assert.True(t, q.IsDeferrable(ct, "action1"))
+		assert.False(t, q.IsDeferrable(ct, "action2"))
+		q, err = NewDeferredQueue(dir, New())
+		assert.NoError(t, err)
+		defer q.Close()
+		assert.True(t, q.IsDeferrable(ct, "action1"))
+	})
+
+	t.Run("deliver again when the session closes", func(t *testing.T) {
+		r := New()
+		q, err := NewDeferredQueue(t.TempDir(), r)
+		assert.NoError(t, err)
+		defer q.Close()
+
+		sess, err := r.NewSession(ct, req)
+		assert.NoError(t, err)
+		// the client disconnects when it receives the action message
+		sess.conn = testWebsocketConn(t, func(message []byte) {
+			r.CloseSession(sess)
+		})
+
+		job, err := q.Enqueue(ct, newMessage(), nil)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			resp := q.Response(job)
+			return resp.Status == types.JobStatusQueued && resp.Attempts == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("deliver again after the client was busy", func(t *testing.T) {
+		defer func(d time.Duration) { deferredBusyRetryInterval = d }(deferredBusyRetryInterval)
+		deferredBusyRetryInterval = 10 * time.Millisecond
+
+		r := New()
+		q, err := NewDeferredQueue(t.TempDir(), r)
+		assert.NoError(t, err)
+		defer q.Close()
+
+		sess, err := r.NewSession(ct, req)
+		assert.NoError(t, err)
+		// the client rejects the first delivery as busy
+		status := types.ActionResultStatusBusy
+		sess.conn = testWebsocketConn(t, func(message []byte) {
+			env, err := types.ParseEnvelope(message)
+			assert.NoError(t, err)
+			assert.NoError(t, sess.HandleActionResult(&types.ActionResult{
+				Id:     env.Id,
+				Status: status,
+			}))
+			status = types.ActionResultStatusSuccess
+		})
+
+		job, err := q.Enqueue(ct, newMessage(), nil)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return q.Response(job).Status == types.JobStatusSucceeded
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, 2, q.Response(job).Attempts)
+	})
+
+	t.Run("deliver again after the server stopped while delivering", func(t *testing.T) {
+		dir := t.TempDir()
+		job := &DeferredJob{
+			Id:        "00000000-0000-0000-0000-000000000004",
+			ClientId:  ct.Id,
+			Message:   newMessage(),
+			Status:    types.JobStatusRunning,
+			Attempts:  1,
+			CreatedAt: time.Now(),
+		}
+		b, err := json.Marshal(job)
+		assert.NoError(t, err)
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "jobs"), 0700))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "jobs", job.Id+".json"), b, 0600))
+
+		q, err := NewDeferredQueue(dir, New())
+		assert.NoError(t, err)
+		defer q.Close()
+		assert.Equal(t, types.JobStatusQueued, q.Response(q.Get(ct, job.Id)).Status)
+	})
+
+	t.Run("expire and remove", func(t *testing.T) {
+		dir := t.TempDir()
+		q, err := NewDeferredQueue(dir, New(), WithDeferredTTL(0), WithDeferredRetention(0))
+		assert.NoError(t, err)
+		defer q.Close()
+
+		job, err := q.Enqueue(ct, newMessage(), nil)
+		assert.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+		q.sweep()
+		assert.Equal(t, types.JobStatusTimeout, q.Response(job).Status)
+		assert.Equal(t, "The client did not connect in time", q.Response(job).Error)
+		time.Sleep(10 * time.Millisecond)
+		q.sweep()
+		assert.Nil(t, q.Get(ct, job.Id))
+		assert.NoFileExists(t, filepath.Join(dir, "jobs", job.Id+".json"))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		q, err := NewDeferredQueue(t.TempDir(), New())
+		assert.NoError(t, err)
+		defer q.Close()
+
+		job, err := q.Enqueue(ct, newMessage(), nil)
+		assert.NoError(t, err)
+		assert.False(t, q.Delete(&auth.Client{Id: "00000000-0000-0000-0000-000000000002"}, job.Id))
+		assert.True(t, q.Delete(ct, job.Id))
+		assert.Nil(t, q.Get(ct, job.Id))
+	})
+}
@@ -0,0 +1,123 @@
+package router
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ForwardedHeader is the request header that a node sets when it forwards the request to another node.
+// Its value is the id of the forwarding node. The forwarded requests are never forwarded again.
+const ForwardedHeader = "X-Actions-Gateway-Forwarded-By"
+
+// ForwardSignatureHeader is the request header that authenticates the request forwarded by another node.
+// Its value is "<unix time>.<signature>", and the signature is the HMAC-SHA256 of the id of the forwarding node
+// and the time with the key that all the nodes share.
+const ForwardSignatureHeader = "X-Actions-Gateway-Forward-Signature"
+
+// forwardSignatureMaxAge is the maximum age of the signature of a forwarded request.
+const forwardSignatureMaxAge = time.Minute
+
+// signForward returns the value of ForwardSignatureHeader for the request that the node forwards at the time.
+func signForward(key []byte, nodeId string, at time.Time) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	return ts + "." + forwardSignature(key, nodeId, ts)
+}
+
+// verifyForward reports whether the value of ForwardSignatureHeader is a valid signature of the node at now.
+func verifyForward(key []byte, nodeId string, value string, now time.Time) bool {
+	ts, sig, ok := strings.Cut(value, ".")
+	if !ok || len(key) == 0 || nodeId == "" {
+		return false
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > forwardSignatureMaxAge || age < -forwardSignatureMaxAge {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(forwardSignature(key, nodeId, ts)))
+}
+
+func forwardSignature(key []byte, nodeId string, ts string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(nodeId + "." + ts))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Forwarder forwards the request to the node.
+type Forwarder interface {
+	Forward(w http.ResponseWriter, req *http.Request, node *NodeEntry)
+}
+
+// HTTPForwarder is a Forwarder that proxies the request to the node over HTTP.
+// The response is streamed to the caller as the node writes it.
+type HTTPForwarder struct {
+	// Transport is used to send the request to the node. If it is nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+func (f *HTTPForwarder) Forward(w http.ResponseWriter, req *http.Request, node *NodeEntry) {
+	target, err := url.Parse(node.NodeURL)
+	if err != nil {
+		http.Error(w, "The replica of the client is not reachable", http.StatusBadGateway)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			// keep the address of the caller for the logs of the node
+			pr.SetXForwarded()
+			pr.Out.Header[ForwardedHeader] = pr.In.Header[ForwardedHeader]
+			pr.Out.Header[ForwardSignatureHeader] = pr.In.Header[ForwardSignatureHeader]
+		},
+		Transport: f.Transport,
+		// flush immediately for the streaming actions
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			http.Error(w, "The replica of the client is not reachable", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, req)
+}
+
+// ForwardedResponse is the response of a request forwarded to another node that is kept in memory.
+// It is the http.ResponseWriter that the request is forwarded with.
+type ForwardedResponse struct {
+	// StatusCode is the status code of the response
+	StatusCode int
+	// Body is the response body
+	Body bytes.Buffer
+
+	header http.Header
+}
+
+func newForwardedResponse() *ForwardedResponse {
+	return &ForwardedResponse{
+		StatusCode: http.StatusOK,
+		header:     make(http.Header),
+	}
+}
+
+func (res *ForwardedResponse) Header() http.Header {
+	return res.header
+}
+
+func (res *ForwardedResponse) Write(b []byte) (int, error) {
+	return res.Body.Write(b)
+}
+
+func (res *ForwardedResponse) WriteHeader(statusCode int) {
+	res.StatusCode = statusCode
+}
+
+// Flush does nothing, because the response is read after the forwarding finishes.
+func (res *ForwardedResponse) Flush() {}
@@ -0,0 +1,224 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// IdempotencyStore remembers the responses of the requests by their idempotency keys,
+// so that the retries of a request return the same response instead of running the action again.
+// The keys are scoped to the client, and each key is bound to the hash of the request that used it first.
+type IdempotencyStore struct {
+	// entries stores the entries by client id and idempotency key
+	entries map[idempotencyKey]*IdempotencyEntry
+	// completed is a list of the entries that have the stored responses in the order of completion
+	// to forget the oldest ones when the store is full
+	completed []*IdempotencyEntry
+	// size is the total size of the bodies of the stored responses in bytes
+	size int
+	// ttl is the time to remember the response after the request finished
+	ttl time.Duration
+	// maxEntries is the maximum number of the stored responses. Zero means no limit.
+	maxEntries int
+	// maxBytes is the maximum total size of the bodies of the stored responses. Zero means no limit.
+	maxBytes int
+	// sweptAt is the time when the expired entries were removed last
+	sweptAt time.Time
+	// mu is a mutex for operations on entries
+	mu sync.Mutex
+}
+
+type idempotencyKey struct {
+	clientId string
+	key      string
+}
+
+// IdempotencyEntry is the state of a request with an idempotency key.
+type IdempotencyEntry struct {
+	key idempotencyKey
+	// hash is the hash of the request
+	hash string
+	// done is closed when the request finishes
+	done chan struct{}
+	// response is the stored response. It is nil if the request finished without a response to remember.
+	response *StoredResponse
+	// expiresAt is the time when the entry expires. It is zero while the request is in flight.
+	expiresAt time.Time
+}
+
+// StoredResponse is an HTTP response that is replayed for the retries.
+type StoredResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+type IdempotencyStoreOption func(*IdempotencyStore)
+
+// WithIdempotencyMaxEntries sets the maximum number of the stored responses.
+// The oldest responses are forgotten when the store is full.
+func WithIdempotencyMaxEntries(n int) IdempotencyStoreOption {
+	return func(s *IdempotencyStore) {
+		s.maxEntries = n
+	}
+}
+
+// WithIdempotencyMaxBytes sets the maximum total size of the bodies of the stored responses.
+// The oldest responses are forgotten when the store is full, and a larger response is not remembered.
+func WithIdempotencyMaxBytes(n int) IdempotencyStoreOption {
+	return func(s *IdempotencyStore) {
+		s.maxBytes = n
+	}
+}
+
+// NewIdempotencyStore creates a new IdempotencyStore object that remembers the responses for ttl.
+func NewIdempotencyStore(ttl time.Duration, options ...IdempotencyStoreOption) *IdempotencyStore {
+	s := &IdempotencyStore{
+		entries: make(map[idempotencyKey]*IdempotencyEntry),
+		ttl:     ttl,
+		sweptAt: time.Now(),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+var (
+	// ErrIdempotencyKeyMismatch means that the idempotency key was used for a different request.
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key was used for a different request")
+)
+
+// idempotencySweepInterval is the interval to remove the expired entries.
+var idempotencySweepInterval = time.Minute
+
+// Begin starts the request with the idempotency key of the client.
+// If the key is new, it returns a new entry, and the caller must run the request
+// and call Complete or Abort with the entry.
+// If the key is in use by the same request, it waits for the request to finish and returns its stored response.
+// If the first request was aborted, the caller takes it over as if the key were new.
+func (s *IdempotencyStore) Begin(ctx context.Context, clientId string, key string, hash string) (*IdempotencyEntry, *StoredResponse, error) {
+	k := idempotencyKey{clientId: clientId, key: key}
+	for {
+		s.mu.Lock()
+		s.sweep()
+		entry := s.entries[k]
+		if entry != nil && !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+			s.remove(entry)
+			entry = nil
+		}
+		if entry == nil {
+			entry = &IdempotencyEntry{
+				key:  k,
+				hash: hash,
+				done: make(chan struct{}),
+			}
+			s.entries[k] = entry
+			s.mu.Unlock()
+			return entry, nil, nil
+		}
+		s.mu.Unlock()
+
+		if entry.hash != hash {
+			return nil, nil, ErrIdempotencyKeyMismatch
+		}
+
+		// attach to the request in flight
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if entry.response != nil {
+			return nil, entry.response, nil
+		}
+		// The request was aborted. Try to take it over.
+	}
+}
+
+// Complete stores the response of the request, and returns it to the retries until the entry expires.
+// The oldest responses are forgotten to keep the store within its limits.
+// The response that is larger than the limit is not stored, and the request is aborted instead.
+func (s *IdempotencyStore) Complete(entry *IdempotencyEntry, resp *StoredResponse) {
+	if s.maxBytes > 0 && len(resp.Body) > s.maxBytes {
+		s.Abort(entry)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries[entry.key] == entry {
+		for len(s.completed) > 0 && ((s.maxEntries > 0 && len(s.completed) >= s.maxEntries) || (s.maxBytes > 0 && s.size+len(resp.Body) > s.maxBytes)) {
+			s.remove(s.completed[0])
+		}
+		s.completed = append(s.completed, entry)
+		s.size += len(resp.Body)
+	}
+	entry.response = resp
+	entry.expiresAt = time.Now().Add(s.ttl)
+	close(entry.done)
+}
+
+// Abort forgets the request that finished without a response to remember, such as when the client was unavailable,
+// so that a retry runs the request again.
+func (s *IdempotencyStore) Abort(entry *IdempotencyEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(entry)
+	close(entry.done)
+}
+
+// Len returns the number of the entries including the requests in flight.
+func (s *IdempotencyStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Size returns the total size of the bodies of the stored responses in bytes.
+func (s *IdempotencyStore) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// MaxBytes returns the maximum total size of the bodies of the stored responses. Zero means no limit.
+func (s *IdempotencyStore) MaxBytes() int {
+	return s.maxBytes
+}
+
+// remove forgets the entry. The caller must hold the lock.
+func (s *IdempotencyStore) remove(entry *IdempotencyEntry) {
+	if s.entries[entry.key] != entry {
+		return
+	}
+	delete(s.entries, entry.key)
+	if entry.response != nil {
+		s.size -= len(entry.response.Body)
+		if len(s.completed) > 0 && s.completed[0] == entry {
+			// The oldest entry is removed in most cases.
+			s.completed = s.completed[1:]
+		} else {
+			s.completed = slices.DeleteFunc(s.completed, func(e *IdempotencyEntry) bool {
+				return e == entry
+			})
+		}
+	}
+}
+
+// sweep removes the expired entries. The caller must hold the lock.
+func (s *IdempotencyStore) sweep() {
+	now := time.Now()
+	if now.Sub(s.sweptAt) < idempotencySweepInterval {
+		return
+	}
+	s.sweptAt = now
+	// The entries expire in the order of completion, because they have the same ttl.
+	for len(s.completed) > 0 && now.After(s.completed[0].expiresAt) {
+		s.remove(s.completed[0])
+	}
+}
@@ -0,0 +1,142 @@
+package router
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	clientId := "00000000-0000-0000-0000-000000000001"
+
+	t.Run("replay the stored response", func(t *testing.T) {
+		s := NewIdempotencyStore(time.Minute)
+		entry, stored, err := s.Begin(context.Background(), clientId, "key1", "hash1")
+		assert.NoError(t, err)
+		assert.NotNil(t, entry)
+		assert.Nil(t, stored)
+
+		// the retry attaches to the request in flight
+		ch := make(chan *StoredResponse, 1)
+		go func() {
+			_, stored, err := s.Begin(context.Background(), clientId, "key1", "hash1")
+			assert.NoError(t, err)
+			ch <- stored
+		}()
+
+		s.Complete(entry, &StoredResponse{StatusCode: http.StatusOK, Body: []byte("ok")})
+		select {
+		case stored := <-ch:
+			assert.Equal(t, []byte("ok"), stored.Body)
+		case <-time.After(time.Second):
+			t.Fatal("the retry did not return the stored response")
+		}
+
+		entry, stored, err = s.Begin(context.Background(), clientId, "key1", "hash1")
+		assert.NoError(t, err)
+		assert.Nil(t, entry)
+		assert.Equal(t, http.StatusOK, stored.StatusCode)
+
+		// the key is scoped to the client
+		entry, stored, err = s.Begin(context.Background(), "00000000-0000-0000-0000-000000000002", "key1", "hash2")
+		assert.NoError(t, err)
+		assert.NotNil(t, entry)
+		assert.Nil(t, stored)
+	})
+
+	t.Run("different request", func(t *testing.T) {
+		s := NewIdempotencyStore(time.Minute)
+		_, _, err := s.Begin(context.Background(), clientId, "key1", "hash1")
+		assert.NoError(t, err)
+		_, _, err = s.Begin(context.Background(), clientId, "key1", "hash2")
+		assert.ErrorIs(t, err, ErrIdempotencyKeyMismatch)
+	})
+
+	t.Run("take over the aborted request", func(t *testing.T) {
+		s := NewIdempotencyStore(time.Minute)
+		entry, _, err := s.Begin(context.Background(), clientId, "key1", "hash1")
+		assert.NoError(t, err)
+
+		ch := make(chan *IdempotencyEntry, 1)
+		go func() {
+			entry, _, err := s.Begin(context.Background(), clientId, "key1", "hash1")
+			assert.NoError(t, err)
+			ch <- entry
+		}()
+
+		s.Abort(entry)
+		select {
+		case retry := <-ch:
+			assert.NotNil(t, retry)
+			assert.NotEqual(t, entry, retry)
+		case <-time.After(time.Second):
+			t.Fatal("the retry did not take over the request")
+		}
+	})
+
+	t.Run("the caller gives up waiting", func(t *testing.T) {
+		s := NewIdempotencyStore(time.Minute)
+		_, _, err := s.Begin(context.Background(), clientId, "key1", "hash1")
+		assert.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, _, err = s.Begin(ctx, clientId, "key1", "hash1")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		s := NewIdempotencyStore(0)
+		entry, _, err := s.Begin(context.Background(), clientId, "key1", "hash1")
+		assert.NoError(t, err)
+		s.Complete(entry, &StoredResponse{StatusCode: http.StatusOK})
+		time.Sleep(time.Millisecond)
+
+		// the expired key can be used for a different request
+		entry, stored, err := s.Begin(context.Background(), clientId, "key1", "hash2")
+		assert.NoError(t, err)
+		assert.NotNil(t, entry)
+		assert.Nil(t, stored)
+		assert.Equal(t, 1, s.Len())
+	})
+	t.Run("limits", func(t *testing.T) {
+		s := NewIdempotencyStore(time.Minute, WithIdempotencyMaxEntries(2), WithIdempotencyMaxBytes(10))
+		complete := func(key string, body string) {
+			entry, _, err := s.Begin(context.Background(), clientId, key, "hash")
+			assert.NoError(t, err)
+			s.Complete(entry, &StoredResponse{StatusCode: http.StatusOK, Body: []byte(body)})
+		}
+		stored := func(key string) bool {
+			entry, stored, err := s.Begin(context.Background(), clientId, key, "hash")
+			assert.NoError(t, err)
+			if entry != nil {
+				s.Abort(entry)
+			}
+			return stored != nil
+		}
+
+		complete("key1", "1234")
+		complete("key2", "1234")
+		// the oldest response is forgotten by the number of the entries
+		complete("key3", "1234")
+		assert.False(t, stored("key1"))
+		assert.True(t, stored("key2"))
+		assert.True(t, stored("key3"))
+		assert.Equal(t, 8, s.Size())
+
+		// the oldest response is forgotten by the size
+		complete("key4", "1234567")
+		assert.False(t, stored("key2"))
+		assert.False(t, stored("key3"))
+		assert.True(t, stored("key4"))
+		assert.Equal(t, 7, s.Size())
+
+		// the response larger than the limit is not stored
+		complete("key5", "12345678901")
+		assert.False(t, stored("key5"))
+		assert.True(t, stored("key4"))
+		assert.Equal(t, 1, s.Len())
+	})
+}
@@ -0,0 +1,248 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"sync"
+	"time"
+)
+
+// GenJobIdFunc is a type of function to generate a job id
+type GenJobIdFunc func() (uuid.UUID, error)
+
+// JobManager is an object to manage the asynchronous action invocations (jobs).
+// A job is owned by the client that created it, and it can be retrieved only by the same client.
+type JobManager struct {
+	// jobs stores the jobs by job id
+	jobs map[string]*Job
+	// mutex for operations on jobs
+	mu sync.RWMutex
+	// timeout is the maximum execution time of a job
+	timeout time.Duration
+	// retention is the time to keep a finished job
+	retention time.Duration
+	// genJobId is a function to generate a job id
+	genJobId GenJobIdFunc
+	// nodeId is the id of the node that is prefixed to the job ids
+	nodeId string
+}
+
+type JobManagerOption func(*JobManager)
+
+func WithJobId(jId string) JobManagerOption {
+	return func(m *JobManager) {
+		m.genJobId = func() (uuid.UUID, error) {
+			return uuid.Parse(jId)
+		}
+	}
+}
+
+func WithJobTimeout(timeout time.Duration) JobManagerOption {
+	return func(m *JobManager) {
+		m.timeout = timeout
+	}
+}
+
+func WithJobRetention(retention time.Duration) JobManagerOption {
+	return func(m *JobManager) {
+		m.retention = retention
+	}
+}
+
+// WithJobNode prefixes the job ids with the id of the node, so that the other nodes can forward the requests
+// for the jobs to the node that runs them.
+func WithJobNode(nodeId string) JobManagerOption {
+	return func(m *JobManager) {
+		m.nodeId = nodeId
+	}
+}
+
+// NewJobManager creates a new JobManager object
+func NewJobManager(options ...JobManagerOption) *JobManager {
+	m := &JobManager{
+		jobs:      make(map[string]*Job),
+		timeout:   1 * time.Hour,
+		retention: 1 * time.Hour,
+		genJobId:  uuid.NewV7,
+	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// Start creates a new job and invokes the action message on the session in the background.
+// The router takes over the invocation to another session that matches the selector if the session is closed.
+func (m *JobManager) Start(r *Router, sess *Session, msg *types.ActionMessage, selector Selector) (*Job, error) {
+	UUID, err := m.genJobId()
+	if err != nil {
+		return nil, err
+	}
+
+	// The timeout declared by the action takes precedence over the job timeout.
+	timeout := m.timeout
+	if t := sess.ActionTimeout(msg.Name); t > 0 {
+		timeout = t
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	job := &Job{
+		id:        withNodeId(m.nodeId, UUID.String()),
+		clientId:  sess.client.Id,
+		action:    msg.Name,
+		status:    types.JobStatusRunning,
+		createdAt: time.Now(),
+		cancel:    cancel,
+	}
+
+	m.mu.Lock()
+	m.jobs[job.id] = job
+	m.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		result, err := r.Invoke(ctx, sess, msg, selector)
+		job.finish(result, err)
+		// remove the finished job after the retention time
+		time.AfterFunc(m.retention, func() {
+			m.remove(job)
+		})
+	}()
+
+	return job, nil
+}
+
+// Get returns the job that is owned by the client.
+// It returns nil if the job is not found.
+func (m *JobManager) Get(client *auth.Client, id string) *Job {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	job := m.jobs[id]
+	if job == nil || job.clientId != client.Id {
+		return nil
+	}
+	return job
+}
+
+// Delete cancels the job if it is running and removes it.
+// It returns false if the job is not found.
+func (m *JobManager) Delete(client *auth.Client, id string) bool {
+	job := m.Get(client, id)
+	if job == nil {
+		return false
+	}
+	job.cancelByCaller()
+	m.remove(job)
+	return true
+}
+
+func (m *JobManager) remove(job *Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.jobs[job.id] == job {
+		delete(m.jobs, job.id)
+	}
+}
+
+func (m *JobManager) NumJobs() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.jobs)
+}
+
+// Job represents an asynchronous action invocation.
+type Job struct {
+	// id is a job id
+	id string
+	// clientId is the id of the client that owns the job
+	clientId string
+	// action is the action name
+	action string
+	// status is the current status of the job
+	status types.JobStatus
+	// result is the action result. It is nil until the job finishes.
+	result *types.ActionResult
+	// err is the error of invoking the action. It is nil unless the job failed without the result.
+	err error
+	// createdAt is the time when the job was created
+	createdAt time.Time
+	// finishedAt is the time when the job finished
+	finishedAt time.Time
+	// cancel cancels the job execution
+	cancel context.CancelFunc
+	// mu is a mutex for operations on the job state
+	mu sync.RWMutex
+}
+
+func (job *Job) Id() string {
+	return job.id
+}
+
+func (job *Job) Status() types.JobStatus {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.status
+}
+
+func (job *Job) finish(result *types.ActionResult, err error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.status != types.JobStatusRunning {
+		// already canceled by the caller
+		return
+	}
+	job.finishedAt = time.Now()
+	job.result = result
+	job.err = err
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		job.status = types.JobStatusTimeout
+	case err != nil:
+		job.status = types.JobStatusFailed
+	case result.Status == types.ActionResultStatusSuccess:
+		job.status = types.JobStatusSucceeded
+	default:
+		job.status = types.JobStatusFailed
+	}
+}
+
+func (job *Job) cancelByCaller() {
+	job.mu.Lock()
+	if job.status == types.JobStatusRunning {
+		job.status = types.JobStatusCanceled
+		job.finishedAt = time.Now()
+	}
+	job.mu.Unlock()
+	job.cancel()
+}
+
+// Response returns a snapshot of the job for the API response.
+func (job *Job) Response() *types.JobResponse {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+
+	resp := &types.JobResponse{
+		Id:        job.id,
+		Action:    job.action,
+		Status:    job.status,
+		CreatedAt: job.createdAt,
+	}
+	if job.result != nil {
+		// The binary result is encoded in base64 to return it in JSON.
+		resp.Body, resp.BodyEncoding = types.EncodeBody(job.result.Body)
+		resp.StatusCode = job.result.StatusCode
+		resp.Headers = job.result.Headers
+	}
+	if job.err != nil {
+		resp.Error = invokeErrorMessage(job.err)
+	}
+	if !job.finishedAt.IsZero() {
+		finishedAt := job.finishedAt
+		resp.FinishedAt = &finishedAt
+		resp.DurationMs = finishedAt.Sub(job.createdAt).Milliseconds()
+	}
+	return resp
+}
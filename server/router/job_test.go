@@ -0,0 +1,170 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestJobManager_Start(t *testing.T) {
+	t.Run("the job fails when the session has no connection", func(t *testing.T) {
+		m := NewJobManager(WithJobId("00000000-0000-0000-0000-000000000003"))
+		ct := &auth.Client{
+			Id: "00000000-0000-0000-0000-000000000001",
+		}
+		sess := &Session{
+			id:      "00000000-0000-0000-0000-000000000002",
+			client:  ct,
+			results: make(map[string]chan *types.ActionResult),
+		}
+
+		job, err := m.Start(New(), sess, &types.ActionMessage{
+			Id:   "00000000-0000-0000-0000-000000000004",
+			Name: "action1",
+		}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "00000000-0000-0000-0000-000000000003", job.Id())
+		assert.Equal(t, 1, m.NumJobs())
+
+		assert.Eventually(t, func() bool {
+			return job.Status() == types.JobStatusFailed
+		}, time.Second, 10*time.Millisecond)
+
+		resp := job.Response()
+		assert.Equal(t, "action1", resp.Action)
+		assert.NotNil(t, resp.FinishedAt)
+	})
+
+	t.Run("the job id has the node id", func(t *testing.T) {
+		m := NewJobManager(WithJobId("00000000-0000-0000-0000-000000000003"), WithJobNode("node1"))
+		sess := &Session{
+			id:      "00000000-0000-0000-0000-000000000002",
+			client:  &auth.Client{Id: "00000000-0000-0000-0000-000000000001"},
+			results: make(map[string]chan *types.ActionResult),
+		}
+
+		job, err := m.Start(New(), sess, &types.ActionMessage{
+			Id:   "00000000-0000-0000-0000-000000000004",
+			Name: "action1",
+		}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "node1.00000000-0000-0000-0000-000000000003", job.Id())
+		assert.Equal(t, "node1", NodeIdOf(job.Id()))
+	})
+}
+
+func TestJobManager_GetAndDelete(t *testing.T) {
+	m := NewJobManager()
+	owner := &auth.Client{Id: "00000000-0000-0000-0000-000000000001"}
+	other := &auth.Client{Id: "00000000-0000-0000-0000-000000000002"}
+
+	canceled := false
+	job := &Job{
+		id:       "00000000-0000-0000-0000-000000000003",
+		clientId: owner.Id,
+		status:   types.JobStatusRunning,
+		cancel: func() {
+			canceled = true
+		},
+	}
+	m.jobs[job.id] = job
+
+	// the job can be retrieved only by the owner
+	assert.Equal(t, job, m.Get(owner, job.id))
+	assert.Nil(t, m.Get(other, job.id))
+	assert.False(t, m.Delete(other, job.id))
+
+	// deleting a running job cancels it
+	assert.True(t, m.Delete(owner, job.id))
+	assert.True(t, canceled)
+	assert.Equal(t, types.JobStatusCanceled, job.Status())
+	assert.Nil(t, m.Get(owner, job.id))
+	assert.Equal(t, 0, m.NumJobs())
+}
+
+func TestJob_finish(t *testing.T) {
+	testCases := map[string]struct {
+		result        *types.ActionResult
+		err           error
+		expected      types.JobStatus
+		expectedError string
+	}{
+		"success": {
+			result:   &types.ActionResult{Status: types.ActionResultStatusSuccess},
+			expected: types.JobStatusSucceeded,
+		},
+		"action error": {
+			result:   &types.ActionResult{Status: types.ActionResultStatusError},
+			expected: types.JobStatusFailed,
+		},
+		"timeout": {
+			err:           context.DeadlineExceeded,
+			expected:      types.JobStatusTimeout,
+			expectedError: "The action execution timeout",
+		},
+		"disconnected": {
+			err:           ErrSessionClosed,
+			expected:      types.JobStatusFailed,
+			expectedError: "The client disconnected while running the action",
+		},
+		"other error": {
+			err:           errors.New("error"),
+			expected:      types.JobStatusFailed,
+			expectedError: "error",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			job := &Job{
+				status:    types.JobStatusRunning,
+				createdAt: time.Now(),
+			}
+			job.finish(tc.result, tc.err)
+			assert.Equal(t, tc.expected, job.Status())
+			assert.Equal(t, tc.expectedError, job.Response().Error)
+		})
+	}
+}
+
+func TestJob_Response(t *testing.T) {
+	job := &Job{
+		id:        "00000000-0000-0000-0000-000000000001",
+		action:    "action1",
+		status:    types.JobStatusRunning,
+		createdAt: time.Now(),
+	}
+	// the binary result is encoded in base64
+	job.finish(&types.ActionResult{
+		Status: types.ActionResultStatusSuccess,
+		Body:   string([]byte{0x89, 0x50, 0x4e, 0x47, 0x00, 0xff}),
+	}, nil)
+
+	resp := job.Response()
+	assert.Equal(t, types.JobStatusSucceeded, resp.Status)
+	assert.Equal(t, "iVBORwD/", resp.Body)
+	assert.Equal(t, types.BodyEncodingBase64, resp.BodyEncoding)
+	assert.NotNil(t, resp.FinishedAt)
+
+	// the response that the action declared is kept
+	job = &Job{
+		id:        "00000000-0000-0000-0000-000000000002",
+		action:    "action1",
+		status:    types.JobStatusRunning,
+		createdAt: time.Now(),
+	}
+	job.finish(&types.ActionResult{
+		Status:     types.ActionResultStatusSuccess,
+		Body:       "created",
+		StatusCode: http.StatusCreated,
+		Headers:    map[string]string{"Location": "/items/1"},
+	}, nil)
+	resp = job.Response()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, map[string]string{"Location": "/items/1"}, resp.Headers)
+}
@@ -0,0 +1,110 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"github.com/kohkimakimoto/actions-gateway/metrics"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"time"
+)
+
+// The outcomes of the invocations in the metrics.
+const (
+	outcomeSuccess       = "success"
+	outcomeError         = "error"
+	outcomeBusy          = "busy"
+	outcomeTimeout       = "timeout"
+	outcomeCanceled      = "canceled"
+	outcomeSessionClosed = "session_closed"
+	outcomeSendFailed    = "send_failed"
+)
+
+// routerMetrics is a set of the metrics of the router and its sessions.
+// The methods do nothing on nil, so that the sessions that are not created by a router can be used without metrics.
+type routerMetrics struct {
+	sessionsCreated    *metrics.Counter
+	sessionsClosed     *metrics.Counter
+	invocations        *metrics.Counter
+	invocationDuration *metrics.Histogram
+	timeouts           *metrics.Counter
+	writeFailures      *metrics.Counter
+}
+
+// newRouterMetrics creates the metrics of the router and registers them to the registry.
+func newRouterMetrics(r *Router, reg *metrics.Registry) *routerMetrics {
+	reg.NewGaugeFunc("actions_gateway_sessions", "The number of the sessions of the agents including the ones that are not connected yet.", func() float64 {
+		return float64(r.NumSessions())
+	})
+	reg.NewGaugeFunc("actions_gateway_pending_results", "The number of the invocations that wait for their results from the agents.", func() float64 {
+		return float64(r.NumPendingResults())
+	})
+	reg.NewGaugeFunc("actions_gateway_outbound_queue_depth", "The number of the messages that wait to be written to the websocket connections of the agents.", func() float64 {
+		return float64(r.OutboundQueueDepth())
+	})
+	reg.NewGaugeFunc("actions_gateway_reconnect_queued", "The number of the invocations that wait for the agents to reconnect.", func() float64 {
+		return float64(r.NumQueued())
+	})
+	return &routerMetrics{
+		sessionsCreated:    reg.NewCounter("actions_gateway_sessions_created_total", "The number of the sessions that were created."),
+		sessionsClosed:     reg.NewCounter("actions_gateway_sessions_closed_total", "The number of the sessions that were closed or expired."),
+		invocations:        reg.NewCounter("actions_gateway_invocations_total", "The number of the invocations of the actions on the agents by action and outcome.", "action", "outcome"),
+		invocationDuration: reg.NewHistogram("actions_gateway_invocation_duration_seconds", "The time from sending the actions to the agents until their results arrive.", metrics.DefaultBuckets, "action"),
+		timeouts:           reg.NewCounter("actions_gateway_invocation_timeouts_total", "The number of the invocations that timed out by action.", "action"),
+		writeFailures:      reg.NewCounter("actions_gateway_websocket_write_failures_total", "The number of the failed writes to the websocket connections of the agents."),
+	}
+}
+
+func (m *routerMetrics) sessionCreated() {
+	if m == nil {
+		return
+	}
+	m.sessionsCreated.Inc()
+}
+
+func (m *routerMetrics) sessionClosed() {
+	if m == nil {
+		return
+	}
+	m.sessionsClosed.Inc()
+}
+
+func (m *routerMetrics) writeFailed() {
+	if m == nil {
+		return
+	}
+	m.writeFailures.Inc()
+}
+
+// invoked records the invocation of the action that started at start and ended with the result or the error.
+func (m *routerMetrics) invoked(name string, start time.Time, result *types.ActionResult, err error) {
+	if m == nil {
+		return
+	}
+	outcome := invocationOutcome(result, err)
+	m.invocations.Inc(name, outcome)
+	if outcome == outcomeTimeout {
+		m.timeouts.Inc(name)
+	}
+	if err == nil {
+		m.invocationDuration.Observe(time.Since(start).Seconds(), name)
+	}
+}
+
+func invocationOutcome(result *types.ActionResult, err error) string {
+	switch {
+	case err == nil && result.Status == types.ActionResultStatusSuccess:
+		return outcomeSuccess
+	case err == nil && result.Status == types.ActionResultStatusBusy:
+		return outcomeBusy
+	case err == nil:
+		return outcomeError
+	case errors.Is(err, context.DeadlineExceeded):
+		return outcomeTimeout
+	case errors.Is(err, context.Canceled):
+		return outcomeCanceled
+	case errors.Is(err, ErrSessionClosed), errors.Is(err, ErrSessionReplaced):
+		return outcomeSessionClosed
+	default:
+		return outcomeSendFailed
+	}
+}
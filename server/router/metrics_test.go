@@ -0,0 +1,123 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"github.com/kohkimakimoto/actions-gateway/metrics"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRouter_Metrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	r := New(WithMetrics(reg))
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	req := &types.SessionNewRequest{
+		Actions:          []string{"action1"},
+		ProtocolVersions: []int{types.ProtocolVersion2},
+	}
+	sess1, err := r.NewSession(ct, req)
+	assert.NoError(t, err)
+	sess2, err := r.NewSession(ct, req)
+	assert.NoError(t, err)
+
+	// the first client disconnects when it receives the action message
+	sess1.conn = testWebsocketConn(t, func(message []byte) {
+		r.CloseSession(sess1)
+	})
+	// the second client returns the result of the first action, and never returns the result of the second one
+	sess2.conn = testWebsocketConn(t, func(message []byte) {
+		env, err := types.ParseEnvelope(message)
+		assert.NoError(t, err)
+		if env.Id == "00000000-0000-0000-0000-000000000004" {
+			assert.NoError(t, sess2.HandleActionResult(&types.ActionResult{
+				Id:     env.Id,
+				Status: types.ActionResultStatusSuccess,
+			}))
+		} else {
+			assert.Equal(t, 1, r.NumPendingResults())
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = r.Invoke(ctx, sess1, &types.ActionMessage{
+		Id:   "00000000-0000-0000-0000-000000000004",
+		Name: "action1",
+	}, nil)
+	assert.NoError(t, err)
+
+	// The deadline leaves time for the client to receive the action message while it is pending.
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = r.Invoke(ctx, sess2, &types.ActionMessage{
+		Id:   "00000000-0000-0000-0000-000000000005",
+		Name: "action1",
+	}, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	assert.Equal(t, 0, r.NumPendingResults())
+	assert.Equal(t, float64(2), r.metrics.sessionsCreated.Value())
+	assert.Equal(t, float64(1), r.metrics.sessionsClosed.Value())
+	assert.Equal(t, float64(1), r.metrics.invocations.Value("action1", outcomeSessionClosed))
+	assert.Equal(t, float64(1), r.metrics.invocations.Value("action1", outcomeSuccess))
+	assert.Equal(t, float64(1), r.metrics.invocations.Value("action1", outcomeTimeout))
+	assert.Equal(t, float64(1), r.metrics.timeouts.Value("action1"))
+	assert.Equal(t, uint64(1), r.metrics.invocationDuration.Count("action1"))
+
+	var buf bytes.Buffer
+	assert.NoError(t, reg.Write(&buf))
+	assert.Contains(t, buf.String(), "actions_gateway_sessions 1\n")
+	assert.Contains(t, buf.String(), "actions_gateway_pending_results 0\n")
+	assert.Contains(t, buf.String(), "actions_gateway_outbound_queue_depth 0\n")
+	assert.Contains(t, buf.String(), `actions_gateway_invocations_total{action="action1",outcome="success"} 1`)
+}
+
+func TestInvocationOutcome(t *testing.T) {
+	testCases := map[string]struct {
+		result   *types.ActionResult
+		err      error
+		expected string
+	}{
+		"success": {
+			result:   &types.ActionResult{Status: types.ActionResultStatusSuccess},
+			expected: outcomeSuccess,
+		},
+		"error": {
+			result:   &types.ActionResult{Status: types.ActionResultStatusError},
+			expected: outcomeError,
+		},
+		"busy": {
+			result:   &types.ActionResult{Status: types.ActionResultStatusBusy},
+			expected: outcomeBusy,
+		},
+		"timeout": {
+			err:      errors.Wrap(context.DeadlineExceeded, "failed to send a cancel message"),
+			expected: outcomeTimeout,
+		},
+		"canceled": {
+			err:      context.Canceled,
+			expected: outcomeCanceled,
+		},
+		"session replaced": {
+			err:      ErrSessionReplaced,
+			expected: outcomeSessionClosed,
+		},
+		"send failed": {
+			err:      errors.WithStack(ErrOutboundQueueFull),
+			expected: outcomeSendFailed,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, invocationOutcome(tc.result, tc.err))
+		})
+	}
+}
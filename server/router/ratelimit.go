@@ -0,0 +1,222 @@
+package router
+
+import (
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"math"
+	"sync"
+	"time"
+)
+
+// The scopes of the rate limits.
+const (
+	// RateLimitScopeClient limits the requests to a client
+	RateLimitScopeClient = "client"
+	// RateLimitScopeAction limits the requests to an action of a client
+	RateLimitScopeAction = "action"
+	// RateLimitScopeIP limits the requests from a source IP address
+	RateLimitScopeIP = "ip"
+)
+
+// RateLimiter limits the rate of the requests with token buckets.
+// Each bucket is identified by the scope and the key, such as the client id for RateLimitScopeClient.
+type RateLimiter struct {
+	// buckets stores the token buckets by scope and key
+	buckets map[rateLimitKey]*tokenBucket
+	// limits stores the default rate limits by scope
+	limits map[string]*types.RateLimit
+	// rejected stores the number of the rejected requests by scope
+	rejected map[string]int64
+	// sweptAt is the time when the full buckets were removed last
+	sweptAt time.Time
+	// mu is a mutex for operations on buckets and rejected
+	mu sync.Mutex
+}
+
+type rateLimitKey struct {
+	scope string
+	key   string
+}
+
+type tokenBucket struct {
+	limit types.RateLimit
+	// tokens is the number of the tokens at updatedAt
+	tokens    float64
+	updatedAt time.Time
+}
+
+// RateLimitCheck is a rate limit to check for a request.
+type RateLimitCheck struct {
+	// Scope is the scope of the rate limit
+	Scope string
+	// Key identifies the bucket in the scope
+	Key string
+	// Limit is the rate limit. The check is skipped if it is nil.
+	Limit *types.RateLimit
+}
+
+// RateLimitDecision is the result of checking the rate limits for a request.
+type RateLimitDecision struct {
+	// Allowed reports whether the request is allowed
+	Allowed bool
+	// Scope is the scope of the rate limit that the other fields describe.
+	// It is the rate limit that rejected the request, or the one that has the fewest remaining requests.
+	Scope string
+	// Limit is the maximum number of the requests in a burst
+	Limit int
+	// Remaining is the number of the requests that can be made now
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the rejected request can be made
+	RetryAfter time.Duration
+}
+
+type RateLimiterOption func(*RateLimiter)
+
+// WithRateLimit sets the default rate limit of the scope. Nil disables it.
+func WithRateLimit(scope string, limit *types.RateLimit) RateLimiterOption {
+	return func(l *RateLimiter) {
+		l.limits[scope] = limit
+	}
+}
+
+// NewRateLimiter creates a new RateLimiter object.
+func NewRateLimiter(options ...RateLimiterOption) *RateLimiter {
+	l := &RateLimiter{
+		buckets:  make(map[rateLimitKey]*tokenBucket),
+		limits:   make(map[string]*types.RateLimit),
+		rejected: make(map[string]int64),
+		sweptAt:  time.Now(),
+	}
+	for _, option := range options {
+		option(l)
+	}
+	return l
+}
+
+// Limit returns the default rate limit of the scope. It returns nil if the scope is not limited by default.
+func (l *RateLimiter) Limit(scope string) *types.RateLimit {
+	return l.limits[scope]
+}
+
+// rateLimitSweepInterval is the interval to remove the buckets that are full.
+var rateLimitSweepInterval = time.Minute
+
+// Allow checks the rate limits for a request. The request is allowed only if all the rate limits allow it,
+// and then it takes a token from each bucket. The rejected request takes no tokens.
+// It returns nil if there are no rate limits to check.
+func (l *RateLimiter) Allow(checks ...*RateLimitCheck) *RateLimitDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	type checked struct {
+		check  *RateLimitCheck
+		bucket *tokenBucket
+	}
+	var targets []checked
+	var rejected *RateLimitDecision
+	for _, check := range checks {
+		if check.Limit == nil {
+			continue
+		}
+		k := rateLimitKey{scope: check.Scope, key: check.Key}
+		b, ok := l.buckets[k]
+		if !ok || b.limit != *check.Limit {
+			// The bucket starts full, and also when the limit has been changed.
+			b = &tokenBucket{limit: *check.Limit, tokens: float64(check.Limit.Count), updatedAt: now}
+			l.buckets[k] = b
+		}
+		b.refill(now)
+		targets = append(targets, checked{check: check, bucket: b})
+
+		if b.tokens < 1 {
+			l.rejected[check.Scope]++
+			retryAfter := b.timeUntil(1)
+			if rejected == nil || retryAfter > rejected.RetryAfter {
+				rejected = &RateLimitDecision{
+					Scope:      check.Scope,
+					Limit:      b.limit.Count,
+					Reset:      b.timeUntil(float64(b.limit.Count)),
+					RetryAfter: retryAfter,
+				}
+			}
+		}
+	}
+	if rejected != nil {
+		return rejected
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	var decision *RateLimitDecision
+	for _, t := range targets {
+		t.bucket.tokens--
+		remaining := int(t.bucket.tokens)
+		if decision == nil || remaining < decision.Remaining {
+			decision = &RateLimitDecision{
+				Allowed:   true,
+				Scope:     t.check.Scope,
+				Limit:     t.bucket.limit.Count,
+				Remaining: remaining,
+				Reset:     t.bucket.timeUntil(float64(t.bucket.limit.Count)),
+			}
+		}
+	}
+	return decision
+}
+
+// Rejected returns the number of the rejected requests by scope.
+func (l *RateLimiter) Rejected() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rejected := make(map[string]int64, len(l.rejected))
+	for scope, n := range l.rejected {
+		rejected[scope] = n
+	}
+	return rejected
+}
+
+// Len returns the number of the buckets.
+func (l *RateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// sweep removes the buckets that are full, because they are the same as the new ones. The caller must hold the lock.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.sweptAt) < rateLimitSweepInterval {
+		return
+	}
+	l.sweptAt = now
+	for k, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Count) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// refill adds the tokens for the time elapsed since the last update.
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updatedAt)
+	b.tokens = math.Min(float64(b.limit.Count), b.tokens+elapsed.Seconds()*b.rate())
+	b.updatedAt = now
+}
+
+// rate returns the number of the tokens that are added per second.
+func (b *tokenBucket) rate() float64 {
+	return float64(b.limit.Count) / b.limit.Period.Seconds()
+}
+
+// timeUntil returns the time until the bucket has the tokens.
+func (b *tokenBucket) timeUntil(tokens float64) time.Duration {
+	if b.tokens >= tokens {
+		return 0
+	}
+	return time.Duration((tokens - b.tokens) / b.rate() * float64(time.Second))
+}
@@ -0,0 +1,101 @@
+package router
+
+import (
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	clientId := "00000000-0000-0000-0000-000000000001"
+	perMinute := func(n int) *types.RateLimit {
+		return &types.RateLimit{Count: n, Period: time.Minute}
+	}
+
+	t.Run("no rate limits", func(t *testing.T) {
+		l := NewRateLimiter()
+		assert.Nil(t, l.Allow(&RateLimitCheck{Scope: RateLimitScopeClient, Key: clientId}))
+		assert.Equal(t, 0, l.Len())
+	})
+
+	t.Run("allow a burst up to the limit", func(t *testing.T) {
+		l := NewRateLimiter(WithRateLimit(RateLimitScopeClient, perMinute(3)))
+		check := &RateLimitCheck{Scope: RateLimitScopeClient, Key: clientId, Limit: l.Limit(RateLimitScopeClient)}
+		for i := 2; i >= 0; i-- {
+			d := l.Allow(check)
+			assert.True(t, d.Allowed)
+			assert.Equal(t, 3, d.Limit)
+			assert.Equal(t, i, d.Remaining)
+		}
+
+		d := l.Allow(check)
+		assert.False(t, d.Allowed)
+		assert.Equal(t, RateLimitScopeClient, d.Scope)
+		assert.Equal(t, 0, d.Remaining)
+		assert.InDelta(t, 20*time.Second, d.RetryAfter, float64(time.Second))
+		assert.InDelta(t, time.Minute, d.Reset, float64(time.Second))
+		assert.Equal(t, map[string]int64{RateLimitScopeClient: 1}, l.Rejected())
+
+		// the other key has its own bucket
+		assert.True(t, l.Allow(&RateLimitCheck{Scope: RateLimitScopeClient, Key: "other", Limit: check.Limit}).Allowed)
+		assert.Equal(t, 2, l.Len())
+	})
+
+	t.Run("the rejected request takes no tokens", func(t *testing.T) {
+		l := NewRateLimiter()
+		client := &RateLimitCheck{Scope: RateLimitScopeClient, Key: clientId, Limit: perMinute(2)}
+		action := &RateLimitCheck{Scope: RateLimitScopeAction, Key: clientId + "/test", Limit: perMinute(1)}
+
+		d := l.Allow(client, action)
+		assert.True(t, d.Allowed)
+		// the decision describes the limit with the fewest remaining requests
+		assert.Equal(t, RateLimitScopeAction, d.Scope)
+
+		d = l.Allow(client, action)
+		assert.False(t, d.Allowed)
+		assert.Equal(t, RateLimitScopeAction, d.Scope)
+
+		// the client bucket still has a token
+		d = l.Allow(client)
+		assert.True(t, d.Allowed)
+		assert.Equal(t, 0, d.Remaining)
+	})
+
+	t.Run("refill the tokens", func(t *testing.T) {
+		l := NewRateLimiter()
+		check := &RateLimitCheck{Scope: RateLimitScopeIP, Key: "192.0.2.1", Limit: &types.RateLimit{Count: 1, Period: 50 * time.Millisecond}}
+		assert.True(t, l.Allow(check).Allowed)
+		assert.False(t, l.Allow(check).Allowed)
+		time.Sleep(60 * time.Millisecond)
+		assert.True(t, l.Allow(check).Allowed)
+	})
+
+	t.Run("reset the bucket when the limit changes", func(t *testing.T) {
+		l := NewRateLimiter()
+		check := &RateLimitCheck{Scope: RateLimitScopeAction, Key: clientId + "/test", Limit: perMinute(1)}
+		assert.True(t, l.Allow(check).Allowed)
+		assert.False(t, l.Allow(check).Allowed)
+
+		check.Limit = perMinute(5)
+		d := l.Allow(check)
+		assert.True(t, d.Allowed)
+		assert.Equal(t, 4, d.Remaining)
+	})
+
+	t.Run("remove the full buckets", func(t *testing.T) {
+		interval := rateLimitSweepInterval
+		rateLimitSweepInterval = 0
+		defer func() {
+			rateLimitSweepInterval = interval
+		}()
+
+		l := NewRateLimiter()
+		check := &RateLimitCheck{Scope: RateLimitScopeIP, Key: "192.0.2.1", Limit: &types.RateLimit{Count: 1, Period: 10 * time.Millisecond}}
+		assert.True(t, l.Allow(check).Allowed)
+		assert.Equal(t, 1, l.Len())
+		time.Sleep(20 * time.Millisecond)
+		l.Allow(&RateLimitCheck{Scope: RateLimitScopeIP, Key: "192.0.2.2", Limit: check.Limit})
+		assert.Equal(t, 1, l.Len())
+	})
+}
@@ -0,0 +1,91 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"time"
+)
+
+var (
+	// ErrNotReconnecting is returned when the client has no active session and is not expected to reconnect,
+	// because it disconnected before the grace period or the grace period is disabled.
+	ErrNotReconnecting = errors.New("the client is not reconnecting")
+	// ErrReconnectQueueFull is returned when too many invocations wait for the client to reconnect.
+	ErrReconnectQueueFull = errors.New("too many invocations wait for the client to reconnect")
+	// ErrReconnectTimeout is returned when the client does not reconnect within the grace period.
+	ErrReconnectTimeout = errors.New("the client did not reconnect within the grace period")
+)
+
+// WaitForReconnect waits for the client to reconnect and returns its active sessions.
+// The invocations can wait only within the grace period after the last active session of the client closed,
+// and only up to the queue size of the invocations can wait at the same time.
+func (r *Router) WaitForReconnect(ctx context.Context, client *auth.Client) ([]*Session, error) {
+	r.mu.Lock()
+	if sessions := r.activeSessions(client.Id); len(sessions) > 0 {
+		// The client has already reconnected.
+		r.mu.Unlock()
+		return sessions, nil
+	}
+	disconnectedAt, ok := r.disconnectedAt[client.Id]
+	deadline := disconnectedAt.Add(r.gracePeriod)
+	if r.gracePeriod <= 0 || !ok || !time.Now().Before(deadline) {
+		// the grace period has passed
+		delete(r.disconnectedAt, client.Id)
+		r.mu.Unlock()
+		return nil, ErrNotReconnecting
+	}
+	if r.queued[client.Id] >= r.queueSize {
+		r.mu.Unlock()
+		return nil, ErrReconnectQueueFull
+	}
+	r.queued[client.Id]++
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.queued[client.Id]--
+		if r.queued[client.Id] == 0 {
+			delete(r.queued, client.Id)
+			delete(r.activated, client.Id)
+		}
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		r.mu.Lock()
+		if sessions := r.activeSessions(client.Id); len(sessions) > 0 {
+			r.mu.Unlock()
+			return sessions, nil
+		}
+		activated, ok := r.activated[client.Id]
+		if !ok {
+			activated = make(chan struct{})
+			r.activated[client.Id] = activated
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-activated:
+			// check the active sessions again, because the session may have closed already
+		case <-timer.C:
+			return nil, ErrReconnectTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// NumQueued returns the number of the invocations that wait for the clients to reconnect.
+func (r *Router) NumQueued() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n := 0
+	for _, queued := range r.queued {
+		n += queued
+	}
+	return n
+}
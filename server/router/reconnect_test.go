@@ -0,0 +1,157 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouter_WaitForReconnect(t *testing.T) {
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	// disconnect closes the active session of the client to start the grace period
+	disconnect := func(t *testing.T, r *Router) {
+		sess, err := r.NewSession(ct, &types.SessionNewRequest{})
+		assert.NoError(t, err)
+		sess.conn = &websocket.Conn{}
+		r.mu.Lock()
+		r.removeSession(sess)
+		sess.conn = nil
+		r.mu.Unlock()
+		r.disconnectedAt[ct.Id] = time.Now()
+	}
+
+	t.Run("the client reconnects", func(t *testing.T) {
+		r := New(WithReconnectGracePeriod(5 * time.Second))
+		disconnect(t, r)
+
+		ch := make(chan []*Session, 1)
+		go func() {
+			sessions, err := r.WaitForReconnect(context.Background(), ct)
+			assert.NoError(t, err)
+			ch <- sessions
+		}()
+		assert.Eventually(t, func() bool {
+			return r.NumQueued() == 1
+		}, time.Second, 10*time.Millisecond)
+
+		sess, err := r.NewSession(ct, &types.SessionNewRequest{})
+		assert.NoError(t, err)
+		_, err = r.ActivateSession(testUpgradableResponseWriter(), testUpgradeRequest(), ct, sess.id)
+		assert.NoError(t, err)
+
+		select {
+		case sessions := <-ch:
+			assert.Equal(t, []*Session{sess}, sessions)
+		case <-time.After(time.Second):
+			t.Fatal("the invocation was not dispatched")
+		}
+		assert.Eventually(t, func() bool {
+			return r.NumQueued() == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("the client is not reconnecting", func(t *testing.T) {
+		r := New(WithReconnectGracePeriod(5 * time.Second))
+		_, err := r.WaitForReconnect(context.Background(), ct)
+		assert.ErrorIs(t, err, ErrNotReconnecting)
+
+		// the grace period is disabled
+		r = New()
+		disconnect(t, r)
+		_, err = r.WaitForReconnect(context.Background(), ct)
+		assert.ErrorIs(t, err, ErrNotReconnecting)
+	})
+
+	t.Run("the client does not reconnect in time", func(t *testing.T) {
+		r := New(WithReconnectGracePeriod(100 * time.Millisecond))
+		disconnect(t, r)
+		_, err := r.WaitForReconnect(context.Background(), ct)
+		assert.ErrorIs(t, err, ErrReconnectTimeout)
+
+		// the grace period has passed
+		_, err = r.WaitForReconnect(context.Background(), ct)
+		assert.ErrorIs(t, err, ErrNotReconnecting)
+	})
+
+	t.Run("the queue is full", func(t *testing.T) {
+		r := New(WithReconnectGracePeriod(5*time.Second), WithReconnectQueueSize(1))
+		disconnect(t, r)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			_, _ = r.WaitForReconnect(ctx, ct)
+		}()
+		assert.Eventually(t, func() bool {
+			return r.NumQueued() == 1
+		}, time.Second, 10*time.Millisecond)
+
+		_, err := r.WaitForReconnect(context.Background(), ct)
+		assert.ErrorIs(t, err, ErrReconnectQueueFull)
+
+		// the caller gives up
+		cancel()
+		assert.Eventually(t, func() bool {
+			return r.NumQueued() == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestRouter_CloseSession_StartsGracePeriod(t *testing.T) {
+	r := New(WithReconnectGracePeriod(200 * time.Millisecond))
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	sess1, err := r.NewSession(ct, &types.SessionNewRequest{})
+	assert.NoError(t, err)
+	sess1.conn = testWebsocketConn(t, func(message []byte) {})
+	sess2, err := r.NewSession(ct, &types.SessionNewRequest{})
+	assert.NoError(t, err)
+	sess2.conn = testWebsocketConn(t, func(message []byte) {})
+
+	// the client still has an active session
+	r.CloseSession(sess1)
+	assert.NotContains(t, r.disconnectedAt, ct.Id)
+
+	r.CloseSession(sess2)
+	r.mu.RLock()
+	assert.Contains(t, r.disconnectedAt, ct.Id)
+	r.mu.RUnlock()
+
+	// the time of the disconnection is forgotten after the grace period
+	assert.Eventually(t, func() bool {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		_, ok := r.disconnectedAt[ct.Id]
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func testUpgradeRequest() *http.Request {
+	return &http.Request{
+		Method: http.MethodGet,
+		Header: http.Header{
+			"Upgrade":               []string{"websocket"},
+			"Connection":            []string{"upgrade"},
+			"Sec-Websocket-Key":     []string{"dGhlIHNhbXBsZSBub25jZQ=="},
+			"Sec-Websocket-Version": []string{"13"},
+		},
+	}
+}
+
+func testUpgradableResponseWriter() *testHijakableResponseWriter {
+	br := bufio.NewReaderSize(strings.NewReader(""), 4096)
+	bw := bufio.NewWriterSize(&bytes.Buffer{}, 4096)
+	return &testHijakableResponseWriter{
+		brw: bufio.NewReadWriter(br, bw),
+	}
+}
@@ -0,0 +1,145 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// Registry is a registry of the sessions that are connected to the server replicas.
+// The router registers the sessions that are connected to its own node,
+// and looks up the sessions that are connected to the other nodes to forward the requests to them.
+type Registry interface {
+	// Register registers the session or updates its entry.
+	Register(entry *RegistryEntry) error
+	// Unregister removes the entry of the session.
+	Unregister(clientId string, sessionId string) error
+	// Lookup returns the entries of the sessions of the client on all the nodes.
+	Lookup(clientId string) ([]*RegistryEntry, error)
+	// RegisterNode registers the node so that the other nodes can reach it, or updates its entry.
+	RegisterNode(node *NodeEntry) error
+	// LookupNode returns the entry of the node. It returns nil if the node is not registered.
+	LookupNode(nodeId string) (*NodeEntry, error)
+}
+
+// NodeEntry describes a server node.
+type NodeEntry struct {
+	// NodeId is the id of the node
+	NodeId string `json:"node_id"`
+	// NodeURL is the URL to reach the node from the other nodes
+	NodeURL string `json:"node_url"`
+	// UpdatedAt is the time when the entry was registered or refreshed
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// RegistryEntry describes a session and the node that it is connected to.
+type RegistryEntry struct {
+	// ClientId is the id of the client of the session
+	ClientId string `json:"client_id"`
+	// SessionId is the session id
+	SessionId string `json:"session_id"`
+	// NodeId is the id of the node that the session is connected to
+	NodeId string `json:"node_id"`
+	// NodeURL is the URL to reach the node from the other nodes
+	NodeURL string `json:"node_url"`
+	// Actions is a list of the action names that are supported by the session
+	Actions []string `json:"actions"`
+	// Labels is the labels of the agent
+	Labels map[string]string `json:"labels,omitempty"`
+	// Timeouts is the execution timeouts in seconds declared by the actions of the session
+	Timeouts map[string]int `json:"timeouts,omitempty"`
+	// UpdatedAt is the time when the entry was registered or refreshed
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// HasAction reports whether the session supports the action.
+func (e *RegistryEntry) HasAction(name string) bool {
+	for _, a := range e.Actions {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ActionTimeout returns the execution timeout declared by the action of the session.
+// It returns zero if the action does not declare it.
+func (e *RegistryEntry) ActionTimeout(name string) time.Duration {
+	return time.Duration(e.Timeouts[name]) * time.Second
+}
+
+// Node returns the entry of the node that the session is connected to.
+func (e *RegistryEntry) Node() *NodeEntry {
+	return &NodeEntry{
+		NodeId:  e.NodeId,
+		NodeURL: e.NodeURL,
+	}
+}
+
+// MemoryRegistry is a Registry that keeps the entries in process memory.
+// It is the default registry for the server that runs as a single node.
+type MemoryRegistry struct {
+	// entries stores the entries by client id and session id
+	entries map[string]map[string]*RegistryEntry
+	// nodes stores the entries of the nodes by node id
+	nodes map[string]*NodeEntry
+	// mu is a mutex for operations on entries and nodes
+	mu sync.RWMutex
+}
+
+// NewMemoryRegistry creates a new MemoryRegistry object
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		entries: make(map[string]map[string]*RegistryEntry),
+		nodes:   make(map[string]*NodeEntry),
+	}
+}
+
+func (reg *MemoryRegistry) Register(entry *RegistryEntry) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if reg.entries[entry.ClientId] == nil {
+		reg.entries[entry.ClientId] = make(map[string]*RegistryEntry)
+	}
+	entry.UpdatedAt = time.Now()
+	reg.entries[entry.ClientId][entry.SessionId] = entry
+	return nil
+}
+
+func (reg *MemoryRegistry) Unregister(clientId string, sessionId string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	delete(reg.entries[clientId], sessionId)
+	if len(reg.entries[clientId]) == 0 {
+		delete(reg.entries, clientId)
+	}
+	return nil
+}
+
+func (reg *MemoryRegistry) Lookup(clientId string) ([]*RegistryEntry, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	entries := make([]*RegistryEntry, 0, len(reg.entries[clientId]))
+	for _, entry := range reg.entries[clientId] {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (reg *MemoryRegistry) RegisterNode(node *NodeEntry) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	node.UpdatedAt = time.Now()
+	reg.nodes[node.NodeId] = node
+	return nil
+}
+
+func (reg *MemoryRegistry) LookupNode(nodeId string) (*NodeEntry, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	return reg.nodes[nodeId], nil
+}
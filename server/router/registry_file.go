@@ -0,0 +1,244 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodesDir is the name of the subdirectory of the entries of the nodes.
+// It never conflicts with the directories of the clients, whose ids are UUIDs.
+const nodesDir = "_nodes"
+
+// FileRegistry is a Registry that shares the entries between the nodes through a directory,
+// such as a directory on a network file system that is mounted on all the nodes.
+// Each entry is a JSON file, and the node refreshes the entries of its own sessions periodically.
+// The entries that are not refreshed within the TTL, for example because their node crashed, are ignored.
+// The entries of the nodes are stored in the nodesDir subdirectory.
+type FileRegistry struct {
+	// dir is the shared directory
+	dir string
+	// ttl is the time to live of the entries that are not refreshed
+	ttl time.Duration
+	// entries stores the entries that this node registered by client id and session id
+	entries map[string]*RegistryEntry
+	// node is the entry of this node. It is nil until the node registers itself.
+	node *NodeEntry
+	// mu is a mutex for operations on entries and node
+	mu sync.Mutex
+	// done is closed when the registry is closed
+	done chan struct{}
+	// closeOnce ensures that the registry is closed only once
+	closeOnce sync.Once
+}
+
+// NewFileRegistry creates a new FileRegistry object that uses the directory,
+// and starts refreshing the entries of this node.
+func NewFileRegistry(dir string, ttl time.Duration) (*FileRegistry, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("the registry ttl must be positive: %s", ttl)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create the registry directory: %w", err)
+	}
+	reg := &FileRegistry{
+		dir:     dir,
+		ttl:     ttl,
+		entries: make(map[string]*RegistryEntry),
+		done:    make(chan struct{}),
+	}
+	go reg.refreshLoop()
+	return reg, nil
+}
+
+func (reg *FileRegistry) Register(entry *RegistryEntry) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	entry.UpdatedAt = time.Now()
+	if err := reg.write(entry); err != nil {
+		return err
+	}
+	reg.entries[entry.ClientId+"/"+entry.SessionId] = entry
+	return nil
+}
+
+func (reg *FileRegistry) Unregister(clientId string, sessionId string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	delete(reg.entries, clientId+"/"+sessionId)
+	if err := os.Remove(reg.path(clientId, sessionId)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove the registry entry: %w", err)
+	}
+	return nil
+}
+
+func (reg *FileRegistry) Lookup(clientId string) ([]*RegistryEntry, error) {
+	files, err := os.ReadDir(filepath.Join(reg.dir, clientId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read the registry directory: %w", err)
+	}
+
+	var entries []*RegistryEntry
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(reg.dir, clientId, f.Name()))
+		if err != nil {
+			// The entry may have been removed after reading the directory.
+			continue
+		}
+		entry := &RegistryEntry{}
+		if err := json.Unmarshal(b, entry); err != nil {
+			continue
+		}
+		if time.Since(entry.UpdatedAt) > reg.ttl {
+			// The node of the entry has stopped refreshing it.
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (reg *FileRegistry) RegisterNode(node *NodeEntry) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	node.UpdatedAt = time.Now()
+	// The entry is written again in the next refresh even if it fails now.
+	reg.node = node
+	return reg.writeNode(node)
+}
+
+func (reg *FileRegistry) LookupNode(nodeId string) (*NodeEntry, error) {
+	if nodeId == "" || filepath.Base(nodeId) != nodeId || nodeId == ".." {
+		// The node id may come from a request, so it must not point outside the directory.
+		return nil, nil
+	}
+	b, err := os.ReadFile(reg.nodePath(nodeId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read the node entry: %w", err)
+	}
+	node := &NodeEntry{}
+	if err := json.Unmarshal(b, node); err != nil {
+		return nil, fmt.Errorf("failed to decode the node entry: %w", err)
+	}
+	if time.Since(node.UpdatedAt) > reg.ttl {
+		// The node has stopped refreshing its entry.
+		return nil, nil
+	}
+	return node, nil
+}
+
+// Close stops refreshing the entries and removes the entries of this node.
+func (reg *FileRegistry) Close() error {
+	reg.closeOnce.Do(func() {
+		close(reg.done)
+	})
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for key, entry := range reg.entries {
+		_ = os.Remove(reg.path(entry.ClientId, entry.SessionId))
+		delete(reg.entries, key)
+	}
+	if reg.node != nil {
+		_ = os.Remove(reg.nodePath(reg.node.NodeId))
+		reg.node = nil
+	}
+	return nil
+}
+
+func (reg *FileRegistry) refreshLoop() {
+	ticker := time.NewTicker(reg.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reg.refresh()
+		case <-reg.done:
+			return
+		}
+	}
+}
+
+func (reg *FileRegistry) refresh() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, entry := range reg.entries {
+		entry.UpdatedAt = time.Now()
+		// The entry will be written again in the next refresh if it fails.
+		_ = reg.write(entry)
+	}
+	if reg.node != nil {
+		reg.node.UpdatedAt = time.Now()
+		_ = reg.writeNode(reg.node)
+	}
+}
+
+func (reg *FileRegistry) path(clientId string, sessionId string) string {
+	return filepath.Join(reg.dir, clientId, sessionId+".json")
+}
+
+func (reg *FileRegistry) nodePath(nodeId string) string {
+	return filepath.Join(reg.dir, nodesDir, nodeId+".json")
+}
+
+// writeNode writes the entry of the node to its file atomically.
+func (reg *FileRegistry) writeNode(node *NodeEntry) error {
+	b, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("failed to encode the node entry: %w", err)
+	}
+	if err := writeFileAtomic(reg.nodePath(node.NodeId), b); err != nil {
+		return fmt.Errorf("failed to write the node entry: %w", err)
+	}
+	return nil
+}
+
+// write writes the entry to its file atomically, so that the other nodes never read a partially written file.
+func (reg *FileRegistry) write(entry *RegistryEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode the registry entry: %w", err)
+	}
+	if err := writeFileAtomic(reg.path(entry.ClientId, entry.SessionId), b); err != nil {
+		return fmt.Errorf("failed to write the registry entry: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes the data to the file through a temporary file in the same directory,
+// so that the readers never see a partially written file. It creates the directory if it does not exist.
+func writeFileAtomic(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
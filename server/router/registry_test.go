@@ -0,0 +1,303 @@
+package router
+
+import (
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	testCases := map[string]func(t *testing.T) Registry{
+		"memory": func(t *testing.T) Registry {
+			return NewMemoryRegistry()
+		},
+		"file": func(t *testing.T) Registry {
+			reg, err := NewFileRegistry(t.TempDir(), time.Minute)
+			assert.NoError(t, err)
+			t.Cleanup(func() {
+				_ = reg.Close()
+			})
+			return reg
+		},
+	}
+
+	for name, newRegistry := range testCases {
+		t.Run(name, func(t *testing.T) {
+			reg := newRegistry(t)
+
+			entries, err := reg.Lookup("client1")
+			assert.NoError(t, err)
+			assert.Empty(t, entries)
+
+			assert.NoError(t, reg.Register(&RegistryEntry{ClientId: "client1", SessionId: "sess1", NodeId: "node1", Actions: []string{"a"}}))
+			assert.NoError(t, reg.Register(&RegistryEntry{ClientId: "client1", SessionId: "sess2", NodeId: "node2", Actions: []string{"b"}}))
+			assert.NoError(t, reg.Register(&RegistryEntry{ClientId: "client2", SessionId: "sess3", NodeId: "node1"}))
+
+			entries, err = reg.Lookup("client1")
+			assert.NoError(t, err)
+			assert.Len(t, entries, 2)
+
+			assert.NoError(t, reg.Unregister("client1", "sess1"))
+			entries, err = reg.Lookup("client1")
+			assert.NoError(t, err)
+			if assert.Len(t, entries, 1) {
+				assert.Equal(t, "sess2", entries[0].SessionId)
+				assert.Equal(t, "node2", entries[0].NodeId)
+				assert.Equal(t, []string{"b"}, entries[0].Actions)
+			}
+
+			// unregistering an unknown session is not an error
+			assert.NoError(t, reg.Unregister("client1", "unknown"))
+
+			node, err := reg.LookupNode("node1")
+			assert.NoError(t, err)
+			assert.Nil(t, node)
+			assert.NoError(t, reg.RegisterNode(&NodeEntry{NodeId: "node1", NodeURL: "http://node1"}))
+			node, err = reg.LookupNode("node1")
+			assert.NoError(t, err)
+			if assert.NotNil(t, node) {
+				assert.Equal(t, "http://node1", node.NodeURL)
+			}
+		})
+	}
+}
+
+func TestFileRegistry(t *testing.T) {
+	t.Run("invalid ttl", func(t *testing.T) {
+		_, err := NewFileRegistry(t.TempDir(), 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("shared by nodes", func(t *testing.T) {
+		dir := t.TempDir()
+		reg1, err := NewFileRegistry(dir, time.Minute)
+		assert.NoError(t, err)
+		defer reg1.Close()
+		reg2, err := NewFileRegistry(dir, time.Minute)
+		assert.NoError(t, err)
+		defer reg2.Close()
+
+		assert.NoError(t, reg1.Register(&RegistryEntry{ClientId: "client1", SessionId: "sess1", NodeId: "node1"}))
+		entries, err := reg2.Lookup("client1")
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+
+		assert.NoError(t, reg1.RegisterNode(&NodeEntry{NodeId: "node1", NodeURL: "http://node1"}))
+		node, err := reg2.LookupNode("node1")
+		assert.NoError(t, err)
+		assert.NotNil(t, node)
+
+		// closing the registry removes the entries of its node
+		assert.NoError(t, reg1.Close())
+		entries, err = reg2.Lookup("client1")
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+		node, err = reg2.LookupNode("node1")
+		assert.NoError(t, err)
+		assert.Nil(t, node)
+	})
+
+	t.Run("invalid node id", func(t *testing.T) {
+		dir := t.TempDir()
+		reg, err := NewFileRegistry(filepath.Join(dir, "registry"), time.Minute)
+		assert.NoError(t, err)
+		defer reg.Close()
+
+		// the file outside the directory is never read
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "secret.json"), []byte(`{"node_id":"secret"}`), 0600))
+		for _, nodeId := range []string{"", "..", "../secret", "../../secret"} {
+			node, err := reg.LookupNode(nodeId)
+			assert.NoError(t, err)
+			assert.Nil(t, node)
+		}
+	})
+
+	t.Run("expired entries", func(t *testing.T) {
+		dir := t.TempDir()
+		reg, err := NewFileRegistry(dir, 300*time.Millisecond)
+		assert.NoError(t, err)
+		defer reg.Close()
+
+		assert.NoError(t, reg.Register(&RegistryEntry{ClientId: "client1", SessionId: "sess1", NodeId: "node1"}))
+		// The entry of a node that crashed is left in the directory without being refreshed.
+		b, err := os.ReadFile(filepath.Join(dir, "client1", "sess1.json"))
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "client1", "sess2.json"), b, 0600))
+
+		time.Sleep(500 * time.Millisecond)
+		entries, err := reg.Lookup("client1")
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 1) {
+			// the entry of this node is refreshed
+			assert.Equal(t, "sess1", entries[0].SessionId)
+		}
+	})
+}
+
+func TestRouter_Registry(t *testing.T) {
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	reg := NewMemoryRegistry()
+	r1 := New(WithRegistry(reg), WithNode("node1", "http://node1"))
+	r2 := New(WithRegistry(reg), WithNode("node2", "http://node2"))
+
+	sess, err := r1.NewSession(ct, &types.SessionNewRequest{
+		Actions: []string{"hello"},
+		Labels:  map[string]string{"region": "tokyo"},
+	})
+	assert.NoError(t, err)
+
+	// inactive sessions are not registered
+	entry, err := r2.LookupRemote(ct, "hello", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+
+	_, err = r1.ActivateSession(testUpgradableResponseWriter(), testUpgradeRequest(), ct, sess.id)
+	assert.NoError(t, err)
+
+	entry, err = r2.LookupRemote(ct, "hello", Selector{"region": "tokyo"})
+	assert.NoError(t, err)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, sess.id, entry.SessionId)
+		assert.Equal(t, "node1", entry.NodeId)
+		assert.Equal(t, "http://node1", entry.NodeURL)
+	}
+
+	// the session does not match
+	entry, err = r2.LookupRemote(ct, "hello", Selector{"region": "osaka"})
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+	entry, err = r2.LookupRemote(ct, "unknown", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+
+	// the session on the own node is not a remote session
+	entry, err = r1.LookupRemote(ct, "hello", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+
+	r1.CloseSession(sess)
+	entry, err = r2.LookupRemote(ct, "hello", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+}
+
+func TestRouter_Forward(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Forwarded-By", req.Header.Get(ForwardedHeader))
+		_, _ = w.Write([]byte("hello from " + req.URL.Path))
+	}))
+	defer ts.Close()
+
+	r := New(WithNode("node1", "http://node1"))
+	req := httptest.NewRequest(http.MethodGet, "/actions/hello", nil)
+	assert.Empty(t, req.Header.Get(ForwardedHeader))
+
+	rec := httptest.NewRecorder()
+	r.Forward(rec, req, &RegistryEntry{NodeId: "node2", NodeURL: ts.URL})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "hello from /actions/hello", rec.Body.String())
+	assert.Equal(t, "node1", rec.Header().Get("X-Forwarded-By"))
+	assert.Equal(t, "node1", req.Header.Get(ForwardedHeader))
+
+	t.Run("forward to the node", func(t *testing.T) {
+		reg := NewMemoryRegistry()
+		r1 := New(WithRegistry(reg), WithNode("node1", "http://node1"))
+		New(WithRegistry(reg), WithNode("node2", ts.URL))
+
+		rec := httptest.NewRecorder()
+		forwarded, err := r1.ForwardToNode(rec, httptest.NewRequest(http.MethodGet, "/jobs/node2.1", nil), "node2")
+		assert.NoError(t, err)
+		assert.True(t, forwarded)
+		assert.Equal(t, "hello from /jobs/node2.1", rec.Body.String())
+
+		// the own node and the unknown nodes are not forwarded to
+		for _, nodeId := range []string{"", "node1", "node3"} {
+			rec := httptest.NewRecorder()
+			forwarded, err := r1.ForwardToNode(rec, httptest.NewRequest(http.MethodGet, "/jobs/1", nil), nodeId)
+			assert.NoError(t, err)
+			assert.False(t, forwarded)
+			assert.Empty(t, rec.Body.String())
+		}
+	})
+
+	t.Run("unreachable node", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		r.Forward(rec, httptest.NewRequest(http.MethodGet, "/actions/hello", nil), &RegistryEntry{NodeId: "node2", NodeURL: "http://127.0.0.1:1"})
+		assert.Equal(t, http.StatusBadGateway, rec.Code)
+	})
+}
+
+func TestNodeIdOf(t *testing.T) {
+	testCases := map[string]string{
+		"00000000-0000-0000-0000-000000000001":          "",
+		"node1.00000000-0000-0000-0000-000000000001":    "node1",
+		"node.a.b.00000000-0000-0000-0000-000000000001": "node.a.b",
+	}
+	for id, expected := range testCases {
+		t.Run(id, func(t *testing.T) {
+			assert.Equal(t, expected, NodeIdOf(id))
+		})
+	}
+}
+
+func TestRouter_IsAuthenticatedForward(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(req.Header.Get(ForwardSignatureHeader)))
+	}))
+	defer ts.Close()
+
+	r1 := New(WithNode("node1", "http://node1"), WithForwardKey([]byte("secret")))
+	r2 := New(WithNode("node2", "http://node2"), WithForwardKey([]byte("secret")))
+
+	req := httptest.NewRequest(http.MethodGet, "/actions/hello", nil)
+	rec := httptest.NewRecorder()
+	r1.Forward(rec, req, &RegistryEntry{NodeId: "node2", NodeURL: ts.URL})
+	assert.NotEmpty(t, rec.Body.String())
+	assert.True(t, r2.IsAuthenticatedForward(req))
+
+	// the node that has another key does not accept the signature
+	assert.False(t, New(WithForwardKey([]byte("other"))).IsAuthenticatedForward(req))
+	// the node that has no key accepts no signatures
+	assert.False(t, New().IsAuthenticatedForward(req))
+
+	// the valid forwarding headers are kept, the others are dropped
+	r2.DropUnauthenticatedForward(req)
+	assert.Equal(t, "node1", req.Header.Get(ForwardedHeader))
+	forged := httptest.NewRequest(http.MethodGet, "/actions/hello", nil)
+	forged.Header.Set(ForwardedHeader, "node1")
+	forged.Header.Set(ForwardSignatureHeader, "forged")
+	assert.False(t, r2.IsAuthenticatedForward(forged))
+	r2.DropUnauthenticatedForward(forged)
+	assert.Empty(t, forged.Header.Get(ForwardedHeader))
+	assert.Empty(t, forged.Header.Get(ForwardSignatureHeader))
+
+	now := time.Now()
+	testCases := map[string]struct {
+		nodeId   string
+		value    string
+		expected bool
+	}{
+		"valid":        {nodeId: "node1", value: signForward([]byte("secret"), "node1", now), expected: true},
+		"another node": {nodeId: "node3", value: signForward([]byte("secret"), "node1", now)},
+		"expired":      {nodeId: "node1", value: signForward([]byte("secret"), "node1", now.Add(-2*time.Minute))},
+		"future":       {nodeId: "node1", value: signForward([]byte("secret"), "node1", now.Add(2*time.Minute))},
+		"forged":       {nodeId: "node1", value: strconv.FormatInt(now.Unix(), 10) + ".forged"},
+		"no signature": {nodeId: "node1", value: ""},
+		"invalid time": {nodeId: "node1", value: "now.forged"},
+		"no node id":   {nodeId: "", value: signForward([]byte("secret"), "", now)},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, verifyForward([]byte("secret"), tc.nodeId, tc.value, now))
+		})
+	}
+}
@@ -1,13 +1,19 @@
 package router
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/kohkimakimoto/actions-gateway/metrics"
 	"github.com/kohkimakimoto/actions-gateway/server/auth"
 	"github.com/kohkimakimoto/actions-gateway/server/types"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,16 +22,49 @@ type GenSessionIdFunc func() (uuid.UUID, error)
 
 // Router is an object to manage the sessions that are connected to the clients via websocket.
 // A client is identified by the client id that is extracted from the JWT token provided by authentication.
-// Each client can have only one session to transfer the actions to the proper client.
+// A client can have multiple sessions, for example agents running on several machines with the same token.
+// Each invocation is dispatched to one of the sessions that advertise the action.
 type Router struct {
-	// sessions stores the sessions by client id
-	sessions map[string]*Session
+	// sessions stores the sessions by client id in the order of creation
+	sessions map[string][]*Session
 	// mutex for operations on sessions
 	mu sync.RWMutex
+	// next is a counter to dispatch the invocations to the sessions in round-robin order
+	next atomic.Uint64
 	// timeout is an expiration time for inactive session
 	timeout time.Duration
+	// heartbeatTimeout is the time after the last heartbeat of the client after which its active session is closed
+	heartbeatTimeout time.Duration
 	// genSessionId is a function to generate a session id
 	genSessionId GenSessionIdFunc
+	// gracePeriod is the time after the client disconnects during which the invocations wait for the client to reconnect
+	gracePeriod time.Duration
+	// queueSize is the maximum number of the invocations of a client that wait for the client to reconnect
+	queueSize int
+	// disconnectedAt stores the time when the last active session of the client closed, by client id
+	disconnectedAt map[string]time.Time
+	// queued stores the number of the invocations that wait for the client to reconnect, by client id
+	queued map[string]int
+	// activated stores the channel that is closed when a session of the client is activated, by client id
+	activated map[string]chan struct{}
+	// registry is the registry of the sessions that are connected to all the server nodes
+	registry Registry
+	// forwarder forwards the requests to the other nodes
+	forwarder Forwarder
+	// nodeId is the id of this server node
+	nodeId string
+	// nodeURL is the URL to reach this server node from the other nodes
+	nodeURL string
+	// forwardKey is the key that all the nodes share to sign the forwarded requests
+	forwardKey []byte
+	// activatedHooks is a list of the functions that are called when a session is activated
+	activatedHooks []func(sess *Session)
+	// outboundQueueSize is the capacity of the outbound queue of each session
+	outboundQueueSize int
+	// metricsRegistry is the registry that the metrics of the router are registered to
+	metricsRegistry *metrics.Registry
+	// metrics is the metrics of the router
+	metrics *routerMetrics
 }
 
 type Option func(*Router)
@@ -38,16 +77,102 @@ func WithSessionId(sId string) Option {
 	}
 }
 
+// WithHeartbeatTimeout sets the time after the last heartbeat message of the client after which
+// its active session is closed as dead. Zero disables it.
+// The sessions of the clients that do not send heartbeat messages are never closed by it.
+func WithHeartbeatTimeout(d time.Duration) Option {
+	return func(r *Router) {
+		r.heartbeatTimeout = d
+	}
+}
+
+// WithReconnectGracePeriod sets the time after the client disconnects during which the invocations
+// wait for the client to reconnect. Zero disables it.
+func WithReconnectGracePeriod(d time.Duration) Option {
+	return func(r *Router) {
+		r.gracePeriod = d
+	}
+}
+
+// WithReconnectQueueSize sets the maximum number of the invocations of a client that wait for the client to reconnect.
+func WithReconnectQueueSize(n int) Option {
+	return func(r *Router) {
+		r.queueSize = n
+	}
+}
+
+// WithRegistry sets the registry of the sessions. The default is an in-memory registry,
+// which is enough for the server that runs as a single node.
+func WithRegistry(reg Registry) Option {
+	return func(r *Router) {
+		r.registry = reg
+	}
+}
+
+// WithForwarder sets the forwarder that forwards the requests to the other nodes.
+func WithForwarder(f Forwarder) Option {
+	return func(r *Router) {
+		r.forwarder = f
+	}
+}
+
+// WithNode sets the id of this server node and the URL to reach it from the other nodes.
+func WithNode(id string, url string) Option {
+	return func(r *Router) {
+		r.nodeId = id
+		r.nodeURL = url
+	}
+}
+
+// WithForwardKey sets the key that all the nodes share to sign the requests that they forward to each other.
+func WithForwardKey(key []byte) Option {
+	return func(r *Router) {
+		r.forwardKey = key
+	}
+}
+
+// WithOutboundQueueSize sets the maximum number of the messages that wait to be written to the websocket connection
+// of each session. The messages beyond it are rejected with ErrOutboundQueueFull after waiting for room.
+func WithOutboundQueueSize(n int) Option {
+	return func(r *Router) {
+		r.outboundQueueSize = n
+	}
+}
+
+// WithMetrics registers the metrics of the router, such as the sessions and the invocations, to the registry.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(r *Router) {
+		r.metricsRegistry = reg
+	}
+}
+
 // New creates a new Router object
 func New(options ...Option) *Router {
 	r := &Router{
-		sessions:     make(map[string]*Session),
-		timeout:      30 * time.Second,
-		genSessionId: uuid.NewV7,
+		sessions:          make(map[string][]*Session),
+		timeout:           30 * time.Second,
+		genSessionId:      uuid.NewV7,
+		queueSize:         100,
+		disconnectedAt:    make(map[string]time.Time),
+		queued:            make(map[string]int),
+		activated:         make(map[string]chan struct{}),
+		registry:          NewMemoryRegistry(),
+		forwarder:         &HTTPForwarder{},
+		nodeId:            uuid.NewString(),
+		outboundQueueSize: defaultOutboundQueueSize,
 	}
 	for _, option := range options {
 		option(r)
 	}
+	if r.metricsRegistry == nil {
+		r.metricsRegistry = metrics.NewRegistry()
+	}
+	r.metrics = newRouterMetrics(r, r.metricsRegistry)
+	if r.nodeURL != "" {
+		// The other nodes forward the requests for the jobs and the results of this node to it.
+		// The file registry writes the entry again in the next refresh if it fails.
+		_ = r.registry.RegisterNode(&NodeEntry{NodeId: r.nodeId, NodeURL: r.nodeURL})
+	}
 	return r
 }
 
@@ -72,14 +197,25 @@ var (
 	ErrSessionInvalidId        = NewSessionError("Session id is invalid")
 )
 
-func (r *Router) NewSession(client *auth.Client, actions []string, spec string) (*Session, error) {
+// supportedCapabilities is a list of the optional features that the server supports.
+var supportedCapabilities = []string{
+	types.CapabilityBase64Body,
+	types.CapabilityMultipart,
+}
+
+// NewSession creates a new inactive session for the client from the session request.
+func (r *Router) NewSession(client *auth.Client, req *types.SessionNewRequest) (*Session, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	// check if the session already exists
-	sess := r.sessions[client.Id]
-	if sess != nil {
-		return nil, ErrSessionAlreadyExists
+	// The clients that do not send the protocol versions are older than the versioned protocol.
+	clientVersions := req.ProtocolVersions
+	if len(clientVersions) == 0 {
+		clientVersions = []int{types.ProtocolVersion1}
+	}
+	protocolVersion, err := types.NegotiateProtocolVersion(types.SupportedProtocolVersions, clientVersions)
+	if err != nil {
+		return nil, NewSessionError(fmt.Sprintf("Unsupported protocol version: the client supports %v, but the server supports %v", clientVersions, types.SupportedProtocolVersions))
 	}
 
 	// initialize a new session
@@ -89,17 +225,47 @@ func (r *Router) NewSession(client *auth.Client, actions []string, spec string)
 	}
 	sessionId := UUID.String()
 
-	sess = &Session{}
+	// check if the session already exists
+	if r.findSession(client, sessionId) != nil {
+		return nil, ErrSessionAlreadyExists
+	}
+
+	// The agent that reconnects after an unclean disconnect takes over its stale session.
+	// The stale session may still be registered, because the server has not noticed the disconnect yet.
+	if req.InstanceId != "" {
+		for _, stale := range slices.Clone(r.sessions[client.Id]) {
+			if stale.instanceId == req.InstanceId {
+				r.closeSession(stale, ErrSessionReplaced)
+			}
+		}
+	}
+
+	sess := &Session{}
 	sess.id = sessionId
 	sess.client = client
-	sess.actions = actions
+	sess.actions = req.Actions
 	sess.actionMap = make(map[string]bool)
-	for _, a := range actions {
+	for _, a := range req.Actions {
 		sess.actionMap[a] = true
 	}
-	sess.spec = spec
+	sess.spec = req.Spec
+	sess.options = req.Options
+	sess.labels = req.Labels
+	sess.instanceId = req.InstanceId
+	sess.protocolVersion = protocolVersion
+	sess.capabilities = make(map[string]bool)
+	for _, c := range req.Capabilities {
+		if slices.Contains(supportedCapabilities, c) {
+			sess.capabilities[c] = true
+		}
+	}
 	sess.results = make(map[string]chan *types.ActionResult)
-	r.sessions[client.Id] = sess
+	sess.outputs = make(map[string]*outputStream)
+	sess.closed = make(chan struct{})
+	sess.outboundQueueSize = r.outboundQueueSize
+	sess.metrics = r.metrics
+	r.sessions[client.Id] = append(r.sessions[client.Id], sess)
+	r.metrics.sessionCreated()
 
 	// start monitoring the session expiration
 	// If the session is not activated within the expiration time, delete it
@@ -113,11 +279,55 @@ func (r *Router) monitorInactiveSessionExpiration(sess *Session) {
 		defer r.mu.Unlock()
 		// if the session is not active, delete it
 		if !sess.IsActive() {
-			delete(r.sessions, sess.client.Id)
+			r.removeSession(sess)
+			return
+		}
+		if r.heartbeatTimeout > 0 {
+			go r.monitorHeartbeat(sess)
+		}
+	})
+}
+
+// monitorDisconnectedExpiration forgets the time when the client disconnected at after the grace period,
+// so that the clients that never reconnect do not remain in the router.
+func (r *Router) monitorDisconnectedExpiration(clientId string, at time.Time) {
+	time.AfterFunc(r.gracePeriod, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// The client may have disconnected again after it reconnected.
+		if disconnectedAt, ok := r.disconnectedAt[clientId]; ok && disconnectedAt.Equal(at) {
+			delete(r.disconnectedAt, clientId)
 		}
 	})
 }
 
+// ErrHeartbeatTimeout is returned to the invocations on the session that is closed
+// because the client stopped sending heartbeat messages.
+var ErrHeartbeatTimeout = errors.New("the client stopped sending heartbeats")
+
+// monitorHeartbeat closes the active session when the client has not sent a heartbeat message
+// within the heartbeat timeout, for example because the connection is half-open.
+// The session is left open if the client has never sent a heartbeat message, because older clients do not send it.
+func (r *Router) monitorHeartbeat(sess *Session) {
+	ticker := time.NewTicker(r.heartbeatTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sess.closed:
+			return
+		case <-ticker.C:
+			last := sess.LastHeartbeat()
+			if last.IsZero() || time.Since(last) < r.heartbeatTimeout {
+				continue
+			}
+			r.mu.Lock()
+			r.closeSession(sess, ErrHeartbeatTimeout)
+			r.mu.Unlock()
+			return
+		}
+	}
+}
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
@@ -129,13 +339,14 @@ func (r *Router) ActivateSession(w http.ResponseWriter, req *http.Request, clien
 	defer r.mu.Unlock()
 
 	// retrieve the session
-	sess := r.sessions[client.Id]
-	if sess == nil {
+	sessions := r.sessions[client.Id]
+	if len(sessions) == 0 {
 		return nil, ErrSessionNotFound
 	}
 
 	// check session id
-	if sess.id != sessionId {
+	sess := r.findSession(client, sessionId)
+	if sess == nil {
 		return nil, ErrSessionInvalidId
 	}
 
@@ -149,35 +360,393 @@ func (r *Router) ActivateSession(w http.ResponseWriter, req *http.Request, clien
 	if err != nil {
 		return nil, err
 	}
+	// register the session so that the other nodes can forward the requests to this node
+	if err := r.registry.Register(r.registryEntry(sess)); err != nil {
+		_ = ws.Close()
+		return nil, fmt.Errorf("failed to register the session: %w", err)
+	}
 	// save the websocket connection
 	sess.conn = ws
+
+	// wake up the invocations that wait for the client to reconnect
+	delete(r.disconnectedAt, client.Id)
+	if ch, ok := r.activated[client.Id]; ok {
+		close(ch)
+		delete(r.activated, client.Id)
+	}
+	for _, hook := range r.activatedHooks {
+		// The hooks run after the lock is released.
+		go hook(sess)
+	}
 	return sess, nil
 }
 
-func (r *Router) GetActiveSession(client *auth.Client) *Session {
+// OnSessionActivated registers the function that is called when a session is activated.
+// It must be called before the router starts accepting sessions.
+func (r *Router) OnSessionActivated(hook func(sess *Session)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.activatedHooks = append(r.activatedHooks, hook)
+}
+
+// findSession returns the session of the client by session id.
+// It returns nil if the session is not found. The caller must hold the lock.
+func (r *Router) findSession(client *auth.Client, sessionId string) *Session {
+	for _, sess := range r.sessions[client.Id] {
+		if sess.id == sessionId {
+			return sess
+		}
+	}
+	return nil
+}
+
+// removeSession removes the session from the router. The caller must hold the lock.
+// It returns false if the session has already been removed.
+func (r *Router) removeSession(sess *Session) bool {
+	sessions := r.sessions[sess.client.Id]
+	n := len(sessions)
+	sessions = slices.DeleteFunc(sessions, func(s *Session) bool {
+		return s == sess
+	})
+	if len(sessions) == 0 {
+		delete(r.sessions, sess.client.Id)
+	} else {
+		r.sessions[sess.client.Id] = sessions
+	}
+	if len(sessions) == n {
+		return false
+	}
+	r.metrics.sessionClosed()
+	return true
+}
+
+// ActiveSessions returns the active sessions of the client in the order of creation.
+func (r *Router) ActiveSessions(client *auth.Client) []*Session {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	return r.activeSessions(client.Id)
+}
+
+// activeSessions returns the active sessions of the client by client id. The caller must hold the lock.
+func (r *Router) activeSessions(clientId string) []*Session {
+	var sessions []*Session
+	for _, sess := range r.sessions[clientId] {
+		if sess.IsActive() {
+			sessions = append(sessions, sess)
+		}
+	}
+	return sessions
+}
 
-	sess := r.sessions[client.Id]
-	if sess == nil || !sess.IsActive() {
+// GetActiveSession returns the oldest active session of the client.
+// It returns nil if the client has no active session.
+func (r *Router) GetActiveSession(client *auth.Client) *Session {
+	sessions := r.ActiveSessions(client)
+	if len(sessions) == 0 {
 		return nil
 	}
-	return sess
+	return sessions[0]
+}
+
+// MatchingSessions returns the active sessions of the client that match the selector.
+func (r *Router) MatchingSessions(client *auth.Client, selector Selector) []*Session {
+	var sessions []*Session
+	for _, sess := range r.ActiveSessions(client) {
+		if selector.Matches(sess.Labels()) {
+			sessions = append(sessions, sess)
+		}
+	}
+	return sessions
+}
+
+// SelectSession returns the active session of the client to dispatch the invocation of the action to.
+// It selects the session that has the fewest actions in flight among the sessions that match the selector
+// and advertise the action. The sessions with the same number of actions in flight are selected in round-robin order.
+// It returns nil if no such session exists.
+func (r *Router) SelectSession(client *auth.Client, name string, selector Selector) *Session {
+	var candidates []*Session
+	for _, sess := range r.MatchingSessions(client, selector) {
+		if sess.IsActionExist(name) {
+			candidates = append(candidates, sess)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	start := int(r.next.Add(1) % uint64(len(candidates)))
+	var selected *Session
+	for i := range candidates {
+		sess := candidates[(start+i)%len(candidates)]
+		if selected == nil || sess.InFlight() < selected.InFlight() {
+			selected = sess
+		}
+	}
+	return selected
+}
+
+// Spec returns the OpenAPI spec of the client that merges the specs of all active sessions.
+// It returns false if the client has no active session.
+func (r *Router) Spec(client *auth.Client) (string, bool, error) {
+	sessions := r.ActiveSessions(client)
+	if len(sessions) == 0 {
+		return "", false, nil
+	}
+	specs := make([]string, 0, len(sessions))
+	for _, sess := range sessions {
+		specs = append(specs, sess.Spec())
+	}
+	spec, err := mergeSpecs(specs)
+	if err != nil {
+		return "", true, err
+	}
+	return spec, true, nil
+}
+
+// HandleActionResult delivers the action result to the session that awaits it.
+// It is used for the results that the clients of protocol version 1 send via HTTP.
+func (r *Router) HandleActionResult(client *auth.Client, result *types.ActionResult) error {
+	for _, sess := range r.ActiveSessions(client) {
+		err := sess.HandleActionResult(result)
+		if errors.Is(err, ErrResultChannelNotFound) {
+			continue
+		}
+		return err
+	}
+	return ErrResultChannelNotFound
+}
+
+// Invoke invokes the action message on the session and waits for its result.
+// If the session is closed before the result arrives, the action message is invoked again on another session
+// that matches the selector and advertises the action. The multipart action messages are not retried,
+// because their uploaded files have been sent to the closed session.
+func (r *Router) Invoke(ctx context.Context, sess *Session, msg *types.ActionMessage, selector Selector) (*types.ActionResult, error) {
+	for {
+		result, err := sess.Invoke(ctx, msg)
+		if !errors.Is(err, ErrSessionClosed) || msg.Multipart {
+			return result, err
+		}
+		if sess = r.SelectSession(sess.client, msg.Name, selector); sess == nil {
+			return nil, err
+		}
+	}
+}
+
+// InvokeStream invokes the action message on the session in streaming mode and waits for its result.
+// If the session is closed before any output arrives, the action message is invoked again on another session
+// like Invoke. Once the output has been passed to onOutput, the action is not retried.
+func (r *Router) InvokeStream(ctx context.Context, sess *Session, msg *types.ActionMessage, selector Selector, onOutput func(data string) error) (*types.ActionResult, error) {
+	started := false
+	for {
+		result, err := sess.InvokeStream(ctx, msg, func(data string) error {
+			started = true
+			return onOutput(data)
+		})
+		if !errors.Is(err, ErrSessionClosed) || msg.Multipart || started {
+			return result, err
+		}
+		if sess = r.SelectSession(sess.client, msg.Name, selector); sess == nil {
+			return nil, err
+		}
+	}
 }
 
 func (r *Router) CloseSession(sess *Session) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.closeSession(sess, ErrSessionClosed)
+}
 
+// closeSession closes the connection of the session and removes it from the router.
+// The invocations that are waiting for their results on the session fail with err.
+// The caller must hold the lock.
+func (r *Router) closeSession(sess *Session, err error) {
 	if sess.conn != nil {
 		_ = sess.conn.Close()
 	}
+	sess.close(err)
+
+	removed := r.removeSession(sess)
+
+	if removed && sess.IsActive() {
+		// The session may remain in the registry until it expires if this fails.
+		_ = r.registry.Unregister(sess.client.Id, sess.id)
+
+		// The grace period for reconnection starts when the last active session of the client closes.
+		if r.gracePeriod > 0 && len(r.activeSessions(sess.client.Id)) == 0 {
+			now := time.Now()
+			r.disconnectedAt[sess.client.Id] = now
+			go r.monitorDisconnectedExpiration(sess.client.Id, now)
+		}
+	}
+}
+
+// registryEntry returns the registry entry of the session on this node.
+func (r *Router) registryEntry(sess *Session) *RegistryEntry {
+	return &RegistryEntry{
+		ClientId:  sess.client.Id,
+		SessionId: sess.id,
+		NodeId:    r.nodeId,
+		NodeURL:   r.nodeURL,
+		Actions:   sess.actions,
+		Labels:    sess.labels,
+		Timeouts:  sess.actionTimeouts(),
+	}
+}
+
+// RemoteEntries returns the registry entries of the sessions of the client on the other nodes
+// that match the selector and advertise the action. If name is empty, the sessions match regardless of their actions.
+func (r *Router) RemoteEntries(client *auth.Client, name string, selector Selector) ([]*RegistryEntry, error) {
+	entries, err := r.registry.Lookup(client.Id)
+	if err != nil {
+		return nil, err
+	}
+	var remote []*RegistryEntry
+	for _, entry := range entries {
+		if entry.NodeId != r.nodeId && entry.NodeURL != "" && (name == "" || entry.HasAction(name)) && selector.Matches(entry.Labels) {
+			remote = append(remote, entry)
+		}
+	}
+	slices.SortFunc(remote, func(a, b *RegistryEntry) int {
+		return strings.Compare(a.SessionId, b.SessionId)
+	})
+	return remote, nil
+}
+
+// LookupRemote returns the registry entry of a session of the client on another node
+// that matches the selector and advertises the action. The entries are selected in round-robin order.
+// If name is empty, the sessions match regardless of their actions. It returns nil if no such session exists.
+func (r *Router) LookupRemote(client *auth.Client, name string, selector Selector) (*RegistryEntry, error) {
+	candidates, err := r.RemoteEntries(client, name, selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	return candidates[r.next.Add(1)%uint64(len(candidates))], nil
+}
+
+// Forward forwards the request to the node of the registry entry, and writes its response to w.
+func (r *Router) Forward(w http.ResponseWriter, req *http.Request, entry *RegistryEntry) {
+	r.forward(w, req, entry.Node())
+}
+
+// ForwardBuffered forwards the request to the node of the registry entry, and returns its response
+// instead of writing it, so that the caller can merge the responses of several nodes.
+func (r *Router) ForwardBuffered(req *http.Request, entry *RegistryEntry) *ForwardedResponse {
+	res := newForwardedResponse()
+	r.forward(res, req, entry.Node())
+	return res
+}
+
+// ForwardToNode forwards the request to the node, and writes its response to w.
+// It returns false without writing the response if the node is this node or is not registered.
+func (r *Router) ForwardToNode(w http.ResponseWriter, req *http.Request, nodeId string) (bool, error) {
+	if nodeId == "" || nodeId == r.nodeId {
+		return false, nil
+	}
+	node, err := r.registry.LookupNode(nodeId)
+	if err != nil {
+		return false, err
+	}
+	if node == nil || node.NodeURL == "" {
+		return false, nil
+	}
+	r.forward(w, req, node)
+	return true, nil
+}
+
+func (r *Router) forward(w http.ResponseWriter, req *http.Request, node *NodeEntry) {
+	r.SignForward(req)
+	r.forwarder.Forward(w, req, node)
+}
 
-	delete(r.sessions, sess.client.Id)
+// SignForward sets the headers that tell the other nodes that this node forwards the request.
+func (r *Router) SignForward(req *http.Request) {
+	req.Header.Set(ForwardedHeader, r.nodeId)
+	if len(r.forwardKey) > 0 {
+		req.Header.Set(ForwardSignatureHeader, signForward(r.forwardKey, r.nodeId, time.Now()))
+	} else {
+		req.Header.Del(ForwardSignatureHeader)
+	}
+}
+
+// IsAuthenticatedForward reports whether the request has been forwarded from another node
+// and its signature is valid. The callers can not forge it.
+// The forwarded requests are never forwarded again.
+func (r *Router) IsAuthenticatedForward(req *http.Request) bool {
+	return verifyForward(r.forwardKey, req.Header.Get(ForwardedHeader), req.Header.Get(ForwardSignatureHeader), time.Now())
+}
+
+// DropUnauthenticatedForward removes the forwarding headers from the request unless their signature is valid,
+// so that the callers can not pretend that another node has forwarded the request.
+func (r *Router) DropUnauthenticatedForward(req *http.Request) {
+	if !r.IsAuthenticatedForward(req) {
+		req.Header.Del(ForwardedHeader)
+		req.Header.Del(ForwardSignatureHeader)
+	}
+}
+
+// NodeIdOf returns the id of the node that created the job or the action message of the id.
+// It returns an empty string if the id has no node id, such as the ids that are created by a single node.
+func NodeIdOf(id string) string {
+	// The UUID has no separator, but the node id may have.
+	i := strings.LastIndex(id, nodeIdSeparator)
+	if i < 0 {
+		return ""
+	}
+	return id[:i]
+}
+
+// nodeIdSeparator separates the node id from the UUID in the ids of the jobs and the action messages
+// that are created by a node of multiple server nodes.
+const nodeIdSeparator = "."
+
+// withNodeId returns the id that is prefixed by the node id.
+func withNodeId(nodeId string, id string) string {
+	if nodeId == "" {
+		return id
+	}
+	return nodeId + nodeIdSeparator + id
 }
 
 func (r *Router) NumSessions() int {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	return len(r.sessions)
+
+	n := 0
+	for _, sessions := range r.sessions {
+		n += len(sessions)
+	}
+	return n
+}
+
+// OutboundQueueDepth returns the number of the frames that wait to be written to the websocket connections
+// of all the sessions.
+func (r *Router) OutboundQueueDepth() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n := 0
+	for _, sessions := range r.sessions {
+		for _, sess := range sessions {
+			n += sess.OutboundQueueDepth()
+		}
+	}
+	return n
+}
+
+// NumPendingResults returns the number of the invocations that wait for their results on all the sessions.
+func (r *Router) NumPendingResults() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n := 0
+	for _, sessions := range r.sessions {
+		for _, sess := range sessions {
+			n += sess.numPendingResults()
+		}
+	}
+	return n
 }
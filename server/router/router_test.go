@@ -3,12 +3,16 @@ package router
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -24,7 +28,7 @@ func TestRouter_NewSession(t *testing.T) {
 		ct := &auth.Client{
 			Id: "00000000-0000-0000-0000-000000000001",
 		}
-		sess, err := r.NewSession(ct, []string{"action1", "action2"}, "")
+		sess, err := r.NewSession(ct, &types.SessionNewRequest{Actions: []string{"action1", "action2"}})
 		assert.NoError(t, err)
 		assert.NotNil(t, sess)
 		assert.Equal(t, "00000000-0000-0000-0000-000000000001", sess.client.Id)
@@ -32,23 +36,110 @@ func TestRouter_NewSession(t *testing.T) {
 		assert.Equal(t, 1, r.NumSessions())
 
 		// test the session already exists
-		sess, err = r.NewSession(ct, []string{"action1", "action2"}, "")
+		sess, err = r.NewSession(ct, &types.SessionNewRequest{Actions: []string{"action1", "action2"}})
 		assert.Error(t, err)
 		assert.Nil(t, sess)
 		assert.Equal(t, ErrSessionAlreadyExists, err)
 
+		// the client can have another session
+		r.genSessionId = func() (uuid.UUID, error) {
+			return uuid.MustParse("00000000-0000-0000-0000-000000000003"), nil
+		}
+		sess, err = r.NewSession(ct, &types.SessionNewRequest{Actions: []string{"action1"}})
+		assert.NoError(t, err)
+		assert.Equal(t, "00000000-0000-0000-0000-000000000003", sess.id)
+		assert.Equal(t, 2, r.NumSessions())
+
 		// test the session timeout
 		time.Sleep(2 * time.Second)
-		assert.Equal(t, 0, r.NumSessions()) // the expired session is removed
+		assert.Equal(t, 0, r.NumSessions()) // the expired sessions are removed
+		r.genSessionId = func() (uuid.UUID, error) {
+			return uuid.MustParse("00000000-0000-0000-0000-000000000002"), nil
+		}
 
 		// the session can be created again
-		sess, err = r.NewSession(ct, []string{"action1", "action2"}, "")
+		sess, err = r.NewSession(ct, &types.SessionNewRequest{Actions: []string{"action1", "action2"}})
 		assert.NoError(t, err)
 		assert.NotNil(t, sess)
 		assert.Equal(t, "00000000-0000-0000-0000-000000000001", sess.client.Id)
 		assert.Equal(t, "00000000-0000-0000-0000-000000000002", sess.id)
 		assert.Equal(t, 1, r.NumSessions())
 	})
+
+	t.Run("protocol version", func(t *testing.T) {
+		r := New()
+		ct := &auth.Client{
+			Id: "00000000-0000-0000-0000-000000000001",
+		}
+
+		// the client that does not send the protocol versions
+		sess, err := r.NewSession(ct, &types.SessionNewRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, types.ProtocolVersion1, sess.ProtocolVersion())
+		r.CloseSession(sess)
+
+		sess, err = r.NewSession(ct, &types.SessionNewRequest{
+			ProtocolVersions: []int{types.ProtocolVersion1, types.ProtocolVersion2},
+			Capabilities:     []string{"unknown", types.CapabilityBase64Body},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, types.ProtocolVersion2, sess.ProtocolVersion())
+		assert.Equal(t, []string{types.CapabilityBase64Body}, sess.Capabilities())
+		r.CloseSession(sess)
+
+		// the client that supports only the newer versions
+		sess, err = r.NewSession(ct, &types.SessionNewRequest{ProtocolVersions: []int{99}})
+		assert.Nil(t, sess)
+		assert.EqualError(t, err, "Unsupported protocol version: the client supports [99], but the server supports [2 1]")
+		assert.Equal(t, 0, r.NumSessions())
+	})
+}
+
+func TestRouter_NewSession_Takeover(t *testing.T) {
+	r := New()
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	req := &types.SessionNewRequest{
+		Actions:          []string{"action1"},
+		ProtocolVersions: []int{types.ProtocolVersion2},
+		InstanceId:       "instance1",
+	}
+	stale, err := r.NewSession(ct, req)
+	assert.NoError(t, err)
+	// the client never returns the result
+	stale.conn = testWebsocketConn(t, func(message []byte) {})
+	other, err := r.NewSession(ct, &types.SessionNewRequest{InstanceId: "instance2"})
+	assert.NoError(t, err)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := r.Invoke(context.Background(), stale, &types.ActionMessage{
+			Id:   "00000000-0000-0000-0000-000000000004",
+			Name: "action1",
+		}, nil)
+		errCh <- err
+	}()
+	assert.Eventually(t, func() bool {
+		return stale.InFlight() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the agent reconnects with the same instance id
+	sess, err := r.NewSession(ct, req)
+	assert.NoError(t, err)
+	assert.NotEqual(t, stale, sess)
+	assert.Equal(t, 2, r.NumSessions())
+	assert.Nil(t, r.findSession(ct, stale.id))
+	assert.NotNil(t, r.findSession(ct, other.id))
+
+	// the in-flight request on the stale session fails
+	select {
+	case err := <-errCh:
+		assert.ErrorIs(t, err, ErrSessionReplaced)
+		assert.ErrorIs(t, err, ErrSessionClosed)
+	case <-time.After(time.Second):
+		t.Fatal("the in-flight request did not fail")
+	}
 }
 
 func TestRouter_ActivateSession(t *testing.T) {
@@ -65,7 +156,7 @@ func TestRouter_ActivateSession(t *testing.T) {
 		assert.Nil(t, r.GetActiveSession(ct))
 
 		// create a new session
-		sess, err := r.NewSession(ct, []string{"action1", "action2"}, "")
+		sess, err := r.NewSession(ct, &types.SessionNewRequest{Actions: []string{"action1", "action2"}})
 		assert.NoError(t, err)
 
 		// activate the session
@@ -100,6 +191,280 @@ func TestRouter_ActivateSession(t *testing.T) {
 		assert.Nil(t, r.GetActiveSession(ct))
 	})
 
+	t.Run("heartbeat timeout", func(t *testing.T) {
+		r := New(WithHeartbeatTimeout(200 * time.Millisecond))
+		r.timeout = 100 * time.Millisecond
+		ct := &auth.Client{
+			Id: "00000000-0000-0000-0000-000000000001",
+		}
+		sess, err := r.NewSession(ct, &types.SessionNewRequest{Actions: []string{"action1"}})
+		assert.NoError(t, err)
+
+		req := &http.Request{
+			Method: http.MethodGet,
+			Header: http.Header{
+				"Upgrade":               []string{"websocket"},
+				"Connection":            []string{"upgrade"},
+				"Sec-Websocket-Key":     []string{"dGhlIHNhbXBsZSBub25jZQ=="},
+				"Sec-Websocket-Version": []string{"13"},
+			}}
+		br := bufio.NewReaderSize(strings.NewReader(""), 4096)
+		bw := bufio.NewWriterSize(&bytes.Buffer{}, 4096)
+		resp := &testHijakableResponseWriter{
+			brw: bufio.NewReadWriter(br, bw),
+		}
+		_, err = r.ActivateSession(resp, req, ct, sess.id)
+		assert.NoError(t, err)
+
+		// the session of the client that has never sent a heartbeat is not closed
+		time.Sleep(500 * time.Millisecond)
+		assert.Equal(t, sess, r.GetActiveSession(ct))
+
+		// the session is closed when the client stops sending heartbeats
+		sess.heartbeat()
+		assert.Eventually(t, func() bool {
+			return r.GetActiveSession(ct) == nil
+		}, 2*time.Second, 50*time.Millisecond)
+		assert.Equal(t, ErrHeartbeatTimeout, sess.closeErr)
+	})
+}
+
+func TestRouter_SelectSession(t *testing.T) {
+	r := New()
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	sess1, err := r.NewSession(ct, &types.SessionNewRequest{Actions: []string{"action1", "action2"}})
+	assert.NoError(t, err)
+	sess2, err := r.NewSession(ct, &types.SessionNewRequest{Actions: []string{"action1"}})
+	assert.NoError(t, err)
+
+	// the inactive sessions are not selected
+	assert.Nil(t, r.SelectSession(ct, "action1", nil))
+	sess1.conn = &websocket.Conn{}
+	sess2.conn = &websocket.Conn{}
+	assert.Equal(t, []*Session{sess1, sess2}, r.ActiveSessions(ct))
+	assert.Equal(t, sess1, r.GetActiveSession(ct))
+
+	// the sessions are selected in round-robin order
+	selected := map[*Session]int{}
+	for i := 0; i < 4; i++ {
+		selected[r.SelectSession(ct, "action1", nil)]++
+	}
+	assert.Equal(t, map[*Session]int{sess1: 2, sess2: 2}, selected)
+
+	// the session that has fewer actions in flight is selected
+	sess1.inFlight.Add(1)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, sess2, r.SelectSession(ct, "action1", nil))
+	}
+
+	// only the session that advertises the action is selected
+	assert.Equal(t, sess1, r.SelectSession(ct, "action2", nil))
+	assert.Nil(t, r.SelectSession(ct, "action3", nil))
+}
+
+func TestRouter_SelectSession_Selector(t *testing.T) {
+	r := New()
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	nas, err := r.NewSession(ct, &types.SessionNewRequest{
+		Actions: []string{"action1"},
+		Labels:  map[string]string{"host": "nas", "env": "prod"},
+	})
+	assert.NoError(t, err)
+	laptop, err := r.NewSession(ct, &types.SessionNewRequest{
+		Actions: []string{"action1"},
+		Labels:  map[string]string{"host": "laptop", "env": "dev"},
+	})
+	assert.NoError(t, err)
+	nas.conn = &websocket.Conn{}
+	laptop.conn = &websocket.Conn{}
+
+	assert.Equal(t, []*Session{nas, laptop}, r.MatchingSessions(ct, nil))
+	assert.Equal(t, []*Session{nas}, r.MatchingSessions(ct, Selector{"env": "prod"}))
+	assert.Nil(t, r.MatchingSessions(ct, Selector{"host": "build"}))
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, laptop, r.SelectSession(ct, "action1", Selector{"host": "laptop"}))
+	}
+	assert.Nil(t, r.SelectSession(ct, "action1", Selector{"host": "build"}))
+}
+
+func TestRouter_Invoke(t *testing.T) {
+	t.Run("fail over to another session", func(t *testing.T) {
+		r := New()
+		ct := &auth.Client{
+			Id: "00000000-0000-0000-0000-000000000001",
+		}
+		req := &types.SessionNewRequest{
+			Actions:          []string{"action1"},
+			ProtocolVersions: []int{types.ProtocolVersion2},
+		}
+		sess1, err := r.NewSession(ct, req)
+		assert.NoError(t, err)
+		sess2, err := r.NewSession(ct, req)
+		assert.NoError(t, err)
+
+		// the first client disconnects when it receives the action message
+		sess1.conn = testWebsocketConn(t, func(message []byte) {
+			r.CloseSession(sess1)
+		})
+		// the second client returns the result
+		sess2.conn = testWebsocketConn(t, func(message []byte) {
+			env, err := types.ParseEnvelope(message)
+			assert.NoError(t, err)
+			assert.NoError(t, sess2.HandleActionResult(&types.ActionResult{
+				Id:     env.Id,
+				Status: types.ActionResultStatusSuccess,
+				Body:   "ok",
+			}))
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result, err := r.Invoke(ctx, sess1, &types.ActionMessage{
+			Id:   "00000000-0000-0000-0000-000000000004",
+			Name: "action1",
+		}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "ok", result.Body)
+		assert.Equal(t, 1, r.NumSessions())
+	})
+
+	t.Run("no session to fail over to", func(t *testing.T) {
+		r := New()
+		ct := &auth.Client{
+			Id: "00000000-0000-0000-0000-000000000001",
+		}
+		sess, err := r.NewSession(ct, &types.SessionNewRequest{
+			Actions:          []string{"action1"},
+			ProtocolVersions: []int{types.ProtocolVersion2},
+		})
+		assert.NoError(t, err)
+		sess.conn = testWebsocketConn(t, func(message []byte) {
+			r.CloseSession(sess)
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result, err := r.Invoke(ctx, sess, &types.ActionMessage{
+			Id:   "00000000-0000-0000-0000-000000000004",
+			Name: "action1",
+		}, nil)
+		assert.Nil(t, result)
+		assert.ErrorIs(t, err, ErrSessionClosed)
+	})
+}
+
+func TestRouter_HandleActionResult(t *testing.T) {
+	r := New()
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+	sess1, err := r.NewSession(ct, &types.SessionNewRequest{Actions: []string{"action1"}})
+	assert.NoError(t, err)
+	sess2, err := r.NewSession(ct, &types.SessionNewRequest{Actions: []string{"action1"}})
+	assert.NoError(t, err)
+	sess1.conn = &websocket.Conn{}
+	sess2.conn = &websocket.Conn{}
+
+	msgId := "00000000-0000-0000-0000-000000000004"
+	ch := sess2.AllocateResultChannel(msgId)
+	result := &types.ActionResult{Id: msgId, Status: types.ActionResultStatusSuccess}
+	assert.NoError(t, r.HandleActionResult(ct, result))
+	assert.Equal(t, result, <-ch)
+
+	sess2.FreeResultChannel(msgId)
+	assert.ErrorIs(t, r.HandleActionResult(ct, result), ErrResultChannelNotFound)
+}
+
+func TestRouter_Spec(t *testing.T) {
+	r := New()
+	ct := &auth.Client{
+		Id: "00000000-0000-0000-0000-000000000001",
+	}
+
+	_, ok, err := r.Spec(ct)
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	sess1, err := r.NewSession(ct, &types.SessionNewRequest{Spec: `openapi: 3.1.0
+info:
+  title: agent1
+paths:
+  /actions/action1:
+    post:
+      summary: action1 of agent1
+`})
+	assert.NoError(t, err)
+	sess1.conn = &websocket.Conn{}
+
+	// the spec of the single session is returned as it is
+	spec, ok, err := r.Spec(ct)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, sess1.Spec(), spec)
+
+	sess2, err := r.NewSession(ct, &types.SessionNewRequest{Spec: `openapi: 3.1.0
+info:
+  title: agent2
+paths:
+  /actions/action1:
+    post:
+      summary: action1 of agent2
+  /actions/action2:
+    post:
+      summary: action2 of agent2
+`})
+	assert.NoError(t, err)
+	sess2.conn = &websocket.Conn{}
+
+	spec, ok, err = r.Spec(ct)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, `openapi: 3.1.0
+info:
+    title: agent1
+paths:
+    /actions/action1:
+        post:
+            summary: action1 of agent1
+    /actions/action2:
+        post:
+            summary: action2 of agent2
+`, spec)
+}
+
+// testWebsocketConn returns a websocket connection to a fake client.
+// The fake client passes the messages sent to the connection to onMessage.
+func testWebsocketConn(t *testing.T, onMessage func(message []byte)) *websocket.Conn {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			onMessage(message)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
 }
 
 // ----------------------------------------------------------------
@@ -0,0 +1,53 @@
+package router
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Selector is a set of the labels that the session must have to run the action.
+// It is written as comma-separated key=value pairs, such as "host=nas,env=prod".
+type Selector map[string]string
+
+// ParseSelector parses the selector string.
+// It returns nil if the string is empty, which matches any session.
+func ParseSelector(s string) (Selector, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	sel := Selector{}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid selector: %q", s)
+		}
+		sel[key] = strings.TrimSpace(value)
+	}
+	return sel, nil
+}
+
+// Matches reports whether the labels have all the key=value pairs of the selector.
+func (sel Selector) Matches(labels map[string]string) bool {
+	for key, value := range sel {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (sel Selector) String() string {
+	return FormatLabels(sel)
+}
+
+// FormatLabels formats the labels as comma-separated key=value pairs sorted by key.
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,67 @@
+package router
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	testCases := map[string]struct {
+		s        string
+		expected Selector
+		err      bool
+	}{
+		"empty": {
+			s:        "",
+			expected: nil,
+		},
+		"single label": {
+			s:        "host=nas",
+			expected: Selector{"host": "nas"},
+		},
+		"multiple labels": {
+			s:        "host=nas, env=prod",
+			expected: Selector{"host": "nas", "env": "prod"},
+		},
+		"empty value": {
+			s:        "host=",
+			expected: Selector{"host": ""},
+		},
+		"no value": {
+			s:   "host",
+			err: true,
+		},
+		"no key": {
+			s:   "=nas",
+			err: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			sel, err := ParseSelector(tc.s)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, sel)
+		})
+	}
+}
+
+func TestSelector_Matches(t *testing.T) {
+	labels := map[string]string{"host": "nas", "env": "prod"}
+	assert.True(t, Selector(nil).Matches(labels))
+	assert.True(t, Selector(nil).Matches(nil))
+	assert.True(t, Selector{"host": "nas"}.Matches(labels))
+	assert.True(t, Selector{"host": "nas", "env": "prod"}.Matches(labels))
+	assert.False(t, Selector{"host": "laptop"}.Matches(labels))
+	assert.False(t, Selector{"host": "nas", "region": "eu"}.Matches(labels))
+	assert.False(t, Selector{"host": ""}.Matches(nil))
+}
+
+func TestFormatLabels(t *testing.T) {
+	assert.Equal(t, "env=prod,host=nas", FormatLabels(map[string]string{"host": "nas", "env": "prod"}))
+	assert.Equal(t, "", FormatLabels(nil))
+}
@@ -1,11 +1,18 @@
 package router
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/kohkimakimoto/actions-gateway/server/auth"
 	"github.com/kohkimakimoto/actions-gateway/server/types"
 	"github.com/pkg/errors"
+	"net/http"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Session represents a connection with a client.
@@ -23,10 +30,110 @@ type Session struct {
 	actionMap map[string]bool
 	// spec is an OpenAPI Spec written in YAML.
 	spec string
+	// options is a map of the action options by action name
+	options map[string]*types.ActionOptions
+	// labels is a set of the labels of the agent
+	labels map[string]string
+	// instanceId identifies the agent across its sessions
+	instanceId string
+	// protocolVersion is the protocol version negotiated with the client
+	protocolVersion int
+	// capabilities is a set of the optional features that both the server and the client support
+	capabilities map[string]bool
 	// results is a map of result channels. The key of the map is an action message id (UUID v7).
 	results map[string]chan *types.ActionResult
-	// mu is a mutex for operations on results
+	// outputs is a map of output streams of the actions that run in streaming mode.
+	// The key of the map is an action message id (UUID v7).
+	outputs map[string]*outputStream
+	// mu is a mutex for operations on results, outputs, lastHeartbeat and creating outbound
 	mu sync.RWMutex
+	// lastHeartbeat is the time when the last heartbeat message was received from the client.
+	lastHeartbeat time.Time
+	// outbound is the queue of the frames that the writer goroutine writes to the websocket connection.
+	// The websocket connection does not support concurrent writers, so only the writer goroutine writes to it.
+	outbound chan *outboundFrame
+	// outboundQueueSize is the capacity of outbound
+	outboundQueueSize int
+	// writerOnce ensures that the writer goroutine is started only once
+	writerOnce sync.Once
+	// writerDone is closed when the writer goroutine stops because of a write error
+	writerDone chan struct{}
+	// writeErr is the error that stopped the writer goroutine
+	writeErr error
+	// inFlight is the number of the action messages that are waiting for their results
+	inFlight atomic.Int64
+	// closed is closed when the session is closed
+	closed chan struct{}
+	// closeErr is the error returned to the invocations that are waiting when the session is closed
+	closeErr error
+	// closeOnce ensures that closed is closed only once
+	closeOnce sync.Once
+	// metrics is the metrics of the router that created the session. It is nil if the session has no metrics.
+	metrics *routerMetrics
+}
+
+// outputStream delivers the output chunks of a running action to the receiver.
+type outputStream struct {
+	ch chan *types.ActionOutput
+	// done is closed when the receiver stops receiving
+	done chan struct{}
+	// overflow is closed when an output chunk arrives while the buffer is full
+	overflow chan struct{}
+	// overflowOnce ensures that overflow is closed only once
+	overflowOnce sync.Once
+}
+
+// outputStreamBufferSize is the number of output chunks that can be buffered in an output stream.
+const outputStreamBufferSize = 64
+
+// outboundFrame is a websocket frame in the outbound queue.
+type outboundFrame struct {
+	messageType int
+	data        []byte
+}
+
+const (
+	// defaultOutboundQueueSize is the default capacity of the outbound queue of a session.
+	defaultOutboundQueueSize = 256
+	// outboundQueueWait is the maximum time to wait for room in the outbound queue.
+	outboundQueueWait = 5 * time.Second
+	// writeWait is the time allowed to write a frame to the websocket connection.
+	writeWait = 10 * time.Second
+)
+
+// ErrOutboundQueueFull is returned when the outbound queue of the session stays full,
+// because the client does not receive the messages as fast as they are sent.
+var ErrOutboundQueueFull = errors.New("the outbound queue of the session is full")
+
+// ErrOutputOverflow is returned when the receiver of the output of the action in streaming mode
+// does not receive the output chunks as fast as the client sends them.
+var ErrOutputOverflow = errors.New("the output stream of the action overflowed")
+
+// ErrResultChannelNotFound is returned when the result arrives for the action message that is no longer awaited.
+var ErrResultChannelNotFound = errors.New("result channel not found")
+
+// ErrSessionClosed is returned when the session is closed while the action message is waiting for its result.
+var ErrSessionClosed = errors.New("session closed")
+
+// ErrSessionReplaced is returned when the session is replaced by a new session of the same agent
+// while the action message is waiting for its result. It is also ErrSessionClosed.
+var ErrSessionReplaced = fmt.Errorf("%w: replaced by a new session of the same agent", ErrSessionClosed)
+
+// invokeErrorMessage returns the message of the error of invoking an action message for the API responses,
+// such as the results of the jobs, the broadcasts and the batches.
+func invokeErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "The action execution timeout"
+	case errors.Is(err, ErrSessionReplaced):
+		return "The client reconnected while running the action"
+	case errors.Is(err, ErrSessionClosed):
+		return "The client disconnected while running the action"
+	case errors.Is(err, ErrOutboundQueueFull):
+		return "The client is too busy to receive the action"
+	default:
+		return err.Error()
+	}
 }
 
 func (sess *Session) Conn() *websocket.Conn {
@@ -41,6 +148,22 @@ func (sess *Session) IsActive() bool {
 	return sess.conn != nil
 }
 
+// InFlight returns the number of the action messages that are waiting for their results.
+func (sess *Session) InFlight() int {
+	return int(sess.inFlight.Load())
+}
+
+// close notifies the invocations waiting for their results that the session is closed.
+// They receive err as the error.
+func (sess *Session) close(err error) {
+	sess.closeOnce.Do(func() {
+		sess.closeErr = err
+		if sess.closed != nil {
+			close(sess.closed)
+		}
+	})
+}
+
 func (sess *Session) Key() string {
 	return sess.client.Id + "/" + sess.id
 }
@@ -49,10 +172,111 @@ func (sess *Session) ConnectPath() string {
 	return "/api/session/connect/" + sess.Key()
 }
 
+// Labels returns the labels of the agent.
+func (sess *Session) Labels() map[string]string {
+	return sess.labels
+}
+
+// ProtocolVersion returns the protocol version negotiated with the client.
+func (sess *Session) ProtocolVersion() int {
+	return sess.protocolVersion
+}
+
+// Supports reports whether both the server and the client support the capability.
+func (sess *Session) Supports(capability string) bool {
+	return sess.capabilities[capability]
+}
+
+// Capabilities returns a list of the optional features that both the server and the client support.
+func (sess *Session) Capabilities() []string {
+	capabilities := make([]string, 0, len(sess.capabilities))
+	for c := range sess.capabilities {
+		capabilities = append(capabilities, c)
+	}
+	slices.Sort(capabilities)
+	return capabilities
+}
+
 func (sess *Session) IsActionExist(name string) bool {
 	return sess.actionMap[name]
 }
 
+// actionOptions returns the options declared by the action.
+// It returns the zero value if the action does not declare any options.
+func (sess *Session) actionOptions(name string) *types.ActionOptions {
+	if opts := sess.options[name]; opts != nil {
+		return opts
+	}
+	return &types.ActionOptions{}
+}
+
+// ActionTimeout returns the execution timeout declared by the action.
+// It returns zero if the action does not declare it.
+func (sess *Session) ActionTimeout(name string) time.Duration {
+	return time.Duration(sess.actionOptions(name).Timeout) * time.Second
+}
+
+// actionTimeouts returns the execution timeouts in seconds declared by the actions.
+func (sess *Session) actionTimeouts() map[string]int {
+	var timeouts map[string]int
+	for name, opts := range sess.options {
+		if opts != nil && opts.Timeout > 0 {
+			if timeouts == nil {
+				timeouts = make(map[string]int)
+			}
+			timeouts[name] = opts.Timeout
+		}
+	}
+	return timeouts
+}
+
+// IsStreamingAction reports whether the action declares that its output is streamed to the HTTP caller.
+func (sess *Session) IsStreamingAction(name string) bool {
+	return sess.actionOptions(name).Stream
+}
+
+// IsDeferrableAction reports whether the action allows the server to queue its invocations while the client is offline.
+func (sess *Session) IsDeferrableAction(name string) bool {
+	return sess.actionOptions(name).Deferrable
+}
+
+// ActionCacheTTL returns the time to cache the successful results of the action. Zero means that they are not cached.
+func (sess *Session) ActionCacheTTL(name string) time.Duration {
+	return time.Duration(sess.actionOptions(name).Cache) * time.Second
+}
+
+// ActionRateLimit returns the rate limit of the requests to the action that the client declared.
+// It returns nil if the action does not declare a valid rate limit.
+func (sess *Session) ActionRateLimit(name string) *types.RateLimit {
+	s := sess.actionOptions(name).RateLimit
+	if s == "" {
+		return nil
+	}
+	limit, err := types.ParseRateLimit(s)
+	if err != nil {
+		return nil
+	}
+	return limit
+}
+
+// defaultActionMethods is a list of the HTTP methods that the action accepts
+// when its spec does not declare any method.
+var defaultActionMethods = []string{http.MethodPost}
+
+// ActionMethods returns the HTTP methods that the action accepts.
+// It returns only POST if the action does not declare any method.
+func (sess *Session) ActionMethods(name string) []string {
+	if methods := sess.actionOptions(name).Methods; len(methods) > 0 {
+		return methods
+	}
+	return defaultActionMethods
+}
+
+// IsMethodAllowed reports whether the action accepts the HTTP method.
+func (sess *Session) IsMethodAllowed(name string, method string) bool {
+	return slices.Contains(sess.ActionMethods(name), method)
+}
+
 func (sess *Session) AllocateResultChannel(msgId string) <-chan *types.ActionResult {
 	sess.mu.Lock()
 	defer sess.mu.Unlock()
@@ -63,6 +287,13 @@ func (sess *Session) AllocateResultChannel(msgId string) <-chan *types.ActionRes
 	return resultChan
 }
 
+// numPendingResults returns the number of the allocated result channels.
+func (sess *Session) numPendingResults() int {
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	return len(sess.results)
+}
+
 func (sess *Session) FreeResultChannel(msgId string) {
 	sess.mu.Lock()
 	defer sess.mu.Unlock()
@@ -73,14 +304,401 @@ func (sess *Session) FreeResultChannel(msgId string) {
 	}
 }
 
+func (sess *Session) AllocateOutputChannel(msgId string) <-chan *types.ActionOutput {
+	return sess.allocateOutputStream(msgId).ch
+}
+
+func (sess *Session) allocateOutputStream(msgId string) *outputStream {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	stream := &outputStream{
+		ch:       make(chan *types.ActionOutput, outputStreamBufferSize),
+		done:     make(chan struct{}),
+		overflow: make(chan struct{}),
+	}
+	if sess.outputs == nil {
+		sess.outputs = make(map[string]*outputStream)
+	}
+	sess.outputs[msgId] = stream
+	return stream
+}
+
+func (sess *Session) FreeOutputChannel(msgId string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if stream, ok := sess.outputs[msgId]; ok {
+		// The output channel is not closed, because HandleActionOutput may be sending to it.
+		close(stream.done)
+		delete(sess.outputs, msgId)
+	}
+}
+
+// HandleActionOutput delivers the output chunk to the receiver.
+// It never blocks, because the reader of the connection also delivers the messages of the other actions.
+// If the buffer of the output stream is full, the stream overflows: the chunk and the following ones are dropped,
+// and the receiver aborts the action with ErrOutputOverflow. It returns ErrOutputOverflow only for the first chunk.
+func (sess *Session) HandleActionOutput(output *types.ActionOutput) error {
+	sess.mu.RLock()
+	stream, ok := sess.outputs[output.Id]
+	sess.mu.RUnlock()
+	if !ok {
+		return ErrResultChannelNotFound
+	}
+
+	select {
+	case <-stream.overflow:
+		return nil
+	default:
+	}
+	select {
+	case stream.ch <- output:
+		return nil
+	case <-stream.done:
+		return nil
+	default:
+	}
+	overflowed := false
+	stream.overflowOnce.Do(func() {
+		close(stream.overflow)
+		overflowed = true
+	})
+	if overflowed {
+		return ErrOutputOverflow
+	}
+	return nil
+}
+
+// HandleMessage handles the message that is sent from the client via websocket.
+func (sess *Session) HandleMessage(message []byte) error {
+	if sess.protocolVersion < types.ProtocolVersion2 {
+		return errors.Errorf("unexpected message from the client of protocol version %d", sess.protocolVersion)
+	}
+
+	env, err := types.ParseEnvelope(message)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	switch env.Type {
+	case types.MessageTypeOutput:
+		output := &types.ActionOutput{}
+		if err := env.DecodePayload(output); err != nil {
+			return errors.WithStack(err)
+		}
+		output.Id = env.Id
+		if output.Data, err = types.DecodeBody(output.Data, output.DataEncoding); err != nil {
+			return errors.WithStack(err)
+		}
+		output.DataEncoding = ""
+		return sess.HandleActionOutput(output)
+	case types.MessageTypeResult:
+		result := &types.ActionResult{}
+		if err := env.DecodePayload(result); err != nil {
+			return errors.WithStack(err)
+		}
+		result.Id = env.Id
+		if result.Body, err = types.DecodeBody(result.Body, result.BodyEncoding); err != nil {
+			return errors.WithStack(err)
+		}
+		result.BodyEncoding = ""
+		return sess.HandleActionResult(result)
+	case types.MessageTypeError:
+		payload := &types.ErrorPayload{}
+		if err := env.DecodePayload(payload); err != nil {
+			return errors.WithStack(err)
+		}
+		if env.Id == "" {
+			// The error is not related to any action message.
+			return errors.Errorf("the client reported an error: %s", payload.Error)
+		}
+		return sess.HandleActionResult(&types.ActionResult{
+			Id:     env.Id,
+			Status: types.ActionResultStatusError,
+			Body:   payload.Error,
+		})
+	case types.MessageTypeHeartbeat:
+		sess.heartbeat()
+		return nil
+	default:
+		return errors.Errorf("unknown message type: %s", env.Type)
+	}
+}
+
+func (sess *Session) heartbeat() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.lastHeartbeat = time.Now()
+}
+
+// LastHeartbeat returns the time when the last heartbeat message was received from the client.
+// It returns the zero time if the client has never sent it.
+func (sess *Session) LastHeartbeat() time.Time {
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	return sess.lastHeartbeat
+}
+
 func (sess *Session) HandleActionResult(result *types.ActionResult) error {
 	sess.mu.RLock()
 	defer sess.mu.RUnlock()
 
 	ch, ok := sess.results[result.Id]
 	if !ok {
-		return errors.New("result channel not found")
+		return ErrResultChannelNotFound
+	}
+	select {
+	case ch <- result:
+	default:
+		// The result for the message has already been received. Ignore the duplicated one.
 	}
-	ch <- result
 	return nil
 }
+
+// send queues the message to be written to the websocket connection as JSON.
+// If the outbound queue is full, it waits for room up to outboundQueueWait and then returns ErrOutboundQueueFull.
+func (sess *Session) send(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return sess.enqueue(&outboundFrame{messageType: websocket.TextMessage, data: data}, outboundQueueWait)
+}
+
+// Ping writes a ping frame to the websocket connection.
+// The control frames can be written concurrently with the writer goroutine, so the ping frame bypasses
+// the outbound queue. Otherwise a full queue would stop the pings and the client would be disconnected.
+func (sess *Session) Ping() error {
+	conn := sess.Conn()
+	if conn == nil {
+		return errors.New("the session is active but the websocket connection is nil")
+	}
+	return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+}
+
+// OutboundQueueDepth returns the number of the frames that wait to be written to the websocket connection.
+func (sess *Session) OutboundQueueDepth() int {
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	return len(sess.outbound)
+}
+
+// enqueue puts the frame into the outbound queue, waiting for room up to wait.
+// The writer goroutine is started on the first frame.
+func (sess *Session) enqueue(frame *outboundFrame, wait time.Duration) error {
+	conn := sess.Conn()
+	if conn == nil {
+		return errors.New("the session is active but the websocket connection is nil")
+	}
+	sess.writerOnce.Do(func() {
+		size := sess.outboundQueueSize
+		if size <= 0 {
+			size = defaultOutboundQueueSize
+		}
+		sess.mu.Lock()
+		sess.outbound = make(chan *outboundFrame, size)
+		sess.mu.Unlock()
+		sess.writerDone = make(chan struct{})
+		go sess.writeLoop(conn)
+	})
+
+	select {
+	case <-sess.writerDone:
+		return errors.Wrap(sess.writeErr, "failed to write to the websocket connection")
+	case sess.outbound <- frame:
+		return nil
+	default:
+	}
+	if wait <= 0 {
+		return ErrOutboundQueueFull
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case sess.outbound <- frame:
+		return nil
+	case <-sess.closed:
+		return sess.closeErr
+	case <-sess.writerDone:
+		return errors.Wrap(sess.writeErr, "failed to write to the websocket connection")
+	case <-timer.C:
+		return ErrOutboundQueueFull
+	}
+}
+
+// writeLoop writes the frames in the outbound queue to the websocket connection one by one
+// until the session is closed. If a write fails, it closes the connection,
+// so that the session is closed by the reader of the connection.
+func (sess *Session) writeLoop(conn *websocket.Conn) {
+	for {
+		select {
+		case frame := <-sess.outbound:
+			err := conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err == nil {
+				err = conn.WriteMessage(frame.messageType, frame.data)
+			}
+			if err != nil {
+				sess.metrics.writeFailed()
+				sess.writeErr = err
+				close(sess.writerDone)
+				_ = conn.Close()
+				return
+			}
+		case <-sess.closed:
+			return
+		}
+	}
+}
+
+// SendAction sends the action message to the client.
+func (sess *Session) SendAction(msg *types.ActionMessage) error {
+	if sess.protocolVersion < types.ProtocolVersion2 {
+		return sess.send(msg)
+	}
+	if sess.Supports(types.CapabilityBase64Body) {
+		encoded := *msg
+		encoded.Body, encoded.BodyEncoding = types.EncodeBody(msg.Body)
+		msg = &encoded
+	}
+	env, err := types.NewEnvelope(types.MessageTypeAction, msg.Id, msg)
+	if err != nil {
+		return err
+	}
+	return sess.send(env)
+}
+
+// SendUpload sends the chunk of an uploaded file of the action message to the client.
+// It is available only if the client supports the multipart capability.
+func (sess *Session) SendUpload(msg *types.ActionMessage, chunk *types.UploadChunk) error {
+	if !sess.Supports(types.CapabilityMultipart) {
+		return errors.New("the client does not support multipart requests")
+	}
+	encoded := *chunk
+	encoded.Data, encoded.DataEncoding = types.EncodeBody(chunk.Data)
+	env, err := types.NewEnvelope(types.MessageTypeUpload, msg.Id, &encoded)
+	if err != nil {
+		return err
+	}
+	return sess.send(env)
+}
+
+// SendCancel sends the message to cancel the running action of the action message to the client.
+// The clients of ProtocolVersion1 do not support cancellation, so nothing is sent to them.
+func (sess *Session) SendCancel(msg *types.ActionMessage) error {
+	if sess.protocolVersion < types.ProtocolVersion2 {
+		return nil
+	}
+	env, err := types.NewEnvelope(types.MessageTypeCancel, msg.Id, nil)
+	if err != nil {
+		return err
+	}
+	return sess.send(env)
+}
+
+// Invoke sends the action message to the client and waits for its result.
+// If the context is done before the result arrives, it sends a cancel message to the client
+// and returns the context error. If the session is closed before the result arrives, it returns ErrSessionClosed
+// or ErrSessionReplaced.
+func (sess *Session) Invoke(ctx context.Context, msg *types.ActionMessage) (result *types.ActionResult, err error) {
+	defer func(start time.Time) {
+		sess.metrics.invoked(msg.Name, start, result, err)
+	}(time.Now())
+
+	sess.inFlight.Add(1)
+	defer sess.inFlight.Add(-1)
+
+	// make sure to free the result channel
+	defer sess.FreeResultChannel(msg.Id)
+
+	// Allocate a result channel to receive the action result
+	resultChan := sess.AllocateResultChannel(msg.Id)
+
+	// Send the action message to the client
+	if err := sess.SendAction(msg); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// Wait for the action result or the end of the context
+	select {
+	case result := <-resultChan:
+		return result, nil
+	case <-sess.closed:
+		return nil, sess.closeErr
+	case <-ctx.Done():
+		return nil, sess.cancel(ctx, msg)
+	}
+}
+
+// InvokeStream sends the action message to the client in streaming mode and waits for its result.
+// The output chunks of the action are passed to onOutput as they arrive.
+// If onOutput returns an error, it cancels the action and returns the error.
+func (sess *Session) InvokeStream(ctx context.Context, msg *types.ActionMessage, onOutput func(data string) error) (result *types.ActionResult, err error) {
+	msg.Stream = true
+	defer func(start time.Time) {
+		sess.metrics.invoked(msg.Name, start, result, err)
+	}(time.Now())
+
+	sess.inFlight.Add(1)
+	defer sess.inFlight.Add(-1)
+
+	// make sure to free the result and output channels
+	defer sess.FreeResultChannel(msg.Id)
+	defer sess.FreeOutputChannel(msg.Id)
+
+	resultChan := sess.AllocateResultChannel(msg.Id)
+	stream := sess.allocateOutputStream(msg.Id)
+	outputChan := stream.ch
+
+	// Send the action message to the client
+	if err := sess.SendAction(msg); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for {
+		select {
+		case output := <-outputChan:
+			if err := onOutput(output.Data); err != nil {
+				_ = sess.SendCancel(msg)
+				return nil, err
+			}
+		case result := <-resultChan:
+			// The client sends all output chunks before the result,
+			// but some of them may still remain in the buffer of the output channel.
+			for drained := false; !drained; {
+				select {
+				case output := <-outputChan:
+					if err := onOutput(output.Data); err != nil {
+						return nil, err
+					}
+				default:
+					drained = true
+				}
+			}
+			select {
+			case <-stream.overflow:
+				// Some output chunks have been dropped.
+				return nil, ErrOutputOverflow
+			default:
+			}
+			return result, nil
+		case <-stream.overflow:
+			// The output is incomplete, so the action is canceled instead of returning the rest of it.
+			_ = sess.SendCancel(msg)
+			return nil, ErrOutputOverflow
+		case <-sess.closed:
+			return nil, sess.closeErr
+		case <-ctx.Done():
+			return nil, sess.cancel(ctx, msg)
+		}
+	}
+}
+
+// cancel sends a cancel message for the action message to the client, because nobody waits for the result anymore.
+// It returns the context error.
+func (sess *Session) cancel(ctx context.Context, msg *types.ActionMessage) error {
+	if err := sess.SendCancel(msg); err != nil {
+		return errors.Wrap(ctx.Err(), "failed to send a cancel message: "+err.Error())
+	}
+	return ctx.Err()
+}
@@ -1,10 +1,16 @@
 package router
 
 import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
 	"github.com/kohkimakimoto/actions-gateway/server/auth"
 	"github.com/kohkimakimoto/actions-gateway/server/types"
 	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSession_Key(t *testing.T) {
@@ -39,6 +45,125 @@ func TestSession_IsActionExist(t *testing.T) {
 	assert.False(t, sess.IsActionExist("action3"))
 }
 
+func TestSession_ActionTimeout(t *testing.T) {
+	sess := &Session{
+		options: map[string]*types.ActionOptions{
+			"action1": {Timeout: 120},
+		},
+	}
+	assert.Equal(t, 120*time.Second, sess.ActionTimeout("action1"))
+	assert.Equal(t, time.Duration(0), sess.ActionTimeout("action2"))
+}
+
+func TestSession_IsStreamingAction(t *testing.T) {
+	sess := &Session{
+		options: map[string]*types.ActionOptions{
+			"action1": {Stream: true},
+		},
+	}
+	assert.True(t, sess.IsStreamingAction("action1"))
+	assert.False(t, sess.IsStreamingAction("action2"))
+}
+
+func TestSession_IsMethodAllowed(t *testing.T) {
+	sess := &Session{
+		options: map[string]*types.ActionOptions{
+			"action1": {Methods: []string{"GET", "DELETE"}},
+		},
+	}
+	assert.True(t, sess.IsMethodAllowed("action1", "GET"))
+	assert.False(t, sess.IsMethodAllowed("action1", "POST"))
+	// the action that does not declare methods accepts only POST
+	assert.True(t, sess.IsMethodAllowed("action2", "POST"))
+	assert.False(t, sess.IsMethodAllowed("action2", "PUT"))
+	assert.Equal(t, []string{"POST"}, sess.ActionMethods("action2"))
+}
+
+func TestSession_SendUpload(t *testing.T) {
+	sess := &Session{
+		protocolVersion: types.ProtocolVersion2,
+	}
+	err := sess.SendUpload(&types.ActionMessage{Id: "00000000-0000-0000-0000-000000000000"}, &types.UploadChunk{})
+	assert.EqualError(t, err, "the client does not support multipart requests")
+}
+
+func TestSession_Send(t *testing.T) {
+	t.Run("concurrent senders", func(t *testing.T) {
+		var mu sync.Mutex
+		received := map[string]bool{}
+		sess := &Session{
+			protocolVersion: types.ProtocolVersion2,
+			closed:          make(chan struct{}),
+		}
+		sess.conn = testWebsocketConn(t, func(message []byte) {
+			// every frame must arrive intact
+			env, err := types.ParseEnvelope(message)
+			assert.NoError(t, err)
+			mu.Lock()
+			defer mu.Unlock()
+			received[env.Id] = true
+		})
+		defer sess.close(ErrSessionClosed)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, sess.SendAction(&types.ActionMessage{
+					Id:   fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+					Name: "action1",
+					Body: strings.Repeat("a", 1024),
+				}))
+				assert.NoError(t, sess.Ping())
+			}()
+		}
+		wg.Wait()
+
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(received) == 100
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	// stalledSession returns the session whose outbound queue is full and is not drained,
+	// like the session of the client that stops receiving the frames.
+	stalledSession := func() *Session {
+		sess := &Session{
+			protocolVersion: types.ProtocolVersion2,
+			conn:            testWebsocketConn(t, func(message []byte) {}),
+			outbound:        make(chan *outboundFrame, 1),
+			writerDone:      make(chan struct{}),
+			closed:          make(chan struct{}),
+		}
+		sess.writerOnce.Do(func() {})
+		sess.outbound <- &outboundFrame{messageType: websocket.PingMessage}
+		return sess
+	}
+
+	t.Run("the outbound queue is full", func(t *testing.T) {
+		sess := stalledSession()
+		assert.Equal(t, 1, sess.OutboundQueueDepth())
+		// the ping frame does not go through the outbound queue
+		assert.NoError(t, sess.Ping())
+
+		start := time.Now()
+		err := sess.enqueue(&outboundFrame{messageType: websocket.TextMessage}, 100*time.Millisecond)
+		assert.ErrorIs(t, err, ErrOutboundQueueFull)
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	})
+
+	t.Run("the session is closed while waiting for room", func(t *testing.T) {
+		sess := stalledSession()
+		time.AfterFunc(50*time.Millisecond, func() {
+			sess.close(ErrSessionClosed)
+		})
+		err := sess.enqueue(&outboundFrame{messageType: websocket.TextMessage}, time.Second)
+		assert.ErrorIs(t, err, ErrSessionClosed)
+	})
+}
+
 func TestSession_AllocateResultChannel(t *testing.T) {
 	// test allocate result channel
 	sess := &Session{
@@ -58,6 +183,9 @@ func TestSession_AllocateResultChannel(t *testing.T) {
 
 	err := sess.HandleActionResult(result)
 	assert.NoError(t, err)
+	// the duplicated result is ignored
+	err = sess.HandleActionResult(result)
+	assert.NoError(t, err)
 	result2 := <-ch
 	assert.Equal(t, result, result2)
 
@@ -68,5 +196,203 @@ func TestSession_AllocateResultChannel(t *testing.T) {
 
 	// test handle action result that is already freed
 	err = sess.HandleActionResult(result)
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrResultChannelNotFound)
+}
+
+func TestSession_AllocateOutputChannel(t *testing.T) {
+	sess := &Session{
+		outputs: make(map[string]*outputStream),
+	}
+	msgId := "00000000-0000-0000-0000-000000000000"
+	ch := sess.AllocateOutputChannel(msgId)
+	assert.NotNil(t, ch)
+	assert.Equal(t, 1, len(sess.outputs))
+
+	// test handle action output
+	output := &types.ActionOutput{
+		Id:   msgId,
+		Data: "chunk",
+	}
+	err := sess.HandleActionOutput(output)
+	assert.NoError(t, err)
+	assert.Equal(t, output, <-ch)
+
+	// test free output channel
+	sess.FreeOutputChannel(msgId)
+	assert.Equal(t, 0, len(sess.outputs))
+
+	// test handle action output that is already freed
+	err = sess.HandleActionOutput(output)
+	assert.ErrorIs(t, err, ErrResultChannelNotFound)
+}
+
+func TestSession_HandleActionOutput(t *testing.T) {
+	sess := &Session{
+		outputs: make(map[string]*outputStream),
+	}
+	msgId := "00000000-0000-0000-0000-000000000000"
+	stream := sess.allocateOutputStream(msgId)
+	for i := 0; i < outputStreamBufferSize; i++ {
+		assert.NoError(t, sess.HandleActionOutput(&types.ActionOutput{Id: msgId, Data: "chunk"}))
+	}
+
+	// The chunk that does not fit in the buffer overflows the stream instead of blocking the reader.
+	assert.ErrorIs(t, sess.HandleActionOutput(&types.ActionOutput{Id: msgId, Data: "chunk"}), ErrOutputOverflow)
+	select {
+	case <-stream.overflow:
+	default:
+		t.Fatal("the stream did not overflow")
+	}
+	// the following chunks are dropped silently
+	assert.NoError(t, sess.HandleActionOutput(&types.ActionOutput{Id: msgId, Data: "chunk"}))
+	assert.Len(t, stream.ch, outputStreamBufferSize)
+}
+
+func TestSession_InvokeStream(t *testing.T) {
+	t.Run("the output overflows", func(t *testing.T) {
+		msgId := "00000000-0000-0000-0000-000000000001"
+		sess := &Session{
+			protocolVersion: types.ProtocolVersion2,
+			results:         make(map[string]chan *types.ActionResult),
+			outputs:         make(map[string]*outputStream),
+			closed:          make(chan struct{}),
+		}
+		defer sess.close(ErrSessionClosed)
+		canceled := make(chan struct{})
+		sess.conn = testWebsocketConn(t, func(message []byte) {
+			env, err := types.ParseEnvelope(message)
+			assert.NoError(t, err)
+			switch env.Type {
+			case types.MessageTypeAction:
+				// the client sends the output faster than the receiver takes it
+				for i := 0; i < outputStreamBufferSize+2; i++ {
+					_ = sess.HandleActionOutput(&types.ActionOutput{Id: msgId, Data: "chunk"})
+				}
+			case types.MessageTypeCancel:
+				close(canceled)
+			}
+		})
+
+		release := make(chan struct{})
+		time.AfterFunc(100*time.Millisecond, func() {
+			close(release)
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := sess.InvokeStream(ctx, &types.ActionMessage{Id: msgId, Name: "action1"}, func(data string) error {
+			<-release
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrOutputOverflow)
+
+		// the client is asked to cancel the action
+		select {
+		case <-canceled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the cancel message was not sent")
+		}
+	})
+}
+
+func TestSession_HandleMessage(t *testing.T) {
+	msgId := "00000000-0000-0000-0000-000000000000"
+
+	t.Run("output message", func(t *testing.T) {
+		sess := &Session{
+			protocolVersion: types.ProtocolVersion2,
+			outputs:         make(map[string]*outputStream),
+		}
+		ch := sess.AllocateOutputChannel(msgId)
+		err := sess.HandleMessage([]byte(`{"type":"output","version":2,"id":"` + msgId + `","payload":{"data":"chunk"}}`))
+		assert.NoError(t, err)
+		output := <-ch
+		assert.Equal(t, msgId, output.Id)
+		assert.Equal(t, "chunk", output.Data)
+	})
+
+	t.Run("result message", func(t *testing.T) {
+		sess := &Session{
+			protocolVersion: types.ProtocolVersion2,
+			results:         make(map[string]chan *types.ActionResult),
+		}
+		ch := sess.AllocateResultChannel(msgId)
+		err := sess.HandleMessage([]byte(`{"type":"result","version":2,"id":"` + msgId + `","payload":{"status":"success","body":"ok"}}`))
+		assert.NoError(t, err)
+		result := <-ch
+		assert.Equal(t, types.ActionResultStatusSuccess, result.Status)
+		assert.Equal(t, "ok", result.Body)
+	})
+
+	t.Run("result message with binary body", func(t *testing.T) {
+		sess := &Session{
+			protocolVersion: types.ProtocolVersion2,
+			results:         make(map[string]chan *types.ActionResult),
+		}
+		ch := sess.AllocateResultChannel(msgId)
+		err := sess.HandleMessage([]byte(`{"type":"result","version":2,"id":"` + msgId + `","payload":{"status":"success","body":"iVBORwD/","body_encoding":"base64"}}`))
+		assert.NoError(t, err)
+		result := <-ch
+		assert.Equal(t, string([]byte{0x89, 0x50, 0x4e, 0x47, 0x00, 0xff}), result.Body)
+		assert.Equal(t, "", result.BodyEncoding)
+	})
+
+	t.Run("error message", func(t *testing.T) {
+		sess := &Session{
+			protocolVersion: types.ProtocolVersion2,
+			results:         make(map[string]chan *types.ActionResult),
+		}
+		ch := sess.AllocateResultChannel(msgId)
+		err := sess.HandleMessage([]byte(`{"type":"error","version":2,"id":"` + msgId + `","payload":{"error":"action not found"}}`))
+		assert.NoError(t, err)
+		result := <-ch
+		assert.Equal(t, types.ActionResultStatusError, result.Status)
+		assert.Equal(t, "action not found", result.Body)
+
+		// the error that is not related to any action message
+		err = sess.HandleMessage([]byte(`{"type":"error","version":2,"payload":{"error":"failed to parse the message"}}`))
+		assert.EqualError(t, err, "the client reported an error: failed to parse the message")
+	})
+
+	t.Run("heartbeat message", func(t *testing.T) {
+		sess := &Session{
+			protocolVersion: types.ProtocolVersion2,
+		}
+		assert.True(t, sess.LastHeartbeat().IsZero())
+		err := sess.HandleMessage([]byte(`{"type":"heartbeat","version":2}`))
+		assert.NoError(t, err)
+		assert.False(t, sess.LastHeartbeat().IsZero())
+	})
+
+	t.Run("unknown message", func(t *testing.T) {
+		sess := &Session{
+			protocolVersion: types.ProtocolVersion2,
+		}
+		err := sess.HandleMessage([]byte(`{"type":"unknown","version":2}`))
+		assert.EqualError(t, err, "unknown message type: unknown")
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		sess := &Session{
+			protocolVersion: types.ProtocolVersion2,
+		}
+		err := sess.HandleMessage([]byte(`{"type":"heartbeat","version":3}`))
+		assert.EqualError(t, err, "unsupported protocol version of the message: 3")
+	})
+
+	t.Run("invalid message", func(t *testing.T) {
+		sess := &Session{
+			protocolVersion: types.ProtocolVersion2,
+		}
+		err := sess.HandleMessage([]byte(`not json`))
+		assert.Error(t, err)
+	})
+
+	t.Run("protocol version 1", func(t *testing.T) {
+		// The clients of protocol version 1 do not send any messages via websocket.
+		sess := &Session{
+			protocolVersion: types.ProtocolVersion1,
+		}
+		err := sess.HandleMessage([]byte(`{"type":"heartbeat","version":2}`))
+		assert.EqualError(t, err, "unexpected message from the client of protocol version 1")
+	})
 }
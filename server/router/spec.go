@@ -0,0 +1,70 @@
+package router
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+)
+
+// mergeSpecs merges the OpenAPI specs of the sessions into one spec.
+// The first spec is used as the base, and the paths of the other specs that the base does not have are added to it.
+// A path that is advertised by several sessions is taken from the first one.
+func mergeSpecs(specs []string) (string, error) {
+	if len(specs) == 1 {
+		return specs[0], nil
+	}
+
+	var base *yaml.Node
+	var basePaths *yaml.Node
+	for i, spec := range specs {
+		doc := &yaml.Node{}
+		if err := yaml.Unmarshal([]byte(spec), doc); err != nil {
+			return "", fmt.Errorf("failed to parse the spec: %w", err)
+		}
+		if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+			return "", fmt.Errorf("failed to parse the spec: the spec is not a mapping")
+		}
+		paths := mappingValue(doc.Content[0], "paths")
+		if i == 0 {
+			base = doc
+			basePaths = paths
+			if basePaths == nil {
+				basePaths = &yaml.Node{}
+				doc.Content[0].Content = append(doc.Content[0].Content,
+					&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "paths"}, basePaths)
+			}
+			if basePaths.Kind != yaml.MappingNode {
+				// The spec of the session that has no actions may have the empty paths.
+				*basePaths = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			}
+			continue
+		}
+		if paths == nil {
+			continue
+		}
+		for j := 0; j+1 < len(paths.Content); j += 2 {
+			if mappingValue(basePaths, paths.Content[j].Value) == nil {
+				basePaths.Content = append(basePaths.Content, paths.Content[j], paths.Content[j+1])
+			}
+		}
+	}
+
+	b, err := yaml.Marshal(base)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate the merged spec: %w", err)
+	}
+	return string(b), nil
+}
+
+// mappingValue returns the value node of the key in the mapping node.
+// It returns nil if the key is not found.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -2,14 +2,19 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
 	"embed"
 	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/kohkimakimoto/actions-gateway/metrics"
 	"github.com/kohkimakimoto/actions-gateway/server/auth"
 	"github.com/kohkimakimoto/actions-gateway/server/config"
 	"github.com/kohkimakimoto/actions-gateway/server/csrf"
 	"github.com/kohkimakimoto/actions-gateway/server/handlers"
 	"github.com/kohkimakimoto/actions-gateway/server/renderer"
 	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
@@ -27,6 +32,62 @@ var (
 )
 
 func Start(cfg *config.Config) error {
+	reg := metrics.NewRegistry()
+	e, closeFn, err := newEcho(cfg, reg)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	// metrics server that listens separately from the server
+	var me *echo.Echo
+	if cfg.Metrics && cfg.MetricsAddr != "" {
+		me = newMetricsEcho(cfg, reg)
+		me.Logger = e.Logger
+	}
+
+	// https://echo.labstack.com/docs/cookbook/graceful-shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// start server
+	go func() {
+		if err := e.Start(e.Server.Addr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Errorf("the server returned an error: %+v", err)
+		}
+	}()
+
+	e.Logger.Infof("server started on %s", e.Server.Addr)
+
+	if me != nil {
+		go func() {
+			if err := me.Start(me.Server.Addr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				e.Logger.Errorf("the metrics server returned an error: %+v", err)
+			}
+		}()
+		e.Logger.Infof("metrics server started on %s", me.Server.Addr)
+	}
+
+	// Wait for interrupt signal to stop the process.
+	<-ctx.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		e.Logger.Errorf("failed to shutdown the server: %+v", err)
+	}
+	if me != nil {
+		if err := me.Shutdown(ctx); err != nil {
+			e.Logger.Errorf("failed to shutdown the metrics server: %+v", err)
+		}
+	}
+
+	return nil
+}
+
+// newEcho creates the echo instance that serves the server from the configuration.
+// The metrics of the server are registered to reg.
+// It also returns a function to release the resources of the server after it stops.
+func newEcho(cfg *config.Config, reg *metrics.Registry) (*echo.Echo, func(), error) {
 	e := echo.New()
 	e.HidePort = true
 	e.HideBanner = true
@@ -44,21 +105,105 @@ func Start(cfg *config.Config) error {
 
 	e.HTTPErrorHandler = handlers.HTTPErrorHandler
 
+	// The IP address of the caller is taken from the X-Forwarded-For header only if the request comes
+	// from a trusted proxy. Otherwise, the callers could spoof the header to evade the rate limits.
+	ranges, err := cfg.TrustedProxyRanges()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ranges) == 0 {
+		e.IPExtractor = echo.ExtractIPDirect()
+	} else {
+		options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+		for _, ipNet := range ranges {
+			options = append(options, echo.TrustIPRange(ipNet))
+		}
+		e.IPExtractor = echo.ExtractIPFromXFFHeader(options...)
+	}
+
 	// ----------------------------------------------------------------
 	// Global objects
 	// ----------------------------------------------------------------
 
-	// router
-	r := router.New()
 	// key
 	key, err := auth.LoadKeyString(cfg.Secret)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	// rate limiter for the action invocations.
+	// It is always created, because the actions can declare their own rate limits.
+	limiter, err := newRateLimiter(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	// session registry shared by the server nodes
+	registry, closeRegistry, err := newRegistry(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The ids of the jobs and the action messages have the id of the node that created them
+	// if the server runs as multiple nodes, so that the other nodes can forward the requests for them.
+	nodeId := uuid.NewString()
+	var jobNodeId string
+	if cfg.Registry != "memory" {
+		jobNodeId = nodeId
 	}
+	// router
+	r := router.New(
+		router.WithHeartbeatTimeout(time.Duration(cfg.HeartbeatTimeout)*time.Second),
+		router.WithReconnectGracePeriod(time.Duration(cfg.ReconnectGracePeriod)*time.Second),
+		router.WithReconnectQueueSize(cfg.ReconnectQueueSize),
+		router.WithOutboundQueueSize(cfg.OutboundQueueSize),
+		router.WithRegistry(registry),
+		router.WithNode(nodeId, cfg.NodeURLOrDefault()),
+		router.WithForwardKey([]byte(cfg.Secret)),
+		router.WithMetrics(reg),
+	)
 	// token generator
 	tokenGenerator := auth.NewTokenGenerator(key)
 	// action message factory
-	aFactory := router.NewActionMessageFactory()
+	aFactory := router.NewActionMessageFactory(router.WithActionNode(jobNodeId))
+
+	// job manager for asynchronous action invocations
+	jm := router.NewJobManager(
+		router.WithJobTimeout(time.Duration(cfg.JobTimeout)*time.Second),
+		router.WithJobRetention(time.Duration(cfg.JobRetention)*time.Second),
+		router.WithJobNode(jobNodeId),
+	)
+
+	// durable queue for the invocations that wait for the client to connect
+	var dq *router.DeferredQueue
+	if cfg.DurableQueueDir != "" {
+		dq, err = router.NewDeferredQueue(cfg.DurableQueueDir, r,
+			router.WithDeferredTTL(time.Duration(cfg.DurableQueueTTL)*time.Second),
+			router.WithDeferredTimeout(time.Duration(cfg.JobTimeout)*time.Second),
+			router.WithDeferredRetention(time.Duration(cfg.JobRetention)*time.Second),
+		)
+		if err != nil {
+			closeRegistry()
+			return nil, nil, err
+		}
+	}
+	// idempotency store for the retries of the action invocations
+	var idempotency *router.IdempotencyStore
+	if cfg.IdempotencyTTL > 0 {
+		idempotency = router.NewIdempotencyStore(time.Duration(cfg.IdempotencyTTL)*time.Second,
+			router.WithIdempotencyMaxEntries(cfg.IdempotencyMaxEntries),
+			router.WithIdempotencyMaxBytes(cfg.IdempotencyMaxBytes),
+		)
+	}
+	// cache for the results of the read-only actions
+	var cache *router.ResultCache
+	if cfg.CacheSize > 0 {
+		cache = router.NewResultCache(cfg.CacheSize)
+	}
+	registerMetrics(reg, tokenGenerator, limiter, dq, idempotency, cache)
+	closeFn := func() {
+		closeRegistry()
+		if dq != nil {
+			_ = dq.Close()
+		}
+	}
 
 	// ----------------------------------------------------------------
 	// middleware
@@ -66,6 +211,7 @@ func Start(cfg *config.Config) error {
 	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{
 		LogLevel: log.ERROR,
 	}))
+	e.Use(handlers.ForwardAuthMiddleware(r))
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: `{"time":"${time_rfc3339}","type":"request","remote_ip":"${remote_ip}",` +
 			`"host":"${host}","method":"${method}","uri":"${uri}","user_agent":"${user_agent}",` +
@@ -84,17 +230,36 @@ func Start(cfg *config.Config) error {
 
 	csrfProtection := csrf.Middleware()
 
+	// rate limit
+	rateLimit := handlers.RateLimitMiddleware(limiter, r)
+
 	// ----------------------------------------------------------------
 	// handlers
 	// ----------------------------------------------------------------
 	e.GET("/", handlers.RootHandler)
 
 	// actions endpoint
-	e.POST("/actions/:name", handlers.FetchActionHandler(r, aFactory), tokenAuth)
+	fetchActionHandler := handlers.FetchActionHandler(r, aFactory, jm, dq, idempotency, cache, cfg.MaxUploadSize)
+	e.Match(handlers.ActionMethods, "/actions/:name", fetchActionHandler, tokenAuth, rateLimit)
+	e.Match(handlers.ActionMethods, "/actions/:name/*", fetchActionHandler, tokenAuth, rateLimit)
+
+	// broadcast endpoint to invoke an action on all agents
+	e.POST("/broadcast/:name", handlers.BroadcastActionHandler(r, aFactory), tokenAuth, rateLimit)
+
+	// batch endpoint to invoke several actions in one request
+	e.POST("/batch", handlers.BatchActionsHandler(r, aFactory, limiter, idempotency), tokenAuth, rateLimit)
+
+	// cache endpoint to purge the cached results of the read-only actions
+	e.DELETE("/cache", handlers.PurgeCacheHandler(cache), tokenAuth)
+	e.DELETE("/cache/:name", handlers.PurgeCacheHandler(cache), tokenAuth)
+
+	// jobs endpoint for asynchronous action invocations
+	e.GET("/jobs/:id", handlers.GetJobHandler(r, jm, dq), tokenAuth)
+	e.DELETE("/jobs/:id", handlers.DeleteJobHandler(r, jm, dq), tokenAuth)
 
 	// "/api/..." endpoints are used to communicate with the client.
 
-	// notify action result
+	// notify action result (for older clients that do not send the results via websocket)
 	e.POST("/api/notify", handlers.NotifyActionResultHandler(r), tokenAuth)
 	// session
 	e.POST("/api/session/new", handlers.SessionNewHandler(cfg, r), tokenAuth)
@@ -114,32 +279,121 @@ func Start(cfg *config.Config) error {
 	// see: https://kamal-deploy.org/docs/configuration/proxy/#healthcheck
 	e.GET("/up", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) })
 
+	// metrics endpoint
+	if cfg.Metrics && cfg.MetricsAddr == "" {
+		e.GET("/metrics", handlers.MetricsHandler(reg), metricsMiddleware(cfg)...)
+	}
+
 	// OpenAPI docs
 	e.GET("/docs*", handlers.DocsHandler(r), basicAuth)
 
 	// static files
 	e.StaticFS("/", echo.MustSubFS(publicFS, "public"))
 
-	// https://echo.labstack.com/docs/cookbook/graceful-shutdown
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
+	return e, closeFn, nil
+}
 
-	// start server
-	go func() {
-		if err := e.Start(e.Server.Addr); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			e.Logger.Errorf("the server returned an error: %+v", err)
-		}
-	}()
+// newMetricsEcho creates the echo instance that serves only the metrics endpoint on the metrics address.
+func newMetricsEcho(cfg *config.Config, reg *metrics.Registry) *echo.Echo {
+	e := echo.New()
+	e.HidePort = true
+	e.HideBanner = true
+	e.Server.Addr = cfg.MetricsAddr
+	e.HTTPErrorHandler = handlers.HTTPErrorHandler
+	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{
+		LogLevel: log.ERROR,
+	}))
+	e.GET("/metrics", handlers.MetricsHandler(reg), metricsMiddleware(cfg)...)
+	return e
+}
 
-	e.Logger.Infof("server started on %s", e.Server.Addr)
+// metricsMiddleware returns the middleware that requires the metrics token as a bearer token if it is configured.
+func metricsMiddleware(cfg *config.Config) []echo.MiddlewareFunc {
+	if cfg.MetricsToken == "" {
+		return nil
+	}
+	return []echo.MiddlewareFunc{
+		middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+			Validator: func(key string, c echo.Context) (bool, error) {
+				return subtle.ConstantTimeCompare([]byte(key), []byte(cfg.MetricsToken)) == 1, nil
+			},
+			ErrorHandler: func(err error, c echo.Context) error {
+				return echo.ErrUnauthorized
+			},
+		}),
+	}
+}
 
-	// Wait for interrupt signal to stop the process.
-	<-ctx.Done()
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if err := e.Shutdown(ctx); err != nil {
-		e.Logger.Errorf("failed to shutdown the server: %+v", err)
+// registerMetrics registers the metrics of the server components other than the router to reg.
+// The components that are disabled by the configuration are nil, and their metrics are not registered.
+func registerMetrics(reg *metrics.Registry, tokenGenerator *auth.TokenGenerator, limiter *router.RateLimiter, dq *router.DeferredQueue, idempotency *router.IdempotencyStore, cache *router.ResultCache) {
+	reg.NewCounterFunc("actions_gateway_tokens_generated_total", "The number of the tokens that were generated.", func() float64 {
+		return float64(tokenGenerator.Generated())
+	})
+	reg.NewCounterMapFunc("actions_gateway_rate_limit_rejections_total", "The number of the requests that were rejected by the rate limits by scope.", "scope", func() map[string]float64 {
+		values := make(map[string]float64)
+		for scope, n := range limiter.Rejected() {
+			values[scope] = float64(n)
+		}
+		return values
+	})
+	if dq != nil {
+		reg.NewGaugeFunc("actions_gateway_deferred_queued", "The number of the durable invocations that wait for the agents to connect.", func() float64 {
+			return float64(dq.NumQueued())
+		})
+	}
+	if idempotency != nil {
+		reg.NewGaugeFunc("actions_gateway_idempotency_keys", "The number of the idempotency keys that are remembered.", func() float64 {
+			return float64(idempotency.Len())
+		})
 	}
+	if cache != nil {
+		reg.NewGaugeFunc("actions_gateway_cached_results", "The number of the cached results of the actions.", func() float64 {
+			return float64(cache.Len())
+		})
+	}
+}
 
-	return nil
+// newRegistry creates the session registry from the configuration.
+// It also returns a function to close the registry.
+func newRegistry(cfg *config.Config) (router.Registry, func(), error) {
+	switch cfg.Registry {
+	case "", "memory":
+		return router.NewMemoryRegistry(), func() {}, nil
+	case "file":
+		if cfg.RegistryDir == "" {
+			return nil, nil, errors.New("registry_dir is required for the file registry")
+		}
+		reg, err := router.NewFileRegistry(cfg.RegistryDir, time.Duration(cfg.RegistryTTL)*time.Second)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reg, func() { _ = reg.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported registry: %q", cfg.Registry)
+	}
+}
+
+// newRateLimiter creates the rate limiter with the default rate limits in the configuration.
+func newRateLimiter(cfg *config.Config) (*router.RateLimiter, error) {
+	var options []router.RateLimiterOption
+	for _, l := range []struct {
+		scope string
+		name  string
+		value string
+	}{
+		{router.RateLimitScopeClient, "rate_limit_client", cfg.RateLimitClient},
+		{router.RateLimitScopeAction, "rate_limit_action", cfg.RateLimitAction},
+		{router.RateLimitScopeIP, "rate_limit_ip", cfg.RateLimitIP},
+	} {
+		if l.value == "" {
+			continue
+		}
+		limit, err := types.ParseRateLimit(l.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", l.name, err)
+		}
+		options = append(options, router.WithRateLimit(l.scope, limit))
+	}
+	return router.NewRateLimiter(options...), nil
 }
@@ -0,0 +1,485 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/kohkimakimoto/actions-gateway/metrics"
+	"github.com/kohkimakimoto/actions-gateway/server/auth"
+	"github.com/kohkimakimoto/actions-gateway/server/config"
+	"github.com/kohkimakimoto/actions-gateway/server/router"
+	"github.com/kohkimakimoto/actions-gateway/server/types"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = `12345678901234567890123456789012`
+
+func TestServer_MultipleNodes(t *testing.T) {
+	dir := t.TempDir()
+	node1 := testNode(t, dir)
+	node2 := testNode(t, dir)
+
+	key, err := auth.LoadKeyString(testSecret)
+	assert.NoError(t, err)
+	token, err := auth.NewTokenGenerator(key).NewTokenAsJWTString()
+	assert.NoError(t, err)
+
+	// The agent connects to node1.
+	testAgent(t, node1.URL, token, "hello")
+
+	t.Run("the request to the node of the agent", func(t *testing.T) {
+		res := testRequest(t, node1.URL+"/actions/hello", token)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "hello from the agent", testReadBody(t, res))
+	})
+
+	t.Run("the request to another node is forwarded", func(t *testing.T) {
+		res := testRequest(t, node2.URL+"/actions/hello", token)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "hello from the agent", testReadBody(t, res))
+	})
+
+	t.Run("the action that no agent has", func(t *testing.T) {
+		res := testRequest(t, node2.URL+"/actions/unknown", token)
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	})
+
+	t.Run("the broadcast reaches the agents on another node", func(t *testing.T) {
+		res := testRequest(t, node2.URL+"/broadcast/hello", token)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		var broadcast types.BroadcastResponse
+		assert.NoError(t, json.Unmarshal([]byte(testReadBody(t, res)), &broadcast))
+		if assert.Len(t, broadcast.Results, 1) {
+			for _, result := range broadcast.Results {
+				assert.Equal(t, types.JobStatusSucceeded, result.Status)
+				assert.Equal(t, "hello from the agent", result.Body)
+			}
+		}
+	})
+
+	t.Run("the batch items are forwarded to another node", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, node2.URL+"/batch", strings.NewReader(`[{"name":"hello"},{"name":"hello","method":"GET"}]`))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		var results []*types.BatchResult
+		assert.NoError(t, json.Unmarshal([]byte(testReadBody(t, res)), &results))
+		if assert.Len(t, results, 2) {
+			assert.Equal(t, types.JobStatusSucceeded, results[0].Status)
+			assert.Equal(t, "hello from the agent", results[0].Body)
+			// the node of the agent checks the methods of the action
+			assert.Equal(t, http.StatusMethodNotAllowed, results[1].StatusCode)
+		}
+	})
+}
+
+func TestServer_RateLimits(t *testing.T) {
+	key, err := auth.LoadKeyString(testSecret)
+	assert.NoError(t, err)
+	token, err := auth.NewTokenGenerator(key).NewTokenAsJWTString()
+	assert.NoError(t, err)
+
+	t.Run("the forwarded requests are limited only on the first node", func(t *testing.T) {
+		dir := t.TempDir()
+		limitAction := func(cfg *config.Config) {
+			cfg.RateLimitAction = "2/m"
+		}
+		node1 := testNode(t, dir, limitAction)
+		node2 := testNode(t, dir, limitAction)
+		// The agent is waited for with the other action, so that it does not take the tokens of the action.
+		testAgent(t, node1.URL, token, "ready", "hello")
+
+		for i := 0; i < 2; i++ {
+			res := testRequest(t, node1.URL+"/actions/hello", token)
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			_ = testReadBody(t, res)
+		}
+		assert.Equal(t, http.StatusTooManyRequests, testRequest(t, node1.URL+"/actions/hello", token).StatusCode)
+
+		// node1 does not limit the requests that node2 forwarded
+		for i := 0; i < 2; i++ {
+			res := testRequest(t, node2.URL+"/actions/hello", token)
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, "hello from the agent", testReadBody(t, res))
+		}
+		assert.Equal(t, http.StatusTooManyRequests, testRequest(t, node2.URL+"/actions/hello", token).StatusCode)
+
+		// the forged header does not bypass the limits
+		req, err := http.NewRequest(http.MethodPost, node1.URL+"/actions/hello", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(router.ForwardedHeader, "node2")
+		req.Header.Set(router.ForwardSignatureHeader, "1.forged")
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		_ = testReadBody(t, res)
+		assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	})
+
+	t.Run("each item of the batch counts against the limit of its action", func(t *testing.T) {
+		node := testNode(t, t.TempDir(), func(cfg *config.Config) {
+			cfg.RateLimitAction = "2/m"
+		})
+		// The agent is waited for with the other action, so that it does not take the tokens of the action.
+		testAgent(t, node.URL, token, "ready", "hello")
+
+		req, err := http.NewRequest(http.MethodPost, node.URL+"/batch", strings.NewReader(`[{"name":"hello"},{"name":"hello"},{"name":"hello"}]`))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		var results []*types.BatchResult
+		assert.NoError(t, json.Unmarshal([]byte(testReadBody(t, res)), &results))
+		if assert.Len(t, results, 3) {
+			assert.Equal(t, types.JobStatusSucceeded, results[0].Status)
+			assert.Equal(t, types.JobStatusSucceeded, results[1].Status)
+			assert.Equal(t, http.StatusTooManyRequests, results[2].StatusCode)
+		}
+	})
+
+	t.Run("the ip address is taken from the trusted proxies", func(t *testing.T) {
+		newEchoWithProxies := func(proxies ...string) *echo.Echo {
+			cfg := config.New()
+			cfg.Secret = testSecret
+			cfg.RateLimitIP = "1/h"
+			cfg.TrustedProxies = proxies
+			e, closeFn, err := newEcho(cfg, metrics.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(closeFn)
+			e.Logger.SetOutput(io.Discard)
+			return e
+		}
+		request := func(e *echo.Echo, ip string) int {
+			req := httptest.NewRequest(http.MethodPost, "/actions/hello", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set(echo.HeaderXForwardedFor, ip)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			return rec.Code
+		}
+
+		// The header is ignored without the trusted proxies, so that it can not be spoofed.
+		e := newEchoWithProxies()
+		assert.Equal(t, http.StatusServiceUnavailable, request(e, "198.51.100.1"))
+		assert.Equal(t, http.StatusTooManyRequests, request(e, "198.51.100.2"))
+
+		// httptest.NewRequest comes from 192.0.2.1
+		e = newEchoWithProxies("192.0.2.0/24")
+		assert.Equal(t, http.StatusServiceUnavailable, request(e, "198.51.100.1"))
+		assert.Equal(t, http.StatusServiceUnavailable, request(e, "198.51.100.2"))
+		assert.Equal(t, http.StatusTooManyRequests, request(e, "198.51.100.1"))
+	})
+}
+
+func TestServer_Batch(t *testing.T) {
+	key, err := auth.LoadKeyString(testSecret)
+	assert.NoError(t, err)
+	token, err := auth.NewTokenGenerator(key).NewTokenAsJWTString()
+	assert.NoError(t, err)
+
+	node := testNode(t, t.TempDir())
+	testAgent(t, node.URL, token, "hello")
+
+	t.Run("the items are invoked with their methods", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, node.URL+"/batch", strings.NewReader(`[{"name":"hello","method":"post"},{"name":"hello","method":"GET"},{"name":"hello","method":"TRACE"}]`))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		var results []*types.BatchResult
+		assert.NoError(t, json.Unmarshal([]byte(testReadBody(t, res)), &results))
+		if assert.Len(t, results, 3) {
+			assert.Equal(t, types.JobStatusSucceeded, results[0].Status)
+			assert.Equal(t, "hello from the agent", results[0].Body)
+			// the action that declares no methods accepts only POST
+			assert.Equal(t, http.StatusMethodNotAllowed, results[1].StatusCode)
+			assert.Equal(t, http.StatusMethodNotAllowed, results[2].StatusCode)
+		}
+	})
+}
+
+func TestServer_Reconnect(t *testing.T) {
+	key, err := auth.LoadKeyString(testSecret)
+	assert.NoError(t, err)
+	token, err := auth.NewTokenGenerator(key).NewTokenAsJWTString()
+	assert.NoError(t, err)
+
+	t.Run("the request over the reconnect queue is rejected with 429", func(t *testing.T) {
+		node := testNode(t, t.TempDir(), func(cfg *config.Config) {
+			cfg.ReconnectGracePeriod = 60
+			cfg.ReconnectQueueSize = 1
+			cfg.Metrics = true
+			cfg.MetricsToken = "metrics_secret"
+		})
+		gauge := func(sample string) bool {
+			req, err := http.NewRequest(http.MethodGet, node.URL+"/metrics", nil)
+			assert.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer metrics_secret")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return strings.Contains(testReadBody(t, res), "\n"+sample+"\n")
+		}
+
+		conn := testAgent(t, node.URL, token, "hello")
+		assert.NoError(t, conn.Close())
+		assert.Eventually(t, func() bool {
+			return gauge("actions_gateway_sessions 0")
+		}, 5*time.Second, 50*time.Millisecond)
+
+		// The first request waits for the agent to reconnect until it gives up.
+		waiting := make(chan struct{})
+		go func() {
+			defer close(waiting)
+			req, err := http.NewRequest(http.MethodPost, node.URL+"/actions/hello", nil)
+			assert.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer "+token)
+			client := &http.Client{Timeout: 2 * time.Second}
+			if res, err := client.Do(req); err == nil {
+				_ = res.Body.Close()
+			}
+		}()
+		assert.Eventually(t, func() bool {
+			return gauge("actions_gateway_reconnect_queued 1")
+		}, 5*time.Second, 50*time.Millisecond)
+
+		res := testRequest(t, node.URL+"/actions/hello", token)
+		assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+		assert.Equal(t, "1", res.Header.Get("Retry-After"))
+		assert.Equal(t, "Too many requests are waiting for the client to reconnect", testReadBody(t, res))
+		<-waiting
+	})
+}
+
+func TestServer_MaxUploadSize(t *testing.T) {
+	key, err := auth.LoadKeyString(testSecret)
+	assert.NoError(t, err)
+	token, err := auth.NewTokenGenerator(key).NewTokenAsJWTString()
+	assert.NoError(t, err)
+
+	node := testNode(t, t.TempDir(), func(cfg *config.Config) {
+		cfg.MaxUploadSize = 1024
+	})
+	testAgent(t, node.URL, token, "hello")
+
+	upload := func(size int, chunked bool) *http.Response {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		fw, err := mw.CreateFormFile("file", "data.bin")
+		assert.NoError(t, err)
+		_, err = fw.Write(bytes.Repeat([]byte("a"), size))
+		assert.NoError(t, err)
+		assert.NoError(t, mw.Close())
+
+		var body io.Reader = &buf
+		if chunked {
+			// The request is sent without the content length.
+			body = io.MultiReader(&buf)
+		}
+		req, err := http.NewRequest(http.MethodPost, node.URL+"/actions/hello", body)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	t.Run("the upload within the limit", func(t *testing.T) {
+		res := upload(100, false)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "hello from the agent", testReadBody(t, res))
+	})
+
+	t.Run("the upload over the limit", func(t *testing.T) {
+		res := upload(2048, false)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+		assert.Equal(t, "The upload is too large. The maximum is 1024 bytes", testReadBody(t, res))
+	})
+
+	t.Run("the upload over the limit without the content length", func(t *testing.T) {
+		res := upload(2048, true)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+		assert.Equal(t, "The upload is too large. The maximum is 1024 bytes", testReadBody(t, res))
+	})
+}
+
+func TestServer_Metrics(t *testing.T) {
+	cfg := config.New()
+	cfg.Secret = testSecret
+	cfg.Metrics = true
+	cfg.MetricsToken = "metrics_secret"
+	e, closeFn, err := newEcho(cfg, metrics.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+	e.Logger.SetOutput(io.Discard)
+
+	request := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("with the metrics token", func(t *testing.T) {
+		rec := request("metrics_secret")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "actions_gateway_sessions 0\n")
+		assert.Contains(t, rec.Body.String(), "actions_gateway_tokens_generated_total 0\n")
+	})
+
+	t.Run("without the metrics token", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, request("").Code)
+		assert.Equal(t, http.StatusUnauthorized, request("invalid").Code)
+	})
+
+	t.Run("on the metrics address", func(t *testing.T) {
+		cfg := *cfg
+		cfg.MetricsAddr = "127.0.0.1:0"
+		e, closeFn, err := newEcho(&cfg, metrics.NewRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFn()
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+// testNode starts a server node that shares the registry directory with the other nodes.
+// The configure functions modify the configuration of the node.
+func testNode(t *testing.T, registryDir string, configure ...func(cfg *config.Config)) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(nil)
+	nodeURL := "http://" + ts.Listener.Addr().String()
+
+	cfg := config.New()
+	cfg.Secret = testSecret
+	cfg.URL = nodeURL
+	cfg.Registry = "file"
+	cfg.RegistryDir = registryDir
+	for _, f := range configure {
+		f(cfg)
+	}
+	e, closeFn, err := newEcho(cfg, metrics.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Logger.SetOutput(io.Discard)
+	ts.Config.Handler = e
+	ts.Start()
+	t.Cleanup(func() {
+		ts.Close()
+		closeFn()
+	})
+	return ts
+}
+
+// testAgent connects an agent that responds to the actions with a fixed body to the server node.
+// It waits for the session to be registered by invoking the first action.
+func testAgent(t *testing.T, serverURL string, token string, actions ...string) *websocket.Conn {
+	t.Helper()
+	b, err := json.Marshal(&types.SessionNewRequest{
+		Actions:          actions,
+		ProtocolVersions: []int{types.ProtocolVersion2},
+		// The uploaded files are ignored.
+		Capabilities: []string{types.CapabilityMultipart},
+	})
+	assert.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, serverURL+"/api/session/new", bytes.NewReader(b))
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	sessRes := &types.SessionNewResponse{}
+	if err := json.NewDecoder(res.Body).Decode(sessRes); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(sessRes.URL, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			env, err := types.ParseEnvelope(message)
+			if err != nil || env.Type != types.MessageTypeAction {
+				continue
+			}
+			resEnv, err := types.NewEnvelope(types.MessageTypeResult, env.Id, &types.ActionResult{
+				Id:     env.Id,
+				Status: types.ActionResultStatusSuccess,
+				Body:   "hello from the agent",
+			})
+			if err != nil {
+				return
+			}
+			if err := conn.WriteJSON(resEnv); err != nil {
+				return
+			}
+		}
+	}()
+
+	// wait for the session to be registered
+	assert.Eventually(t, func() bool {
+		res := testRequest(t, serverURL+"/actions/"+actions[0], token)
+		_ = testReadBody(t, res)
+		return res.StatusCode == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond)
+	return conn
+}
+
+func testRequest(t *testing.T, url string, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func testReadBody(t *testing.T, res *http.Response) string {
+	t.Helper()
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	return string(b)
+}
@@ -0,0 +1,131 @@
+package types
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// The following are the versions of the protocol between the server and the client via websocket.
+const (
+	// ProtocolVersion1 is the original protocol.
+	// The server sends bare action messages, and the client notifies the results via the /api/notify endpoint.
+	ProtocolVersion1 = 1
+	// ProtocolVersion2 wraps all messages in both directions in an Envelope.
+	ProtocolVersion2 = 2
+)
+
+// SupportedProtocolVersions is a list of the protocol versions that this build supports, in order of preference.
+var SupportedProtocolVersions = []int{ProtocolVersion2, ProtocolVersion1}
+
+// The following are the optional features that the server and the client negotiate in addition to the protocol version.
+const (
+	// CapabilityBase64Body means that the bodies that are not valid UTF-8 are encoded in base64 on the wire,
+	// so that binary data such as images and archives are not corrupted.
+	CapabilityBase64Body = "base64-body"
+	// CapabilityMultipart means that the parts of the multipart requests are sent to the client as files
+	// with the upload messages.
+	CapabilityMultipart = "multipart"
+)
+
+// NegotiateProtocolVersion returns the most preferred version in supported that the peer also supports.
+func NegotiateProtocolVersion(supported []int, peer []int) (int, error) {
+	for _, v := range supported {
+		for _, pv := range peer {
+			if v == pv {
+				return v, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no compatible protocol version: the peer supports %v, but this side supports %v", peer, supported)
+}
+
+// Envelope is a message that is exchanged between the server and the client via websocket
+// since ProtocolVersion2.
+type Envelope struct {
+	// Type is the message type
+	Type MessageType `json:"type"`
+	// Version is the protocol version of the message
+	Version int `json:"version"`
+	// Id is the id of the action message that the message relates to.
+	// It is empty for the messages that are not related to any action message, such as heartbeat.
+	Id string `json:"id,omitempty"`
+	// Payload is the content of the message. Its structure depends on the type.
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// NewEnvelope creates a new envelope of the current protocol version.
+// The payload is omitted if it is nil.
+func NewEnvelope(typ MessageType, id string, payload any) (*Envelope, error) {
+	env := &Envelope{
+		Type:    typ,
+		Version: ProtocolVersion2,
+		Id:      id,
+	}
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode the %s payload: %w", typ, err)
+		}
+		env.Payload = b
+	}
+	return env, nil
+}
+
+// ParseEnvelope parses the message and checks that it is of the current protocol version.
+func ParseEnvelope(message []byte) (*Envelope, error) {
+	env := &Envelope{}
+	if err := json.Unmarshal(message, env); err != nil {
+		return nil, fmt.Errorf("failed to parse the message: %w", err)
+	}
+	if env.Version != ProtocolVersion2 {
+		return nil, fmt.Errorf("unsupported protocol version of the message: %d", env.Version)
+	}
+	return env, nil
+}
+
+// DecodePayload decodes the payload into v.
+func (env *Envelope) DecodePayload(v any) error {
+	if len(env.Payload) == 0 {
+		return fmt.Errorf("the %s message has no payload", env.Type)
+	}
+	if err := json.Unmarshal(env.Payload, v); err != nil {
+		return fmt.Errorf("failed to parse the %s payload: %w", env.Type, err)
+	}
+	return nil
+}
+
+// ErrorPayload is the payload of the error message.
+type ErrorPayload struct {
+	Error string `json:"error"`
+}
+
+// BodyEncodingBase64 is the encoding of the body that is encoded in base64.
+const BodyEncodingBase64 = "base64"
+
+// EncodeBody encodes the body to send it on the wire.
+// The body that is valid UTF-8 is sent as it is, and the other is encoded in base64.
+// It returns the encoded body and its encoding.
+func EncodeBody(body string) (string, string) {
+	if utf8.ValidString(body) {
+		return body, ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(body)), BodyEncodingBase64
+}
+
+// DecodeBody decodes the body that is received from the wire.
+func DecodeBody(body string, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return body, nil
+	case BodyEncodingBase64:
+		b, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode the body: %w", err)
+		}
+		return string(b), nil
+	default:
+		return "", fmt.Errorf("unknown body encoding: %s", encoding)
+	}
+}
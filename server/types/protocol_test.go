@@ -0,0 +1,88 @@
+package types
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	testCases := []struct {
+		supported []int
+		peer      []int
+		expected  int
+		err       bool
+	}{
+		{supported: []int{2, 1}, peer: []int{1, 2}, expected: 2},
+		{supported: []int{2, 1}, peer: []int{1}, expected: 1},
+		{supported: []int{2, 1}, peer: []int{3, 2}, expected: 2},
+		{supported: []int{2, 1}, peer: []int{3}, err: true},
+		{supported: []int{2, 1}, peer: nil, err: true},
+	}
+
+	for _, tc := range testCases {
+		v, err := NegotiateProtocolVersion(tc.supported, tc.peer)
+		if tc.err {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, v)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		env, err := NewEnvelope(MessageTypeResult, "00000000-0000-0000-0000-000000000001", &ActionResult{
+			Id:     "00000000-0000-0000-0000-000000000001",
+			Status: ActionResultStatusSuccess,
+			Body:   "ok",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, ProtocolVersion2, env.Version)
+		assert.JSONEq(t, `{"id":"00000000-0000-0000-0000-000000000001","status":"success","body":"ok"}`, string(env.Payload))
+
+		result := &ActionResult{}
+		assert.NoError(t, env.DecodePayload(result))
+		assert.Equal(t, "ok", result.Body)
+	})
+
+	t.Run("no payload", func(t *testing.T) {
+		env, err := ParseEnvelope([]byte(`{"type":"heartbeat","version":2}`))
+		assert.NoError(t, err)
+		assert.Equal(t, MessageTypeHeartbeat, env.Type)
+		assert.EqualError(t, env.DecodePayload(&ActionResult{}), "the heartbeat message has no payload")
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		// the bare action message of protocol version 1 does not have a version
+		_, err := ParseEnvelope([]byte(`{"id":"00000000-0000-0000-0000-000000000001","name":"action","body":""}`))
+		assert.EqualError(t, err, "unsupported protocol version of the message: 0")
+	})
+}
+
+func TestEncodeBody(t *testing.T) {
+	body, encoding := EncodeBody("hello")
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, "", encoding)
+
+	binary := string([]byte{0x89, 0x50, 0x4e, 0x47, 0x00, 0xff})
+	body, encoding = EncodeBody(binary)
+	assert.Equal(t, "iVBORwD/", body)
+	assert.Equal(t, BodyEncodingBase64, encoding)
+
+	decoded, err := DecodeBody(body, encoding)
+	assert.NoError(t, err)
+	assert.Equal(t, binary, decoded)
+}
+
+func TestDecodeBody(t *testing.T) {
+	body, err := DecodeBody("hello", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", body)
+
+	_, err = DecodeBody("not base64!", BodyEncodingBase64)
+	assert.Error(t, err)
+
+	_, err = DecodeBody("hello", "gzip")
+	assert.EqualError(t, err, "unknown body encoding: gzip")
+}
@@ -0,0 +1,58 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimit is a limit of the number of the requests in a period.
+// The requests are limited by a token bucket, so that up to Count requests can be made in a burst,
+// and the tokens are refilled at the rate of Count per Period.
+type RateLimit struct {
+	Count  int
+	Period time.Duration
+}
+
+// ParseRateLimit parses a rate limit like "100/m", which is the number of the requests and the period.
+// The period is "s", "m", "h", or a duration like "30s".
+func ParseRateLimit(s string) (*RateLimit, error) {
+	count, period, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid rate limit: %q", s)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid rate limit: %q", s)
+	}
+
+	var d time.Duration
+	switch period {
+	case "s":
+		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
+	default:
+		d, err = time.ParseDuration(period)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid rate limit: %q", s)
+		}
+	}
+	return &RateLimit{Count: n, Period: d}, nil
+}
+
+// String returns the rate limit in the format of ParseRateLimit.
+func (l *RateLimit) String() string {
+	switch l.Period {
+	case time.Second:
+		return strconv.Itoa(l.Count) + "/s"
+	case time.Minute:
+		return strconv.Itoa(l.Count) + "/m"
+	case time.Hour:
+		return strconv.Itoa(l.Count) + "/h"
+	}
+	return strconv.Itoa(l.Count) + "/" + l.Period.String()
+}
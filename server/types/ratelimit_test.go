@@ -0,0 +1,41 @@
+package types
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	testCases := map[string]struct {
+		s        string
+		expected *RateLimit
+		hasError bool
+	}{
+		"per second":    {s: "10/s", expected: &RateLimit{Count: 10, Period: time.Second}},
+		"per minute":    {s: "100/m", expected: &RateLimit{Count: 100, Period: time.Minute}},
+		"per hour":      {s: " 1000/h ", expected: &RateLimit{Count: 1000, Period: time.Hour}},
+		"duration":      {s: "5/30s", expected: &RateLimit{Count: 5, Period: 30 * time.Second}},
+		"no period":     {s: "100", hasError: true},
+		"zero":          {s: "0/m", hasError: true},
+		"not a number":  {s: "many/m", hasError: true},
+		"unknown unit":  {s: "10/week", hasError: true},
+		"zero duration": {s: "10/0s", hasError: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			l, err := ParseRateLimit(tc.s)
+			if tc.hasError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, l)
+			// the string is parsed to the same rate limit
+			l2, err := ParseRateLimit(l.String())
+			assert.NoError(t, err)
+			assert.Equal(t, l, l2)
+		})
+	}
+}
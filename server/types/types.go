@@ -1,5 +1,10 @@
 package types
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type NewTokenResponse struct {
 	// Token is a JWT token
 	Token string `json:"token"`
@@ -10,12 +15,74 @@ type SessionNewRequest struct {
 	Actions []string `json:"actions"`
 	// Spec is a OpenAPI spec in YAML format that is supported by the session.
 	Spec string `json:"spec"`
+	// Options is a map of the action options. The key of the map is an action name.
+	Options map[string]*ActionOptions `json:"options,omitempty"`
+	// ProtocolVersions is a list of the protocol versions that the client supports.
+	// The clients that do not send it are treated as supporting only ProtocolVersion1.
+	ProtocolVersions []int `json:"protocol_versions,omitempty"`
+	// Capabilities is a list of the optional features that the client supports.
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Labels is a set of the labels of the agent, such as host=nas.
+	// The callers use them to select the agent that runs the action.
+	Labels map[string]string `json:"labels,omitempty"`
+	// InstanceId identifies the agent across its sessions.
+	// A new session with the same instance id replaces the stale session of the agent.
+	InstanceId string `json:"instance_id,omitempty"`
+}
+
+// ActionOptions is the options of an action that are declared in the action's spec.
+type ActionOptions struct {
+	// Timeout is the execution timeout of the action in seconds. Zero means the server default.
+	Timeout int `json:"timeout,omitempty"`
+	// Stream enables streaming the output of the action to the HTTP caller.
+	Stream bool `json:"stream,omitempty"`
+	// Methods is a list of the HTTP methods that the action accepts. Empty means only POST.
+	Methods []string `json:"methods,omitempty"`
+	// Deferrable allows the server to queue the invocations of the action while the client is offline
+	// and deliver them when the client connects.
+	Deferrable bool `json:"deferrable,omitempty"`
+	// Cache is the time in seconds to cache the successful results of the action on the server. Zero disables it.
+	Cache int `json:"cache,omitempty"`
+	// RateLimit is the rate limit of the requests to the action like "10/m". It overrides the server default.
+	RateLimit string `json:"rate_limit,omitempty"`
 }
 
 type SessionNewResponse struct {
 	URL string `json:"url"`
+	// ProtocolVersion is the protocol version that the server chose for the session.
+	// The older servers do not send it, which means ProtocolVersion1.
+	ProtocolVersion int `json:"protocol_version,omitempty"`
+	// Capabilities is a list of the optional features that both the server and the client support.
+	Capabilities []string `json:"capabilities,omitempty"`
 }
 
+// MessageType is a type of the message that is exchanged between the server and the client via websocket.
+type MessageType string
+
+const (
+	// MessageTypeAction is a message to run an action.
+	MessageTypeAction MessageType = "action"
+	// MessageTypeCancel is a message to cancel the running action that has the same id.
+	MessageTypeCancel MessageType = "cancel"
+	// MessageTypeUpload is a message that has a chunk of a file uploaded with a multipart request.
+	// The chunks are sent before the action message that has the same id.
+	MessageTypeUpload MessageType = "upload"
+	// MessageTypeOutput is a message that has a chunk of the output of the running action.
+	// It is sent from the client to the server.
+	MessageTypeOutput MessageType = "output"
+	// MessageTypeResult is a message that has the result of the action.
+	// It is sent from the client to the server.
+	MessageTypeResult MessageType = "result"
+	// MessageTypeError is a message that reports an error of the client.
+	// If it has an id, the action of the action message that has the same id failed.
+	// It is sent from the client to the server.
+	MessageTypeError MessageType = "error"
+	// MessageTypeHeartbeat is a message that the client sends periodically to show that it is alive.
+	MessageTypeHeartbeat MessageType = "heartbeat"
+)
+
+// ActionMessage is the payload of the action message.
+// It is also sent to the clients of ProtocolVersion1 as it is.
 type ActionMessage struct {
 	// Id is a unique identifier for the action message
 	Id string `json:"id"`
@@ -23,6 +90,52 @@ type ActionMessage struct {
 	Name string `json:"name"`
 	// Body is a payload of the action
 	Body string `json:"body"`
+	// BodyEncoding is the encoding of the body on the wire. Empty means that the body is sent as it is.
+	BodyEncoding string `json:"body_encoding,omitempty"`
+	// Stream requests the client to send the output of the action as chunks while the action is running.
+	Stream bool `json:"stream,omitempty"`
+	// Method is the HTTP method of the request
+	Method string `json:"method,omitempty"`
+	// Path is the sub-path of the request that follows "/actions/:name", such as "/items/1".
+	// It is empty if the request has no sub-path.
+	Path string `json:"path,omitempty"`
+	// Query is the raw query string of the request without the leading "?"
+	Query string `json:"query,omitempty"`
+	// Headers is the allowlisted headers of the request by canonical header name.
+	// Multiple values of the same header are joined with ", ".
+	Headers map[string]string `json:"headers,omitempty"`
+	// Multipart means that the request was a multipart request.
+	// Its parts are sent as the upload messages before the action message instead of the body.
+	Multipart bool `json:"multipart,omitempty"`
+	// Deferred means that the action message was queued by the server and may be delivered more than once.
+	// The client runs it only once for the same id.
+	Deferred bool `json:"deferred,omitempty"`
+}
+
+// UploadChunk is a chunk of a part of a multipart request.
+type UploadChunk struct {
+	// Index is the index of the part in the request, starting from 0
+	Index int `json:"index"`
+	// Field is the form field name of the part. It is set only in the first chunk of the part.
+	Field string `json:"field,omitempty"`
+	// Filename is the filename of the part. It is set only in the first chunk of the part.
+	Filename string `json:"filename,omitempty"`
+	// ContentType is the content type of the part. It is set only in the first chunk of the part.
+	ContentType string `json:"content_type,omitempty"`
+	// Data is a chunk of the content of the part
+	Data string `json:"data"`
+	// DataEncoding is the encoding of the data on the wire. Empty means that the data is sent as it is.
+	DataEncoding string `json:"data_encoding,omitempty"`
+}
+
+// ActionOutput is a chunk of the output of the running action.
+type ActionOutput struct {
+	// It is the same as the id of the action message
+	Id string `json:"id"`
+	// Data is a chunk of the action's STDOUT
+	Data string `json:"data"`
+	// DataEncoding is the encoding of the data on the wire. Empty means that the data is sent as it is.
+	DataEncoding string `json:"data_encoding,omitempty"`
 }
 
 type ActionResultStatus string
@@ -30,17 +143,145 @@ type ActionResultStatus string
 const (
 	ActionResultStatusSuccess ActionResultStatus = "success"
 	ActionResultStatusError   ActionResultStatus = "error"
+	// ActionResultStatusBusy means that the client did not run the action, because too many actions are running.
+	ActionResultStatusBusy ActionResultStatus = "busy"
 )
 
 type ActionResult struct {
 	// It is the same as the id of the action message
 	Id string `json:"id"`
-	// "success" or "error"
+	// "success", "error" or "busy"
 	Status ActionResultStatus `json:"status"`
 	// The result of the action that is produced from the action's STDOUT
-	Body string `json:"error"`
+	Body string `json:"body"`
+	// BodyEncoding is the encoding of the body on the wire. Empty means that the body is sent as it is.
+	BodyEncoding string `json:"body_encoding,omitempty"`
+	// StatusCode is the HTTP status code that the action declared. Zero means the default status code.
+	StatusCode int `json:"status_code,omitempty"`
+	// Headers is the HTTP response headers that the action declared.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// LegacyActionResult is the action result that the clients of ProtocolVersion1 send to the /api/notify endpoint.
+// Its body is serialized under the "error" key.
+type LegacyActionResult struct {
+	Id     string             `json:"id"`
+	Status ActionResultStatus `json:"status"`
+	Body   string             `json:"error"`
+}
+
+func NewLegacyActionResult(result *ActionResult) *LegacyActionResult {
+	return &LegacyActionResult{
+		Id:     result.Id,
+		Status: result.Status,
+		Body:   result.Body,
+	}
+}
+
+func (r *LegacyActionResult) ActionResult() *ActionResult {
+	return &ActionResult{
+		Id:     r.Id,
+		Status: r.Status,
+		Body:   r.Body,
+	}
+}
+
+type JobStatus string
+
+const (
+	JobStatusQueued    JobStatus = "queued"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusSucceeded JobStatus = "succeeded"
+	JobStatusFailed    JobStatus = "failed"
+	JobStatusTimeout   JobStatus = "timeout"
+	JobStatusCanceled  JobStatus = "canceled"
+)
+
+type JobResponse struct {
+	// Id is a job id
+	Id string `json:"id"`
+	// Action is the action name
+	Action string `json:"action"`
+	// Status is the current status of the job
+	Status JobStatus `json:"status"`
+	// Body is the result of the action. It is empty until the job finishes.
+	Body string `json:"body,omitempty"`
+	// BodyEncoding is "base64" if the body is binary data encoded in base64.
+	BodyEncoding string `json:"body_encoding,omitempty"`
+	// StatusCode is the HTTP status code that the action declared. It is empty until the job finishes.
+	StatusCode int `json:"status_code,omitempty"`
+	// Headers is the HTTP response headers that the action declared.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Error is the reason why the job failed or timed out without the result of the action,
+	// such as the client disconnected while running it.
+	Error string `json:"error,omitempty"`
+	// CreatedAt is the time when the job was created
+	CreatedAt time.Time `json:"created_at"`
+	// FinishedAt is the time when the job finished
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// DurationMs is the execution time of the job in milliseconds
+	DurationMs int64 `json:"duration_ms,omitempty"`
+	// Attempts is the number of times that the deferred job was delivered to the client
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// BroadcastResponse is the aggregated results of the action that was broadcast to the agents.
+type BroadcastResponse struct {
+	// Action is the action name
+	Action string `json:"action"`
+	// Results is a map of the results. The key of the map is the session id of the agent.
+	Results map[string]*BroadcastResult `json:"results"`
+}
+
+// BroadcastResult is the result of the broadcast action on an agent.
+type BroadcastResult struct {
+	// Labels is the labels of the agent
+	Labels map[string]string `json:"labels,omitempty"`
+	// Status is "succeeded", "failed" or "timeout"
+	Status JobStatus `json:"status"`
+	// StatusCode is the HTTP status code that the action declared
+	StatusCode int `json:"status_code,omitempty"`
+	// Body is the result of the action, or the error message if the agent could not return it.
+	Body string `json:"body,omitempty"`
+	// BodyEncoding is "base64" if the body is binary data encoded in base64.
+	BodyEncoding string `json:"body_encoding,omitempty"`
+	// DurationMs is the execution time of the action in milliseconds
+	DurationMs int64 `json:"duration_ms"`
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
+
+// CachePurgeResponse is the response of the endpoint to purge the cached results.
+type CachePurgeResponse struct {
+	// Purged is the number of the removed results
+	Purged int `json:"purged"`
+}
+
+// BatchItem is an action invocation in the request of the batch endpoint.
+type BatchItem struct {
+	// Name is the action name
+	Name string `json:"name"`
+	// Method is the HTTP method to invoke the action with. Empty means POST.
+	Method string `json:"method,omitempty"`
+	// Body is the request body of the action. A JSON string is sent as is, and the other JSON values are sent as JSON.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// BatchResult is the result of an item of the batch.
+type BatchResult struct {
+	// Name is the action name
+	Name string `json:"name"`
+	// Status is "succeeded", "failed" or "timeout"
+	Status JobStatus `json:"status"`
+	// StatusCode is the HTTP status code that the action declared,
+	// or the status code of the error if the action could not be invoked.
+	StatusCode int `json:"status_code,omitempty"`
+	// Body is the result of the action, or the error message if the action could not be invoked.
+	Body string `json:"body,omitempty"`
+	// BodyEncoding is "base64" if the body is binary data encoded in base64.
+	BodyEncoding string `json:"body_encoding,omitempty"`
+	// DurationMs is the execution time of the action in milliseconds
+	DurationMs int64 `json:"duration_ms"`
+}